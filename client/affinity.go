@@ -0,0 +1,185 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// localityMatch matches devices by region and, if zone >= 0, zone. It is
+// parsed from strings like "r1" or "r1z2".
+type localityMatch struct {
+	region int
+	zone   int
+}
+
+func parseLocalityMatch(s string) (localityMatch, error) {
+	m := localityMatch{zone: -1}
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "r") {
+		return m, fmt.Errorf("invalid locality %q, expected r<region> or r<region>z<zone>", s)
+	}
+	region, zone := s[1:], ""
+	if i := strings.Index(region, "z"); i >= 0 {
+		region, zone = region[:i], region[i+1:]
+		z, err := strconv.Atoi(zone)
+		if err != nil || z < 0 {
+			return m, fmt.Errorf("invalid locality %q, expected r<region> or r<region>z<zone>", s)
+		}
+		m.zone = z
+	}
+	r, err := strconv.Atoi(region)
+	if err != nil || r < 0 {
+		return m, fmt.Errorf("invalid locality %q, expected r<region> or r<region>z<zone>", s)
+	}
+	m.region = r
+	return m, nil
+}
+
+func (m localityMatch) matches(dev *ring.Device) bool {
+	return dev.Region == m.region && (m.zone < 0 || dev.Zone == m.zone)
+}
+
+// readAffinity orders devices for reads, as configured by a read_affinity
+// setting like "r1z1=100, r1=200". Devices get the lowest priority of the
+// entries they match and are read from lowest priority first; devices that
+// match no entry go last.
+type readAffinity []readAffinityEntry
+
+type readAffinityEntry struct {
+	localityMatch
+	priority int
+}
+
+func parseReadAffinity(s string) (readAffinity, error) {
+	var ra readAffinity
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid read affinity entry %q, expected <locality>=<priority>", strings.TrimSpace(entry))
+		}
+		m, err := parseLocalityMatch(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		priority, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid read affinity priority %q", strings.TrimSpace(parts[1]))
+		}
+		ra = append(ra, readAffinityEntry{localityMatch: m, priority: priority})
+	}
+	return ra, nil
+}
+
+func (ra readAffinity) priority(dev *ring.Device) int {
+	p := math.MaxInt32
+	for _, entry := range ra {
+		if entry.priority < p && entry.matches(dev) {
+			p = entry.priority
+		}
+	}
+	return p
+}
+
+// sort orders devs by priority, keeping the existing order among devices of
+// the same priority.
+func (ra readAffinity) sort(devs []*ring.Device) {
+	if len(ra) == 0 {
+		return
+	}
+	sort.SliceStable(devs, func(i, j int) bool {
+		return ra.priority(devs[i]) < ra.priority(devs[j])
+	})
+}
+
+// writeAffinity is the set of localities, configured by a write_affinity
+// setting like "r1, r2z1", that are considered local for writes.
+type writeAffinity []localityMatch
+
+func parseWriteAffinity(s string) (writeAffinity, error) {
+	var wa writeAffinity
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		m, err := parseLocalityMatch(entry)
+		if err != nil {
+			return nil, err
+		}
+		wa = append(wa, m)
+	}
+	return wa, nil
+}
+
+func (wa writeAffinity) local(dev *ring.Device) bool {
+	for _, m := range wa {
+		if m.matches(dev) {
+			return true
+		}
+	}
+	return false
+}
+
+// localFirst considers the primaries in devs plus enough handoffs from more
+// to make nodeCount devices, and returns the local ones among them followed by
+// the rest in their original order.
+func (wa writeAffinity) localFirst(devs []*ring.Device, more ring.MoreNodes, nodeCount int) []*ring.Device {
+	candidates := append([]*ring.Device{}, devs...)
+	for len(candidates) < nodeCount {
+		dev := more.Next()
+		if dev == nil {
+			break
+		}
+		candidates = append(candidates, dev)
+	}
+	local := make([]*ring.Device, 0, len(candidates))
+	var remote []*ring.Device
+	for _, dev := range candidates {
+		if wa.local(dev) {
+			local = append(local, dev)
+		} else {
+			remote = append(remote, dev)
+		}
+	}
+	return append(local, remote...)
+}
+
+// parseWriteAffinityNodeCount parses a write_affinity_node_count setting,
+// which is either a number of devices or "<n> * replicas", into a function
+// returning the number of devices for a given replica count.
+func parseWriteAffinityNodeCount(s string) (func(replicas int) int, error) {
+	parts := strings.SplitN(s, "*", 2)
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid write affinity node count %q, expected <n> or <n> * replicas", s)
+	}
+	if len(parts) == 1 {
+		return func(int) int { return n }, nil
+	}
+	if strings.TrimSpace(parts[1]) != "replicas" {
+		return nil, fmt.Errorf("invalid write affinity node count %q, expected <n> or <n> * replicas", s)
+	}
+	return func(replicas int) int { return n * replicas }, nil
+}
@@ -0,0 +1,151 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+type listMoreNodes struct {
+	devs []*ring.Device
+}
+
+func (m *listMoreNodes) Next() *ring.Device {
+	if len(m.devs) == 0 {
+		return nil
+	}
+	dev := m.devs[0]
+	m.devs = m.devs[1:]
+	return dev
+}
+
+func deviceNames(devs []*ring.Device) []string {
+	names := make([]string, 0, len(devs))
+	for _, dev := range devs {
+		names = append(names, dev.Device)
+	}
+	return names
+}
+
+func TestParseReadAffinity(t *testing.T) {
+	ra, err := parseReadAffinity("r1z1=100, r1=200,r2z3=50")
+	require.Nil(t, err)
+	require.Equal(t, readAffinity{
+		{localityMatch{region: 1, zone: 1}, 100},
+		{localityMatch{region: 1, zone: -1}, 200},
+		{localityMatch{region: 2, zone: 3}, 50},
+	}, ra)
+
+	ra, err = parseReadAffinity("")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ra))
+
+	for _, bad := range []string{"r1", "z1=100", "r1z=100", "rx=100", "r1=high"} {
+		_, err = parseReadAffinity(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestReadAffinitySort(t *testing.T) {
+	devs := []*ring.Device{
+		{Device: "r2z1", Region: 2, Zone: 1},
+		{Device: "r1z2", Region: 1, Zone: 2},
+		{Device: "r3z1", Region: 3, Zone: 1},
+		{Device: "r1z1", Region: 1, Zone: 1},
+	}
+	ra, err := parseReadAffinity("r1z1=100, r1=200, r2=300")
+	require.Nil(t, err)
+	ra.sort(devs)
+	require.Equal(t, []string{"r1z1", "r1z2", "r2z1", "r3z1"}, deviceNames(devs))
+
+	var none readAffinity
+	none.sort(devs[:2])
+	require.Equal(t, []string{"r1z1", "r1z2", "r2z1", "r3z1"}, deviceNames(devs))
+}
+
+func TestParseWriteAffinity(t *testing.T) {
+	wa, err := parseWriteAffinity("r1, r2z2")
+	require.Nil(t, err)
+	require.True(t, wa.local(&ring.Device{Region: 1, Zone: 5}))
+	require.True(t, wa.local(&ring.Device{Region: 2, Zone: 2}))
+	require.False(t, wa.local(&ring.Device{Region: 2, Zone: 1}))
+
+	_, err = parseWriteAffinity("r1=100")
+	require.NotNil(t, err)
+}
+
+func TestParseWriteAffinityNodeCount(t *testing.T) {
+	count, err := parseWriteAffinityNodeCount("2 * replicas")
+	require.Nil(t, err)
+	require.Equal(t, 6, count(3))
+	count, err = parseWriteAffinityNodeCount("5")
+	require.Nil(t, err)
+	require.Equal(t, 5, count(3))
+	for _, bad := range []string{"", "two * replicas", "2 * devices", "-1"} {
+		_, err = parseWriteAffinityNodeCount(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestWriteNodesAffinity(t *testing.T) {
+	devs := []*ring.Device{
+		{Device: "p0", Region: 1},
+		{Device: "p1", Region: 2},
+		{Device: "p2", Region: 2},
+		{Device: "h0", Region: 2},
+		{Device: "h1", Region: 1},
+		{Device: "h2", Region: 1},
+		{Device: "h3", Region: 1},
+	}
+	newClient := func(affinity string) *standardObjectClient {
+		wa, err := parseWriteAffinity(affinity)
+		require.Nil(t, err)
+		count, err := parseWriteAffinityNodeCount("2 * replicas")
+		require.Nil(t, err)
+		return &standardObjectClient{
+			proxyDirectClient:      &ProxyDirectClient{},
+			writeAffinity:          wa,
+			writeAffinityNodeCount: count,
+		}
+	}
+	fakeRing := func() ring.Ring {
+		return &test.FakeRing{MockDevices: devs, MockGetMoreNodes: &listMoreNodes{devs: devs[3:]}}
+	}
+
+	// Local primaries and handoffs go first, remote primaries are only
+	// fallbacks.
+	primaries, more := newClient("r1").writeNodes(fakeRing(), 0)
+	require.Equal(t, []string{"p0", "h1", "h2"}, deviceNames(primaries))
+	require.Equal(t, "p1", more.Next().Device)
+	require.Equal(t, "p2", more.Next().Device)
+	require.Equal(t, "h0", more.Next().Device)
+	require.Nil(t, more.Next())
+
+	// The node count limits how many handoffs are considered.
+	oc := newClient("r1")
+	oc.writeAffinityNodeCount = func(int) int { return 4 }
+	primaries, _ = oc.writeNodes(fakeRing(), 0)
+	require.Equal(t, []string{"p0", "p1", "p2"}, deviceNames(primaries))
+
+	// Without write affinity the primaries are used as is.
+	primaries, more = newClient("").writeNodes(fakeRing(), 0)
+	require.Equal(t, []string{"p0", "p1", "p2"}, deviceNames(primaries))
+	require.Equal(t, "h0", more.Next().Device)
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/nectar"
 	"github.com/troubling/nectar/nectarutil"
 	"go.uber.org/zap"
@@ -52,6 +53,7 @@ type ProxyDirectClient struct {
 	objectClients map[int]proxyObjectClient
 	lcm           sync.RWMutex
 	Logger        srv.LowLevelLogger
+	NodeTracker   *NodeTracker
 }
 
 func NewProxyDirectClient(policyList conf.PolicyList, cnf srv.ConfigLoader, logger srv.LowLevelLogger, certFile, keyFile string) (*ProxyDirectClient, error) {
@@ -84,7 +86,8 @@ func NewProxyDirectClient(policyList conf.PolicyList, cnf srv.ConfigLoader, logg
 			Transport: xport,
 			Timeout:   120 * time.Minute,
 		},
-		Logger: logger,
+		Logger:      logger,
+		NodeTracker: NewNodeTracker(),
 	}
 	if c.policyList == nil {
 		policyList, err := cnf.GetPolicies()
@@ -121,20 +124,75 @@ func NewProxyDirectClient(policyList conf.PolicyList, cnf srv.ConfigLoader, logg
 				client.deviceLimit = 3
 			}
 		}
+		if client.readAffinity, err = parseReadAffinity(policy.Config["read_affinity"]); err != nil {
+			return nil, fmt.Errorf("Invalid read_affinity for policy %d: %v", policy.Index, err)
+		}
+		if client.writeAffinity, err = parseWriteAffinity(policy.Config["write_affinity"]); err != nil {
+			return nil, fmt.Errorf("Invalid write_affinity for policy %d: %v", policy.Index, err)
+		}
+		nodeCount := policy.Config["write_affinity_node_count"]
+		if nodeCount == "" {
+			nodeCount = "2 * replicas"
+		}
+		if client.writeAffinityNodeCount, err = parseWriteAffinityNodeCount(nodeCount); err != nil {
+			return nil, fmt.Errorf("Invalid write_affinity_node_count for policy %d: %v", policy.Index, err)
+		}
 		c.objectClients[policy.Index] = client
 	}
 	return c, nil
 }
 
+// do sends req to dev and records the outcome with the NodeTracker, including
+// the response time if timed is set.
+func (c *ProxyDirectClient) do(dev *ring.Device, req *http.Request, timed bool) (*http.Response, error) {
+	span := tracing.Default().StartChildSpan(req.Method, tracing.KindClient, req.Header)
+	span.SetAttribute("net.peer.name", fmt.Sprintf("%s:%d", dev.Ip, dev.Port))
+	span.SetAttribute("device", dev.Device)
+	span.Inject(req.Header)
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		span.SetError(err)
+	} else {
+		span.SetStatus(resp.StatusCode)
+	}
+	span.Finish()
+	var latency time.Duration
+	if timed && err == nil {
+		latency = time.Since(start)
+	}
+	c.NodeTracker.Record(dev, resp, err, latency)
+	return resp, err
+}
+
 func (c *ProxyDirectClient) writeNodes(r ring.Ring, partition uint64) ([]*ring.Device, ring.MoreNodes) {
-	// TODO: if the client has been configured for write affinity, devices will be filtered here.
+	// Write affinity is configured per policy, so it's applied by standardObjectClient.writeNodes.
 	return r.GetNodes(partition), r.GetMoreNodes(partition)
 }
 
 // quorumResponse returns with a response representative of a quorum of nodes.
+// The requests are traced as children of the span in headers, if any.
 //
 // This is analogous to swift's best_response function.
-func (c *ProxyDirectClient) quorumResponse(r ring.Ring, partition uint64, devToRequest func(int, *ring.Device) (*http.Request, error)) *http.Response {
+func (c *ProxyDirectClient) quorumResponse(r ring.Ring, partition uint64, headers http.Header, devToRequest func(int, *ring.Device) (*http.Request, error)) (quorumResp *http.Response) {
+	span := tracing.Default().StartChildSpan("quorum", tracing.KindInternal, headers)
+	span.SetAttribute("replicas", int(r.ReplicaCount()))
+	defer func() {
+		if quorumResp != nil {
+			span.SetStatus(quorumResp.StatusCode)
+		}
+		span.Finish()
+	}()
+	if span != nil {
+		untraced := devToRequest
+		devToRequest = func(index int, dev *ring.Device) (*http.Request, error) {
+			req, err := untraced(index, dev)
+			if err == nil {
+				span.Inject(req.Header)
+			}
+			return req, err
+		}
+	}
 	cancel := make(chan struct{})
 	defer close(cancel)
 	responsec := make(chan *http.Response)
@@ -144,10 +202,18 @@ func (c *ProxyDirectClient) quorumResponse(r ring.Ring, partition uint64, devToR
 			var resp *http.Response
 			var firstResp *http.Response
 			for dev := devs[index]; dev != nil; dev = more.Next() {
+				if c.NodeTracker.Limited(dev) {
+					// Count a skipped node as an error, as firstResponse does,
+					// so a handoff not having the item doesn't turn into a 404.
+					if firstResp == nil {
+						firstResp = nectarutil.ResponseStub(http.StatusServiceUnavailable, "Node is error limited")
+					}
+					continue
+				}
 				if req, err := devToRequest(index, dev); err != nil {
 					c.Logger.Error("unable to get response", zap.Error(err))
 					resp = nectarutil.ResponseStub(http.StatusInternalServerError, err.Error())
-				} else if r, err := c.client.Do(req); err != nil {
+				} else if r, err := c.do(dev, req, true); err != nil {
 					c.Logger.Error("unable to get response", zap.Error(err))
 					resp = nectarutil.ResponseStub(http.StatusInternalServerError, err.Error())
 				} else {
@@ -160,6 +226,9 @@ func (c *ProxyDirectClient) quorumResponse(r ring.Ring, partition uint64, devToR
 					break
 				}
 			}
+			if resp == nil {
+				resp = nectarutil.ResponseStub(http.StatusServiceUnavailable, "All nodes are error limited")
+			}
 			// In the case where we're about to respond with Not Found, ensure
 			// it's a response from the primary node. This corrects for the
 			// case where the primary node 5xx errored and subsequent nodes
@@ -196,7 +265,11 @@ func (c *ProxyDirectClient) quorumResponse(r ring.Ring, partition uint64, devToR
 	return nectarutil.ResponseStub(http.StatusServiceUnavailable, "Unknown State")
 }
 
-func (c *ProxyDirectClient) firstResponse(r ring.Ring, partition uint64, deviceLimit int, devToRequest func(*ring.Device) (*http.Request, error)) (resp *http.Response) {
+// firstResponse returns the first successful response from the nodes for the
+// partition, trying the primaries in a random order, or by latency if the
+// NodeTracker is timing them, then in read affinity order if one is given,
+// before any handoffs. Error limited nodes are skipped.
+func (c *ProxyDirectClient) firstResponse(r ring.Ring, partition uint64, deviceLimit int, affinity readAffinity, devToRequest func(*ring.Device) (*http.Request, error)) (resp *http.Response) {
 	success := make(chan *http.Response)
 	returned := make(chan struct{})
 	defer close(returned)
@@ -209,9 +282,21 @@ func (c *ProxyDirectClient) firstResponse(r ring.Ring, partition uint64, deviceL
 		j := rand.Intn(i + 1)
 		devs[i], devs[j] = devs[j], devs[i]
 	}
+	c.NodeTracker.Sort(devs[:primaries])
+	affinity.sort(devs[:primaries])
 	more := r.GetMoreNodes(partition)
 	internalErrors := 0
 	notFounds := 0
+	usable := make([]*ring.Device, 0, len(devs))
+	for _, dev := range devs {
+		if c.NodeTracker.Limited(dev) {
+			// Count these so a handoff not having the item doesn't turn into a 404.
+			internalErrors++
+		} else {
+			usable = append(usable, dev)
+		}
+	}
+	devs = usable
 	interpretResponse := func(resp *http.Response) *http.Response {
 		if resp != nil && (resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusPreconditionFailed ||
 			resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable) {
@@ -241,6 +326,9 @@ func (c *ProxyDirectClient) firstResponse(r ring.Ring, partition uint64, deviceL
 			dev = devs[requestCount]
 		} else {
 			dev = more.Next()
+			for dev != nil && c.NodeTracker.Limited(dev) {
+				dev = more.Next()
+			}
 			if dev == nil {
 				break
 			}
@@ -253,8 +341,8 @@ func (c *ProxyDirectClient) firstResponse(r ring.Ring, partition uint64, deviceL
 		}
 
 		requestsPending++
-		go func(r *http.Request) {
-			response, err := c.client.Do(r)
+		go func(dev *ring.Device, r *http.Request) {
+			response, err := c.do(dev, r, true)
 			if err != nil {
 				c.Logger.Error("firstResponse response", zap.Error(err))
 				if response != nil {
@@ -269,7 +357,7 @@ func (c *ProxyDirectClient) firstResponse(r ring.Ring, partition uint64, deviceL
 					response.Body.Close()
 				}
 			}
-		}(req)
+		}(dev, req)
 
 		select {
 		case resp = <-success:
@@ -387,7 +475,7 @@ func (c *proxyClient) ContainerRing() ring.Ring {
 
 func (c *ProxyDirectClient) PutAccount(account string, headers http.Header) *http.Response {
 	partition := c.AccountRing.GetPartition(account, "", "")
-	return c.quorumResponse(c.AccountRing, partition, func(i int, dev *ring.Device) (*http.Request, error) {
+	return c.quorumResponse(c.AccountRing, partition, headers, func(i int, dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition, common.Urlencode(account))
 		req, err := http.NewRequest("PUT", url, nil)
 		if err != nil {
@@ -402,7 +490,7 @@ func (c *ProxyDirectClient) PutAccount(account string, headers http.Header) *htt
 
 func (c *ProxyDirectClient) PostAccount(account string, headers http.Header) *http.Response {
 	partition := c.AccountRing.GetPartition(account, "", "")
-	return c.quorumResponse(c.AccountRing, partition, func(i int, dev *ring.Device) (*http.Request, error) {
+	return c.quorumResponse(c.AccountRing, partition, headers, func(i int, dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition, common.Urlencode(account))
 		req, err := http.NewRequest("POST", url, nil)
 		if err != nil {
@@ -418,7 +506,7 @@ func (c *ProxyDirectClient) PostAccount(account string, headers http.Header) *ht
 func (c *ProxyDirectClient) GetAccount(account string, options map[string]string, headers http.Header) *http.Response {
 	partition := c.AccountRing.GetPartition(account, "", "")
 	query := nectarutil.Mkquery(options)
-	return c.firstResponse(c.AccountRing, partition, 0, func(dev *ring.Device) (*http.Request, error) {
+	return c.firstResponse(c.AccountRing, partition, 0, nil, func(dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), query)
 		req, err := http.NewRequest("GET", url, nil)
@@ -434,7 +522,7 @@ func (c *ProxyDirectClient) GetAccount(account string, options map[string]string
 
 func (c *ProxyDirectClient) HeadAccount(account string, headers http.Header) *http.Response {
 	partition := c.AccountRing.GetPartition(account, "", "")
-	return c.firstResponse(c.AccountRing, partition, 0, func(dev *ring.Device) (*http.Request, error) {
+	return c.firstResponse(c.AccountRing, partition, 0, nil, func(dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account))
 		req, err := http.NewRequest("HEAD", url, nil)
@@ -450,7 +538,7 @@ func (c *ProxyDirectClient) HeadAccount(account string, headers http.Header) *ht
 
 func (c *ProxyDirectClient) DeleteAccount(account string, headers http.Header) *http.Response {
 	partition := c.AccountRing.GetPartition(account, "", "")
-	return c.quorumResponse(c.AccountRing, partition, func(i int, dev *ring.Device) (*http.Request, error) {
+	return c.quorumResponse(c.AccountRing, partition, headers, func(i int, dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition, common.Urlencode(account))
 		req, err := http.NewRequest("DELETE", url, nil)
 		if err != nil {
@@ -479,7 +567,7 @@ func (c *ProxyDirectClient) PutContainer(account string, container string, heade
 		policyIndex = policy.Index
 	}
 	containerReplicaCount := int(c.ContainerRing.ReplicaCount())
-	return c.quorumResponse(c.ContainerRing, partition, func(i int, dev *ring.Device) (*http.Request, error) {
+	return c.quorumResponse(c.ContainerRing, partition, headers, func(i int, dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container))
 		req, err := http.NewRequest("PUT", url, nil)
@@ -501,7 +589,7 @@ func (c *ProxyDirectClient) PutContainer(account string, container string, heade
 
 func (c *ProxyDirectClient) PostContainer(account string, container string, headers http.Header) *http.Response {
 	partition := c.ContainerRing.GetPartition(account, container, "")
-	return c.quorumResponse(c.ContainerRing, partition, func(i int, dev *ring.Device) (*http.Request, error) {
+	return c.quorumResponse(c.ContainerRing, partition, headers, func(i int, dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container))
 		req, err := http.NewRequest("POST", url, nil)
@@ -518,7 +606,7 @@ func (c *ProxyDirectClient) PostContainer(account string, container string, head
 func (c *ProxyDirectClient) GetContainer(account string, container string, options map[string]string, headers http.Header) *http.Response {
 	partition := c.ContainerRing.GetPartition(account, container, "")
 	query := nectarutil.Mkquery(options)
-	return c.firstResponse(c.ContainerRing, partition, 0, func(dev *ring.Device) (*http.Request, error) {
+	return c.firstResponse(c.ContainerRing, partition, 0, nil, func(dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), query)
 		req, err := http.NewRequest("GET", url, nil)
@@ -607,7 +695,7 @@ func (c *ProxyDirectClient) GetContainerInfo(account string, container string, m
 
 func (c *ProxyDirectClient) HeadContainer(account string, container string, headers http.Header) *http.Response {
 	partition := c.ContainerRing.GetPartition(account, container, "")
-	return c.firstResponse(c.ContainerRing, partition, 0, func(dev *ring.Device) (*http.Request, error) {
+	return c.firstResponse(c.ContainerRing, partition, 0, nil, func(dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container))
 		req, err := http.NewRequest("HEAD", url, nil)
@@ -626,7 +714,7 @@ func (c *ProxyDirectClient) DeleteContainer(account string, container string, he
 	accountPartition := c.AccountRing.GetPartition(account, "", "")
 	accountDevices := c.AccountRing.GetNodes(accountPartition)
 	containerReplicaCount := int(c.ContainerRing.ReplicaCount())
-	return c.quorumResponse(c.ContainerRing, partition, func(i int, dev *ring.Device) (*http.Request, error) {
+	return c.quorumResponse(c.ContainerRing, partition, headers, func(i int, dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container))
 		req, err := http.NewRequest("DELETE", url, nil)
@@ -650,28 +738,88 @@ func (c *ProxyDirectClient) getObjectClient(account string, container string, mc
 	return c.objectClients[ci.StoragePolicyIndex]
 }
 
+// getObjectClients returns the client for the container's storage policy and,
+// while the container is being migrated to that policy, the client for the
+// policy it's being migrated from. When objects are being migrated, an
+// X-Backend-Storage-Policy-Index header alongside a common.PolicyMigrationHeader
+// picks one of the migration's policies instead.
+func (c *ProxyDirectClient) getObjectClients(account string, container string, headers http.Header, mc ring.MemcacheRing, lc map[string]*ContainerInfo) (proxyObjectClient, proxyObjectClient) {
+	ci, err := c.GetContainerInfo(account, container, mc, lc)
+	if err != nil {
+		return &erroringObjectClient{err.Error()}, nil
+	}
+	if migration, err := common.ParsePolicyMigration(headers.Get(common.PolicyMigrationHeader)); err == nil {
+		value := headers.Get("X-Backend-Storage-Policy-Index")
+		if policy, err := strconv.Atoi(value); err == nil && (policy == migration.From || policy == migration.To) && c.objectClients[policy] != nil {
+			return c.objectClients[policy], nil
+		}
+		return &erroringObjectClient{fmt.Sprintf("Invalid X-Backend-Storage-Policy-Index %q", value)}, nil
+	}
+	if m, err := common.ParsePolicyMigration(ci.SysMetadata["Policy-Migration"]); err == nil && c.objectClients[m.To] != nil && c.objectClients[m.From] != nil {
+		return c.objectClients[m.To], c.objectClients[m.From]
+	}
+	return c.objectClients[ci.StoragePolicyIndex], nil
+}
+
 func (c *ProxyDirectClient) PutObject(account string, container string, obj string, headers http.Header, src io.Reader, mc ring.MemcacheRing, lc map[string]*ContainerInfo) *http.Response {
-	return c.getObjectClient(account, container, mc, lc).putObject(account, container, obj, headers, src)
+	oc, _ := c.getObjectClients(account, container, headers, mc, lc)
+	return oc.putObject(account, container, obj, headers, src)
 }
 
 func (c *ProxyDirectClient) PostObject(account string, container string, obj string, headers http.Header, mc ring.MemcacheRing, lc map[string]*ContainerInfo) *http.Response {
-	return c.getObjectClient(account, container, mc, lc).postObject(account, container, obj, headers)
+	oc, from := c.getObjectClients(account, container, headers, mc, lc)
+	resp := oc.postObject(account, container, obj, headers)
+	if from != nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return from.postObject(account, container, obj, headers)
+	}
+	return resp
 }
 
 func (c *ProxyDirectClient) GetObject(account string, container string, obj string, headers http.Header, mc ring.MemcacheRing, lc map[string]*ContainerInfo) *http.Response {
-	return c.getObjectClient(account, container, mc, lc).getObject(account, container, obj, headers)
+	oc, from := c.getObjectClients(account, container, headers, mc, lc)
+	resp := oc.getObject(account, container, obj, headers)
+	if from != nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return from.getObject(account, container, obj, headers)
+	}
+	return resp
 }
 
 func (c *ProxyDirectClient) GrepObject(account string, container string, obj string, search string, mc ring.MemcacheRing, lc map[string]*ContainerInfo) *http.Response {
-	return c.getObjectClient(account, container, mc, lc).grepObject(account, container, obj, search)
+	oc, from := c.getObjectClients(account, container, nil, mc, lc)
+	resp := oc.grepObject(account, container, obj, search)
+	if from != nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return from.grepObject(account, container, obj, search)
+	}
+	return resp
 }
 
 func (c *ProxyDirectClient) HeadObject(account string, container string, obj string, headers http.Header, mc ring.MemcacheRing, lc map[string]*ContainerInfo) *http.Response {
-	return c.getObjectClient(account, container, mc, lc).headObject(account, container, obj, headers)
+	oc, from := c.getObjectClients(account, container, headers, mc, lc)
+	resp := oc.headObject(account, container, obj, headers)
+	if from != nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return from.headObject(account, container, obj, headers)
+	}
+	return resp
 }
 
+// DeleteObject deletes the object from both policies of a container being
+// migrated, so that the migration doesn't bring it back.
 func (c *ProxyDirectClient) DeleteObject(account string, container string, obj string, headers http.Header, mc ring.MemcacheRing, lc map[string]*ContainerInfo) *http.Response {
-	return c.getObjectClient(account, container, mc, lc).deleteObject(account, container, obj, headers)
+	oc, from := c.getObjectClients(account, container, headers, mc, lc)
+	resp := oc.deleteObject(account, container, obj, headers)
+	if from != nil {
+		fromResp := from.deleteObject(account, container, obj, headers)
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return fromResp
+		}
+		fromResp.Body.Close()
+	}
+	return resp
 }
 
 func (c *ProxyDirectClient) ObjectRingFor(account string, container string, mc ring.MemcacheRing, lc map[string]*ContainerInfo) (ring.Ring, *http.Response) {
@@ -715,11 +863,14 @@ func (oc *erroringObjectClient) ring() (ring.Ring, *http.Response) {
 }
 
 type standardObjectClient struct {
-	proxyDirectClient *ProxyDirectClient
-	policy            int
-	objectRing        ring.Ring
-	deviceLimit       int
-	Logger            srv.LowLevelLogger
+	proxyDirectClient      *ProxyDirectClient
+	policy                 int
+	objectRing             ring.Ring
+	deviceLimit            int
+	readAffinity           readAffinity
+	writeAffinity          writeAffinity
+	writeAffinityNodeCount func(replicas int) int
+	Logger                 srv.LowLevelLogger
 }
 
 // putReader is a Reader proxy that sends its reader over the ready channel the first time Read is called.
@@ -776,15 +927,33 @@ func (lm *lessMore) Next() *ring.Device {
 	return lm.more.Next()
 }
 
+// writeNodes returns the devices to write to and the ones to fall back on. With
+// write affinity configured, local devices among the primaries and first
+// handoffs are written to first, leaving replication to move the data to any
+// remote primaries.
 func (oc *standardObjectClient) writeNodes(r ring.Ring, partition uint64) ([]*ring.Device, ring.MoreNodes) {
 	devs, more := oc.proxyDirectClient.writeNodes(r, partition)
-	if oc.deviceLimit > 0 && len(devs) > oc.deviceLimit {
-		return devs[0:oc.deviceLimit], &lessMore{devs: devs[oc.deviceLimit:], more: more, limit: oc.deviceLimit}
+	replicas := len(devs)
+	if oc.deviceLimit > 0 && replicas > oc.deviceLimit {
+		replicas = oc.deviceLimit
 	}
-	return devs, &lessMore{more: more, limit: len(devs)}
+	if len(oc.writeAffinity) > 0 {
+		devs = oc.writeAffinity.localFirst(devs, more, oc.writeAffinityNodeCount(replicas))
+	}
+	if len(devs) > replicas {
+		return devs[0:replicas], &lessMore{devs: devs[replicas:], more: more, limit: replicas}
+	}
+	return devs, &lessMore{more: more, limit: replicas}
 }
 
-func (oc *standardObjectClient) putObject(account, container, obj string, headers http.Header, src io.Reader) *http.Response {
+func (oc *standardObjectClient) putObject(account, container, obj string, headers http.Header, src io.Reader) (quorumResp *http.Response) {
+	span := tracing.Default().StartChildSpan("quorum", tracing.KindInternal, headers)
+	defer func() {
+		if quorumResp != nil {
+			span.SetStatus(quorumResp.StatusCode)
+		}
+		span.Finish()
+	}()
 	objectPartition := oc.objectRing.GetPartition(account, container, obj)
 	containerPartition := oc.proxyDirectClient.ContainerRing.GetPartition(account, container, "")
 	containerDevices := oc.proxyDirectClient.ContainerRing.GetNodes(containerPartition)
@@ -794,6 +963,7 @@ func (oc *standardObjectClient) putObject(account, container, obj string, header
 	responsec := make(chan *http.Response)
 	devs, more := oc.writeNodes(oc.objectRing, objectPartition)
 	objectReplicaCount := len(devs)
+	span.SetAttribute("replicas", objectReplicaCount)
 
 	devToRequest := func(index int, dev *ring.Device) (*http.Request, error) {
 		trp, wp := io.Pipe()
@@ -812,6 +982,7 @@ func (oc *standardObjectClient) putObject(account, container, obj string, header
 		req.Header.Set("X-Container-Partition", strconv.FormatUint(containerPartition, 10))
 		addUpdateHeaders("X-Container", req.Header, containerDevices, index, objectReplicaCount)
 		req.Header.Set("Expect", "100-continue")
+		span.Inject(req.Header)
 		return req, nil
 	}
 
@@ -819,10 +990,18 @@ func (oc *standardObjectClient) putObject(account, container, obj string, header
 		go func(index int) {
 			var resp *http.Response
 			for dev := devs[index]; dev != nil; dev = more.Next() {
+				if oc.proxyDirectClient.NodeTracker.Limited(dev) {
+					// If every node is error limited, the PUT is a 503 like a
+					// GET or HEAD would be, not a 500.
+					if resp == nil {
+						resp = nectarutil.ResponseStub(http.StatusServiceUnavailable, "Node is error limited")
+					}
+					continue
+				}
 				if req, err := devToRequest(index, dev); err != nil {
 					oc.Logger.Error("unable create PUT request", zap.Error(err))
 					resp = nectarutil.ResponseStub(http.StatusInternalServerError, err.Error())
-				} else if r, err := oc.proxyDirectClient.client.Do(req); err != nil {
+				} else if r, err := oc.proxyDirectClient.do(dev, req, false); err != nil {
 					oc.Logger.Error("unable to PUT object", zap.Error(err))
 					resp = nectarutil.ResponseStub(http.StatusInternalServerError, err.Error())
 				} else {
@@ -898,7 +1077,7 @@ func (oc *standardObjectClient) postObject(account, container, obj string, heade
 	containerPartition := oc.proxyDirectClient.ContainerRing.GetPartition(account, container, "")
 	containerDevices := oc.proxyDirectClient.ContainerRing.GetNodes(containerPartition)
 	objectReplicaCount := int(oc.objectRing.ReplicaCount())
-	return oc.proxyDirectClient.quorumResponse(oc.objectRing, partition, func(i int, dev *ring.Device) (*http.Request, error) {
+	return oc.proxyDirectClient.quorumResponse(oc.objectRing, partition, headers, func(i int, dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
 		req, err := http.NewRequest("POST", url, nil)
@@ -917,10 +1096,13 @@ func (oc *standardObjectClient) postObject(account, container, obj string, heade
 
 func (oc *standardObjectClient) getObject(account, container, obj string, headers http.Header) *http.Response {
 	partition := oc.objectRing.GetPartition(account, container, obj)
-	return oc.proxyDirectClient.firstResponse(oc.objectRing, partition, oc.deviceLimit, func(dev *ring.Device) (*http.Request, error) {
-		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
+	url := func(dev *ring.Device) string {
+		return fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
-		req, err := http.NewRequest("GET", url, nil)
+	}
+	requestDevs := map[*http.Request]*ring.Device{}
+	resp := oc.proxyDirectClient.firstResponse(oc.objectRing, partition, oc.deviceLimit, oc.readAffinity, func(dev *ring.Device) (*http.Request, error) {
+		req, err := http.NewRequest("GET", url(dev), nil)
 		if err != nil {
 			return nil, err
 		}
@@ -928,13 +1110,18 @@ func (oc *standardObjectClient) getObject(account, container, obj string, header
 			req.Header.Set(key, headers.Get(key))
 		}
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(oc.policy))
+		requestDevs[req] = dev
 		return req, nil
 	})
+	if resp.Request != nil {
+		resp.Body = newResumingBody(oc, resp, requestDevs[resp.Request], partition, headers, url)
+	}
+	return resp
 }
 
 func (oc *standardObjectClient) grepObject(account, container, obj string, search string) *http.Response {
 	partition := oc.objectRing.GetPartition(account, container, obj)
-	return oc.proxyDirectClient.firstResponse(oc.objectRing, partition, oc.deviceLimit, func(dev *ring.Device) (*http.Request, error) {
+	return oc.proxyDirectClient.firstResponse(oc.objectRing, partition, oc.deviceLimit, oc.readAffinity, func(dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s?e=%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj), common.Urlencode(search))
 		req, err := http.NewRequest("GREP", url, nil)
@@ -948,7 +1135,7 @@ func (oc *standardObjectClient) grepObject(account, container, obj string, searc
 
 func (oc *standardObjectClient) headObject(account, container, obj string, headers http.Header) *http.Response {
 	partition := oc.objectRing.GetPartition(account, container, obj)
-	return oc.proxyDirectClient.firstResponse(oc.objectRing, partition, oc.deviceLimit, func(dev *ring.Device) (*http.Request, error) {
+	return oc.proxyDirectClient.firstResponse(oc.objectRing, partition, oc.deviceLimit, oc.readAffinity, func(dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
 		req, err := http.NewRequest("HEAD", url, nil)
@@ -968,7 +1155,7 @@ func (oc *standardObjectClient) deleteObject(account, container, obj string, hea
 	containerPartition := oc.proxyDirectClient.ContainerRing.GetPartition(account, container, "")
 	containerDevices := oc.proxyDirectClient.ContainerRing.GetNodes(containerPartition)
 	objectReplicaCount := int(oc.objectRing.ReplicaCount())
-	return oc.proxyDirectClient.quorumResponse(oc.objectRing, partition, func(i int, dev *ring.Device) (*http.Request, error) {
+	return oc.proxyDirectClient.quorumResponse(oc.objectRing, partition, headers, func(i int, dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
 		req, err := http.NewRequest("DELETE", url, nil)
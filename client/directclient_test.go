@@ -1,11 +1,22 @@
 package client
 
 import (
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+	"github.com/troubling/hummingbird/common/tracing"
+	"github.com/troubling/nectar/nectarutil"
+	"go.uber.org/zap"
 )
 
 func TestAddUpdateHeaders(t *testing.T) {
@@ -62,3 +73,156 @@ func TestAddUpdateHeaders(t *testing.T) {
 	require.Equal(t, "", headers.Get("X-Container-Host"))
 	require.Equal(t, "", headers.Get("X-Container-Device"))
 }
+
+// policyTestObjectClient is a storage policy holding the named objects.
+type policyTestObjectClient struct {
+	erroringObjectClient
+	objects map[string]bool
+}
+
+func (oc *policyTestObjectClient) status(obj string, found int) *http.Response {
+	if oc.objects[obj] {
+		return nectarutil.ResponseStub(found, "")
+	}
+	return nectarutil.ResponseStub(http.StatusNotFound, "")
+}
+
+func (oc *policyTestObjectClient) putObject(account, container, obj string, headers http.Header, src io.Reader) *http.Response {
+	oc.objects[obj] = true
+	return nectarutil.ResponseStub(http.StatusCreated, "")
+}
+
+func (oc *policyTestObjectClient) getObject(account, container, obj string, headers http.Header) *http.Response {
+	return oc.status(obj, http.StatusOK)
+}
+
+func (oc *policyTestObjectClient) deleteObject(account, container, obj string, headers http.Header) *http.Response {
+	resp := oc.status(obj, http.StatusNoContent)
+	delete(oc.objects, obj)
+	return resp
+}
+
+func TestPolicyMigrationObjectClients(t *testing.T) {
+	from := &policyTestObjectClient{objects: map[string]bool{"old": true, "both": true}}
+	to := &policyTestObjectClient{objects: map[string]bool{"both": true}}
+	c := &ProxyDirectClient{objectClients: map[int]proxyObjectClient{0: from, 1: to}}
+	lc := map[string]*ContainerInfo{"container/a/c": {StoragePolicyIndex: 1, SysMetadata: map[string]string{"Policy-Migration": "0:1"}}}
+
+	require.Equal(t, http.StatusOK, c.GetObject("a", "c", "old", nil, nil, lc).StatusCode)
+	require.Equal(t, http.StatusNotFound, c.GetObject("a", "c", "old", http.Header{"X-Backend-Storage-Policy-Index": {"1"}, common.PolicyMigrationHeader: {"0:1"}}, nil, lc).StatusCode)
+	require.Equal(t, http.StatusNotFound, c.GetObject("a", "c", "new", nil, nil, lc).StatusCode)
+	require.Equal(t, http.StatusInternalServerError, c.GetObject("a", "c", "old", http.Header{"X-Backend-Storage-Policy-Index": {"7"}, common.PolicyMigrationHeader: {"0:1"}}, nil, lc).StatusCode)
+	// Without the migration header the policy index is ignored.
+	require.Equal(t, http.StatusOK, c.GetObject("a", "c", "old", http.Header{"X-Backend-Storage-Policy-Index": {"1"}}, nil, lc).StatusCode)
+
+	// New objects go to the new policy.
+	require.Equal(t, http.StatusCreated, c.PutObject("a", "c", "new", nil, nil, nil, lc).StatusCode)
+	require.True(t, to.objects["new"])
+	require.False(t, from.objects["new"])
+
+	// Deletes are from both.
+	require.Equal(t, http.StatusNoContent, c.DeleteObject("a", "c", "both", nil, nil, lc).StatusCode)
+	require.False(t, to.objects["both"])
+	require.False(t, from.objects["both"])
+	require.Equal(t, http.StatusNoContent, c.DeleteObject("a", "c", "old", nil, nil, lc).StatusCode)
+	require.False(t, from.objects["old"])
+
+	// Once the migration is done only the one policy is read.
+	from.objects["old"] = true
+	lc["container/a/c"].SysMetadata = map[string]string{}
+	require.Equal(t, http.StatusNotFound, c.GetObject("a", "c", "old", nil, nil, lc).StatusCode)
+}
+
+type tracingTestExporter struct {
+	lock  sync.Mutex
+	spans map[string]*tracing.Span
+}
+
+func (e *tracingTestExporter) ExportSpans(spans []*tracing.Span) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, s := range spans {
+		e.spans[s.SpanID] = s
+	}
+	return nil
+}
+
+func (e *tracingTestExporter) Close() error {
+	return nil
+}
+
+func TestQuorumResponseTracing(t *testing.T) {
+	var lock sync.Mutex
+	var received []tracing.SpanContext
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		received = append(received, tracing.FromHeader(r.Header))
+		lock.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	var devs []*ring.Device
+	for _, name := range []string{"sda", "sdb", "sdc"} {
+		devs = append(devs, &ring.Device{Scheme: "http", Ip: u.Hostname(), Port: port, Device: name})
+	}
+	e := &tracingTestExporter{spans: map[string]*tracing.Span{}}
+	tracer := tracing.NewTracer("proxy", e, 1, 0)
+	defer tracer.Close()
+	tracing.SetDefault(tracer)
+	defer tracing.SetDefault(nil)
+
+	root := tracer.StartSpan("PUT", tracing.KindServer, tracing.SpanContext{})
+	headers := http.Header{}
+	root.Inject(headers)
+	c := &ProxyDirectClient{client: http.DefaultClient, Logger: zap.NewNop(), NodeTracker: NewNodeTracker()}
+	r := &test.FakeRing{MockDevices: devs, MockGetMoreNodes: &listMoreNodes{}}
+	resp := c.quorumResponse(r, 0, headers, func(i int, dev *ring.Device) (*http.Request, error) {
+		req, err := http.NewRequest("PUT", server.URL+"/"+dev.Device, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key := range headers {
+			req.Header.Set(key, headers.Get(key))
+		}
+		return req, nil
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	for i := 0; i < 100; i++ {
+		tracer.Flush()
+		e.lock.Lock()
+		count := len(e.spans)
+		e.lock.Unlock()
+		if count == 4 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	require.Equal(t, 4, len(e.spans))
+	var quorum *tracing.Span
+	for _, s := range e.spans {
+		if s.Name == "quorum" {
+			quorum = s
+		}
+	}
+	require.NotNil(t, quorum)
+	require.Equal(t, root.SpanID, quorum.ParentID)
+	require.Equal(t, 201, quorum.Attributes["http.status_code"])
+	// Each backend is sent the span of the request made to it.
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, 3, len(received))
+	for _, sc := range received {
+		s := e.spans[sc.Traceparent()[36:52]]
+		require.NotNil(t, s)
+		require.Equal(t, tracing.KindClient, s.Kind)
+		require.Equal(t, quorum.SpanID, s.ParentID)
+		require.Equal(t, root.TraceID, s.TraceID)
+	}
+}
@@ -0,0 +1,220 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/uber-go/tally"
+)
+
+// latencyWeight is how much each new response time counts toward a device's
+// moving average latency.
+const latencyWeight = 0.3
+
+// NodeTracker keeps track of errors and response times from backend devices,
+// so requests can skip devices that keep failing and prefer fast ones.
+//
+// A device that has more than ErrorLimit errors, each within ErrorInterval of
+// the last, is error limited and skipped until ErrorInterval has passed since
+// its last error. If Timing is set, reads go to the devices with the lowest
+// moving average latency first; latencies older than TimingExpiry are
+// forgotten so that slow devices get tried again.
+//
+// A nil NodeTracker tracks nothing and never limits a device.
+type NodeTracker struct {
+	ErrorLimit    int
+	ErrorInterval time.Duration
+	Timing        bool
+	TimingExpiry  time.Duration
+
+	lock          sync.Mutex
+	nodes         map[string]*nodeStats
+	limitedCount  int
+	limitsMetric  tally.Counter
+	limitedMetric tally.Gauge
+	errorsMetric  tally.Counter
+	now           func() time.Time
+}
+
+type nodeStats struct {
+	errors       int
+	lastError    time.Time
+	limited      bool
+	latency      float64
+	lastResponse time.Time
+}
+
+// LimitedNode describes an error limited device.
+type LimitedNode struct {
+	Node      string    `json:"node"`
+	Errors    int       `json:"errors"`
+	LastError time.Time `json:"last_error"`
+	Until     time.Time `json:"until"`
+}
+
+// NewNodeTracker returns a NodeTracker with Swift's default error limiting and
+// timing disabled.
+func NewNodeTracker() *NodeTracker {
+	nt := &NodeTracker{
+		ErrorLimit:    10,
+		ErrorInterval: time.Minute,
+		TimingExpiry:  5 * time.Minute,
+		nodes:         map[string]*nodeStats{},
+		now:           time.Now,
+	}
+	nt.SetMetricsScope(tally.NoopScope)
+	return nt
+}
+
+// SetMetricsScope sets where error limiting metrics are reported.
+func (nt *NodeTracker) SetMetricsScope(metricsScope tally.Scope) {
+	nt.lock.Lock()
+	defer nt.lock.Unlock()
+	nt.limitsMetric = metricsScope.Counter("backend_error_limits")
+	nt.limitedMetric = metricsScope.Gauge("backend_error_limited_nodes")
+	nt.errorsMetric = metricsScope.Counter("backend_errors")
+	nt.limitedMetric.Update(float64(nt.limitedCount))
+}
+
+func nodeKey(dev *ring.Device) string {
+	return fmt.Sprintf("%s:%d/%s", dev.Ip, dev.Port, dev.Device)
+}
+
+func (nt *NodeTracker) stats(dev *ring.Device) *nodeStats {
+	key := nodeKey(dev)
+	ns := nt.nodes[key]
+	if ns == nil {
+		ns = &nodeStats{}
+		nt.nodes[key] = ns
+	}
+	return ns
+}
+
+// expire clears the error limit on ns if ErrorInterval has passed since its
+// last error.
+func (nt *NodeTracker) expire(ns *nodeStats, now time.Time) {
+	if ns.errors > 0 && now.Sub(ns.lastError) > nt.ErrorInterval {
+		ns.errors = 0
+		if ns.limited {
+			ns.limited = false
+			nt.limitedCount--
+			nt.limitedMetric.Update(float64(nt.limitedCount))
+		}
+	}
+}
+
+func (nt *NodeTracker) addErrors(ns *nodeStats, errors int, now time.Time) {
+	nt.expire(ns, now)
+	ns.errors += errors
+	ns.lastError = now
+	nt.errorsMetric.Inc(1)
+	if !ns.limited && ns.errors > nt.ErrorLimit {
+		ns.limited = true
+		nt.limitedCount++
+		nt.limitsMetric.Inc(1)
+		nt.limitedMetric.Update(float64(nt.limitedCount))
+	}
+}
+
+// Limited returns whether dev is error limited and should be skipped.
+func (nt *NodeTracker) Limited(dev *ring.Device) bool {
+	if nt == nil {
+		return false
+	}
+	nt.lock.Lock()
+	defer nt.lock.Unlock()
+	ns := nt.nodes[nodeKey(dev)]
+	if ns == nil {
+		return false
+	}
+	nt.expire(ns, nt.now())
+	return ns.limited
+}
+
+// Record notes the outcome of a request to dev. A request error or 5xx
+// response counts as an error; a 507 Insufficient Storage error limits the
+// device right away. A latency of zero isn't recorded, for requests like PUTs
+// whose duration doesn't reflect the device's responsiveness.
+func (nt *NodeTracker) Record(dev *ring.Device, resp *http.Response, err error, latency time.Duration) {
+	if nt == nil {
+		return
+	}
+	nt.lock.Lock()
+	defer nt.lock.Unlock()
+	now := nt.now()
+	ns := nt.stats(dev)
+	if err != nil || resp == nil {
+		nt.addErrors(ns, 1, now)
+	} else if resp.StatusCode == http.StatusInsufficientStorage {
+		nt.addErrors(ns, nt.ErrorLimit+1, now)
+	} else if resp.StatusCode/100 == 5 {
+		nt.addErrors(ns, 1, now)
+	}
+	if latency > 0 {
+		if ns.lastResponse.IsZero() || now.Sub(ns.lastResponse) > nt.TimingExpiry {
+			ns.latency = latency.Seconds()
+		} else {
+			ns.latency = latencyWeight*latency.Seconds() + (1-latencyWeight)*ns.latency
+		}
+		ns.lastResponse = now
+	}
+}
+
+// Sort orders devs by moving average latency if Timing is set, keeping the
+// existing order among devices with the same latency. Devices without a
+// recent latency go first so they get measured.
+func (nt *NodeTracker) Sort(devs []*ring.Device) {
+	if nt == nil || !nt.Timing {
+		return
+	}
+	nt.lock.Lock()
+	now := nt.now()
+	latencies := make(map[*ring.Device]float64, len(devs))
+	for _, dev := range devs {
+		if ns := nt.nodes[nodeKey(dev)]; ns != nil && now.Sub(ns.lastResponse) <= nt.TimingExpiry {
+			latencies[dev] = ns.latency
+		}
+	}
+	nt.lock.Unlock()
+	sort.SliceStable(devs, func(i, j int) bool {
+		return latencies[devs[i]] < latencies[devs[j]]
+	})
+}
+
+// LimitedNodes returns the devices currently error limited.
+func (nt *NodeTracker) LimitedNodes() []LimitedNode {
+	limited := []LimitedNode{}
+	if nt == nil {
+		return limited
+	}
+	nt.lock.Lock()
+	defer nt.lock.Unlock()
+	now := nt.now()
+	for key, ns := range nt.nodes {
+		nt.expire(ns, now)
+		if ns.limited {
+			limited = append(limited, LimitedNode{Node: key, Errors: ns.errors, LastError: ns.lastError, Until: ns.lastError.Add(nt.ErrorInterval)})
+		}
+	}
+	sort.Slice(limited, func(i, j int) bool { return limited[i].Node < limited[j].Node })
+	return limited
+}
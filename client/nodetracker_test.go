@@ -0,0 +1,210 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func newTestNodeTracker(now *time.Time) *NodeTracker {
+	nt := NewNodeTracker()
+	nt.ErrorLimit = 2
+	nt.now = func() time.Time { return *now }
+	return nt
+}
+
+func TestNodeTrackerErrorLimit(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	nt := newTestNodeTracker(&now)
+	dev := &ring.Device{Ip: "127.0.0.1", Port: 6000, Device: "sda"}
+	other := &ring.Device{Ip: "127.0.0.1", Port: 6000, Device: "sdb"}
+
+	nt.Record(dev, nil, errors.New("connection refused"), 0)
+	nt.Record(dev, &http.Response{StatusCode: 503}, nil, 0)
+	nt.Record(dev, &http.Response{StatusCode: 404}, nil, 0)
+	require.False(t, nt.Limited(dev))
+	nt.Record(dev, &http.Response{StatusCode: 500}, nil, 0)
+	require.True(t, nt.Limited(dev))
+	require.False(t, nt.Limited(other))
+
+	limited := nt.LimitedNodes()
+	require.Equal(t, 1, len(limited))
+	require.Equal(t, "127.0.0.1:6000/sda", limited[0].Node)
+	require.Equal(t, 3, limited[0].Errors)
+	require.Equal(t, now.Add(time.Minute), limited[0].Until)
+
+	now = now.Add(61 * time.Second)
+	require.False(t, nt.Limited(dev))
+	require.Equal(t, 0, len(nt.LimitedNodes()))
+
+	// Errors spread out further than the interval never add up to a limit.
+	for i := 0; i < 5; i++ {
+		nt.Record(dev, &http.Response{StatusCode: 500}, nil, 0)
+		now = now.Add(61 * time.Second)
+	}
+	require.False(t, nt.Limited(dev))
+
+	nt.Record(other, &http.Response{StatusCode: 507}, nil, 0)
+	require.True(t, nt.Limited(other))
+}
+
+func TestNodeTrackerSort(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	nt := newTestNodeTracker(&now)
+	fast := &ring.Device{Device: "fast"}
+	slow := &ring.Device{Device: "slow"}
+	unknown := &ring.Device{Device: "unknown"}
+	nt.Record(fast, &http.Response{StatusCode: 200}, nil, 10*time.Millisecond)
+	nt.Record(slow, &http.Response{StatusCode: 200}, nil, 100*time.Millisecond)
+	nt.Record(slow, &http.Response{StatusCode: 200}, nil, 5*time.Millisecond)
+
+	devs := []*ring.Device{slow, fast, unknown}
+	nt.Sort(devs)
+	require.Equal(t, []string{"slow", "fast", "unknown"}, deviceNames(devs))
+
+	nt.Timing = true
+	nt.Sort(devs)
+	require.Equal(t, []string{"unknown", "fast", "slow"}, deviceNames(devs))
+
+	now = now.Add(6 * time.Minute)
+	nt.Record(fast, &http.Response{StatusCode: 200}, nil, 20*time.Millisecond)
+	nt.Sort(devs)
+	require.Equal(t, []string{"unknown", "slow", "fast"}, deviceNames(devs))
+}
+
+func TestNilNodeTracker(t *testing.T) {
+	var nt *NodeTracker
+	dev := &ring.Device{Device: "sda"}
+	nt.Record(dev, nil, errors.New("nope"), 0)
+	require.False(t, nt.Limited(dev))
+	require.Equal(t, 0, len(nt.LimitedNodes()))
+}
+
+func TestFirstResponseSkipsLimitedNodes(t *testing.T) {
+	var badRequests int64
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&badRequests, 1)
+		w.WriteHeader(http.StatusInsufficientStorage)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer good.Close()
+	device := func(server *httptest.Server, name string) *ring.Device {
+		u, err := url.Parse(server.URL)
+		require.Nil(t, err)
+		port, err := strconv.Atoi(u.Port())
+		require.Nil(t, err)
+		return &ring.Device{Scheme: "http", Ip: u.Hostname(), Port: port, Device: name}
+	}
+	badDev := device(bad, "sda")
+	devs := []*ring.Device{badDev, device(good, "sdb"), device(good, "sdc")}
+	c := &ProxyDirectClient{client: http.DefaultClient, Logger: zap.NewNop(), NodeTracker: NewNodeTracker()}
+	r := &test.FakeRing{MockDevices: devs, MockGetMoreNodes: &listMoreNodes{}}
+	devToRequest := func(dev *ring.Device) (*http.Request, error) {
+		return http.NewRequest("GET", dev.Scheme+"://"+dev.Ip+":"+strconv.Itoa(dev.Port)+"/"+dev.Device, nil)
+	}
+
+	// Keep asking until the bad node has been tried first and error limited.
+	for i := 0; i < 100 && atomic.LoadInt64(&badRequests) == 0; i++ {
+		resp := c.firstResponse(r, 0, 0, nil, devToRequest)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	require.Equal(t, int64(1), atomic.LoadInt64(&badRequests))
+	require.True(t, c.NodeTracker.Limited(badDev))
+	for i := 0; i < 20; i++ {
+		resp := c.firstResponse(r, 0, 0, nil, devToRequest)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	require.Equal(t, int64(1), atomic.LoadInt64(&badRequests))
+}
+
+type lockedMoreNodes struct {
+	lock sync.Mutex
+	listMoreNodes
+}
+
+func (m *lockedMoreNodes) Next() *ring.Device {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.listMoreNodes.Next()
+}
+
+func TestQuorumResponseLimitedPrimaries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	var devs []*ring.Device
+	for _, name := range []string{"sda", "sdb", "sdc", "sdd"} {
+		devs = append(devs, &ring.Device{Scheme: "http", Ip: u.Hostname(), Port: port, Device: name})
+	}
+	c := &ProxyDirectClient{client: http.DefaultClient, Logger: zap.NewNop(), NodeTracker: NewNodeTracker()}
+	c.NodeTracker.Record(devs[0], &http.Response{StatusCode: 507}, nil, 0)
+	c.NodeTracker.Record(devs[1], &http.Response{StatusCode: 507}, nil, 0)
+	r := &test.FakeRing{MockDevices: devs[:3], MockGetMoreNodes: &lockedMoreNodes{listMoreNodes: listMoreNodes{devs: devs[3:]}}}
+
+	// The handoff not having the item mustn't outvote the primaries that
+	// couldn't be asked.
+	resp := c.quorumResponse(r, 0, http.Header{}, func(i int, dev *ring.Device) (*http.Request, error) {
+		return http.NewRequest("PUT", server.URL+"/"+dev.Device, nil)
+	})
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestPutObjectAllLimited(t *testing.T) {
+	var devs []*ring.Device
+	for _, name := range []string{"sda", "sdb", "sdc", "sdd"} {
+		devs = append(devs, &ring.Device{Scheme: "http", Ip: "127.0.0.1", Port: 1, Device: name})
+	}
+	nt := NewNodeTracker()
+	for _, dev := range devs {
+		nt.Record(dev, &http.Response{StatusCode: 507}, nil, 0)
+	}
+	oc := &standardObjectClient{
+		proxyDirectClient: &ProxyDirectClient{
+			client:        http.DefaultClient,
+			Logger:        zap.NewNop(),
+			NodeTracker:   nt,
+			ContainerRing: &test.FakeRing{MockDevices: devs[:3]},
+		},
+		objectRing: &test.FakeRing{MockDevices: devs[:3], MockGetMoreNodes: &lockedMoreNodes{listMoreNodes: listMoreNodes{devs: devs[3:]}}},
+		Logger:     zap.NewNop(),
+	}
+	resp := oc.putObject("a", "c", "o", http.Header{}, bytes.NewReader([]byte("data")))
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
@@ -0,0 +1,156 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common/ring"
+	"go.uber.org/zap"
+)
+
+// resumingBody is an object GET response body that, if the object server
+// stops sending part way through, fetches the rest of the body from another
+// replica or handoff and carries on as if nothing happened.
+type resumingBody struct {
+	io.ReadCloser
+	oc        *standardObjectClient
+	dev       *ring.Device
+	tried     map[string]bool
+	url       func(dev *ring.Device) string
+	headers   http.Header
+	partition uint64
+	// etag is the object's Etag without the quotes the object server sends.
+	etag string
+	// start and end are the offsets of the bytes still to be read, inclusive.
+	start int64
+	end   int64
+}
+
+// newResumingBody wraps resp.Body, which came from dev, in a resumingBody if
+// the response is a whole object or a single range of one. Otherwise resp.Body
+// is returned as is.
+func newResumingBody(oc *standardObjectClient, resp *http.Response, dev *ring.Device, partition uint64, headers http.Header, url func(dev *ring.Device) string) io.ReadCloser {
+	if dev == nil || resp.Header.Get("Etag") == "" {
+		return resp.Body
+	}
+	length, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return resp.Body
+	}
+	rb := &resumingBody{
+		ReadCloser: resp.Body,
+		oc:         oc,
+		dev:        dev,
+		tried:      map[string]bool{nodeKey(dev): true},
+		url:        url,
+		headers:    headers,
+		partition:  partition,
+		etag:       strings.Trim(resp.Header.Get("Etag"), "\""),
+		end:        length - 1,
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "multipart/byteranges" {
+			return resp.Body
+		}
+		var total int64
+		if n, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &rb.start, &rb.end, &total); err != nil || n != 3 || rb.end-rb.start+1 != length {
+			return resp.Body
+		}
+	default:
+		return resp.Body
+	}
+	return rb
+}
+
+func (rb *resumingBody) Read(p []byte) (int, error) {
+	for {
+		n, err := rb.ReadCloser.Read(p)
+		rb.start += int64(n)
+		if err == nil {
+			return n, nil
+		}
+		if rb.start > rb.end {
+			return n, io.EOF
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		rb.oc.proxyDirectClient.NodeTracker.Record(rb.dev, nil, err, 0)
+		if rerr := rb.resume(err); rerr != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the body with the rest of the object from a device that
+// hasn't been tried yet, trying the primaries and then as many handoffs.
+func (rb *resumingBody) resume(cause error) error {
+	rb.ReadCloser.Close()
+	rb.ReadCloser = http.NoBody
+	devs := rb.oc.objectRing.GetNodes(rb.partition)
+	more := rb.oc.objectRing.GetMoreNodes(rb.partition)
+	for i := 0; i < 2*len(devs); i++ {
+		var dev *ring.Device
+		if i < len(devs) {
+			dev = devs[i]
+		} else if dev = more.Next(); dev == nil {
+			break
+		}
+		if rb.tried[nodeKey(dev)] || rb.oc.proxyDirectClient.NodeTracker.Limited(dev) {
+			continue
+		}
+		rb.tried[nodeKey(dev)] = true
+		req, err := http.NewRequest("GET", rb.url(dev), nil)
+		if err != nil {
+			continue
+		}
+		for key := range rb.headers {
+			req.Header.Set(key, rb.headers.Get(key))
+		}
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+		req.Header.Set("If-Match", "\""+rb.etag+"\"")
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rb.start, rb.end))
+		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(rb.oc.policy))
+		resp, err := rb.oc.proxyDirectClient.do(dev, req, false)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusPartialContent || strings.Trim(resp.Header.Get("Etag"), "\"") != rb.etag {
+			resp.Body.Close()
+			continue
+		}
+		rb.oc.Logger.Info("resuming object GET from another node", zap.Error(cause),
+			zap.String("from", nodeKey(rb.dev)), zap.String("to", nodeKey(dev)), zap.Int64("offset", rb.start))
+		rb.ReadCloser = resp.Body
+		rb.dev = dev
+		return nil
+	}
+	rb.oc.Logger.Error("unable to resume object GET", zap.Error(cause), zap.String("from", nodeKey(rb.dev)), zap.Int64("offset", rb.start))
+	return errors.New("no node to resume from")
+}
@@ -0,0 +1,119 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+const resumeTestBody = "0123456789"
+
+// resumeTestServer serves resumeTestBody, honoring a single Range and
+// If-Match, and drops the connection after sending truncate bytes if truncate
+// is positive.
+func resumeTestServer(t *testing.T, truncate int) (*httptest.Server, *ring.Device) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if im := r.Header.Get("If-Match"); im != "" && !common.ParseIfMatch(im)["abc"] {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		start, end := 0, len(resumeTestBody)-1
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(resumeTestBody)))
+			status = http.StatusPartialContent
+		}
+		body := resumeTestBody[start : end+1]
+		w.Header().Set("Etag", "\"abc\"")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		if truncate > 0 && truncate < len(body) {
+			w.Write([]byte(body[:truncate]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte(body))
+	}))
+	u, err := url.Parse(server.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	return server, &ring.Device{Scheme: "http", Ip: u.Hostname(), Port: port, Device: "sda"}
+}
+
+func resumeTestGet(t *testing.T, oc *standardObjectClient, dev *ring.Device, headers http.Header) (string, error) {
+	urlFor := func(dev *ring.Device) string {
+		return fmt.Sprintf("%s://%s:%d/%s/0/a/c/o", dev.Scheme, dev.Ip, dev.Port, dev.Device)
+	}
+	req, err := http.NewRequest("GET", urlFor(dev), nil)
+	require.Nil(t, err)
+	for key := range headers {
+		req.Header.Set(key, headers.Get(key))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	body := newResumingBody(oc, resp, dev, 0, headers, urlFor)
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	return string(data), err
+}
+
+func TestResumingBody(t *testing.T) {
+	truncating, truncatingDev := resumeTestServer(t, 3)
+	defer truncating.Close()
+	good, goodDev := resumeTestServer(t, 0)
+	defer good.Close()
+	oc := &standardObjectClient{
+		proxyDirectClient: &ProxyDirectClient{client: http.DefaultClient, NodeTracker: NewNodeTracker()},
+		objectRing:        &test.FakeRing{MockDevices: []*ring.Device{truncatingDev, goodDev, goodDev}, MockGetMoreNodes: &listMoreNodes{}},
+		Logger:            zap.NewNop(),
+	}
+
+	body, err := resumeTestGet(t, oc, truncatingDev, http.Header{})
+	require.Nil(t, err)
+	require.Equal(t, resumeTestBody, body)
+
+	body, err = resumeTestGet(t, oc, truncatingDev, http.Header{"Range": {"bytes=2-7"}})
+	require.Nil(t, err)
+	require.Equal(t, "234567", body)
+}
+
+func TestResumingBodyNoGoodNodes(t *testing.T) {
+	truncating, truncatingDev := resumeTestServer(t, 3)
+	defer truncating.Close()
+	oc := &standardObjectClient{
+		proxyDirectClient: &ProxyDirectClient{client: http.DefaultClient, NodeTracker: NewNodeTracker()},
+		objectRing:        &test.FakeRing{MockDevices: []*ring.Device{truncatingDev, truncatingDev, truncatingDev}, MockGetMoreNodes: &listMoreNodes{}},
+		Logger:            zap.NewNop(),
+	}
+	body, err := resumeTestGet(t, oc, truncatingDev, http.Header{})
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	require.Equal(t, "012", body)
+}
@@ -178,11 +178,17 @@ func initCommand(args []string) error {
 	print(``)
 	print(`[filter:slo]`)
 	print(``)
+	print(`[filter:symlink]`)
+	print(``)
 	print(`[filter:tempurl]`)
 	print(``)
+	print(`[filter:s3api]`)
+	print(``)
 	print(`[filter:staticweb]`)
 	print(``)
 	print(`[filter:copy]`)
+	print(``)
+	print(`[filter:multipart]`)
 	print(`EOF`)
 	if subcmd != "deb" {
 		print(`sudo chown %s: %s/etc/hummingbird/proxy-server.conf`, username, prefix)
@@ -321,6 +321,7 @@ func main() {
 		fmt.Fprintf(os.Stderr, "    rebalance [-dryrun] (rebalance the ring)\n")
 		fmt.Fprintf(os.Stderr, "    search <search_flags> (search for devices in the ring)\n")
 		fmt.Fprintf(os.Stderr, "    set_weight <search_flags> [-yes] <weight> (change the weight of 1 or more devices)\n")
+		fmt.Fprintf(os.Stderr, "    set_target_weight <search_flags> [-yes] <target_weight> <step> (have andrewd ramp the weight of 1 or more devices a step per rebalance; a step of 0 cancels)\n")
 		fmt.Fprintf(os.Stderr, "    remove <search_flags> [-yes] (remove device from the ring)\n")
 		fmt.Fprintf(os.Stderr, "    set_info <search_flags> [-yes] <change_flags> (change device information)\n")
 		fmt.Fprintf(os.Stderr, "    info (display ring info)\n")
@@ -328,10 +329,16 @@ func main() {
 		fmt.Fprintf(os.Stderr, "    validate (validate ring)\n")
 		fmt.Fprintf(os.Stderr, "    write_ring (write the ring file)\n")
 		fmt.Fprintf(os.Stderr, "    pretend_min_part_hours_passed (reset min_part_hours)\n")
+		fmt.Fprintf(os.Stderr, "    simulate [-cycles <n>] [-recon=false] <script_file> (simulate changes without saving them)\n")
+		fmt.Fprintf(os.Stderr, "    export [<json_file>] (write the builder, or a ring file given in place of the builder, as JSON)\n")
+		fmt.Fprintf(os.Stderr, "    import <json_file> (replace the builder or ring file with one exported as JSON)\n")
 		fmt.Fprintf(os.Stderr, "  <device> is of the form: [r<region>]z<zone>[s<scheme>]-<ip>:<port>[R<r_ip>:<r_port>]/<device_name>_<meta>\n")
 		fmt.Fprintf(os.Stderr, "  <scheme> can be either http or https\n")
 		fmt.Fprintf(os.Stderr, "  <search_flags> is at least one of: -region, -zone, -scheme, -ip, -port, -replication-ip, replication-port, -device, -meta, -weight\n")
 		fmt.Fprintf(os.Stderr, "  <change_flags> is at least one of: -change-ip, -change-port, -change-replication-ip, -change-replication-port, -change-device, -change-meta, -change-scheme\n")
+		fmt.Fprintf(os.Stderr, "  <script_file> has one change per line: add <device> <weight>, set_weight <id|ip:port/device> <weight>, remove <id|ip:port/device> [purge]\n")
+		fmt.Fprintf(os.Stderr, "hummingbird ring diff [-recon=false] <old.ring.gz> <new.ring.gz>\n")
+		fmt.Fprintf(os.Stderr, "  Reports partition moves, device and dispersion changes between two ring files.\n")
 		ringBuilderFlags.PrintDefaults()
 	}
 
@@ -397,6 +404,36 @@ func main() {
 		reconFlags.PrintDefaults()
 	}
 
+	migratePolicyFlags := flag.NewFlagSet("", flag.ExitOnError)
+	migratePolicyFlags.String("P", "", "Name of the storage policy to move the container to")
+	migratePolicyFlags.String("c", findConfig("andrewd"), "Andrewd Config file to use")
+	migratePolicyFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird migratepolicy -P policy_name ACCOUNT/CONTAINER\n")
+		fmt.Fprintln(os.Stderr, "  Moves a container to another storage policy. New objects go to the new")
+		fmt.Fprintln(os.Stderr, "  policy at once and andrewd moves the rest, while they can still be read.")
+		migratePolicyFlags.PrintDefaults()
+	}
+
+	auditVerifyFlags := flag.NewFlagSet("", flag.ExitOnError)
+	auditVerifyFlags.String("k", "", "File holding the audit log's key, if it has one")
+	auditVerifyFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird auditverify [-k key_file] AUDIT_LOG...\n")
+		fmt.Fprintln(os.Stderr, "  Checks that the proxy audit log files, oldest first, haven't been altered.")
+		auditVerifyFlags.PrintDefaults()
+	}
+
+	tempURLFlags := flag.NewFlagSet("", flag.ExitOnError)
+	tempURLFlags.String("digest", "sha256", "Digest to sign with: sha1, sha256 or sha512")
+	tempURLFlags.Bool("prefix", false, "Sign for every object whose name starts with the object in PATH")
+	tempURLFlags.String("ip-range", "", "Only allow requests from this address or CIDR network")
+	tempURLFlags.Bool("absolute", false, "SECONDS is the Unix time the URL expires at rather than how long it lasts")
+	tempURLFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird tempurl [ARGS] METHOD SECONDS PATH KEY\n")
+		fmt.Fprintln(os.Stderr, "  Prints a temp URL for PATH, /v1/<account>/<container>/<object>, signed with")
+		fmt.Fprintln(os.Stderr, "  the account's or container's X-*-Meta-Temp-URL-Key.")
+		tempURLFlags.PrintDefaults()
+	}
+
 	/* main flag parser, which doesn't do much */
 
 	flag.Usage = func() {
@@ -456,6 +493,12 @@ func main() {
 		objectInfoFlags.Usage()
 		fmt.Fprintln(os.Stderr)
 		reconFlags.Usage()
+		fmt.Fprintln(os.Stderr)
+		migratePolicyFlags.Usage()
+		fmt.Fprintln(os.Stderr)
+		auditVerifyFlags.Usage()
+		fmt.Fprintln(os.Stderr)
+		tempURLFlags.Usage()
 	}
 
 	flag.Parse()
@@ -530,6 +573,21 @@ func main() {
 		if pass := tools.ReconClient(reconFlags, srv.DefaultConfigLoader{}); !pass {
 			os.Exit(1)
 		}
+	case "migratepolicy":
+		migratePolicyFlags.Parse(flag.Args()[1:])
+		if ok := tools.MigratePolicy(migratePolicyFlags, srv.DefaultConfigLoader{}); !ok {
+			os.Exit(1)
+		}
+	case "auditverify":
+		auditVerifyFlags.Parse(flag.Args()[1:])
+		if ok := tools.VerifyAuditLog(auditVerifyFlags, srv.DefaultConfigLoader{}); !ok {
+			os.Exit(1)
+		}
+	case "tempurl":
+		tempURLFlags.Parse(flag.Args()[1:])
+		if ok := tools.TempURL(tempURLFlags, srv.DefaultConfigLoader{}); !ok {
+			os.Exit(1)
+		}
 	case "init":
 		if err := initCommand(flag.Args()[1:]); err != nil {
 			fmt.Fprintln(os.Stderr, "init error:", err)
@@ -0,0 +1,107 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// AuditRecord is one line of the proxy's audit log. Each record holds the
+// hash of the record before it, so that changing, removing or reordering
+// records breaks the chain.
+type AuditRecord struct {
+	Seq       int64    `json:"seq"`
+	Time      string   `json:"time"`
+	TxId      string   `json:"trans_id"`
+	Identity  []string `json:"identity,omitempty"`
+	Account   string   `json:"account,omitempty"`
+	Container string   `json:"container,omitempty"`
+	Object    string   `json:"object,omitempty"`
+	Method    string   `json:"method"`
+	Path      string   `json:"path"`
+	Status    int      `json:"status"`
+	BytesIn   int64    `json:"bytes_in"`
+	BytesOut  int64    `json:"bytes_out"`
+	SourceIP  string   `json:"source_ip"`
+	Prev      string   `json:"prev"`
+	Hash      string   `json:"hash"`
+}
+
+// ComputeHash returns the hash of the record without its Hash: its SHA-256,
+// or its HMAC-SHA256 when there's a key, so that only those with the key can
+// rewrite the chain.
+func (r *AuditRecord) ComputeHash(key []byte) string {
+	unhashed := *r
+	unhashed.Hash = ""
+	data, _ := json.Marshal(&unhashed)
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditVerifier checks audit log records in order, across as many files as
+// the log was rotated into. The first record it sees starts the chain, since
+// older files may have been removed.
+type AuditVerifier struct {
+	Key     []byte
+	Seq     int64
+	Prev    string
+	Records int64
+}
+
+// Verify checks the records read from r, continuing the chain from any
+// records already verified.
+func (v *AuditVerifier) Verify(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: invalid record: %v", line, err)
+		}
+		if data, _ := json.Marshal(&rec); !bytes.Equal(data, scanner.Bytes()) {
+			return fmt.Errorf("line %d: record %d has been altered", line, rec.Seq)
+		}
+		if rec.ComputeHash(v.Key) != rec.Hash {
+			return fmt.Errorf("line %d: record %d has been altered", line, rec.Seq)
+		}
+		if v.Records > 0 {
+			if rec.Seq != v.Seq+1 {
+				return fmt.Errorf("line %d: record %d follows record %d", line, rec.Seq, v.Seq)
+			}
+			if rec.Prev != v.Prev {
+				return fmt.Errorf("line %d: record %d doesn't follow the record before it", line, rec.Seq)
+			}
+		}
+		v.Seq = rec.Seq
+		v.Prev = rec.Hash
+		v.Records++
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,68 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func auditTestLog(t *testing.T, key []byte, n int) []string {
+	var lines []string
+	prev := ""
+	for i := 1; i <= n; i++ {
+		rec := &AuditRecord{Seq: int64(i), Method: "GET", Path: "/v1/a/c/o", Status: 200, Account: "a", Prev: prev}
+		rec.Hash = rec.ComputeHash(key)
+		prev = rec.Hash
+		data, err := json.Marshal(rec)
+		require.Nil(t, err)
+		lines = append(lines, string(data))
+	}
+	return lines
+}
+
+func TestAuditVerifier(t *testing.T) {
+	key := []byte("secret")
+	lines := auditTestLog(t, key, 5)
+	v := &AuditVerifier{Key: key}
+	require.Nil(t, v.Verify(strings.NewReader(strings.Join(lines[:2], "\n")+"\n")))
+	// Rotated files continue the chain.
+	require.Nil(t, v.Verify(strings.NewReader(strings.Join(lines[2:], "\n")+"\n")))
+	require.Equal(t, int64(5), v.Records)
+	require.Equal(t, int64(5), v.Seq)
+
+	// The chain can start anywhere, since old files get removed.
+	v = &AuditVerifier{Key: key}
+	require.Nil(t, v.Verify(strings.NewReader(strings.Join(lines[3:], "\n"))))
+
+	for name, bad := range map[string][]string{
+		"removed":   {lines[0], lines[2], lines[3]},
+		"reordered": {lines[0], lines[2], lines[1]},
+		"edited":    {lines[0], strings.Replace(lines[1], `"status":200`, `"status":201`, 1)},
+		"added":     {lines[0], strings.Replace(lines[1], `"seq":2,`, `"seq":2,"extra":1,`, 1)},
+		"garbage":   {lines[0], "junk"},
+	} {
+		v = &AuditVerifier{Key: key}
+		require.NotNil(t, v.Verify(strings.NewReader(strings.Join(bad, "\n"))), name)
+	}
+	v = &AuditVerifier{Key: []byte("wrong")}
+	require.NotNil(t, v.Verify(strings.NewReader(lines[0])))
+	v = &AuditVerifier{}
+	require.Nil(t, v.Verify(strings.NewReader(strings.Join(auditTestLog(t, nil, 3), "\n"))))
+}
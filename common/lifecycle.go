@@ -0,0 +1,118 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The proxy records each container with lifecycle rules as an object in
+// LifecycleAccount/LifecycleContainer, named by LifecycleRecord, so that
+// andrewd knows which containers to walk.
+const (
+	LifecycleAccount   = ".lifecycle"
+	LifecycleContainer = "containers"
+	LifecycleSysmeta   = "X-Container-Sysmeta-Lifecycle"
+	// MaxLifecycleRules is the most rules a container may have.
+	MaxLifecycleRules = 50
+)
+
+// LifecycleRule applies to the objects in a container whose names start with
+// Prefix. It expires them ExpireAfterDays after they were last modified, and
+// moves them to StoragePolicy TransitionAfterDays after they were last
+// modified.
+type LifecycleRule struct {
+	Prefix              string `json:"prefix"`
+	ExpireAfterDays     int    `json:"expire_after_days,omitempty"`
+	TransitionAfterDays int    `json:"transition_after_days,omitempty"`
+	StoragePolicy       string `json:"storage_policy,omitempty"`
+}
+
+// Matches returns whether the rule applies to the named object.
+func (r *LifecycleRule) Matches(name string) bool {
+	return strings.HasPrefix(name, r.Prefix)
+}
+
+// ExpiresAt returns when an object last modified at lastModified expires
+// under the rule, or the zero time if the rule doesn't expire objects.
+func (r *LifecycleRule) ExpiresAt(lastModified time.Time) time.Time {
+	if r.ExpireAfterDays <= 0 {
+		return time.Time{}
+	}
+	return lastModified.Add(time.Duration(r.ExpireAfterDays) * 24 * time.Hour)
+}
+
+// TransitionsAt returns when an object last modified at lastModified moves
+// to the rule's storage policy, or the zero time if the rule doesn't move
+// objects.
+func (r *LifecycleRule) TransitionsAt(lastModified time.Time) time.Time {
+	if r.TransitionAfterDays <= 0 {
+		return time.Time{}
+	}
+	return lastModified.Add(time.Duration(r.TransitionAfterDays) * 24 * time.Hour)
+}
+
+// ParseLifecycleRules parses and validates a container's lifecycle rules, a
+// JSON list of LifecycleRule.
+func ParseLifecycleRules(value string) ([]LifecycleRule, error) {
+	var rules []LifecycleRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("Lifecycle rules must be a JSON list: %v", err)
+	}
+	if len(rules) > MaxLifecycleRules {
+		return nil, fmt.Errorf("Too many lifecycle rules; max %d", MaxLifecycleRules)
+	}
+	for i, rule := range rules {
+		if rule.ExpireAfterDays < 0 || rule.TransitionAfterDays < 0 {
+			return nil, fmt.Errorf("Lifecycle rule %d: days may not be negative", i)
+		}
+		if rule.ExpireAfterDays == 0 && rule.TransitionAfterDays == 0 {
+			return nil, fmt.Errorf("Lifecycle rule %d: expire_after_days or transition_after_days is required", i)
+		}
+		if (rule.TransitionAfterDays > 0) != (rule.StoragePolicy != "") {
+			return nil, fmt.Errorf("Lifecycle rule %d: transition_after_days and storage_policy must be given together", i)
+		}
+		if rule.ExpireAfterDays > 0 && rule.TransitionAfterDays >= rule.ExpireAfterDays {
+			return nil, fmt.Errorf("Lifecycle rule %d: objects must transition before they expire", i)
+		}
+	}
+	return rules, nil
+}
+
+// LifecycleRecord returns the name of the object recording that a container
+// has lifecycle rules.
+func LifecycleRecord(account, container string) string {
+	return account + "/" + container
+}
+
+// ParseLifecycleRecord is the inverse of LifecycleRecord.
+func ParseLifecycleRecord(name string) (account, container string, err error) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid lifecycle record %q", name)
+	}
+	return parts[0], parts[1], nil
+}
+
+// LifecycleTransitionContainer returns the name of the hidden container, in
+// the storage policy with the given index, that holds the objects moved out
+// of container by its lifecycle rules.
+func LifecycleTransitionContainer(container string, policy int) string {
+	return fmt.Sprintf(".%s+policy%d", container, policy)
+}
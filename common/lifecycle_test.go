@@ -0,0 +1,59 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLifecycleRules(t *testing.T) {
+	rules, err := ParseLifecycleRules(`[{"prefix": "logs/", "expire_after_days": 30}, {"transition_after_days": 7, "storage_policy": "ec"}]`)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(rules))
+	require.True(t, rules[0].Matches("logs/today"))
+	require.False(t, rules[0].Matches("other"))
+	require.True(t, rules[1].Matches("other"))
+	lastModified := time.Unix(1500000000, 0)
+	require.Equal(t, lastModified.Add(30*24*time.Hour), rules[0].ExpiresAt(lastModified))
+	require.True(t, rules[0].TransitionsAt(lastModified).IsZero())
+	require.Equal(t, lastModified.Add(7*24*time.Hour), rules[1].TransitionsAt(lastModified))
+	require.True(t, rules[1].ExpiresAt(lastModified).IsZero())
+
+	for _, bad := range []string{
+		`{"prefix": "a"}`,
+		`[{"prefix": "a"}]`,
+		`[{"expire_after_days": -1}]`,
+		`[{"transition_after_days": 7}]`,
+		`[{"expire_after_days": 7, "storage_policy": "ec"}]`,
+		`[{"expire_after_days": 7, "transition_after_days": 7, "storage_policy": "ec"}]`,
+	} {
+		_, err := ParseLifecycleRules(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestLifecycleRecord(t *testing.T) {
+	account, container, err := ParseLifecycleRecord(LifecycleRecord("a", "c"))
+	require.Nil(t, err)
+	require.Equal(t, "a", account)
+	require.Equal(t, "c", container)
+	_, _, err = ParseLifecycleRecord("a")
+	require.NotNil(t, err)
+	require.Equal(t, ".c+policy1", LifecycleTransitionContainer("c", 1))
+}
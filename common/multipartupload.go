@@ -0,0 +1,57 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The proxy records each multipart upload it starts as an object in
+// MultipartUploadsAccount/MultipartUploadsContainer, named by
+// MultipartUploadRecord, so that andrewd can find and clean up uploads that
+// are never completed or aborted.
+const (
+	MultipartUploadsAccount   = ".multipart_uploads"
+	MultipartUploadsContainer = "uploads"
+)
+
+// MultipartSegmentsContainer returns the name of the hidden container that
+// holds the parts of multipart uploads to container.
+func MultipartSegmentsContainer(container string) string {
+	return "." + container + "+segments"
+}
+
+// MultipartUploadRecord returns the name of the object recording a multipart
+// upload. Names sort by the time the upload was initiated.
+func MultipartUploadRecord(initiated time.Time, account, container, object, uploadId string) string {
+	return fmt.Sprintf("%010d/%s/%s/%s/%s", initiated.Unix(), uploadId, account, container, object)
+}
+
+// ParseMultipartUploadRecord is the inverse of MultipartUploadRecord.
+func ParseMultipartUploadRecord(name string) (initiated time.Time, account, container, object, uploadId string, err error) {
+	parts := strings.SplitN(name, "/", 5)
+	if len(parts) != 5 || parts[1] == "" || parts[2] == "" || parts[3] == "" || parts[4] == "" {
+		return initiated, "", "", "", "", fmt.Errorf("Invalid multipart upload record %q", name)
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return initiated, "", "", "", "", fmt.Errorf("Invalid multipart upload record %q: %v", name, err)
+	}
+	return time.Unix(ts, 0), parts[2], parts[3], parts[4], parts[1], nil
+}
@@ -0,0 +1,41 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipartUploadRecord(t *testing.T) {
+	initiated := time.Unix(1500000000, 0)
+	name := MultipartUploadRecord(initiated, "a", "c", "dir/o", "id")
+	require.Equal(t, "1500000000/id/a/c/dir/o", name)
+	parsedInitiated, account, container, object, uploadId, err := ParseMultipartUploadRecord(name)
+	require.Nil(t, err)
+	require.True(t, initiated.Equal(parsedInitiated))
+	require.Equal(t, "a", account)
+	require.Equal(t, "c", container)
+	require.Equal(t, "dir/o", object)
+	require.Equal(t, "id", uploadId)
+
+	_, _, _, _, _, err = ParseMultipartUploadRecord("1500000000/id/a/c")
+	require.NotNil(t, err)
+	_, _, _, _, _, err = ParseMultipartUploadRecord("x/id/a/c/o")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,82 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A container being moved to another storage policy keeps the move in its
+// PolicyMigrationSysmeta, and is recorded as an object in
+// PolicyMigrationAccount/PolicyMigrationContainer, named by
+// PolicyMigrationRecord, so that andrewd knows which containers to migrate.
+const (
+	PolicyMigrationAccount   = ".policy-migrations"
+	PolicyMigrationContainer = "containers"
+	PolicyMigrationSysmeta   = "X-Container-Sysmeta-Policy-Migration"
+)
+
+// PolicyMigrationHeader is set, to the migration, only on the backend requests
+// andrewd makes to migrate a container. X-Backend-Storage-Policy-Index is only
+// trusted to change a container's policy, or to pick the policy an object is
+// read from or written to, alongside it, and the proxy removes it from every
+// client request.
+const PolicyMigrationHeader = "X-Backend-Policy-Migration"
+
+// PolicyMigration is a container's move from one storage policy to another.
+type PolicyMigration struct {
+	From int
+	To   int
+}
+
+// String returns the migration as it's kept in PolicyMigrationSysmeta.
+func (m *PolicyMigration) String() string {
+	return fmt.Sprintf("%d:%d", m.From, m.To)
+}
+
+// ParsePolicyMigration is the inverse of PolicyMigration.String.
+func ParsePolicyMigration(value string) (*PolicyMigration, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid policy migration %q", value)
+	}
+	from, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid policy migration %q", value)
+	}
+	to, err := strconv.Atoi(parts[1])
+	if err != nil || from == to {
+		return nil, fmt.Errorf("Invalid policy migration %q", value)
+	}
+	return &PolicyMigration{From: from, To: to}, nil
+}
+
+// PolicyMigrationRecord returns the name of the object recording that a
+// container is being migrated.
+func PolicyMigrationRecord(account, container string) string {
+	return account + "/" + container
+}
+
+// ParsePolicyMigrationRecord is the inverse of PolicyMigrationRecord.
+func ParsePolicyMigrationRecord(name string) (account, container string, err error) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid policy migration record %q", name)
+	}
+	return parts[0], parts[1], nil
+}
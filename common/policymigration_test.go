@@ -0,0 +1,42 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicyMigration(t *testing.T) {
+	m, err := ParsePolicyMigration((&PolicyMigration{From: 0, To: 2}).String())
+	require.Nil(t, err)
+	require.Equal(t, 0, m.From)
+	require.Equal(t, 2, m.To)
+	for _, bad := range []string{"", "1", "1:1", "a:2", "1:b", "1:2:3"} {
+		_, err := ParsePolicyMigration(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestPolicyMigrationRecord(t *testing.T) {
+	account, container, err := ParsePolicyMigrationRecord(PolicyMigrationRecord("a", "c/d"))
+	require.Nil(t, err)
+	require.Equal(t, "a", account)
+	require.Equal(t, "c/d", container)
+	_, _, err = ParsePolicyMigrationRecord("/c")
+	require.NotNil(t, err)
+}
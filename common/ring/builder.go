@@ -16,6 +16,7 @@
 package ring
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
@@ -149,7 +150,10 @@ type RingBuilderDevice struct {
 	ReplicationIp   string  `pickle:"replication_ip"`
 	Parts           int64   `pickle:"parts"`
 	Id              int64   `pickle:"id"`
-	tiers           [4]string
+	// TargetWeight is the weight StepWeights moves Weight toward, WeightStep at a time; a WeightStep of 0 means the device is not ramping.
+	TargetWeight float64 `pickle:"target_weight"`
+	WeightStep   float64 `pickle:"weight_step"`
+	tiers        [4]string
 }
 
 type RingBuilder struct {
@@ -241,6 +245,13 @@ func NewRingBuilderFromFile(builderPath string, debug bool) (*RingBuilder, error
 	}
 	buff := make([]byte, fi.Size())
 	_, err = f.Read(buff)
+	if isJSON(buff) {
+		rbj := &RingBuilderJSON{}
+		if err = json.Unmarshal(buff, rbj); err != nil {
+			return nil, err
+		}
+		return NewRingBuilderFromJSON(rbj, debug)
+	}
 	rbp := RingBuilderPickle{}
 	err = pickle.Unmarshal(buff, &rbp)
 	if err != nil {
@@ -375,6 +386,56 @@ func (b *RingBuilder) SetDevWeight(devId int64, weight float64) error {
 	return nil
 }
 
+// SetDevTargetWeight sets the weight that StepWeights will gradually move the device to, step at a time.  A step of 0 cancels any ramp in progress.
+func (b *RingBuilder) SetDevTargetWeight(devId int64, targetWeight, step float64) error {
+	for _, dev := range b.removedDevs {
+		if devId == dev.Id {
+			return fmt.Errorf("Can not set target weight of devId %d because it is marked for removal", devId)
+		}
+	}
+	if targetWeight < 0 || step < 0 {
+		return fmt.Errorf("Target weight and step can not be negative")
+	}
+	b.Devs[devId].TargetWeight = targetWeight
+	b.Devs[devId].WeightStep = step
+	if b.Devs[devId].Weight == targetWeight {
+		b.Devs[devId].WeightStep = 0
+	}
+	b.Version += 1
+	return nil
+}
+
+// RampingDevs returns the devices whose weights are still being moved toward their target weights.
+func (b *RingBuilder) RampingDevs() []*RingBuilderDevice {
+	var devs []*RingBuilderDevice
+	for next, dev := devIterator(b.Devs); dev != nil; dev = next() {
+		if dev.WeightStep > 0 && dev.Weight >= 0 {
+			devs = append(devs, dev)
+		}
+	}
+	return devs
+}
+
+// StepWeights moves the weight of each ramping device one step toward its target weight and returns the devices that changed.  Devices that reach their target weight stop ramping.
+func (b *RingBuilder) StepWeights() []*RingBuilderDevice {
+	devs := b.RampingDevs()
+	for _, dev := range devs {
+		if dev.Weight < dev.TargetWeight {
+			dev.Weight = math.Min(dev.Weight+dev.WeightStep, dev.TargetWeight)
+		} else {
+			dev.Weight = math.Max(dev.Weight-dev.WeightStep, dev.TargetWeight)
+		}
+		if dev.Weight == dev.TargetWeight {
+			dev.WeightStep = 0
+		}
+	}
+	if len(devs) > 0 {
+		b.DevsChanged = true
+		b.Version += 1
+	}
+	return devs
+}
+
 // Remove a device from the ring.
 func (b *RingBuilder) RemoveDev(devId int64, purge bool) {
 	if purge {
@@ -1778,6 +1839,21 @@ func SetWeight(builderPath string, devs []*RingBuilderDevice, weight float64) er
 	return builder.Save(builderPath)
 }
 
+// Note that no locking is done here, you should call LockBuilderPath first.
+func SetTargetWeight(builderPath string, devs []*RingBuilderDevice, targetWeight, step float64) error {
+	builder, err := NewRingBuilderFromFile(builderPath, false)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devs {
+		err := builder.SetDevTargetWeight(dev.Id, targetWeight, step)
+		if err != nil {
+			return err
+		}
+	}
+	return builder.Save(builderPath)
+}
+
 // Note that no locking is done here, you should call LockBuilderPath first.
 func RemoveDevs(builderPath string, devs []*RingBuilderDevice, purge bool) error {
 	builder, err := NewRingBuilderFromFile(builderPath, false)
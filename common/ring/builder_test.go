@@ -0,0 +1,73 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStepWeights(t *testing.T) {
+	b := simulationBuilder(t, 4)
+	require.Nil(t, b.SetDevTargetWeight(0, 250, 100))
+	require.Nil(t, b.SetDevTargetWeight(1, 0, 40))
+	require.Equal(t, 2, len(b.RampingDevs()))
+
+	require.Equal(t, 2, len(b.StepWeights()))
+	require.Equal(t, 200.0, b.Devs[0].Weight)
+	require.Equal(t, 60.0, b.Devs[1].Weight)
+	require.Equal(t, 2, len(b.StepWeights()))
+	require.Equal(t, 250.0, b.Devs[0].Weight)
+	require.Equal(t, 20.0, b.Devs[1].Weight)
+	require.Equal(t, 0.0, b.Devs[0].WeightStep)
+	require.Equal(t, 1, len(b.StepWeights()))
+	require.Equal(t, 0.0, b.Devs[1].Weight)
+	require.Equal(t, 0, len(b.RampingDevs()))
+	require.Equal(t, 0, len(b.StepWeights()))
+}
+
+func TestSetDevTargetWeight(t *testing.T) {
+	b := simulationBuilder(t, 4)
+	require.NotNil(t, b.SetDevTargetWeight(0, -1, 10))
+	require.NotNil(t, b.SetDevTargetWeight(0, 10, -1))
+	// already at the target; nothing to ramp.
+	require.Nil(t, b.SetDevTargetWeight(0, 100, 10))
+	require.Equal(t, 0, len(b.RampingDevs()))
+	b.RemoveDev(2, false)
+	require.NotNil(t, b.SetDevTargetWeight(2, 200, 10))
+}
+
+func TestTargetWeightSaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := simulationBuilder(t, 3)
+	require.Nil(t, b.SetDevTargetWeight(1, 300, 50))
+	builderPath := filepath.Join(dir, "object.builder")
+	require.Nil(t, b.Save(builderPath))
+	lb, err := NewRingBuilderFromFile(builderPath, false)
+	require.Nil(t, err)
+	require.Equal(t, 300.0, lb.Devs[1].TargetWeight)
+	require.Equal(t, 50.0, lb.Devs[1].WeightStep)
+	jb, err := NewRingBuilderFromJSON(lb.JSON(), false)
+	require.Nil(t, err)
+	require.Equal(t, 300.0, jb.Devs[1].TargetWeight)
+	require.Equal(t, 50.0, jb.Devs[1].WeightStep)
+}
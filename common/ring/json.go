@@ -0,0 +1,529 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// The JSON forms of builders and rings are documented in docs/rings.md.
+const (
+	BuilderJSONFormat = "hummingbird-ring-builder"
+	RingJSONFormat    = "hummingbird-ring"
+	jsonFormatVersion = 1
+)
+
+// RingBuilderDeviceJSON is the JSON form of a RingBuilderDevice.
+type RingBuilderDeviceJSON struct {
+	Id              int64   `json:"id"`
+	Region          int64   `json:"region"`
+	Zone            int64   `json:"zone"`
+	Scheme          string  `json:"scheme"`
+	Ip              string  `json:"ip"`
+	Port            int64   `json:"port"`
+	ReplicationIp   string  `json:"replication_ip"`
+	ReplicationPort int64   `json:"replication_port"`
+	Device          string  `json:"device"`
+	Weight          float64 `json:"weight"`
+	Meta            string  `json:"meta"`
+	Parts           int64   `json:"parts"`
+	PartsWanted     int64   `json:"parts_wanted"`
+	TargetWeight    float64 `json:"target_weight"`
+	WeightStep      float64 `json:"weight_step"`
+}
+
+// RingBuilderJSON is the JSON form of a RingBuilder.  It holds everything the pickled builder does, so a builder survives a round trip through it unchanged.
+type RingBuilderJSON struct {
+	Format              string                   `json:"format"`
+	FormatVersion       int                      `json:"format_version"`
+	PartPower           int                      `json:"part_power"`
+	Replicas            float64                  `json:"replicas"`
+	MinPartHours        int                      `json:"min_part_hours"`
+	Parts               int                      `json:"parts"`
+	Overload            float64                  `json:"overload"`
+	DevsChanged         bool                     `json:"devs_changed"`
+	Version             int                      `json:"version"`
+	Dispersion          float64                  `json:"dispersion"`
+	LastPartMovesEpoch  int64                    `json:"last_part_moves_epoch"`
+	LastPartGatherStart int                      `json:"last_part_gather_start"`
+	Devs                []*RingBuilderDeviceJSON `json:"devs"`
+	RemovedDevs         []*RingBuilderDeviceJSON `json:"removed_devs"`
+	LastPartMoves       []int                    `json:"last_part_moves"`
+	Replica2Part2Dev    [][]uint                 `json:"replica2part2dev"`
+}
+
+// RingJSON is the JSON form of a ring file.
+type RingJSON struct {
+	Format           string     `json:"format"`
+	FormatVersion    int        `json:"format_version"`
+	ReplicaCount     int        `json:"replica_count"`
+	PartShift        uint64     `json:"part_shift"`
+	Devs             []*Device  `json:"devs"`
+	Replica2Part2Dev [][]uint16 `json:"replica2part2dev"`
+}
+
+func builderDeviceToJSON(dev *RingBuilderDevice) *RingBuilderDeviceJSON {
+	if dev == nil {
+		return nil
+	}
+	return &RingBuilderDeviceJSON{
+		Id:              dev.Id,
+		Region:          dev.Region,
+		Zone:            dev.Zone,
+		Scheme:          dev.Scheme,
+		Ip:              dev.Ip,
+		Port:            dev.Port,
+		ReplicationIp:   dev.ReplicationIp,
+		ReplicationPort: dev.ReplicationPort,
+		Device:          dev.Device,
+		Weight:          dev.Weight,
+		Meta:            dev.Meta,
+		Parts:           dev.Parts,
+		PartsWanted:     dev.PartsWanted,
+		TargetWeight:    dev.TargetWeight,
+		WeightStep:      dev.WeightStep,
+	}
+}
+
+func builderDeviceFromJSON(dev *RingBuilderDeviceJSON) *RingBuilderDevice {
+	if dev == nil {
+		return nil
+	}
+	return &RingBuilderDevice{
+		Id:              dev.Id,
+		Region:          dev.Region,
+		Zone:            dev.Zone,
+		Scheme:          dev.Scheme,
+		Ip:              dev.Ip,
+		Port:            dev.Port,
+		ReplicationIp:   dev.ReplicationIp,
+		ReplicationPort: dev.ReplicationPort,
+		Device:          dev.Device,
+		Weight:          dev.Weight,
+		Meta:            dev.Meta,
+		Parts:           dev.Parts,
+		PartsWanted:     dev.PartsWanted,
+		TargetWeight:    dev.TargetWeight,
+		WeightStep:      dev.WeightStep,
+	}
+}
+
+// JSON returns the JSON form of the builder.
+func (b *RingBuilder) JSON() *RingBuilderJSON {
+	rbj := &RingBuilderJSON{
+		Format:              BuilderJSONFormat,
+		FormatVersion:       jsonFormatVersion,
+		PartPower:           b.PartPower,
+		Replicas:            b.Replicas,
+		MinPartHours:        b.MinPartHours,
+		Parts:               b.Parts,
+		Overload:            b.Overload,
+		DevsChanged:         b.DevsChanged,
+		Version:             b.Version,
+		Dispersion:          b.Dispersion,
+		LastPartMovesEpoch:  b.lastPartMovesEpoch,
+		LastPartGatherStart: b.lastPartGatherStart,
+		Devs:                make([]*RingBuilderDeviceJSON, len(b.Devs)),
+		RemovedDevs:         make([]*RingBuilderDeviceJSON, len(b.removedDevs)),
+		LastPartMoves:       make([]int, len(b.lastPartMoves)),
+		Replica2Part2Dev:    b.replica2Part2Dev,
+	}
+	for i, dev := range b.Devs {
+		rbj.Devs[i] = builderDeviceToJSON(dev)
+	}
+	for i, dev := range b.removedDevs {
+		rbj.RemovedDevs[i] = builderDeviceToJSON(dev)
+	}
+	for i, moved := range b.lastPartMoves {
+		rbj.LastPartMoves[i] = int(moved)
+	}
+	return rbj
+}
+
+// NewRingBuilderFromJSON creates a RingBuilder from its JSON form, returning an error if the devices and partition assignments don't agree with each other.
+func NewRingBuilderFromJSON(rbj *RingBuilderJSON, debug bool) (*RingBuilder, error) {
+	if rbj.Format != BuilderJSONFormat {
+		return nil, fmt.Errorf("Not a ring builder; format is %q", rbj.Format)
+	}
+	if rbj.FormatVersion != jsonFormatVersion {
+		return nil, fmt.Errorf("Unknown ring builder format version %d", rbj.FormatVersion)
+	}
+	if rbj.PartPower < 0 || rbj.PartPower > 32 || rbj.Parts != int(math.Exp2(float64(rbj.PartPower))) {
+		return nil, fmt.Errorf("Part power %d does not match %d parts", rbj.PartPower, rbj.Parts)
+	}
+	if len(rbj.LastPartMoves) != 0 && len(rbj.LastPartMoves) != rbj.Parts {
+		return nil, fmt.Errorf("last_part_moves has %d entries for %d parts", len(rbj.LastPartMoves), rbj.Parts)
+	}
+	for i, dev := range rbj.Devs {
+		if dev != nil && dev.Id != int64(i) {
+			return nil, fmt.Errorf("Device at index %d has id %d", i, dev.Id)
+		}
+	}
+	builder := &RingBuilder{
+		PartPower:           rbj.PartPower,
+		Replicas:            rbj.Replicas,
+		MinPartHours:        rbj.MinPartHours,
+		Parts:               rbj.Parts,
+		Overload:            rbj.Overload,
+		DevsChanged:         rbj.DevsChanged,
+		Version:             rbj.Version,
+		Dispersion:          rbj.Dispersion,
+		lastPartMovesEpoch:  rbj.LastPartMovesEpoch,
+		lastPartGatherStart: rbj.LastPartGatherStart,
+		Debug:               debug,
+	}
+	builder.lastPartMoves = make([]byte, len(rbj.LastPartMoves))
+	for i, moved := range rbj.LastPartMoves {
+		if moved < 0 || moved > 0xff {
+			return nil, fmt.Errorf("last_part_moves value %d out of range", moved)
+		}
+		builder.lastPartMoves[i] = byte(moved)
+	}
+	builder.replica2Part2Dev = make([][]uint, len(rbj.Replica2Part2Dev))
+	for i, part2Dev := range rbj.Replica2Part2Dev {
+		if len(part2Dev) > rbj.Parts {
+			return nil, fmt.Errorf("Replica %d has %d parts; more than the %d in the ring", i, len(part2Dev), rbj.Parts)
+		}
+		for part, devId := range part2Dev {
+			if devId != NONE_DEV && (devId >= uint(len(rbj.Devs)) || rbj.Devs[devId] == nil) {
+				return nil, fmt.Errorf("Partition %d replica %d is assigned to missing device %d", part, i, devId)
+			}
+		}
+		builder.replica2Part2Dev[i] = part2Dev
+		if builder.replica2Part2Dev[i] == nil {
+			builder.replica2Part2Dev[i] = []uint{}
+		}
+	}
+	builder.partMovedBitmap = make([]byte, maxInt(int(math.Exp2(float64(builder.PartPower-3))), 1))
+	builder.Devs = make([]*RingBuilderDevice, len(rbj.Devs))
+	for i, dev := range rbj.Devs {
+		builder.Devs[i] = builderDeviceFromJSON(dev)
+	}
+	// removed devices are the same objects as those in Devs, just as they are in a pickled builder.
+	builder.removedDevs = make([]*RingBuilderDevice, len(rbj.RemovedDevs))
+	for i, dev := range rbj.RemovedDevs {
+		if dev == nil {
+			return nil, fmt.Errorf("removed_devs entry %d is null", i)
+		}
+		if dev.Id < 0 {
+			return nil, fmt.Errorf("removed_devs entry %d has id %d", i, dev.Id)
+		}
+		if dev.Id < int64(len(builder.Devs)) && builder.Devs[dev.Id] != nil {
+			builder.removedDevs[i] = builder.Devs[dev.Id]
+		} else {
+			builder.removedDevs[i] = builderDeviceFromJSON(dev)
+		}
+	}
+	return builder, nil
+}
+
+// JSON returns the JSON form of the ring.
+func (r *hashRing) JSON() *RingJSON {
+	d := r.getData()
+	return &RingJSON{
+		Format:           RingJSONFormat,
+		FormatVersion:    jsonFormatVersion,
+		ReplicaCount:     d.ReplicaCount,
+		PartShift:        d.PartShift,
+		Devs:             d.Devs,
+		Replica2Part2Dev: d.replica2part2devId,
+	}
+}
+
+// ringDataFromJSON validates the JSON form of a ring and returns its ringData.
+func ringDataFromJSON(rj *RingJSON) (*ringData, error) {
+	if rj.Format != RingJSONFormat {
+		return nil, fmt.Errorf("Not a ring; format is %q", rj.Format)
+	}
+	if rj.FormatVersion != jsonFormatVersion {
+		return nil, fmt.Errorf("Unknown ring format version %d", rj.FormatVersion)
+	}
+	if rj.PartShift > 32 {
+		return nil, fmt.Errorf("Invalid part_shift %d", rj.PartShift)
+	}
+	if rj.ReplicaCount < 1 {
+		return nil, fmt.Errorf("Invalid replica_count %d", rj.ReplicaCount)
+	}
+	if rj.ReplicaCount != len(rj.Replica2Part2Dev) {
+		return nil, fmt.Errorf("replica_count is %d but there are %d replicas", rj.ReplicaCount, len(rj.Replica2Part2Dev))
+	}
+	for i, dev := range rj.Devs {
+		if dev != nil && dev.Id != i {
+			return nil, fmt.Errorf("Device at index %d has id %d", i, dev.Id)
+		}
+	}
+	partitionCount := 1 << (32 - rj.PartShift)
+	for i, part2Dev := range rj.Replica2Part2Dev {
+		if len(part2Dev) != partitionCount {
+			return nil, fmt.Errorf("Replica %d has %d parts instead of the %d part_shift %d gives", i, len(part2Dev), partitionCount, rj.PartShift)
+		}
+		for part, devId := range part2Dev {
+			if int(devId) >= len(rj.Devs) || rj.Devs[devId] == nil {
+				return nil, fmt.Errorf("Partition %d replica %d is assigned to missing device %d", part, i, devId)
+			}
+		}
+	}
+	return &ringData{
+		Devs:               rj.Devs,
+		ReplicaCount:       rj.ReplicaCount,
+		PartShift:          rj.PartShift,
+		replica2part2devId: rj.Replica2Part2Dev,
+	}, nil
+}
+
+// NewRingFromJSON creates a Ring from its JSON form; it can be written out as a ring file with SaveRing.
+func NewRingFromJSON(rj *RingJSON) (Ring, error) {
+	data, err := ringDataFromJSON(rj)
+	if err != nil {
+		return nil, err
+	}
+	r := &hashRing{}
+	r.data.Store(data)
+	return r, nil
+}
+
+// SaveRing writes a ring in the standard gzipped ring file format.
+func SaveRing(r Ring, filename string) error {
+	hr, ok := r.(*hashRing)
+	if !ok {
+		return fmt.Errorf("Unable to save ring of type %T", r)
+	}
+	return hr.Save(filename)
+}
+
+// RingJSONOf returns the JSON form of a ring loaded with LoadRing or GetRing.
+func RingJSONOf(r Ring) (*RingJSON, error) {
+	hr, ok := r.(*hashRing)
+	if !ok {
+		return nil, fmt.Errorf("Unable to export ring of type %T", r)
+	}
+	return hr.JSON(), nil
+}
+
+// jsonField is a single key of a JSON object written by writeJSONObject.
+type jsonField struct {
+	key   string
+	value interface{}
+	// perLine writes each element of a slice value on its own line.
+	perLine bool
+}
+
+// writeJSONObject writes a JSON object with one field per line so that the output diffs well.  Large arrays stay on a single line unless perLine is set.
+func writeJSONObject(w io.Writer, fields []jsonField) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("{\n")
+	for i, f := range fields {
+		key, _ := json.Marshal(f.key)
+		bw.WriteString("  ")
+		bw.Write(key)
+		bw.WriteString(": ")
+		if f.perLine {
+			val, err := json.Marshal(f.value)
+			if err != nil {
+				return err
+			}
+			var elems []json.RawMessage
+			if err := json.Unmarshal(val, &elems); err != nil {
+				return err
+			}
+			if len(elems) == 0 {
+				bw.WriteString("[]")
+			} else {
+				bw.WriteString("[\n")
+				for j, elem := range elems {
+					bw.WriteString("    ")
+					bw.Write(elem)
+					if j < len(elems)-1 {
+						bw.WriteString(",")
+					}
+					bw.WriteString("\n")
+				}
+				bw.WriteString("  ]")
+			}
+		} else {
+			val, err := json.Marshal(f.value)
+			if err != nil {
+				return err
+			}
+			bw.Write(val)
+		}
+		if i < len(fields)-1 {
+			bw.WriteString(",")
+		}
+		bw.WriteString("\n")
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// WriteJSON writes the builder's JSON form to w.
+func (rbj *RingBuilderJSON) WriteJSON(w io.Writer) error {
+	return writeJSONObject(w, []jsonField{
+		{key: "format", value: rbj.Format},
+		{key: "format_version", value: rbj.FormatVersion},
+		{key: "part_power", value: rbj.PartPower},
+		{key: "replicas", value: rbj.Replicas},
+		{key: "min_part_hours", value: rbj.MinPartHours},
+		{key: "parts", value: rbj.Parts},
+		{key: "overload", value: rbj.Overload},
+		{key: "devs_changed", value: rbj.DevsChanged},
+		{key: "version", value: rbj.Version},
+		{key: "dispersion", value: rbj.Dispersion},
+		{key: "last_part_moves_epoch", value: rbj.LastPartMovesEpoch},
+		{key: "last_part_gather_start", value: rbj.LastPartGatherStart},
+		{key: "devs", value: rbj.Devs, perLine: true},
+		{key: "removed_devs", value: rbj.RemovedDevs, perLine: true},
+		{key: "last_part_moves", value: rbj.LastPartMoves},
+		{key: "replica2part2dev", value: rbj.Replica2Part2Dev, perLine: true},
+	})
+}
+
+// WriteJSON writes the ring's JSON form to w.
+func (rj *RingJSON) WriteJSON(w io.Writer) error {
+	return writeJSONObject(w, []jsonField{
+		{key: "format", value: rj.Format},
+		{key: "format_version", value: rj.FormatVersion},
+		{key: "replica_count", value: rj.ReplicaCount},
+		{key: "part_shift", value: rj.PartShift},
+		{key: "devs", value: rj.Devs, perLine: true},
+		{key: "replica2part2dev", value: rj.Replica2Part2Dev, perLine: true},
+	})
+}
+
+// isJSON reports whether data looks like a JSON object rather than a pickle or gzip stream.
+func isJSON(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '{'
+}
+
+// jsonFormatOf returns the format field of a builder or ring in JSON form.
+func jsonFormatOf(data []byte) (string, error) {
+	var header struct {
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return "", err
+	}
+	return header.Format, nil
+}
+
+// ImportJSON reads a builder or ring in JSON form from jsonPath and writes it to outPath as a pickled builder or gzipped ring, whichever the JSON holds.
+//
+//	A copy is also saved in the backups folder next to outPath.
+//	Returns the format that was imported.
+//
+// Note that no locking is done here, you should call LockBuilderPath first.
+func ImportJSON(jsonPath, outPath string) (string, error) {
+	data, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		return "", err
+	}
+	format, err := jsonFormatOf(data)
+	if err != nil {
+		return "", err
+	}
+	var save func(string) error
+	switch format {
+	case BuilderJSONFormat:
+		rbj := &RingBuilderJSON{}
+		if err := json.Unmarshal(data, rbj); err != nil {
+			return "", err
+		}
+		builder, err := NewRingBuilderFromJSON(rbj, false)
+		if err != nil {
+			return "", err
+		}
+		if err = builder.Validate(); err != nil {
+			return "", err
+		}
+		save = builder.Save
+	case RingJSONFormat:
+		rj := &RingJSON{}
+		if err := json.Unmarshal(data, rj); err != nil {
+			return "", err
+		}
+		r, err := NewRingFromJSON(rj)
+		if err != nil {
+			return "", err
+		}
+		save = func(filename string) error { return SaveRing(r, filename) }
+	default:
+		return "", fmt.Errorf("Unknown format %q", format)
+	}
+	backupPath := path.Join(path.Dir(outPath), "backups")
+	err = os.Mkdir(backupPath, 0777)
+	if err != nil {
+		e := err.(*os.PathError)
+		if e.Err != syscall.EEXIST {
+			return "", err
+		}
+	}
+	if err = save(path.Join(backupPath, fmt.Sprintf("%d.%s", time.Now().UnixNano(), path.Base(outPath)))); err != nil {
+		return "", err
+	}
+	// Write to a temporary file first; Save doesn't truncate and a half written ring shouldn't replace a good one.
+	tmpPath := path.Join(path.Dir(outPath), ".import."+path.Base(outPath))
+	os.Remove(tmpPath)
+	if err = save(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return format, os.Rename(tmpPath, outPath)
+}
+
+// ExportJSON writes the builder or ring file at filePath to w in JSON form.
+//
+//	Returns the format that was exported.
+//
+// Note that no locking is done here, you should call LockBuilderPath first.
+func ExportJSON(filePath string, w io.Writer) (string, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	isRing := len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+	if isJSON(data) {
+		format, err := jsonFormatOf(data)
+		if err != nil {
+			return "", err
+		}
+		isRing = format == RingJSONFormat
+	}
+	if isRing {
+		rd, err := readRingData(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		r := &hashRing{}
+		r.data.Store(rd)
+		return RingJSONFormat, r.JSON().WriteJSON(w)
+	}
+	builder, err := NewRingBuilderFromFile(filePath, false)
+	if err != nil {
+		return "", err
+	}
+	return BuilderJSONFormat, builder.JSON().WriteJSON(w)
+}
@@ -0,0 +1,171 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilderJSONRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := simulationBuilder(t, 4)
+	b.RemoveDev(1, false)
+	builderPath := filepath.Join(dir, "object.builder")
+	require.Nil(t, b.Save(builderPath))
+
+	buf := &bytes.Buffer{}
+	format, err := ExportJSON(builderPath, buf)
+	require.Nil(t, err)
+	require.Equal(t, BuilderJSONFormat, format)
+	jsonPath := filepath.Join(dir, "object.builder.json")
+	require.Nil(t, ioutil.WriteFile(jsonPath, buf.Bytes(), 0644))
+
+	importPath := filepath.Join(dir, "imported.builder")
+	format, err = ImportJSON(jsonPath, importPath)
+	require.Nil(t, err)
+	require.Equal(t, BuilderJSONFormat, format)
+	// compare against a plain load and save of the pickle, which resets the gather start just as the export did.
+	pb, err := NewRingBuilderFromFile(builderPath, false)
+	require.Nil(t, err)
+	resavedPath := filepath.Join(dir, "resaved.builder")
+	require.Nil(t, pb.Save(resavedPath))
+	orig, err := ioutil.ReadFile(resavedPath)
+	require.Nil(t, err)
+	imported, err := ioutil.ReadFile(importPath)
+	require.Nil(t, err)
+	require.Equal(t, orig, imported)
+
+	// the JSON form can be loaded directly as well.
+	jb, err := NewRingBuilderFromFile(jsonPath, false)
+	require.Nil(t, err)
+	require.Equal(t, b.replica2Part2Dev, jb.replica2Part2Dev)
+	require.Equal(t, 1, len(jb.removedDevs))
+	require.True(t, jb.removedDevs[0] == jb.Devs[1])
+}
+
+func TestRingJSONRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := simulationBuilder(t, 4)
+	ringPath := filepath.Join(dir, "object.ring.gz")
+	require.Nil(t, b.GetRing().Save(ringPath))
+
+	buf := &bytes.Buffer{}
+	format, err := ExportJSON(ringPath, buf)
+	require.Nil(t, err)
+	require.Equal(t, RingJSONFormat, format)
+	jsonPath := filepath.Join(dir, "object.ring.json")
+	require.Nil(t, ioutil.WriteFile(jsonPath, buf.Bytes(), 0644))
+
+	importPath := filepath.Join(dir, "imported.ring.gz")
+	format, err = ImportJSON(jsonPath, importPath)
+	require.Nil(t, err)
+	require.Equal(t, RingJSONFormat, format)
+	orig, err := ioutil.ReadFile(ringPath)
+	require.Nil(t, err)
+	imported, err := ioutil.ReadFile(importPath)
+	require.Nil(t, err)
+	require.Equal(t, orig, imported)
+	backups, err := ioutil.ReadDir(filepath.Join(dir, "backups"))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(backups))
+
+	// the JSON form can be loaded directly as well.
+	r := &hashRing{path: jsonPath}
+	require.Nil(t, r.Reload())
+	want := b.GetRing()
+	require.Equal(t, want.PartitionCount(), r.PartitionCount())
+	for part := uint64(0); part < want.PartitionCount(); part++ {
+		wantNodes := want.GetNodes(part)
+		nodes := r.GetNodes(part)
+		require.Equal(t, len(wantNodes), len(nodes))
+		for i := range nodes {
+			require.Equal(t, wantNodes[i].Id, nodes[i].Id)
+		}
+	}
+}
+
+func TestRingJSONValidation(t *testing.T) {
+	b := simulationBuilder(t, 3)
+	rj, err := RingJSONOf(b.GetRing())
+	require.Nil(t, err)
+	rj.Replica2Part2Dev[0][5] = 99
+	_, err = NewRingFromJSON(rj)
+	require.NotNil(t, err)
+	rj, err = RingJSONOf(b.GetRing())
+	require.Nil(t, err)
+	rj.Devs[0].Id = 1
+	_, err = NewRingFromJSON(rj)
+	require.NotNil(t, err)
+	rj.Format = BuilderJSONFormat
+	_, err = NewRingFromJSON(rj)
+	require.NotNil(t, err)
+	// A ring without replicas would panic in GetNodes.
+	rj, err = RingJSONOf(b.GetRing())
+	require.Nil(t, err)
+	rj.ReplicaCount = 0
+	rj.Replica2Part2Dev = nil
+	_, err = NewRingFromJSON(rj)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "replica_count")
+	rj, err = RingJSONOf(b.GetRing())
+	require.Nil(t, err)
+	rj.PartShift++
+	_, err = NewRingFromJSON(rj)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "part_shift")
+
+	rbj := b.JSON()
+	rbj.Parts = 100
+	_, err = NewRingBuilderFromJSON(rbj, false)
+	require.NotNil(t, err)
+
+	rbj = b.JSON()
+	rbj.Devs[1].Id = 2
+	_, err = NewRingBuilderFromJSON(rbj, false)
+	require.NotNil(t, err)
+
+	rbj = b.JSON()
+	rbj.Replica2Part2Dev = [][]uint{append([]uint(nil), rbj.Replica2Part2Dev[0]...)}
+	rbj.Replica2Part2Dev[0][5] = 99
+	_, err = NewRingBuilderFromJSON(rbj, false)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "missing device 99")
+	rbj.Replica2Part2Dev[0][5] = NONE_DEV
+	_, err = NewRingBuilderFromJSON(rbj, false)
+	require.Nil(t, err)
+
+	// The JSON path of NewRingBuilderFromFile checks the same.
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	rbj.Replica2Part2Dev[0][5] = 99
+	buf := &bytes.Buffer{}
+	require.Nil(t, rbj.WriteJSON(buf))
+	jsonPath := filepath.Join(dir, "object.builder")
+	require.Nil(t, ioutil.WriteFile(jsonPath, buf.Bytes(), 0644))
+	_, err = NewRingBuilderFromFile(jsonPath, false)
+	require.NotNil(t, err)
+}
@@ -16,6 +16,7 @@
 package ring
 
 import (
+	"bufio"
 	"compress/gzip"
 	"crypto/md5"
 	"encoding/binary"
@@ -280,6 +281,50 @@ func (r *hashRing) RingMatching(md5 string) RingMD5 {
 	return nil
 }
 
+// readRingData reads a ring in the standard gzipped format, or in the JSON form written by "ring export", gzipped or not.
+func readRingData(rd io.Reader) (*ringData, error) {
+	br := bufio.NewReader(rd)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(gz)
+	}
+	if start, err := br.Peek(1); err == nil && isJSON(start) {
+		rj := &RingJSON{}
+		if err := json.NewDecoder(br).Decode(rj); err != nil {
+			return nil, err
+		}
+		return ringDataFromJSON(rj)
+	}
+	data := &ringData{}
+	magicBuf := make([]byte, 4)
+	io.ReadFull(br, magicBuf)
+	if string(magicBuf) != "R1NG" {
+		return nil, errors.New("Bad magic string")
+	}
+	var ringVersion uint16
+	binary.Read(br, binary.BigEndian, &ringVersion)
+	if ringVersion != 1 {
+		return nil, fmt.Errorf("Unknown ring version %d", ringVersion)
+	}
+	var json_len uint32
+	binary.Read(br, binary.BigEndian, &json_len)
+	jsonBuf := make([]byte, json_len)
+	io.ReadFull(br, jsonBuf)
+	if err := json.Unmarshal(jsonBuf, data); err != nil {
+		return nil, err
+	}
+	partitionCount := 1 << (32 - data.PartShift)
+	for i := 0; i < data.ReplicaCount; i++ {
+		part2dev := make([]uint16, partitionCount)
+		binary.Read(br, binary.LittleEndian, &part2dev)
+		data.replica2part2devId = append(data.replica2part2devId, part2dev)
+	}
+	return data, nil
+}
+
 func (r *hashRing) Reload() error {
 	fi, err := os.Stat(r.path)
 	if err != nil {
@@ -288,47 +333,25 @@ func (r *hashRing) Reload() error {
 	if fi.ModTime() == r.mtime {
 		return nil
 	}
-	data := &ringData{}
 	fp, err := os.Open(r.path)
 	if err != nil {
 		return err
 	}
 	defer fp.Close()
+	md5sum := ""
 	if r.calcMD5 {
 		h := md5.New()
 		if _, err := io.Copy(h, fp); err != nil {
 			return err
 		}
-		data.md5 = fmt.Sprintf("%x", h.Sum(nil))
+		md5sum = fmt.Sprintf("%x", h.Sum(nil))
 		fp.Seek(0, 0)
 	}
-	gz, err := gzip.NewReader(fp)
+	data, err := readRingData(fp)
 	if err != nil {
 		return err
 	}
-	magicBuf := make([]byte, 4)
-	io.ReadFull(gz, magicBuf)
-	if string(magicBuf) != "R1NG" {
-		return errors.New("Bad magic string")
-	}
-	var ringVersion uint16
-	binary.Read(gz, binary.BigEndian, &ringVersion)
-	if ringVersion != 1 {
-		return fmt.Errorf("Unknown ring version %d", ringVersion)
-	}
-	var json_len uint32
-	binary.Read(gz, binary.BigEndian, &json_len)
-	jsonBuf := make([]byte, json_len)
-	io.ReadFull(gz, jsonBuf)
-	if err := json.Unmarshal(jsonBuf, data); err != nil {
-		return err
-	}
-	partitionCount := 1 << (32 - data.PartShift)
-	for i := 0; i < data.ReplicaCount; i++ {
-		part2dev := make([]uint16, partitionCount)
-		binary.Read(gz, binary.LittleEndian, &part2dev)
-		data.replica2part2devId = append(data.replica2part2devId, part2dev)
-	}
+	data.md5 = md5sum
 	regionCount := make(map[int]bool)
 	zoneCount := make(map[regionZone]bool)
 	ipPortCount := make(map[ipPort]bool)
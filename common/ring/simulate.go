@@ -0,0 +1,311 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// TierNames are the names of the tier levels reported by TierDispersion, from widest to narrowest.
+var TierNames = []string{"region", "zone", "ip", "device"}
+
+// SimulationOp is a hypothetical change to apply to a builder before simulating rebalances.
+//
+// Op is one of "add", "set_weight" or "remove".  Dev is the device to add for "add".  For the other ops the target device is DevId, or, if DevId is negative, the device matching Ip, Port and Device.
+type SimulationOp struct {
+	Op     string
+	Dev    *RingBuilderDevice
+	DevId  int64
+	Ip     string
+	Port   int64
+	Device string
+	Weight float64
+	Purge  bool
+}
+
+// SimulationCycle is the outcome of a single rebalance during a simulation.
+type SimulationCycle struct {
+	Cycle      int                `json:"cycle"`
+	PartsMoved int                `json:"parts_moved"`
+	Balance    float64            `json:"balance"`
+	Removed    int                `json:"removed"`
+	Dispersion map[string]float64 `json:"dispersion"`
+}
+
+// SimulationDevice describes how the partition assignments of a single device changed over a simulation.
+type SimulationDevice struct {
+	Id          int64   `json:"id"`
+	Region      int64   `json:"region"`
+	Zone        int64   `json:"zone"`
+	Ip          string  `json:"ip"`
+	Port        int64   `json:"port"`
+	Device      string  `json:"device"`
+	Weight      float64 `json:"weight"`
+	PartsBefore int64   `json:"parts_before"`
+	PartsAfter  int64   `json:"parts_after"`
+	PartsGained int64   `json:"parts_gained"`
+	PartsLost   int64   `json:"parts_lost"`
+}
+
+// SimulationResult is the overall outcome of Simulate.
+type SimulationResult struct {
+	MinPartHours     int                 `json:"min_part_hours"`
+	WaitSeconds      int                 `json:"wait_seconds"`
+	Cycles           []*SimulationCycle  `json:"cycles"`
+	Devs             []*SimulationDevice `json:"devs"`
+	PartsMoved       int64               `json:"parts_moved"`
+	Balance          float64             `json:"balance"`
+	DispersionBefore map[string]float64  `json:"dispersion_before"`
+	DispersionAfter  map[string]float64  `json:"dispersion_after"`
+}
+
+// findDev returns the id of the device the op refers to.
+func (op *SimulationOp) findDev(b *RingBuilder) (int64, error) {
+	if op.DevId >= 0 {
+		if op.DevId >= int64(len(b.Devs)) || b.Devs[op.DevId] == nil {
+			return -1, fmt.Errorf("No device with id %d", op.DevId)
+		}
+		return op.DevId, nil
+	}
+	for next, dev := devIterator(b.Devs); dev != nil; dev = next() {
+		if dev.Ip == op.Ip && dev.Port == op.Port && dev.Device == op.Device {
+			return dev.Id, nil
+		}
+	}
+	return -1, fmt.Errorf("No device matching %s:%d/%s", op.Ip, op.Port, op.Device)
+}
+
+// apply applies the op to the builder.
+func (op *SimulationOp) apply(b *RingBuilder) error {
+	switch op.Op {
+	case "add":
+		dev := *op.Dev
+		_, err := b.AddDev(&dev)
+		return err
+	case "set_weight":
+		devId, err := op.findDev(b)
+		if err != nil {
+			return err
+		}
+		return b.SetDevWeight(devId, op.Weight)
+	case "remove":
+		devId, err := op.findDev(b)
+		if err != nil {
+			return err
+		}
+		b.RemoveDev(devId, op.Purge)
+		return nil
+	}
+	return fmt.Errorf("Unknown simulation operation: %q", op.Op)
+}
+
+// Simulate applies the ops to the builder and then rebalances it up to maxCycles times, pretending min_part_hours has passed before each rebalance, until a rebalance no longer moves any partitions.
+//
+// The builder is modified in place, so it should be a sandbox copy that is never saved.  WaitSeconds in the result is how long the real builder has left before its first rebalance would be allowed.
+func Simulate(b *RingBuilder, ops []*SimulationOp, maxCycles int) (*SimulationResult, error) {
+	var before Ring
+	if len(b.replica2Part2Dev) > 0 {
+		before = b.GetRing()
+	}
+	res := &SimulationResult{MinPartHours: b.MinPartHours, WaitSeconds: b.MinPartSecondsLeft()}
+	if before != nil {
+		res.DispersionBefore = TierDispersion(before)
+	}
+	for i, op := range ops {
+		if err := op.apply(b); err != nil {
+			return nil, fmt.Errorf("Operation %d (%s): %s", i+1, op.Op, err)
+		}
+	}
+	for cycle := 1; cycle <= maxCycles; cycle++ {
+		// Each reload of a builder starts with a clean moved bitmap; mimic that along with the passing of min_part_hours.
+		b.PretendMinPartHoursPassed()
+		b.partMovedBitmap = make([]byte, len(b.partMovedBitmap))
+		changed, balance, removed, err := b.Rebalance()
+		if err != nil {
+			return nil, err
+		}
+		if err = b.Validate(); err != nil {
+			return nil, err
+		}
+		res.Cycles = append(res.Cycles, &SimulationCycle{
+			Cycle:      cycle,
+			PartsMoved: changed,
+			Balance:    balance,
+			Removed:    removed,
+			Dispersion: TierDispersion(b.GetRing()),
+		})
+		if changed == 0 && removed == 0 {
+			break
+		}
+	}
+	after := b.GetRing()
+	res.Balance = b.GetBalance()
+	res.DispersionAfter = TierDispersion(after)
+	res.Devs = DevicePartMoves(before, after)
+	for _, dev := range res.Devs {
+		res.PartsMoved += dev.PartsGained
+	}
+	return res, nil
+}
+
+// DevicePartMoves compares the assignments of two rings and returns the partition counts, gains and losses for every device in either ring, ordered by device id.  The old ring may be nil, in which case every assignment in the new ring is a gain.
+func DevicePartMoves(oldRing, newRing Ring) []*SimulationDevice {
+	devs := map[int64]*SimulationDevice{}
+	addDevs := func(r Ring) {
+		for _, dev := range r.AllDevices() {
+			if dev == nil {
+				continue
+			}
+			devs[int64(dev.Id)] = &SimulationDevice{
+				Id:     int64(dev.Id),
+				Region: int64(dev.Region),
+				Zone:   int64(dev.Zone),
+				Ip:     dev.Ip,
+				Port:   int64(dev.Port),
+				Device: dev.Device,
+				Weight: dev.Weight,
+			}
+		}
+	}
+	if oldRing != nil {
+		addDevs(oldRing)
+	}
+	addDevs(newRing)
+	for part := uint64(0); ; part++ {
+		var oldNodes []*Device
+		if oldRing != nil {
+			oldNodes = oldRing.GetNodes(part)
+		}
+		newNodes := newRing.GetNodes(part)
+		if oldNodes == nil && newNodes == nil {
+			break
+		}
+		for replica := 0; replica < len(oldNodes) || replica < len(newNodes); replica++ {
+			var oldDev, newDev *Device
+			if replica < len(oldNodes) {
+				oldDev = oldNodes[replica]
+				devs[int64(oldDev.Id)].PartsBefore++
+			}
+			if replica < len(newNodes) {
+				newDev = newNodes[replica]
+				devs[int64(newDev.Id)].PartsAfter++
+			}
+			if oldDev != nil && newDev != nil && oldDev.Id == newDev.Id {
+				continue
+			}
+			if oldDev != nil {
+				devs[int64(oldDev.Id)].PartsLost++
+			}
+			if newDev != nil {
+				devs[int64(newDev.Id)].PartsGained++
+			}
+		}
+	}
+	ids := make([]int64, 0, len(devs))
+	for id := range devs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	out := make([]*SimulationDevice, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, devs[id])
+	}
+	return out
+}
+
+// deviceTiers returns the tiers of a ring device, in the same form as the builder's tiersForDev.
+func deviceTiers(dev *Device) [4]string {
+	return [4]string{
+		fmt.Sprintf("%d", dev.Region),
+		fmt.Sprintf("%d;%d", dev.Region, dev.Zone),
+		fmt.Sprintf("%d;%d;%s", dev.Region, dev.Zone, dev.Ip),
+		fmt.Sprintf("%d;%d;%s;%d", dev.Region, dev.Zone, dev.Ip, dev.Id),
+	}
+}
+
+// TierDispersion returns, for each of the TierNames, the percentage of partitions that have more replicas in a single tier of that level than the most dispersed placement of the weighted devices would allow.
+func TierDispersion(r Ring) map[string]float64 {
+	dispersion := make(map[string]float64, len(TierNames))
+	for _, name := range TierNames {
+		dispersion[name] = 0
+	}
+	tier2Children := map[string][]string{}
+	seen := map[string]bool{}
+	for _, dev := range r.AllDevices() {
+		if dev == nil || dev.Weight <= 0 {
+			continue
+		}
+		parent := ""
+		for _, tier := range deviceTiers(dev) {
+			if !seen[tier] {
+				seen[tier] = true
+				tier2Children[parent] = append(tier2Children[parent], tier)
+			}
+			parent = tier
+		}
+	}
+	maxReplicas := map[string]float64{}
+	var walkTree func(string, float64)
+	walkTree = func(tier string, replicaCount float64) {
+		if strings.Count(tier, ";") == 3 {
+			replicaCount = math.Min(1.0, replicaCount)
+		}
+		maxReplicas[tier] = replicaCount
+		for _, subTier := range tier2Children[tier] {
+			walkTree(subTier, math.Ceil(replicaCount/float64(len(tier2Children[tier]))))
+		}
+	}
+	walkTree("", float64(r.ReplicaCount()))
+	parts := 0
+	badParts := make([]int, len(TierNames))
+	for part := uint64(0); ; part++ {
+		nodes := r.GetNodes(part)
+		if nodes == nil {
+			break
+		}
+		parts++
+		counts := map[string]float64{}
+		for _, dev := range nodes {
+			if dev == nil {
+				continue
+			}
+			for _, tier := range deviceTiers(dev) {
+				counts[tier]++
+			}
+		}
+		for level := range TierNames {
+			for _, dev := range nodes {
+				if dev == nil {
+					continue
+				}
+				tier := deviceTiers(dev)[level]
+				if max, ok := maxReplicas[tier]; ok && counts[tier] > max {
+					badParts[level]++
+					break
+				}
+			}
+		}
+	}
+	if parts > 0 {
+		for level, name := range TierNames {
+			dispersion[name] = 100.0 * float64(badParts[level]) / float64(parts)
+		}
+	}
+	return dispersion
+}
@@ -0,0 +1,93 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func simulationBuilder(t *testing.T, zones int) *RingBuilder {
+	b, err := NewRingBuilder(8, 3, 1, false)
+	require.Nil(t, err)
+	for z := 0; z < zones; z++ {
+		_, err := b.AddDev(&RingBuilderDevice{Id: -1, Region: 1, Zone: int64(z), Ip: fmt.Sprintf("127.0.0.%d", z+1), Port: 6000, Device: "sda", Weight: 100, Scheme: "http"})
+		require.Nil(t, err)
+	}
+	_, _, _, err = b.Rebalance()
+	require.Nil(t, err)
+	return b
+}
+
+func TestSimulateAddDevice(t *testing.T) {
+	b := simulationBuilder(t, 3)
+	ops := []*SimulationOp{{Op: "add", Dev: &RingBuilderDevice{Id: -1, Region: 1, Zone: 3, Ip: "127.0.0.4", Port: 6000, Device: "sda", Weight: 100, Scheme: "http"}}}
+	res, err := Simulate(b, ops, 5)
+	require.Nil(t, err)
+	require.True(t, len(res.Cycles) > 0)
+	require.Equal(t, 4, len(res.Devs))
+	gained := int64(0)
+	lost := int64(0)
+	for _, dev := range res.Devs {
+		gained += dev.PartsGained
+		lost += dev.PartsLost
+		require.Equal(t, dev.PartsBefore+dev.PartsGained-dev.PartsLost, dev.PartsAfter)
+	}
+	require.Equal(t, gained, lost)
+	require.Equal(t, gained, res.PartsMoved)
+	require.Equal(t, int64(0), res.Devs[3].PartsBefore)
+	require.Equal(t, int64(192), res.Devs[3].PartsAfter)
+	require.Equal(t, 0.0, res.DispersionAfter["zone"])
+}
+
+func TestSimulateRemoveByAddress(t *testing.T) {
+	b := simulationBuilder(t, 4)
+	ops := []*SimulationOp{{Op: "remove", DevId: -1, Ip: "127.0.0.2", Port: 6000, Device: "sda", Purge: true}}
+	res, err := Simulate(b, ops, 5)
+	require.Nil(t, err)
+	require.Equal(t, int64(192), res.Devs[1].PartsBefore)
+	require.Equal(t, int64(0), res.Devs[1].PartsAfter)
+	require.Equal(t, int64(192), res.Devs[1].PartsLost)
+	require.Nil(t, b.Devs[1])
+}
+
+func TestSimulateBadOp(t *testing.T) {
+	b := simulationBuilder(t, 3)
+	_, err := Simulate(b, []*SimulationOp{{Op: "set_weight", DevId: 12, Weight: 1}}, 5)
+	require.NotNil(t, err)
+	_, err = Simulate(b, []*SimulationOp{{Op: "explode"}}, 5)
+	require.NotNil(t, err)
+}
+
+func TestTierDispersion(t *testing.T) {
+	b := simulationBuilder(t, 3)
+	r := b.GetRing()
+	d := TierDispersion(r)
+	for _, name := range TierNames {
+		require.Equal(t, 0.0, d[name])
+	}
+	// put every replica of partition 0 on the first device
+	data := r.getData()
+	for replica := range data.replica2part2devId {
+		data.replica2part2devId[replica][0] = 0
+	}
+	d = TierDispersion(r)
+	require.InDelta(t, 100.0/256.0, d["zone"], 0.0001)
+	require.InDelta(t, 100.0/256.0, d["device"], 0.0001)
+	require.Equal(t, 0.0, d["region"])
+}
@@ -204,6 +204,9 @@ func (r *router) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	if vars != nil && txnId != "" {
 		vars["txnId"] = txnId
 	}
+	if traceparent := request.Header.Get("Traceparent"); vars != nil && traceparent != "" {
+		vars["traceparent"] = traceparent
+	}
 	request = SetVars(request, vars)
 	handler.ServeHTTP(writer, request)
 }
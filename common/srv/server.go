@@ -39,6 +39,7 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/tracing"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/net/http2"
@@ -76,6 +77,7 @@ var responseBodies = map[int]string{
 	416: fmt.Sprintf(responseTemplate, "Requested Range Not Satisfiable", "The Range requested is not available."),
 	417: fmt.Sprintf(responseTemplate, "Expectation Failed", "Expectation failed."),
 	422: fmt.Sprintf(responseTemplate, "Unprocessable Entity", "Unable to process the contained instructions"),
+	429: fmt.Sprintf(responseTemplate, "Too Many Requests", "The client is sending too many requests and should slow down."),
 	498: fmt.Sprintf(responseTemplate, "Ratelimited", "The client is sending too many requests and should slow down."),
 	499: fmt.Sprintf(responseTemplate, "Client Disconnect", "The client was disconnected during request."),
 	500: fmt.Sprintf(responseTemplate, "Internal Error", "The server has either erred or is incapable of performing the requested operation."),
@@ -306,7 +308,15 @@ func LogRequest(logger LowLevelLogger, next http.Handler) http.Handler {
 		request.Body = newReader
 		logr := logger.With(zap.String("txn", request.Header.Get("X-Trans-Id")))
 		request = SetLogger(request, logr)
+		span := tracing.Default().StartSpanFromHeader(request.Method, tracing.KindServer, request.Header)
+		span.SetAttribute("http.method", request.Method)
+		span.SetAttribute("http.target", request.URL.Path)
+		span.SetAttribute("txn", request.Header.Get("X-Trans-Id"))
+		// Anything this server sends on for the request is a child of its span.
+		span.Inject(request.Header)
 		next.ServeHTTP(newWriter, request)
+		span.SetStatus(newWriter.Status)
+		span.Finish()
 		LogRequestLine(logr, request, start, newWriter, newReader)
 	})
 }
@@ -485,6 +495,14 @@ type Server interface {
 	Finalize() // This is called before stoping gracefully so that a server can clean up before closing
 }
 
+// MetricsServer is implemented by servers that construct things reporting to
+// their metrics scope up front, so that errors doing so stop startup.
+// RunServers calls SetupMetrics with the server's metrics prefix before
+// GetHandler.
+type MetricsServer interface {
+	SetupMetrics(metricsPrefix string) error
+}
+
 func RunServers(getServer func(conf.Config, *flag.FlagSet, ConfigLoader) (*IpPort, Server, LowLevelLogger, error), flags *flag.FlagSet) {
 	var servers []*HummingbirdServer
 
@@ -506,6 +524,16 @@ func RunServers(getServer func(conf.Config, *flag.FlagSet, ConfigLoader) (*IpPor
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			os.Exit(1)
 		}
+		// Servers started together share a tracer, from the first of their configs.
+		if tracing.Default() == nil {
+			tracer, err := tracing.NewTracerFromConfig(config, server.Type())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error setting up tracing: %v\n", err)
+				os.Exit(1)
+			}
+			tracing.SetDefault(tracer)
+			defer tracer.Close()
+		}
 		var metricsPrefix string
 		if len(configs) == 1 {
 			metricsPrefix = fmt.Sprintf("hb_%s", server.Type())
@@ -514,6 +542,12 @@ func RunServers(getServer func(conf.Config, *flag.FlagSet, ConfigLoader) (*IpPor
 		}
 		metricsPrefix = strings.Replace(metricsPrefix, "-", "_", -1)
 		metricsPrefix = strings.Replace(metricsPrefix, ".", "_", -1)
+		if ms, ok := server.(MetricsServer); ok {
+			if err := ms.SetupMetrics(metricsPrefix); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+		}
 		sock, err := RetryListen(ipPort.Ip, ipPort.Port)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error listening: %v\n", err)
@@ -0,0 +1,81 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// TempURLDigests are the hash functions temp URL signatures can be made with.
+var TempURLDigests = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// TempURLHMAC returns the HMAC a temp URL's signature is made of. Signatures
+// for every object under a prefix have "prefix:" in front of the path, and
+// ones limited to an IP range start with it.
+func TempURLHMAC(newHash func() hash.Hash, key []byte, method string, expires int64, path, ipRange string) []byte {
+	mac := hmac.New(newHash, key)
+	if ipRange != "" {
+		fmt.Fprintf(mac, "ip=%s\n", ipRange)
+	}
+	fmt.Fprintf(mac, "%s\n%d\n%s", method, expires, path)
+	return mac.Sum(nil)
+}
+
+// ParseTempURLSig returns the digest and bytes of a temp_url_sig, which is
+// either hex, in which case its length gives the digest, or "<digest>:" and
+// then base64.
+func ParseTempURLSig(sig string) (string, []byte, error) {
+	if i := strings.Index(sig, ":"); i >= 0 {
+		digest := sig[:i]
+		newHash, ok := TempURLDigests[digest]
+		if !ok {
+			return "", nil, fmt.Errorf("Unknown digest %q", digest)
+		}
+		// Both the URL safe and standard alphabets are allowed, with or
+		// without padding.
+		encoded := strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(sig[i+1:], "="))
+		b, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(b) != newHash().Size() {
+			return "", nil, fmt.Errorf("Signature is the wrong length for %s", digest)
+		}
+		return digest, b, nil
+	}
+	b, err := hex.DecodeString(sig)
+	if err != nil {
+		return "", nil, err
+	}
+	for digest, newHash := range TempURLDigests {
+		if len(b) == newHash().Size() {
+			return digest, b, nil
+		}
+	}
+	return "", nil, fmt.Errorf("Signature is the wrong length")
+}
@@ -0,0 +1,57 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTempURLHMAC(t *testing.T) {
+	// Generated with Swift's tempurl code.
+	mac := TempURLHMAC(sha1.New, []byte("mykey"), "GET", 1493709631, "/v1/AUTH_account/container/object", "")
+	require.Equal(t, "6deb0c7da21f396f1368681dc0bd57df0d1c4369", hex.EncodeToString(mac))
+	require.NotEqual(t, mac, TempURLHMAC(sha1.New, []byte("mykey"), "GET", 1493709631, "/v1/AUTH_account/container/object", "1.2.3.4"))
+	require.Equal(t, 64, len(TempURLHMAC(sha512.New, []byte("mykey"), "GET", 1, "/v1/a/c/o", "")))
+}
+
+func TestParseTempURLSig(t *testing.T) {
+	mac := TempURLHMAC(sha256.New, []byte("mykey"), "GET", 1, "/v1/a/c/o", "")
+	for _, sig := range []string{
+		hex.EncodeToString(mac),
+		"sha256:" + base64.URLEncoding.EncodeToString(mac),
+		"sha256:" + base64.RawURLEncoding.EncodeToString(mac),
+		"sha256:" + base64.StdEncoding.EncodeToString(mac),
+	} {
+		digest, b, err := ParseTempURLSig(sig)
+		require.Nil(t, err, sig)
+		require.Equal(t, "sha256", digest)
+		require.Equal(t, mac, b)
+	}
+	digest, _, err := ParseTempURLSig("6deb0c7da21f396f1368681dc0bd57df0d1c4369")
+	require.Nil(t, err)
+	require.Equal(t, "sha1", digest)
+	for _, sig := range []string{"", "zz", "abcd", "md5:" + base64.StdEncoding.EncodeToString(mac), "sha512:" + base64.StdEncoding.EncodeToString(mac), "sha256:!!"} {
+		_, _, err := ParseTempURLSig(sig)
+		require.NotNil(t, err, sig)
+	}
+}
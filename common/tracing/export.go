@@ -0,0 +1,247 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+// Exporter sends finished spans somewhere they can be looked at.
+type Exporter interface {
+	ExportSpans(spans []*Span) error
+	Close() error
+}
+
+var exporters = map[string]func(conf.Section) (Exporter, error){
+	"file": NewFileExporter,
+	"otlp": NewOTLPExporter,
+}
+
+// RegisterExporter makes an Exporter available to the [tracing] section's
+// exporter option.
+func RegisterExporter(name string, constructor func(conf.Section) (Exporter, error)) {
+	exporters[name] = constructor
+}
+
+// fileExporter writes spans to a file as JSON lines.
+type fileExporter struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(config conf.Section) (Exporter, error) {
+	path := config.GetDefault("file", "/var/log/hummingbird/traces.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open trace file: %v", err)
+	}
+	return &fileExporter{file: f}, nil
+}
+
+func (e *fileExporter) ExportSpans(spans []*Span) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, s := range spans {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err := e.file.Write(buf.Bytes())
+	return err
+}
+
+func (e *fileExporter) Close() error {
+	return e.file.Close()
+}
+
+// otlpExporter posts spans to an OpenTelemetry collector using OTLP's JSON
+// encoding over HTTP.
+type otlpExporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func NewOTLPExporter(config conf.Section) (Exporter, error) {
+	e := &otlpExporter{
+		url:     config.GetDefault("url", "http://127.0.0.1:4318/v1/traces"),
+		headers: map[string]string{},
+		client:  &http.Client{Timeout: time.Duration(config.GetFloat("timeout", 10) * float64(time.Second))},
+	}
+	// headers = Name: value, Name: value
+	for _, h := range strings.Split(config.GetDefault("headers", ""), ",") {
+		if parts := strings.SplitN(h, ":", 2); len(parts) == 2 {
+			e.headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return e, nil
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttributeFor(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	case bool:
+		a.Value.BoolValue = &v
+	case string:
+		a.Value.StringValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+var otlpKinds = map[string]int{KindInternal: 1, KindServer: 2, KindClient: 3}
+
+func (e *otlpExporter) ExportSpans(spans []*Span) error {
+	byService := map[string]*otlpResourceSpans{}
+	var services []string
+	for _, s := range spans {
+		rs := byService[s.Service]
+		if rs == nil {
+			rs = &otlpResourceSpans{ScopeSpans: []otlpScopeSpans{{}}}
+			rs.Resource.Attributes = []otlpAttribute{otlpAttributeFor("service.name", s.Service)}
+			rs.ScopeSpans[0].Scope.Name = "hummingbird"
+			byService[s.Service] = rs
+			services = append(services, s.Service)
+		}
+		span := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              otlpKinds[s.Kind],
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		keys := make([]string, 0, len(s.Attributes))
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			span.Attributes = append(span.Attributes, otlpAttributeFor(k, s.Attributes[k]))
+		}
+		if s.Error {
+			span.Status.Code = 2
+		}
+		rs.ScopeSpans[0].Spans = append(rs.ScopeSpans[0].Spans, span)
+	}
+	req := otlpRequest{}
+	for _, service := range services {
+		req.ResourceSpans = append(req.ResourceSpans, *byService[service])
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (e *otlpExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,404 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package tracing records spans for requests as they pass between the proxy
+// and the backend servers, propagating them with W3C traceparent headers.
+//
+// A nil *Tracer and a nil *Span are both valid and do nothing, so callers
+// don't need to check whether tracing is turned on.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+const (
+	KindInternal = "internal"
+	KindServer   = "server"
+	KindClient   = "client"
+
+	exportBatchSize = 512
+	queueSize       = 8192
+)
+
+// SpanContext is the part of a span passed on to other servers.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Valid returns whether the context identifies a span.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent returns the context as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value, returning an
+// invalid SpanContext if it can't.
+func ParseTraceparent(value string) SpanContext {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}
+	}
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.Valid() {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// FromHeader returns the span context in the request's Traceparent header.
+func FromHeader(header http.Header) SpanContext {
+	return ParseTraceparent(header.Get("Traceparent"))
+}
+
+// Span is a timed operation within a trace.
+type Span struct {
+	Name       string
+	Kind       string
+	Service    string
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      bool
+
+	context SpanContext
+	tracer  *Tracer
+	lock    sync.Mutex
+	ended   bool
+}
+
+// Context returns the span's context, for starting child spans.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// Inject sets the Traceparent header so the span is the parent of any span
+// started by whoever receives the header.
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	header.Set("Traceparent", s.context.Traceparent())
+}
+
+// SetAttribute records a key and value on the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.Attributes[key] = value
+	s.lock.Unlock()
+}
+
+// SetStatus records an HTTP status code, marking the span as failed if it's a
+// server error.
+func (s *Span) SetStatus(status int) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.Attributes["http.status_code"] = status
+	if status >= 500 {
+		s.Error = true
+	}
+	s.lock.Unlock()
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	s.Error = true
+	s.Attributes["error"] = err.Error()
+	s.lock.Unlock()
+}
+
+// Finish ends the span and queues it for export if it's sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.lock.Unlock()
+	if s.context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// Tracer starts spans and sends the finished ones to its Exporter in batches.
+type Tracer struct {
+	service    string
+	exporter   Exporter
+	sampleRate float64
+	queue      chan *Span
+	flush      chan chan struct{}
+	done       chan struct{}
+	stopped    chan struct{}
+	closeOnce  sync.Once
+	dropped    int64
+	interval   time.Duration
+}
+
+// NewTracer returns a Tracer for the named service, sampling sampleRate of the
+// traces it starts itself. Traces started elsewhere are sampled if their
+// parent was.
+func NewTracer(service string, exporter Exporter, sampleRate float64, interval time.Duration) *Tracer {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	t := &Tracer{
+		service:    service,
+		exporter:   exporter,
+		sampleRate: sampleRate,
+		queue:      make(chan *Span, queueSize),
+		flush:      make(chan chan struct{}),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		interval:   interval,
+	}
+	go t.run()
+	return t
+}
+
+// NewTracerFromConfig returns a Tracer set up by the config's [tracing]
+// section, or nil if tracing isn't turned on.
+func NewTracerFromConfig(config conf.Config, service string) (*Tracer, error) {
+	section := config.GetSection("tracing")
+	name := section.GetDefault("exporter", "none")
+	if name == "none" || name == "" {
+		return nil, nil
+	}
+	constructor, ok := exporters[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown trace exporter %q", name)
+	}
+	exporter, err := constructor(section)
+	if err != nil {
+		return nil, err
+	}
+	sampleRate := section.GetFloat("sample_rate", 1.0)
+	interval := time.Duration(section.GetFloat("flush_interval", 1) * float64(time.Second))
+	return NewTracer(section.GetDefault("service_name", service), exporter, sampleRate, interval), nil
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		mrand.Read(b)
+	}
+}
+
+// StartSpan starts a span of the given kind, as a child of parent if it's
+// valid or else as the root of a new trace.
+func (t *Tracer) StartSpan(name, kind string, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		Service:    t.service,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+		tracer:     t,
+	}
+	if parent.Valid() {
+		s.context.TraceID = parent.TraceID
+		s.context.Sampled = parent.Sampled
+		s.ParentID = hex.EncodeToString(parent.SpanID[:])
+	} else {
+		randomID(s.context.TraceID[:])
+		s.context.Sampled = mrand.Float64() < t.sampleRate
+	}
+	randomID(s.context.SpanID[:])
+	s.TraceID = hex.EncodeToString(s.context.TraceID[:])
+	s.SpanID = hex.EncodeToString(s.context.SpanID[:])
+	return s
+}
+
+// StartSpanFromHeader starts a span whose parent is given by the header's
+// Traceparent, if it has one.
+func (t *Tracer) StartSpanFromHeader(name, kind string, header http.Header) *Span {
+	return t.StartSpan(name, kind, FromHeader(header))
+}
+
+// StartChildSpan starts a span whose parent is given by the header's
+// Traceparent, or returns nil if there isn't one, for work that's only worth
+// tracing as part of a larger request.
+func (t *Tracer) StartChildSpan(name, kind string, header http.Header) *Span {
+	parent := FromHeader(header)
+	if !parent.Valid() {
+		return nil
+	}
+	return t.StartSpan(name, kind, parent)
+}
+
+// Dropped returns the number of spans dropped because the export queue was
+// full or the Exporter failed.
+func (t *Tracer) Dropped() int64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&t.dropped)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+func (t *Tracer) export(batch []*Span) []*Span {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := t.exporter.ExportSpans(batch); err != nil {
+		atomic.AddInt64(&t.dropped, int64(len(batch)))
+	}
+	return batch[:0]
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, exportBatchSize)
+	drain := func() {
+		for {
+			select {
+			case s := <-t.queue:
+				if batch = append(batch, s); len(batch) >= exportBatchSize {
+					batch = t.export(batch)
+				}
+			default:
+				batch = t.export(batch)
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) >= exportBatchSize {
+				batch = t.export(batch)
+			}
+		case <-ticker.C:
+			batch = t.export(batch)
+		case c := <-t.flush:
+			drain()
+			close(c)
+		case <-t.done:
+			drain()
+			return
+		}
+	}
+}
+
+// Flush exports any spans that have finished.
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	c := make(chan struct{})
+	select {
+	case t.flush <- c:
+		<-c
+	case <-t.done:
+	}
+}
+
+// Close exports any spans that have finished and closes the Exporter.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.done)
+		<-t.stopped
+		err = t.exporter.Close()
+	})
+	return err
+}
+
+var (
+	defaultTracer     *Tracer
+	defaultTracerLock sync.RWMutex
+)
+
+// SetDefault sets the Tracer used by the servers and clients in this process.
+func SetDefault(t *Tracer) {
+	defaultTracerLock.Lock()
+	defaultTracer = t
+	defaultTracerLock.Unlock()
+}
+
+// Default returns the Tracer used by the servers and clients in this process,
+// which is nil if tracing isn't turned on.
+func Default() *Tracer {
+	defaultTracerLock.RLock()
+	defer defaultTracerLock.RUnlock()
+	return defaultTracer
+}
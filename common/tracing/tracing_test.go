@@ -0,0 +1,209 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+type memoryExporter struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) ExportSpans(spans []*Span) error {
+	e.lock.Lock()
+	e.spans = append(e.spans, spans...)
+	e.lock.Unlock()
+	return nil
+}
+
+func (e *memoryExporter) Close() error {
+	return nil
+}
+
+func TestTraceparent(t *testing.T) {
+	sc := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, sc.Valid())
+	require.True(t, sc.Sampled)
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+	sc = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	require.True(t, sc.Valid())
+	require.False(t, sc.Sampled)
+	// Later versions may add fields.
+	require.True(t, ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra").Valid())
+	for _, bad := range []string{
+		"",
+		"junk",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		require.False(t, ParseTraceparent(bad).Valid(), bad)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.StartSpan("x", KindServer, SpanContext{})
+	require.Nil(t, span)
+	header := http.Header{}
+	span.SetAttribute("a", 1)
+	span.SetStatus(500)
+	span.Inject(header)
+	span.Finish()
+	require.Equal(t, "", header.Get("Traceparent"))
+	require.Nil(t, tracer.Close())
+}
+
+func TestSpans(t *testing.T) {
+	e := &memoryExporter{}
+	tracer := NewTracer("proxy", e, 1, 0)
+	root := tracer.StartSpan("GET", KindServer, SpanContext{})
+	header := http.Header{}
+	root.Inject(header)
+	child := tracer.StartChildSpan("quorum", KindInternal, header)
+	child.SetStatus(503)
+	child.Finish()
+	child.Finish()
+	root.Finish()
+	require.Nil(t, tracer.StartChildSpan("orphan", KindClient, http.Header{}))
+	tracer.Flush()
+	require.Equal(t, 2, len(e.spans))
+	require.Equal(t, "quorum", e.spans[0].Name)
+	require.Equal(t, root.TraceID, e.spans[0].TraceID)
+	require.Equal(t, root.SpanID, e.spans[0].ParentID)
+	require.True(t, e.spans[0].Error)
+	require.Equal(t, "", e.spans[1].ParentID)
+	require.Equal(t, "proxy", e.spans[1].Service)
+
+	// Unsampled traces are propagated but not exported.
+	tracer = NewTracer("proxy", e, 0, 0)
+	root = tracer.StartSpan("GET", KindServer, SpanContext{})
+	root.Inject(header)
+	require.Equal(t, "00", header.Get("Traceparent")[53:])
+	tracer.StartChildSpan("quorum", KindInternal, header).Finish()
+	root.Finish()
+	require.Nil(t, tracer.Close())
+	require.Equal(t, 2, len(e.spans))
+}
+
+type failingExporter struct {
+	memoryExporter
+}
+
+func (e *failingExporter) ExportSpans(spans []*Span) error {
+	return errors.New("collector is down")
+}
+
+func TestDropped(t *testing.T) {
+	tracer := NewTracer("proxy", &failingExporter{}, 1, 0)
+	tracer.StartSpan("GET", KindServer, SpanContext{}).Finish()
+	tracer.Flush()
+	require.Equal(t, int64(1), tracer.Dropped())
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got otlpRequest
+	var contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		require.Equal(t, "secret", r.Header.Get("Authorization"))
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(200)
+	}))
+	defer collector.Close()
+	config, err := conf.StringConfig("[tracing]\nexporter = otlp\nurl = " + collector.URL + "/v1/traces\nheaders = Authorization: secret\n")
+	require.Nil(t, err)
+	tracer, err := NewTracerFromConfig(config, "object")
+	require.Nil(t, err)
+	span := tracer.StartSpan("PUT", KindServer, ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	span.SetAttribute("device", "sda")
+	span.SetStatus(201)
+	span.Finish()
+	require.Nil(t, tracer.Close())
+
+	require.Equal(t, "application/json", contentType)
+	require.Equal(t, 1, len(got.ResourceSpans))
+	rs := got.ResourceSpans[0]
+	require.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	require.Equal(t, "object", *rs.Resource.Attributes[0].Value.StringValue)
+	s := rs.ScopeSpans[0].Spans[0]
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.TraceID)
+	require.Equal(t, "00f067aa0ba902b7", s.ParentSpanID)
+	require.Equal(t, span.SpanID, s.SpanID)
+	require.Equal(t, 2, s.Kind)
+	require.Equal(t, 0, s.Status.Code)
+	require.Equal(t, "device", s.Attributes[0].Key)
+	require.Equal(t, "sda", *s.Attributes[0].Value.StringValue)
+	require.Equal(t, "http.status_code", s.Attributes[1].Key)
+	require.Equal(t, "201", *s.Attributes[1].Value.IntValue)
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "traces.json")
+	config, err := conf.StringConfig("[tracing]\nexporter = file\nfile = " + path + "\n")
+	require.Nil(t, err)
+	tracer, err := NewTracerFromConfig(config, "container")
+	require.Nil(t, err)
+	tracer.StartSpan("GET", KindServer, SpanContext{}).Finish()
+	tracer.StartSpan("PUT", KindServer, SpanContext{}).Finish()
+	require.Nil(t, tracer.Close())
+
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s Span
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &s))
+		require.Equal(t, "container", s.Service)
+		names = append(names, s.Name)
+	}
+	require.Equal(t, []string{"GET", "PUT"}, names)
+}
+
+func TestTracerFromConfig(t *testing.T) {
+	config, err := conf.StringConfig("[app:object-server]\n")
+	require.Nil(t, err)
+	tracer, err := NewTracerFromConfig(config, "object")
+	require.Nil(t, err)
+	require.Nil(t, tracer)
+	config, err = conf.StringConfig("[tracing]\nexporter = carrier-pigeon\n")
+	require.Nil(t, err)
+	_, err = NewTracerFromConfig(config, "object")
+	require.NotNil(t, err)
+}
@@ -74,6 +74,9 @@ type ObjectListingRecord struct {
 	Size         int64    `xml:"bytes" json:"bytes"`
 	ContentType  string   `xml:"content_type" json:"content_type"`
 	ETag         string   `xml:"hash" json:"hash"`
+	SymlinkPath  string   `xml:"symlink_path,omitempty" json:"symlink_path,omitempty"`
+	SymlinkEtag  string   `xml:"symlink_etag,omitempty" json:"symlink_etag,omitempty"`
+	SymlinkBytes *int64   `xml:"symlink_bytes,omitempty" json:"symlink_bytes,omitempty"`
 }
 
 // SubdirListingRecord is the struct used for serializing subdirs in json and xml container listings.
@@ -119,6 +122,10 @@ type Container interface {
 	PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int) error
 	// DeleteObject deletes an object from the container.
 	DeleteObject(name string, timestamp string, storagePolicyIndex int) error
+	// SetStoragePolicy changes the container's storage policy as of timestamp, recording the change so replication carries it.
+	SetStoragePolicy(storagePolicyIndex int, timestamp string) error
+	// PolicyStats returns the count and bytes used of the container's objects in a storage policy.
+	PolicyStats(storagePolicyIndex int) (int64, int64, error)
 	// ID returns a unique identifier for the container.
 	ID() string
 	// Close frees any resources associated with the container.
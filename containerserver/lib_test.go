@@ -174,6 +174,12 @@ func (f fakeDatabase) CheckSyncLink() error {
 func (f fakeDatabase) PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int) error {
 	return errors.New("")
 }
+func (f fakeDatabase) SetStoragePolicy(storagePolicyIndex int, timestamp string) error {
+	return errors.New("")
+}
+func (f fakeDatabase) PolicyStats(storagePolicyIndex int) (int64, int64, error) {
+	return 0, 0, errors.New("")
+}
 func (f fakeDatabase) DeleteObject(name string, timestamp string, storagePolicyIndex int) error {
 	return errors.New("")
 }
@@ -151,6 +151,12 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 	for key, value := range metadata {
 		headers.Set(key, value)
 	}
+	// While the container is being migrated to its storage policy, the
+	// objects not yet moved are still listed and counted as its own.
+	migration, err := common.ParsePolicyMigration(metadata[common.PolicyMigrationSysmeta])
+	if err != nil || migration.To != info.StoragePolicyIndex {
+		migration = nil
+	}
 	if deleted, err := db.IsDeleted(); err != nil {
 		srv.GetLogger(request).Error("Error calling IsDeleted.", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -159,8 +165,26 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 		srv.StandardResponse(writer, http.StatusNotFound)
 		return
 	} else {
-		headers.Set("X-Container-Object-Count", strconv.FormatInt(info.ObjectCount, 10))
-		headers.Set("X-Container-Bytes-Used", strconv.FormatInt(info.BytesUsed, 10))
+		objectCount, bytesUsed := info.ObjectCount, info.BytesUsed
+		if migration != nil {
+			remainingCount, remainingBytes, err := db.PolicyStats(migration.From)
+			if err != nil {
+				srv.GetLogger(request).Error("Unable to get policy stats.", zap.Error(err))
+				srv.StandardResponse(writer, http.StatusInternalServerError)
+				return
+			}
+			objectCount += remainingCount
+			bytesUsed += remainingBytes
+			if policy := server.policyList[migration.From]; policy != nil {
+				headers.Set("X-Container-Policy-Migration-From", policy.Name)
+			} else {
+				headers.Set("X-Container-Policy-Migration-From", strconv.Itoa(migration.From))
+			}
+			headers.Set("X-Container-Policy-Migration-Objects-Remaining", strconv.FormatInt(remainingCount, 10))
+			headers.Set("X-Container-Policy-Migration-Bytes-Remaining", strconv.FormatInt(remainingBytes, 10))
+		}
+		headers.Set("X-Container-Object-Count", strconv.FormatInt(objectCount, 10))
+		headers.Set("X-Container-Bytes-Used", strconv.FormatInt(bytesUsed, 10))
 		if ts, err := common.GetEpochFromTimestamp(info.CreatedAt); err == nil {
 			headers.Set("X-Timestamp", ts)
 		}
@@ -174,6 +198,10 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 		writer.Write([]byte(""))
 		return
 	}
+	if _, ok := request.Form["changes"]; ok {
+		server.containerChanges(writer, request, db, info)
+		return
+	}
 	limit := int64(10000)
 	limitStr := request.FormValue("limit")
 	if limitStr != "" {
@@ -196,9 +224,17 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 	policyIndex, err := strconv.Atoi(request.Header.Get("X-Backend-Storage-Policy-Index"))
 	if err != nil {
 		policyIndex = info.StoragePolicyIndex
+	} else {
+		migration = nil
 	}
 	reverse := common.LooksTrue(request.Form.Get("reverse"))
 	objects, err := db.ListObjects(int(limit), marker, endMarker, prefix, delimiter, path, reverse, policyIndex)
+	if err == nil && migration != nil {
+		var unmoved []interface{}
+		if unmoved, err = db.ListObjects(int(limit), marker, endMarker, prefix, delimiter, path, reverse, migration.From); err == nil {
+			objects = mergeListings(objects, unmoved, int(limit), reverse)
+		}
+	}
 	if err != nil {
 		srv.GetLogger(request).Error("Unable to list objects.", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -260,6 +296,84 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 	}
 }
 
+// containerChanges writes the container's change feed: its object records,
+// including deletions, with a row greater than the since parameter, in row
+// order. Rows are only comparable between requests to the same database,
+// identified by X-Container-Changes-Id.
+func (server *ContainerServer) containerChanges(writer http.ResponseWriter, request *http.Request, db Container, info *ContainerInfo) {
+	rdb, ok := db.(ReplicableContainer)
+	if !ok {
+		srv.StandardResponse(writer, http.StatusNotImplemented)
+		return
+	}
+	since := int64(0)
+	if sinceStr := request.Form.Get("since"); sinceStr != "" {
+		var err error
+		if since, err = strconv.ParseInt(sinceStr, 10, 64); err != nil || since < 0 {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid since")
+			return
+		}
+	}
+	limit := 10000
+	if limitStr := request.Form.Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			limit = 10000
+		} else if limit > 10000 {
+			srv.StandardResponse(writer, http.StatusPreconditionFailed)
+			return
+		}
+	}
+	records, err := rdb.ItemsSince(since, limit)
+	if err != nil {
+		srv.GetLogger(request).Error("Unable to list changes.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(records)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	headers := writer.Header()
+	headers.Set("X-Container-Changes-Id", info.ID)
+	headers.Set("X-Container-Changes-Max-Row", strconv.FormatInt(info.MaxRow, 10))
+	headers.Set("Content-Type", "application/json; charset=utf-8")
+	headers.Set("Content-Length", strconv.Itoa(len(output)))
+	writer.WriteHeader(200)
+	writer.Write(output)
+}
+
+func listingName(item interface{}) string {
+	switch r := item.(type) {
+	case *ObjectListingRecord:
+		return r.Name
+	case *SubdirListingRecord:
+		return r.Name
+	}
+	return ""
+}
+
+// mergeListings merges two listings in the same order into one of at most
+// limit items, keeping a's item for any name in both.
+func mergeListings(a, b []interface{}, limit int, reverse bool) []interface{} {
+	merged := make([]interface{}, 0, len(a)+len(b))
+	for len(merged) < limit && (len(a) > 0 || len(b) > 0) {
+		if len(b) == 0 {
+			merged, a = append(merged, a[0]), a[1:]
+		} else if len(a) == 0 {
+			merged, b = append(merged, b[0]), b[1:]
+		} else if an, bn := listingName(a[0]), listingName(b[0]); an == bn {
+			merged, a, b = append(merged, a[0]), a[1:], b[1:]
+		} else if (an < bn) != reverse {
+			merged, a = append(merged, a[0]), a[1:]
+		} else {
+			merged, b = append(merged, b[0]), b[1:]
+		}
+	}
+	return merged
+}
+
 // ContainerPutHandler handles PUT requests for a container.
 func (server *ContainerServer) ContainerPutHandler(writer http.ResponseWriter, request *http.Request) {
 	vars := srv.GetVars(request)
@@ -387,6 +501,19 @@ func (server *ContainerServer) ContainerPostHandler(writer http.ResponseWriter,
 		srv.StandardResponse(writer, http.StatusNotFound)
 		return
 	}
+	// The storage policy is only changed like this to migrate the container.
+	if value := request.Header.Get(common.PolicyMigrationHeader); value != "" {
+		migration, err := common.ParsePolicyMigration(value)
+		if err != nil || migration.To < 0 {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+			return
+		}
+		if err := db.SetStoragePolicy(migration.To, timestamp); err != nil {
+			srv.GetLogger(request).Error("Unable to set storage policy.", zap.Error(err))
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+	}
 	if err := db.UpdateMetadata(updates, timestamp); err == ErrorInvalidMetadata {
 		srv.StandardResponse(writer, http.StatusBadRequest)
 	} else if err != nil {
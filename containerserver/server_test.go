@@ -18,6 +18,7 @@ package containerserver
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"net/http"
 	"testing"
 
@@ -338,6 +339,180 @@ func TestContainerPutObjectsGet(t *testing.T) {
 	// TODO parse and validate xml.  or maybe we won't do that.
 }
 
+func TestContainerPolicyMigration(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	putObject := func(name string, policy string) {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("PUT", "/device/1/a/c/"+name, nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("X-Content-Type", "application/octet-stream")
+		req.Header.Set("X-Size", "2")
+		req.Header.Set("X-Etag", "d41d8cd98f00b204e9800998ecf8427e")
+		req.Header.Set("X-Backend-Storage-Policy-Index", policy)
+		handler.ServeHTTP(rsp, req)
+		require.Equal(t, 201, rsp.Status)
+	}
+	for _, name := range []string{"1", "2", "3"} {
+		putObject(name, "0")
+	}
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("POST", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000001.00001")
+	req.Header.Set(common.PolicyMigrationHeader, "0:2")
+	req.Header.Set(common.PolicyMigrationSysmeta, "0:2")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 204, rsp.Status)
+
+	// One object is moved and another written since the migration started.
+	putObject("2", "2")
+	putObject("4", "2")
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c?format=json", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	require.Equal(t, "2", rsp.Header().Get("X-Backend-Storage-Policy-Index"))
+	require.Equal(t, "0", rsp.Header().Get("X-Container-Policy-Migration-From"))
+	require.Equal(t, "3", rsp.Header().Get("X-Container-Policy-Migration-Objects-Remaining"))
+	require.Equal(t, "6", rsp.Header().Get("X-Container-Policy-Migration-Bytes-Remaining"))
+	require.Equal(t, "5", rsp.Header().Get("X-Container-Object-Count"))
+	var data []ObjectListingRecord
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &data))
+	require.Equal(t, 4, len(data))
+	for i, name := range []string{"1", "2", "3", "4"} {
+		require.Equal(t, name, data[i].Name)
+	}
+
+	// A listing of one policy is only of that policy.
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c?format=json", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	data = nil
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &data))
+	require.Equal(t, 3, len(data))
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("POST", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000002.00001")
+	req.Header.Set(common.PolicyMigrationHeader, "nope")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 400, rsp.Status)
+
+	// The policy index alone doesn't change the policy.
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("POST", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000003.00001")
+	req.Header.Set("X-Backend-Storage-Policy-Index", "1")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 204, rsp.Status)
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("HEAD", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, "2", rsp.Header().Get("X-Backend-Storage-Policy-Index"))
+}
+
+func TestContainerChanges(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	for _, name := range []string{"1", "2", "3"} {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("PUT", "/device/1/a/c/"+name, nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("X-Content-Type", "text/plain")
+		req.Header.Set("X-Size", "2")
+		req.Header.Set("X-Etag", "d41d8cd98f00b204e9800998ecf8427e")
+		handler.ServeHTTP(rsp, req)
+		require.Equal(t, 201, rsp.Status)
+	}
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("DELETE", "/device/1/a/c/1", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 204, rsp.Status)
+
+	changes := func(query string) []ObjectRecord {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("GET", "/device/1/a/c?changes&"+query, nil)
+		require.Nil(t, err)
+		handler.ServeHTTP(rsp, req)
+		require.Equal(t, 200, rsp.Status)
+		require.NotEqual(t, "", rsp.Header().Get("X-Container-Changes-Id"))
+		var records []ObjectRecord
+		require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &records))
+		return records
+	}
+	records := changes("")
+	require.Equal(t, 3, len(records))
+	// The deleted object's tombstone is the latest change.
+	require.Equal(t, "2", records[0].Name)
+	require.Equal(t, "3", records[1].Name)
+	require.Equal(t, "1", records[2].Name)
+	require.Equal(t, 1, records[2].Deleted)
+	require.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", records[0].ETag)
+
+	records = changes(fmt.Sprintf("since=%d&limit=1", records[0].Rowid))
+	require.Equal(t, 1, len(records))
+	require.Equal(t, "3", records[0].Name)
+	require.Equal(t, 0, len(changes(fmt.Sprintf("since=%d", records[0].Rowid+1))))
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c?changes&since=nope", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 400, rsp.Status)
+}
+
+func TestMergeListings(t *testing.T) {
+	names := func(items []interface{}) []string {
+		var n []string
+		for _, item := range items {
+			n = append(n, listingName(item))
+		}
+		return n
+	}
+	a := []interface{}{&ObjectListingRecord{Name: "a"}, &SubdirListingRecord{Name: "b/"}, &ObjectListingRecord{Name: "d"}}
+	b := []interface{}{&ObjectListingRecord{Name: "a", Size: 1}, &ObjectListingRecord{Name: "c"}, &ObjectListingRecord{Name: "e"}}
+	merged := mergeListings(a, b, 10, false)
+	require.Equal(t, []string{"a", "b/", "c", "d", "e"}, names(merged))
+	require.Equal(t, int64(0), merged[0].(*ObjectListingRecord).Size)
+	require.Equal(t, []string{"a", "b/"}, names(mergeListings(a, b, 2, false)))
+	ra := []interface{}{a[2], a[1], a[0]}
+	rb := []interface{}{b[2], b[1], b[0]}
+	require.Equal(t, []string{"e", "d", "c", "b/", "a"}, names(mergeListings(ra, rb, 10, true)))
+}
+
 func TestContainerPutObjectsFails(t *testing.T) {
 	server, handler, cleanup, err := makeTestServer2()
 	require.Nil(t, err)
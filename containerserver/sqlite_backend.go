@@ -26,6 +26,7 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
+	"mime"
 	"os"
 	"path"
 	"path/filepath"
@@ -337,7 +338,40 @@ func updateRecord(rec *ObjectListingRecord) error {
 
 	rec.ContentType, rec.Size, err = common.ParseContentTypeForSlo(
 		rec.ContentType, rec.Size)
-	return err
+	if err != nil {
+		return err
+	}
+	updateSymlinkRecord(rec)
+	return nil
+}
+
+// updateSymlinkRecord moves the symlink_target* parameters the symlink
+// middleware adds to a symlink's listed content type into the record's symlink
+// fields. Anything it can't parse is left as it is rather than failing the
+// whole listing.
+func updateSymlinkRecord(rec *ObjectListingRecord) {
+	if !strings.Contains(rec.ContentType, "symlink_target") {
+		return
+	}
+	contentType, params, err := mime.ParseMediaType(rec.ContentType)
+	if err != nil {
+		return
+	}
+	target, ok := params["symlink_target"]
+	if !ok {
+		return
+	}
+	rec.SymlinkPath = fmt.Sprintf("/v1/%s/%s", params["symlink_target_account"], target)
+	if etag, ok := params["symlink_target_etag"]; ok {
+		rec.SymlinkEtag = etag
+		if bytes, err := strconv.ParseInt(params["symlink_target_bytes"], 10, 64); err == nil {
+			rec.SymlinkBytes = &bytes
+		}
+	}
+	for _, param := range []string{"symlink_target", "symlink_target_account", "symlink_target_etag", "symlink_target_bytes"} {
+		delete(params, param)
+	}
+	rec.ContentType = mime.FormatMediaType(contentType, params)
 }
 
 // ListObjects implements object listings.  Path is a string pointer because behavior is different for empty and missing path query parameters.
@@ -570,6 +604,80 @@ func (db *sqliteContainer) UpdateMetadata(newMetadata map[string][]string, times
 	return tx.Commit()
 }
 
+// storagePolicyMetaKey is the metadata entry SetStoragePolicy records a
+// change of storage policy in, so that replication carries the change to the
+// other replicas with the rest of the metadata.  The object server and proxy
+// know the header it becomes, and clients never see it.
+const storagePolicyMetaKey = "X-Backend-Storage-Policy-Index"
+
+// changedStoragePolicy returns the storage policy of the newest change in the
+// metadata, if there's been one since the container was last deleted.
+func changedStoragePolicy(deleteTimestamp string, metas ...map[string][]string) (int, bool) {
+	var newest []string
+	for _, meta := range metas {
+		if v, ok := meta[storagePolicyMetaKey]; ok && len(v) == 2 && v[0] != "" && v[1] >= deleteTimestamp && (newest == nil || v[1] > newest[1]) {
+			newest = v
+		}
+	}
+	if newest == nil {
+		return 0, false
+	}
+	policy, err := strconv.Atoi(newest[0])
+	return policy, err == nil
+}
+
+// SetStoragePolicy changes the container's storage policy, as when it's being
+// migrated to another one, unless it's already been changed since timestamp.
+// Objects already recorded in the old policy are left where they are.
+func (db *sqliteContainer) SetStoragePolicy(storagePolicyIndex int, timestamp string) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var metadataValue, deleteTimestamp string
+	if err := tx.QueryRow("SELECT metadata, delete_timestamp FROM container_info").Scan(&metadataValue, &deleteTimestamp); err != nil {
+		return err
+	}
+	existingMetadata := map[string][]string{}
+	if metadataValue != "" {
+		if err := json.Unmarshal([]byte(metadataValue), &existingMetadata); err != nil {
+			return err
+		}
+	}
+	change := map[string][]string{storagePolicyMetaKey: {strconv.Itoa(storagePolicyIndex), timestamp}}
+	policy, _ := changedStoragePolicy(deleteTimestamp, existingMetadata, change)
+	metastr, err := db.mergeMetas(existingMetadata, change, deleteTimestamp)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("UPDATE container_info SET metadata = ?, storage_policy_index = ?", metastr, policy); err != nil {
+		return err
+	}
+	defer db.invalidateCache()
+	return tx.Commit()
+}
+
+// PolicyStats returns the count and bytes used of the container's objects in
+// a storage policy.
+func (db *sqliteContainer) PolicyStats(storagePolicyIndex int) (int64, int64, error) {
+	if err := db.connect(); err != nil {
+		return 0, 0, err
+	}
+	if err := db.flush(); err != nil {
+		return 0, 0, err
+	}
+	var objectCount, bytesUsed int64
+	if err := db.QueryRow("SELECT object_count, bytes_used FROM policy_stat WHERE storage_policy_index = ?",
+		storagePolicyIndex).Scan(&objectCount, &bytesUsed); err != nil && err != sql.ErrNoRows {
+		return 0, 0, err
+	}
+	return objectCount, bytesUsed, nil
+}
+
 // MergeSyncTable updates the container's current incoming_sync table records.
 func (db *sqliteContainer) MergeSyncTable(records []*SyncRecord) error {
 	if err := db.connect(); err != nil {
@@ -698,6 +806,12 @@ func (db *sqliteContainer) SyncRemoteData(maxRow int64, hash, id, createdAt, put
 		createdAt, putTimestamp, deleteTimestamp, metastr); err != nil {
 		return nil, err
 	}
+	// A change of storage policy this replica missed comes with the metadata.
+	if policy, ok := changedStoragePolicy(localDeleteTimestamp, lm, rm); ok {
+		if _, err = tx.Exec("UPDATE container_info SET storage_policy_index = ?", policy); err != nil {
+			return nil, err
+		}
+	}
 	if err := tx.QueryRow("SELECT IFNULL(MAX(sync_point), -1) FROM incoming_sync WHERE remote_id = ?", id).Scan(&localPoint); err != nil {
 		return nil, err
 	}
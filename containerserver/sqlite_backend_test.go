@@ -91,6 +91,34 @@ func TestContainerUpdateRecord(t *testing.T) {
 	require.NotNil(t, updateRecord(rec))
 }
 
+func TestContainerUpdateRecordSymlink(t *testing.T) {
+	rec := &ObjectListingRecord{Name: "a", ContentType: `text/plain; symlink_target="c/o"; symlink_target_account=AUTH_a`, LastModified: "1.0"}
+	require.Nil(t, updateRecord(rec))
+	require.Equal(t, "text/plain", rec.ContentType)
+	require.Equal(t, "/v1/AUTH_a/c/o", rec.SymlinkPath)
+	require.Equal(t, "", rec.SymlinkEtag)
+	require.Nil(t, rec.SymlinkBytes)
+
+	rec = &ObjectListingRecord{Name: "a", ContentType: `text/plain; charset=utf-8; symlink_target="c/o"; symlink_target_account=AUTH_a; symlink_target_etag=abc; symlink_target_bytes=10`, LastModified: "1.0"}
+	require.Nil(t, updateRecord(rec))
+	require.Equal(t, "text/plain; charset=utf-8", rec.ContentType)
+	require.Equal(t, "/v1/AUTH_a/c/o", rec.SymlinkPath)
+	require.Equal(t, "abc", rec.SymlinkEtag)
+	require.Equal(t, int64(10), *rec.SymlinkBytes)
+
+	rec = &ObjectListingRecord{Name: "a", ContentType: `text/plain; symlink_target="c/o"; symlink_target_account=AUTH_a; symlink_target_etag=abc; symlink_target_bytes=X`, LastModified: "1.0"}
+	require.Nil(t, updateRecord(rec))
+	require.Equal(t, "text/plain", rec.ContentType)
+	require.Equal(t, "/v1/AUTH_a/c/o", rec.SymlinkPath)
+	require.Equal(t, "abc", rec.SymlinkEtag)
+	require.Nil(t, rec.SymlinkBytes)
+
+	rec = &ObjectListingRecord{Name: "a", ContentType: `text/plain; symlink_target="c/o`, LastModified: "1.0"}
+	require.Nil(t, updateRecord(rec))
+	require.Equal(t, `text/plain; symlink_target="c/o`, rec.ContentType)
+	require.Equal(t, "", rec.SymlinkPath)
+}
+
 func TestContainerListingsLimit(t *testing.T) {
 	db, _, cleanup, err := createTestDatabase("100000000.00000")
 	require.Nil(t, err)
@@ -610,6 +638,41 @@ func TestSyncRemoteData(t *testing.T) {
 	require.Equal(t, 0, len(meta))
 }
 
+func TestSetStoragePolicyReplicates(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("1000.0001")
+	require.Nil(t, err)
+	defer cleanup()
+	other, _, otherCleanup, err := createTestDatabase("1000.0001")
+	require.Nil(t, err)
+	defer otherCleanup()
+
+	require.Nil(t, db.SetStoragePolicy(2, "2000.0001"))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, 2, info.StoragePolicyIndex)
+
+	// The replica that missed the change picks it up with the metadata.
+	_, err = other.SyncRemoteData(0, "00000000000000000000000000000000", info.ID, info.CreatedAt, info.PutTimestamp, info.DeleteTimestamp, info.RawMetadata)
+	require.Nil(t, err)
+	otherInfo, err := other.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, 2, otherInfo.StoragePolicyIndex)
+
+	// An older change doesn't undo a newer one.
+	require.Nil(t, other.SetStoragePolicy(1, "1500.0001"))
+	otherInfo, err = other.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, 2, otherInfo.StoragePolicyIndex)
+
+	// Nor does one from before the container was deleted.
+	require.Nil(t, db.Delete("3000.0001"))
+	_, err = db.SyncRemoteData(0, "00000000000000000000000000000000", otherInfo.ID, otherInfo.CreatedAt, otherInfo.PutTimestamp, otherInfo.DeleteTimestamp, otherInfo.RawMetadata)
+	require.Nil(t, err)
+	meta, err := db.GetMetadata()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(meta))
+}
+
 func TestCreateExistingNoPolicy(t *testing.T) {
 	db, _, cleanup, err := createTestDatabase("200000000.00000")
 	require.Nil(t, err)
@@ -105,6 +105,7 @@ func (f *ecEngine) New(vars map[string]string, needData bool, asyncWG *sync.Wait
 		metadata:        map[string]string{},
 		nurseryReplicas: f.nurseryReplicas,
 		txnId:           vars["txnId"],
+		traceparent:     vars["traceparent"],
 	}
 	if idb, err := f.getDB(vars["device"]); err == nil {
 		obj.idb = idb
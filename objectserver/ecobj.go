@@ -35,6 +35,7 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/fs"
 	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/tracing"
 )
 
 type ecObject struct {
@@ -52,6 +53,27 @@ type ecObject struct {
 	client          *http.Client
 	nurseryReplicas int
 	txnId           string
+	traceparent     string
+}
+
+// fragmentDo sends a request for one of the object's fragments, tracing it as
+// part of the request for the object.
+func (o *ecObject) fragmentDo(req *http.Request, shard int) (*http.Response, error) {
+	if o.traceparent != "" {
+		req.Header.Set("Traceparent", o.traceparent)
+	}
+	span := tracing.Default().StartChildSpan("fragment "+req.Method, tracing.KindClient, req.Header)
+	span.SetAttribute("net.peer.name", req.URL.Host)
+	span.SetAttribute("shard", shard)
+	span.Inject(req.Header)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		span.SetError(err)
+	} else {
+		span.SetStatus(resp.StatusCode)
+	}
+	span.Finish()
+	return resp, err
 }
 
 func (o *ecObject) Metadata() map[string]string {
@@ -136,7 +158,7 @@ func (o *ecObject) Copy(dsts ...io.Writer) (written int64, err error) {
 		}
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("X-Trans-Id", o.txnId)
-		resp, err := o.client.Do(req)
+		resp, err := o.fragmentDo(req, i)
 		if err != nil {
 			continue
 		}
@@ -196,7 +218,7 @@ func (o *ecObject) CopyRange(w io.Writer, start int64, end int64) (int64, error)
 		}
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", shardStart, shardEnd))
-		resp, err := o.client.Do(req)
+		resp, err := o.fragmentDo(req, i)
 		if err != nil {
 			continue
 		}
@@ -302,7 +324,7 @@ func (o *ecObject) Reconstruct() error {
 			continue
 		}
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
-		resp, err := o.client.Do(req)
+		resp, err := o.fragmentDo(req, i)
 		if err != nil {
 			o.logger.Error("client.Do failed", zap.String("url", url))
 			failed[i] = node
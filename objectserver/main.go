@@ -356,7 +356,7 @@ func (server *ObjectServer) ObjPostHandler(writer http.ResponseWriter, request *
 	}
 	var deleteAtTime time.Time
 	if deleteAt := request.Header.Get("X-Delete-At"); deleteAt != "" {
-		if deleteAtTime, err := common.ParseDate(deleteAt); err != nil || deleteAtTime.Before(time.Now()) {
+		if deleteAtTime, err = common.ParseDate(deleteAt); err != nil || deleteAtTime.Before(time.Now()) {
 			http.Error(writer, "X-Delete-At in past", 400)
 			return
 		}
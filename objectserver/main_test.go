@@ -503,6 +503,50 @@ func TestEmptyObject(t *testing.T) {
 	assert.Equal(t, 400, resp.StatusCode)
 }
 
+func TestPostDeleteAt(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBuffer([]byte("SOME DATA")))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Length", "9")
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 201, resp.StatusCode)
+
+	deleteAt := time.Now().Unix() + 30
+	req, err = http.NewRequest("POST", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Delete-At", strconv.FormatInt(deleteAt, 10))
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 202, resp.StatusCode)
+
+	// With no X-Delete-At-Host, the expiring objects update is saved for later.
+	asyncs, err := filepath.Glob(filepath.Join(ts.root, "sda", "async_pending", "*", "*"))
+	require.Nil(t, err)
+	found := false
+	for _, async := range asyncs {
+		data, err := ioutil.ReadFile(async)
+		require.Nil(t, err)
+		a, err := pickle.PickleLoads(data)
+		require.Nil(t, err)
+		asyncData := a.(map[interface{}]interface{})
+		if asyncData["account"] == ".expiring_objects" {
+			found = true
+			require.Equal(t, "PUT", asyncData["op"])
+			require.Equal(t, fmt.Sprintf("%010d-a/c/o", deleteAt), asyncData["obj"])
+		}
+	}
+	require.True(t, found)
+}
+
 func TestBasicPutDeleteAt(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
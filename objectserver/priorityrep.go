@@ -147,8 +147,8 @@ func doPriRepJobs(jobs []*PriorityRepJob, deviceMax int, client *http.Client) []
 	return badParts
 }
 
-// getPartMoveJobs takes two rings and creates a list of jobs for any partition moves between them.
-func getPartMoveJobs(oldRing, newRing ring.Ring, overrideParts []uint64, policy int) []*PriorityRepJob {
+// GetPartMoveJobs takes two rings and creates a list of jobs for any partition moves between them.
+func GetPartMoveJobs(oldRing, newRing ring.Ring, overrideParts []uint64, policy int) []*PriorityRepJob {
 	allNewDevices := map[string]bool{}
 	for _, dev := range newRing.AllDevices() {
 		if dev == nil {
@@ -172,6 +172,10 @@ func getPartMoveJobs(oldRing, newRing ring.Ring, overrideParts []uint64, policy
 			break
 		}
 		for i := range olddevs {
+			if i >= len(newdevs) {
+				// replica count was reduced; nothing to move
+				break
+			}
 			if olddevs[i].Id != newdevs[i].Id {
 				// TODO: handle if a node just changes positions, which doesn't happen, but isn't against the contract.
 				fromDev := olddevs[i]
@@ -269,7 +273,7 @@ func doMoveParts(args []string, cnf srv.ConfigLoader) int {
 	}
 	badParts := []uint64{}
 	for {
-		jobs := getPartMoveJobs(oldRing, curRing, badParts, *policy)
+		jobs := GetPartMoveJobs(oldRing, curRing, badParts, *policy)
 		lastRun := len(jobs)
 		for i := len(jobs) - 1; i > 0; i-- { // shuffle jobs list
 			j := rand.Intn(i + 1)
@@ -106,7 +106,7 @@ func TestGetPartMoveJobs(t *testing.T) {
 	devs = append(devs, &ring.Device{Id: 10, Device: "drive10", Ip: "127.0.0.1", Port: 10})
 	newRing.fakeDevs = devs
 
-	jobs := getPartMoveJobs(oldRing, newRing, []uint64{}, 3)
+	jobs := GetPartMoveJobs(oldRing, newRing, []uint64{}, 3)
 	require.EqualValues(t, 2, len(jobs))
 	require.EqualValues(t, 0, jobs[0].Partition)
 	require.EqualValues(t, 1, jobs[0].FromDevice.Id)
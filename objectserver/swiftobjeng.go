@@ -40,6 +40,7 @@ import (
 	"github.com/troubling/hummingbird/common/pickle"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 )
 
 func getFile(filePath string) (fp *os.File, xattrs []byte, size int64, err error) {
@@ -356,9 +357,12 @@ func (rd *swiftDevice) PriorityReplicate(w http.ResponseWriter, pri PriorityRepJ
 
 func (rd *swiftDevice) beginReplication(dev *ring.Device, partition string, hashes bool, rChan chan beginReplicationResponse, headers map[string]string) {
 	var brr BeginReplicationResponse
-	if headers == nil {
-		headers = map[string]string{}
+	// The job's headers are shared by the connections to each node.
+	reqHeaders := map[string]string{}
+	for k, v := range headers {
+		reqHeaders[k] = v
 	}
+	headers = reqHeaders
 	headers["X-Trans-Id"] = fmt.Sprintf("%s-%d", common.UUID(), dev.Id)
 
 	if rc, err := NewRepConn(dev, partition, rd.policy, headers, rd.r.CertFile, rd.r.KeyFile, rd.r.rcTimeout); err != nil {
@@ -563,13 +567,25 @@ func (rd *swiftDevice) replicatePartition(partition string) {
 	if policy == nil {
 		return
 	}
-	rjob := replJob{partition: partition, nodes: nodes}
+	span := tracing.Default().StartSpan("replicate partition", tracing.KindInternal, tracing.SpanContext{})
+	span.SetAttribute("device", rd.dev.Device)
+	span.SetAttribute("partition", partition)
+	span.SetAttribute("policy", rd.policy)
+	span.SetAttribute("handoff", handoff)
+	rjob := replJob{partition: partition, nodes: nodes, headers: map[string]string{}}
+	if span != nil {
+		rjob.headers["Traceparent"] = span.Context().Traceparent()
+	}
+	var syncs int64
 	if handoff || (policy.Type == "replication-nursery" &&
 		!common.LooksTrue(policy.Config["cache_hash_dirs"])) {
-		rd.i.replicateAll(rjob, handoff)
+		syncs, err = rd.i.replicateAll(rjob, handoff)
 	} else {
-		rd.i.replicateUsingHashes(rjob, rd.r.objectRings[rd.policy].GetMoreNodes(partitioni))
+		syncs, err = rd.i.replicateUsingHashes(rjob, rd.r.objectRings[rd.policy].GetMoreNodes(partitioni))
 	}
+	span.SetAttribute("synced", syncs)
+	span.SetError(err)
+	span.Finish()
 	rd.UpdateStat("PartitionsDone", 1)
 }
 
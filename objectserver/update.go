@@ -106,6 +106,16 @@ func (server *ObjectServer) saveAsync(method, account, container, obj, localDevi
 	logger.Error("Error saving obj async", zap.String("objPath", fmt.Sprintf("%s/%s/%s", account, container, obj)), zap.Error(err))
 }
 
+// containerUpdateValue returns the value to send in container updates for a
+// piece of object metadata, letting middleware replace it with an
+// X-Object-Sysmeta-Container-Update-Override-* value.
+func containerUpdateValue(metadata map[string]string, key string, override string) string {
+	if v, ok := metadata["X-Object-Sysmeta-Container-Update-Override-"+override]; ok {
+		return v
+	}
+	return metadata[key]
+}
+
 func (server *ObjectServer) updateContainer(metadata map[string]string, request *http.Request, vars map[string]string, logger srv.LowLevelLogger) {
 	partition := request.Header.Get("X-Container-Partition")
 	hosts := splitHeader(request.Header.Get("X-Container-Host"))
@@ -125,9 +135,9 @@ func (server *ObjectServer) updateContainer(metadata map[string]string, request
 		"X-Timestamp":                    {request.Header.Get("X-Timestamp")},
 	}
 	if request.Method != "DELETE" {
-		requestHeaders.Add("X-Content-Type", metadata["Content-Type"])
-		requestHeaders.Add("X-Size", metadata["Content-Length"])
-		requestHeaders.Add("X-Etag", metadata["ETag"])
+		requestHeaders.Add("X-Content-Type", containerUpdateValue(metadata, "Content-Type", "Content-Type"))
+		requestHeaders.Add("X-Size", containerUpdateValue(metadata, "Content-Length", "Size"))
+		requestHeaders.Add("X-Etag", containerUpdateValue(metadata, "ETag", "Etag"))
 	}
 	failures := 0
 	for index := range hosts {
@@ -202,6 +202,44 @@ func TestUpdateContainer(t *testing.T) {
 	require.Equal(t, asyncData["obj"], "o")
 }
 
+func TestUpdateContainerOverride(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	server := ts.objServer
+	defer ts.Close()
+
+	requestSent := false
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "text/plain;symlink_target=c2/o2", r.Header.Get("X-Content-Type"))
+		require.Equal(t, "30", r.Header.Get("X-Size"))
+		require.Equal(t, "eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee", r.Header.Get("X-Etag"))
+		requestSent = true
+	}))
+	defer cs.Close()
+	u, err := url.Parse(cs.URL)
+	require.Nil(t, err)
+	req, err := http.NewRequest("PUT", "/I/dont/think/this/matters", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-Container-Partition", "1")
+	req.Header.Add("X-Container-Host", u.Host)
+	req.Header.Add("X-Container-Device", "sdb")
+	req.Header.Add("X-Timestamp", "12345.6789")
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
+	req = srv.SetVars(req, vars)
+	metadata := map[string]string{
+		"X-Timestamp":    "12345.789",
+		"Content-Type":   "text/plain",
+		"Content-Length": "30",
+		"ETag":           "ffffffffffffffffffffffffffffffff",
+		"X-Object-Sysmeta-Container-Update-Override-Content-Type": "text/plain;symlink_target=c2/o2",
+		"X-Object-Sysmeta-Container-Update-Override-Etag":         "eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee",
+	}
+	server.updateContainer(metadata, req, vars, zap.NewNop())
+	require.True(t, requestSent)
+}
+
 func TestUpdateContainerNoHeaders(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
@@ -34,6 +34,8 @@ var listingQueryParms = map[string]bool{
 	"delimiter":  true,
 	"reverse":    true,
 	"path":       true,
+	"changes":    true,
+	"since":      true,
 }
 
 func (server *ProxyServer) ContainerGetHandler(writer http.ResponseWriter, request *http.Request) {
@@ -16,6 +16,7 @@
 package proxyserver
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -46,6 +47,85 @@ type ProxyServer struct {
 	accountAutoCreate bool
 	proxyDirectClient *client.ProxyDirectClient
 	metricsCloser     io.Closer
+	config            conf.Config
+	pipeline          []alice.Constructor
+}
+
+var defaultTempAuthPipeline = []string{"catch_errors", "gatekeeper", "healthcheck", "proxy-logging", "crossdomain", "cors", "formpost",
+	"tempurl", "s3api", "tempauth", "bulk", "multirange", "ratelimit", "staticweb", "copy", "multipart",
+	"container-quotas", "account_quotas", "lifecycle", "versioned_writes", "slo", "symlink", "notifications"}
+
+var defaultKeystonePipeline = []string{"catch_errors", "gatekeeper", "healthcheck", "proxy-logging", "crossdomain", "cors", "formpost",
+	"tempurl", "s3api", "authtoken", "keystoneauth", "bulk", "multirange", "ratelimit", "staticweb", "copy",
+	"multipart", "container-quotas", "account_quotas", "lifecycle", "versioned_writes", "slo", "symlink", "notifications"}
+
+// loadPipeline constructs the middleware in the proxy pipeline, from the
+// pipeline setting if there is one, returning their names along with them.
+func loadPipeline(config conf.Config, metricsScope tally.Scope) ([]string, []alice.Constructor, error) {
+	var names []string
+	if p, ok := config.Get("app:proxy-server", "pipeline"); ok {
+		names = strings.Fields(p)
+	} else if config.GetBool("proxy-server", "tempauth_enabled", true) {
+		names = defaultTempAuthPipeline
+	} else {
+		names = defaultKeystonePipeline
+	}
+	names = requireGatekeeper(names)
+	seen := map[string]bool{}
+	pipeline := make([]alice.Constructor, 0, len(names))
+	for _, name := range names {
+		construct, ok := middleware.GetMiddleware(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("Unknown middleware %q in pipeline, available middleware: %s", name, strings.Join(middleware.RegisteredMiddleware(), " "))
+		}
+		if seen[name] {
+			return nil, nil, fmt.Errorf("Middleware %q is in the pipeline more than once", name)
+		}
+		seen[name] = true
+		mid, err := construct(config.GetSection("filter:"+name), metricsScope)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to construct middleware %s: %v", name, err)
+		}
+		pipeline = append(pipeline, mid)
+	}
+	return names, pipeline, nil
+}
+
+// requireGatekeeper returns the pipeline with gatekeeper added after
+// catch_errors, or first if there's no catch_errors, if it isn't there
+// already, since without it clients could send the headers the backend
+// servers trust.
+func requireGatekeeper(names []string) []string {
+	at := 0
+	for i, name := range names {
+		if name == "gatekeeper" {
+			return names
+		}
+		if name == "catch_errors" {
+			at = i + 1
+		}
+	}
+	withGatekeeper := make([]string, 0, len(names)+1)
+	withGatekeeper = append(withGatekeeper, names[:at]...)
+	withGatekeeper = append(withGatekeeper, "gatekeeper")
+	return append(withGatekeeper, names[at:]...)
+}
+
+// configureNodeTracker sets up the direct client's error limiting and timing
+// of backend nodes from the [app:proxy-server] config.
+func configureNodeTracker(tracker *client.NodeTracker, config conf.Config) error {
+	tracker.ErrorLimit = int(config.GetInt("app:proxy-server", "error_suppression_limit", 10))
+	tracker.ErrorInterval = time.Duration(config.GetFloat("app:proxy-server", "error_suppression_interval", 60) * float64(time.Second))
+	tracker.TimingExpiry = time.Duration(config.GetFloat("app:proxy-server", "timing_expiry", 300) * float64(time.Second))
+	switch sortingMethod := config.GetDefault("app:proxy-server", "sorting_method", "shuffle"); sortingMethod {
+	case "shuffle":
+		tracker.Timing = false
+	case "timing":
+		tracker.Timing = true
+	default:
+		return fmt.Errorf("Invalid sorting_method %q, must be shuffle or timing", sortingMethod)
+	}
+	return nil
 }
 
 func (server *ProxyServer) Type() string {
@@ -62,8 +142,21 @@ func (server *ProxyServer) Finalize() {
 	}
 }
 
-func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
-	obfuscatedPrefix, _ := config.Get("proxy-server", "obfuscated_prefix")
+// ErrorLimitsHandler lists the backend nodes that are currently error limited.
+func (server *ProxyServer) ErrorLimitsHandler(writer http.ResponseWriter, request *http.Request) {
+	data, err := json.Marshal(server.proxyDirectClient.NodeTracker.LimitedNodes())
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(data)
+}
+
+// SetupMetrics creates the server's metrics scope with the prefix RunServers
+// chose for it and constructs the middleware, which report to it, once.
+func (server *ProxyServer) SetupMetrics(metricsPrefix string) error {
 	var metricsScope tally.Scope
 	metricsScope, server.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
 		Prefix:         metricsPrefix,
@@ -71,11 +164,24 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
 		Separator:      promreporter.DefaultSeparator,
 	}, time.Second)
+	server.proxyDirectClient.NodeTracker.SetMetricsScope(metricsScope)
+	var err error
+	if _, server.pipeline, err = loadPipeline(server.config, metricsScope); err != nil {
+		server.metricsCloser.Close()
+		server.metricsCloser = nil
+		return err
+	}
+	return nil
+}
+
+func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
+	obfuscatedPrefix, _ := config.Get("proxy-server", "obfuscated_prefix")
 	router := srv.NewRouter()
 	if obfuscatedPrefix != "" {
 		router.Get(path.Join("/", obfuscatedPrefix, "metrics"), prometheus.Handler())
 		router.Get(path.Join("/", obfuscatedPrefix, "loglevel"), server.logLevel)
 		router.Put(path.Join("/", obfuscatedPrefix, "loglevel"), server.logLevel)
+		router.Get(path.Join("/", obfuscatedPrefix, "errorlimits"), http.HandlerFunc(server.ErrorLimitsHandler))
 		router.Get(path.Join("/", obfuscatedPrefix, "debug/pprof/:parm"), http.DefaultServeMux)
 		router.Post(path.Join("/", obfuscatedPrefix, "debug/pprof/:parm"), http.DefaultServeMux)
 	}
@@ -112,69 +218,9 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 	router.Options("/v1/:account", http.HandlerFunc(server.OptionsHandler))
 	router.Options("/v1/:account/", http.HandlerFunc(server.OptionsHandler))
 
-	tempAuth := config.GetBool("proxy-server", "tempauth_enabled", true)
-	var middlewares []struct {
-		construct func(conf.Section, tally.Scope) (func(http.Handler) http.Handler, error)
-		section   string
-	}
-	// TODO: make this all dynamical and stuff
-	if tempAuth {
-		middlewares = []struct {
-			construct func(conf.Section, tally.Scope) (func(http.Handler) http.Handler, error)
-			section   string
-		}{
-			{middleware.NewCatchError, "filter:catch_errors"},
-			{middleware.NewHealthcheck, "filter:healthcheck"},
-			{middleware.NewRequestLogger, "filter:proxy-logging"},
-			{middleware.NewCrossDomain, "filter:crossdomain"},
-			{middleware.NewCors, "filter:cors"}, // TODO: i dont want to have to have a seciton for this
-			{middleware.NewFormPost, "filter:formpost"},
-			{middleware.NewTempURL, "filter:tempurl"},
-			{middleware.NewTempAuth, "filter:tempauth"},
-			{middleware.NewBulk, "filter:bulk"},
-			{middleware.NewMultirange, "filter:multirange"},
-			{middleware.NewRatelimiter, "filter:ratelimit"},
-			{middleware.NewStaticWeb, "filter:staticweb"},
-			{middleware.NewCopyMiddleware, "filter:copy"},
-			{middleware.NewContainerQuota, "filter:container-quotas"},
-			{middleware.NewVersionedWrites, "filter:versioned_writes"},
-			{middleware.NewXlo, "filter:slo"},
-		}
-	} else {
-		middlewares = []struct {
-			construct func(conf.Section, tally.Scope) (func(http.Handler) http.Handler, error)
-			section   string
-		}{
-			{middleware.NewCatchError, "filter:catch_errors"},
-			{middleware.NewHealthcheck, "filter:healthcheck"},
-			{middleware.NewRequestLogger, "filter:proxy-logging"},
-			{middleware.NewCrossDomain, "filter:crossdomain"},
-			{middleware.NewCors, "filter:cors"},
-			{middleware.NewFormPost, "filter:formpost"},
-			{middleware.NewTempURL, "filter:tempurl"},
-			{middleware.NewAuthToken, "filter:authtoken"},
-			{middleware.NewKeystoneAuth, "filter:keystoneauth"},
-			{middleware.NewBulk, "filter:bulk"},
-			{middleware.NewMultirange, "filter:multirange"},
-			{middleware.NewRatelimiter, "filter:ratelimit"},
-			{middleware.NewStaticWeb, "filter:staticweb"},
-			{middleware.NewCopyMiddleware, "filter:copy"},
-			{middleware.NewContainerQuota, "filter:container-quotas"},
-			{middleware.NewVersionedWrites, "filter:versioned_writes"},
-			{middleware.NewXlo, "filter:slo"},
-		}
-	}
 	pipeline := alice.New(middleware.NewContext(config.GetBool("debug", "debug_x_source_code", false),
 		server.mc, server.logger, server.proxyDirectClient))
-	for _, m := range middlewares {
-		mid, err := m.construct(config.GetSection(m.section), metricsScope)
-		if err != nil {
-			// TODO: propagate error upwards instead of panicking
-			panic("Unable to construct middleware")
-		}
-		pipeline = pipeline.Append(mid)
-	}
-	return pipeline.Then(router)
+	return pipeline.Append(server.pipeline...).Then(router)
 }
 
 func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader) (*srv.IpPort, srv.Server, srv.LowLevelLogger, error) {
@@ -206,6 +252,10 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	if err != nil {
 		return ipPort, nil, nil, fmt.Errorf("Error setting up proxyDirectClient: %v", err)
 	}
+	if err = configureNodeTracker(server.proxyDirectClient.NodeTracker, serverconf); err != nil {
+		return ipPort, nil, nil, err
+	}
+	server.config = serverconf
 	info := map[string]interface{}{
 		"version":                  common.Version,
 		"strict_cors_mode":         true,
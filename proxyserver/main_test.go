@@ -0,0 +1,140 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+	"github.com/troubling/hummingbird/proxyserver/middleware"
+	"github.com/uber-go/tally"
+)
+
+func init() {
+	middleware.RegisterMiddleware("test-broken", func(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+		return nil, errors.New("broken on purpose")
+	})
+}
+
+func TestLoadPipelineDefaults(t *testing.T) {
+	config, err := conf.StringConfig("[app:proxy-server]\n")
+	require.Nil(t, err)
+	names, _, err := loadPipeline(config, tally.NoopScope)
+	require.Nil(t, err)
+	require.Equal(t, defaultTempAuthPipeline, names)
+
+	config, err = conf.StringConfig("[proxy-server]\ntempauth_enabled = false\n")
+	require.Nil(t, err)
+	names, _, err = loadPipeline(config, tally.NoopScope)
+	require.Nil(t, err)
+	require.Equal(t, defaultKeystonePipeline, names)
+}
+
+func TestLoadPipeline(t *testing.T) {
+	config, err := conf.StringConfig("[app:proxy-server]\npipeline = catch_errors  healthcheck\ttempauth slo\n")
+	require.Nil(t, err)
+	names, pipeline, err := loadPipeline(config, tally.NoopScope)
+	require.Nil(t, err)
+	require.Equal(t, []string{"catch_errors", "gatekeeper", "healthcheck", "tempauth", "slo"}, names)
+	require.Equal(t, len(names), len(pipeline))
+
+	config, err = conf.StringConfig("[app:proxy-server]\npipeline = healthcheck gatekeeper tempauth\n")
+	require.Nil(t, err)
+	names, _, err = loadPipeline(config, tally.NoopScope)
+	require.Nil(t, err)
+	require.Equal(t, []string{"healthcheck", "gatekeeper", "tempauth"}, names)
+
+	config, err = conf.StringConfig("[app:proxy-server]\npipeline = healthcheck tempauth\n")
+	require.Nil(t, err)
+	names, _, err = loadPipeline(config, tally.NoopScope)
+	require.Nil(t, err)
+	require.Equal(t, []string{"gatekeeper", "healthcheck", "tempauth"}, names)
+
+	config, err = conf.StringConfig("[app:proxy-server]\npipeline = catch_errors nothere slo\n")
+	require.Nil(t, err)
+	_, _, err = loadPipeline(config, tally.NoopScope)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "nothere")
+
+	config, err = conf.StringConfig("[app:proxy-server]\npipeline = slo slo\n")
+	require.Nil(t, err)
+	_, _, err = loadPipeline(config, tally.NoopScope)
+	require.NotNil(t, err)
+
+	config, err = conf.StringConfig("[app:proxy-server]\npipeline = catch_errors test-broken\n")
+	require.Nil(t, err)
+	_, _, err = loadPipeline(config, tally.NoopScope)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "broken on purpose")
+}
+
+func TestConfigureNodeTracker(t *testing.T) {
+	tracker := client.NewNodeTracker()
+	config, err := conf.StringConfig("[app:proxy-server]\n")
+	require.Nil(t, err)
+	require.Nil(t, configureNodeTracker(tracker, config))
+	require.Equal(t, 10, tracker.ErrorLimit)
+	require.Equal(t, time.Minute, tracker.ErrorInterval)
+	require.False(t, tracker.Timing)
+
+	config, err = conf.StringConfig("[app:proxy-server]\nerror_suppression_limit = 3\nerror_suppression_interval = 1.5\nsorting_method = timing\ntiming_expiry = 30\n")
+	require.Nil(t, err)
+	require.Nil(t, configureNodeTracker(tracker, config))
+	require.Equal(t, 3, tracker.ErrorLimit)
+	require.Equal(t, 1500*time.Millisecond, tracker.ErrorInterval)
+	require.True(t, tracker.Timing)
+	require.Equal(t, 30*time.Second, tracker.TimingExpiry)
+
+	config, err = conf.StringConfig("[app:proxy-server]\nsorting_method = fastest\n")
+	require.Nil(t, err)
+	require.NotNil(t, configureNodeTracker(tracker, config))
+}
+
+func TestTwoServersOneProcess(t *testing.T) {
+	// RunServers gives each of several configs its own metrics prefix, and
+	// the servers must each be able to register their metrics under it.
+	for _, port := range []int{18080, 18081} {
+		config, err := conf.StringConfig(fmt.Sprintf("[DEFAULT]\nbind_ip = 127.0.0.1\nbind_port = %d\n[app:proxy-server]\n", port))
+		require.Nil(t, err)
+		ipPort, server, _, err := NewServer(config, &flag.FlagSet{}, srv.NewTestConfigLoader(&test.FakeRing{}))
+		require.Nil(t, err)
+		require.Equal(t, port, ipPort.Port)
+		ms, ok := server.(srv.MetricsServer)
+		require.True(t, ok)
+		require.Nil(t, ms.SetupMetrics(fmt.Sprintf("hb_proxy_127_0_0_1_%d", port)))
+		require.NotNil(t, server.GetHandler(config, fmt.Sprintf("hb_proxy_127_0_0_1_%d", port)))
+		defer server.Finalize()
+	}
+}
+
+func TestSetupMetricsBrokenPipeline(t *testing.T) {
+	config, err := conf.StringConfig("[app:proxy-server]\npipeline = catch_errors test-broken\n")
+	require.Nil(t, err)
+	_, server, _, err := NewServer(config, &flag.FlagSet{}, srv.NewTestConfigLoader(&test.FakeRing{}))
+	require.Nil(t, err)
+	err = server.(srv.MetricsServer).SetupMetrics("hb_proxy_broken")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "broken on purpose")
+}
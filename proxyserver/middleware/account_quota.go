@@ -0,0 +1,173 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+const (
+	accountQuotaBytesHeader   = "X-Account-Meta-Quota-Bytes"
+	accountQuotaPolicyHeader  = "X-Account-Quota-Bytes-Policy-"
+	accountQuotaPolicySysmeta = "X-Account-Sysmeta-Quota-Bytes-Policy-"
+)
+
+type accountQuota struct {
+	next           http.Handler
+	policies       conf.PolicyList
+	rejectedMetric tally.Counter
+}
+
+// setQuotas checks that only reseller admins change an account's quotas, and
+// moves per-policy quotas into sysmeta, where account owners can't change
+// them. It returns false if it has already responded.
+func (q *accountQuota) setQuotas(writer http.ResponseWriter, request *http.Request) bool {
+	changed := false
+	for k := range request.Header {
+		if k == accountQuotaBytesHeader || k == "X-Remove-Account-Meta-Quota-Bytes" ||
+			strings.HasPrefix(k, accountQuotaPolicyHeader) || strings.HasPrefix(k, "X-Remove-Account-Quota-Bytes-Policy-") {
+			changed = true
+		}
+	}
+	if !changed {
+		return true
+	}
+	if !authorizeReseller(writer, request) {
+		return false
+	}
+	if v := request.Header.Get(accountQuotaBytesHeader); v != "" {
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid bytes quota.")
+			return false
+		}
+	}
+	for k := range request.Header {
+		var name, value string
+		if strings.HasPrefix(k, accountQuotaPolicyHeader) {
+			name, value = k[len(accountQuotaPolicyHeader):], request.Header.Get(k)
+		} else if strings.HasPrefix(k, "X-Remove-Account-Quota-Bytes-Policy-") {
+			name = k[len("X-Remove-Account-Quota-Bytes-Policy-"):]
+		} else {
+			continue
+		}
+		policy := q.policies.NameLookup(name)
+		if policy == nil {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, fmt.Sprintf("Invalid storage policy %s.", name))
+			return false
+		}
+		if value != "" {
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid bytes quota.")
+				return false
+			}
+		}
+		request.Header.Del(k)
+		request.Header.Set(accountQuotaPolicySysmeta+policy.Name, value)
+	}
+	return true
+}
+
+// policyQuota returns the account's quota for the policy, if it has one.
+func policyQuota(ai *AccountInfo, policy *conf.Policy) (int64, bool) {
+	for k, v := range ai.SysMetadata {
+		if len(k) > 19 && strings.EqualFold(k[:19], "Quota-Bytes-Policy-") && strings.EqualFold(k[19:], policy.Name) {
+			if quota, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return quota, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// exceeded returns true if storing size more bytes in the container would put
+// the account over one of its quotas.
+func (q *accountQuota) exceeded(ctx *ProxyContext, account, container string, size int64) bool {
+	ai, err := ctx.GetAccountInfo(account)
+	if err != nil {
+		return false
+	}
+	if quota, err := strconv.ParseInt(ai.Metadata["Quota-Bytes"], 10, 64); err == nil && quota < ai.ObjectBytes+size {
+		return true
+	}
+	hasPolicyQuotas := false
+	for k := range ai.SysMetadata {
+		if strings.HasPrefix(strings.ToLower(k), "quota-bytes-policy-") {
+			hasPolicyQuotas = true
+		}
+	}
+	if !hasPolicyQuotas {
+		return false
+	}
+	ci, err := ctx.C.GetContainerInfo(account, container)
+	if err != nil {
+		return false
+	}
+	policy := q.policies[ci.StoragePolicyIndex]
+	if policy == nil {
+		return false
+	}
+	quota, ok := policyQuota(ai, policy)
+	return ok && quota < ai.PolicyBytes[strings.ToLower(policy.Name)]+size
+}
+
+func (q *accountQuota) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	apiReq, account, container, obj := getPathParts(request)
+	if ctx == nil || !apiReq || account == "" {
+		q.next.ServeHTTP(writer, request)
+		return
+	}
+	if container == "" && (request.Method == "PUT" || request.Method == "POST") {
+		if !q.setQuotas(writer, request) {
+			return
+		}
+	} else if obj != "" && request.Method == "PUT" {
+		// Copies and bulk extractions arrive here as object PUTs, with the
+		// size given by the source object or archive in Content-Length.
+		size := request.ContentLength
+		if cl, err := strconv.ParseInt(request.Header.Get("Content-Length"), 10, 64); err == nil && cl > size {
+			size = cl
+		}
+		if size < 0 {
+			size = 0
+		}
+		if q.exceeded(ctx, account, container, size) {
+			q.rejectedMetric.Inc(1)
+			srv.SimpleErrorResponse(writer, http.StatusRequestEntityTooLarge, "Upload exceeds quota.")
+			return
+		}
+	}
+	q.next.ServeHTTP(writer, request)
+}
+
+func NewAccountQuota(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	policies, err := conf.GetPolicies()
+	if err != nil {
+		return nil, err
+	}
+	RegisterInfo("account_quotas", map[string]interface{}{})
+	rejectedMetric := metricsScope.Counter("account_quotas_rejected")
+	return func(next http.Handler) http.Handler {
+		return &accountQuota{next: next, policies: policies, rejectedMetric: rejectedMetric}
+	}, nil
+}
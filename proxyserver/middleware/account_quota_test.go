@@ -0,0 +1,171 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+// accountQuotaTestClient serves the account's headers and the container's
+// policy.
+type accountQuotaTestClient struct {
+	client.ProxyClient
+	accountHeaders http.Header
+	policyIndex    int
+}
+
+func (c *accountQuotaTestClient) HeadAccount(account string, headers http.Header) *http.Response {
+	resp := &http.Response{StatusCode: 204, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}
+	resp.Header.Set("X-Account-Container-Count", "1")
+	resp.Header.Set("X-Account-Object-Count", "1")
+	resp.Header.Set("X-Account-Bytes-Used", "0")
+	for k := range c.accountHeaders {
+		resp.Header.Set(k, c.accountHeaders.Get(k))
+	}
+	return resp
+}
+
+func (c *accountQuotaTestClient) GetContainerInfo(account string, container string) (*client.ContainerInfo, error) {
+	return &client.ContainerInfo{StoragePolicyIndex: c.policyIndex}, nil
+}
+
+func newAccountQuotaTestHandler() *accountQuota {
+	return &accountQuota{
+		next: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(200)
+		}),
+		policies: conf.PolicyList{
+			0: {Index: 0, Name: "Policy-0", Default: true},
+			1: {Index: 1, Name: "Gold"},
+		},
+		rejectedMetric: common.NewTestScope().Counter("account_quotas_rejected"),
+	}
+}
+
+func accountQuotaTestRequest(t *testing.T, h http.Handler, ctx *ProxyContext, method, path string, body string, headers map[string]string) *http.Request {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	require.Nil(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	ctx.accountInfoCache = nil
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	req.Response = w.Result()
+	return req
+}
+
+func TestAccountQuotaBytes(t *testing.T) {
+	h := newAccountQuotaTestHandler()
+	c := &accountQuotaTestClient{accountHeaders: http.Header{
+		"X-Account-Meta-Quota-Bytes": {"10"},
+		"X-Account-Bytes-Used":       {"5"},
+	}}
+	ctx := NewFakeProxyContext(h)
+	ctx.Cache = &test.FakeMemcacheRing{MockGetStructured: map[string][]byte{}}
+	ctx.C = c
+
+	req := accountQuotaTestRequest(t, h, ctx, "PUT", "/v1/a/c/o", "123456", nil)
+	require.Equal(t, 413, req.Response.StatusCode)
+	body, _ := ioutil.ReadAll(req.Response.Body)
+	require.Equal(t, "Upload exceeds quota.", string(body))
+	req = accountQuotaTestRequest(t, h, ctx, "PUT", "/v1/a/c/o", "12345", nil)
+	require.Equal(t, 200, req.Response.StatusCode)
+	// Bulk extractions and copies give the size in Content-Length.
+	req = accountQuotaTestRequest(t, h, ctx, "PUT", "/v1/a/c/o", "", map[string]string{"Content-Length": "6"})
+	require.Equal(t, 413, req.Response.StatusCode)
+	req = accountQuotaTestRequest(t, h, ctx, "POST", "/v1/a/c/o", "123456", nil)
+	require.Equal(t, 200, req.Response.StatusCode)
+}
+
+func TestAccountQuotaPolicy(t *testing.T) {
+	h := newAccountQuotaTestHandler()
+	c := &accountQuotaTestClient{accountHeaders: http.Header{
+		"X-Account-Sysmeta-Quota-Bytes-Policy-Gold": {"10"},
+		"X-Account-Storage-Policy-Gold-Bytes-Used":  {"8"},
+		"X-Account-Bytes-Used":                      {"8"},
+	}, policyIndex: 1}
+	ctx := NewFakeProxyContext(h)
+	ctx.Cache = &test.FakeMemcacheRing{MockGetStructured: map[string][]byte{}}
+	ctx.C = c
+
+	req := accountQuotaTestRequest(t, h, ctx, "PUT", "/v1/a/c/o", "123", nil)
+	require.Equal(t, 413, req.Response.StatusCode)
+	req = accountQuotaTestRequest(t, h, ctx, "PUT", "/v1/a/c/o", "12", nil)
+	require.Equal(t, 200, req.Response.StatusCode)
+	c.policyIndex = 0
+	req = accountQuotaTestRequest(t, h, ctx, "PUT", "/v1/a/c/o", "123", nil)
+	require.Equal(t, 200, req.Response.StatusCode)
+}
+
+func TestAccountQuotaSet(t *testing.T) {
+	var got http.Header
+	h := newAccountQuotaTestHandler()
+	h.next = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		got = request.Header
+		writer.WriteHeader(204)
+	})
+	ctx := NewFakeProxyContext(h)
+	ctx.Cache = &test.FakeMemcacheRing{MockGetStructured: map[string][]byte{}}
+	ctx.C = &accountQuotaTestClient{}
+
+	req := accountQuotaTestRequest(t, h, ctx, "POST", "/v1/a", "", map[string]string{"X-Account-Meta-Quota-Bytes": "100"})
+	require.Equal(t, 403, req.Response.StatusCode)
+	// Account owners can change other metadata but not their quotas.
+	ctx.Authorize = func(r *http.Request) (bool, int) { return true, 200 }
+	req = accountQuotaTestRequest(t, h, ctx, "POST", "/v1/a", "", map[string]string{"X-Account-Meta-Quota-Bytes": "100"})
+	require.Equal(t, 403, req.Response.StatusCode)
+	req = accountQuotaTestRequest(t, h, ctx, "POST", "/v1/a", "", map[string]string{"X-Remove-Account-Quota-Bytes-Policy-Gold": "x"})
+	require.Equal(t, 403, req.Response.StatusCode)
+	req = accountQuotaTestRequest(t, h, ctx, "POST", "/v1/a", "", map[string]string{"X-Account-Meta-Color": "blue"})
+	require.Equal(t, 204, req.Response.StatusCode)
+
+	ctx.Authorize = func(r *http.Request) (bool, int) {
+		GetProxyContext(r).ResellerRequest = true
+		return true, 200
+	}
+	req = accountQuotaTestRequest(t, h, ctx, "POST", "/v1/a", "", map[string]string{"X-Account-Meta-Quota-Bytes": "lots"})
+	require.Equal(t, 400, req.Response.StatusCode)
+	req = accountQuotaTestRequest(t, h, ctx, "POST", "/v1/a", "", map[string]string{"X-Account-Quota-Bytes-Policy-Silver": "100"})
+	require.Equal(t, 400, req.Response.StatusCode)
+	req = accountQuotaTestRequest(t, h, ctx, "PUT", "/v1/a", "", map[string]string{
+		"X-Account-Meta-Quota-Bytes":            "1000",
+		"X-Account-Quota-Bytes-Policy-gold":     "100",
+		"X-Account-Quota-Bytes-Policy-Policy-0": "200",
+	})
+	require.Equal(t, 204, req.Response.StatusCode)
+	require.Equal(t, "1000", got.Get("X-Account-Meta-Quota-Bytes"))
+	require.Equal(t, "100", got.Get("X-Account-Sysmeta-Quota-Bytes-Policy-Gold"))
+	require.Equal(t, "200", got.Get("X-Account-Sysmeta-Quota-Bytes-Policy-Policy-0"))
+	require.Equal(t, "", got.Get("X-Account-Quota-Bytes-Policy-Gold"))
+	req = accountQuotaTestRequest(t, h, ctx, "POST", "/v1/a", "", map[string]string{"X-Remove-Account-Quota-Bytes-Policy-Gold": "x"})
+	require.Equal(t, 204, req.Response.StatusCode)
+	v, ok := got["X-Account-Sysmeta-Quota-Bytes-Policy-Gold"]
+	require.True(t, ok)
+	require.Equal(t, []string{""}, v)
+}
@@ -23,6 +23,7 @@ import (
 	"strings"
 
 	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
 )
 
 // Returns a cleaned ACL header value, validating that it meets the formatting
@@ -119,3 +120,24 @@ func AuthorizeUnconfirmedIdentity(r *http.Request, obj string, referrers []strin
 	}
 	return false, errors.New("unable to confirm identity")
 }
+
+// authorizeReseller is for settings that only reseller admins may change,
+// like an account's quotas. Since middleware runs before the proxy authorizes
+// requests, it authorizes the request itself, responding and returning false
+// unless it's from a reseller admin.
+func authorizeReseller(writer http.ResponseWriter, request *http.Request) bool {
+	ctx := GetProxyContext(request)
+	if ctx == nil || ctx.Authorize == nil {
+		srv.StandardResponse(writer, http.StatusForbidden)
+		return false
+	}
+	if ok, s := ctx.Authorize(request); !ok {
+		srv.StandardResponse(writer, s)
+		return false
+	}
+	if !ctx.ResellerRequest {
+		srv.StandardResponse(writer, http.StatusForbidden)
+		return false
+	}
+	return true
+}
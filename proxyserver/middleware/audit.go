@@ -0,0 +1,298 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// auditRotateLayout is the timestamp a rotated log's name ends with.
+const auditRotateLayout = "20060102T150405.000000000"
+
+// auditLog appends hash chained records to a file, rotating it to
+// <path>.<timestamp> when it reaches maxBytes. The chain carries on across
+// rotations and restarts.
+type auditLog struct {
+	lock     sync.Mutex
+	path     string
+	maxBytes int64
+	key      []byte
+	file     *os.File
+	size     int64
+	seq      int64
+	prev     string
+}
+
+var (
+	auditLogs     = map[string]*auditLog{}
+	auditLogsLock sync.Mutex
+)
+
+// getAuditLog returns the open log for the path, so that each file has one
+// chain however many times the middleware is constructed.
+func getAuditLog(path string, maxBytes int64, key []byte) (*auditLog, error) {
+	auditLogsLock.Lock()
+	defer auditLogsLock.Unlock()
+	if l := auditLogs[path]; l != nil {
+		return l, nil
+	}
+	l := &auditLog{path: path, maxBytes: maxBytes, key: key}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	// Pick up the chain from the last record written, which is in the
+	// newest rotated file if the current one is empty.
+	files := []string{path}
+	if rotated, err := rotatedAuditLogs(path); err == nil {
+		sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+		files = append(files, rotated...)
+	}
+	for _, name := range files {
+		if rec, err := lastAuditRecord(name); err != nil {
+			l.file.Close()
+			return nil, err
+		} else if rec != nil {
+			l.seq, l.prev = rec.Seq, rec.Hash
+			break
+		}
+	}
+	auditLogs[path] = l
+	return l, nil
+}
+
+// rotatedAuditLogs returns the files the log at path has been rotated to,
+// ignoring anything else next to it, such as compressed copies.
+func rotatedAuditLogs(path string) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(path) + "."
+	var rotated []string
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		if _, err := time.Parse(auditRotateLayout, strings.TrimPrefix(fi.Name(), prefix)); err == nil {
+			rotated = append(rotated, filepath.Join(filepath.Dir(path), fi.Name()))
+		}
+	}
+	return rotated, nil
+}
+
+// lastAuditRecord returns the last record in the file, or nil if it has none.
+func lastAuditRecord(path string) (*common.AuditRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := fi.Size() - 1024*1024
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	last := lines[len(lines)-1]
+	if last == "" {
+		return nil, nil
+	}
+	var rec common.AuditRecord
+	if err := json.Unmarshal([]byte(last), &rec); err != nil {
+		return nil, fmt.Errorf("Unable to read last record of %s: %v", path, err)
+	}
+	return &rec, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, fi.Size()
+	return nil
+}
+
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	if err := os.Rename(l.path, l.path+"."+time.Now().UTC().Format(auditRotateLayout)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// write adds the record to the end of the chain.
+func (l *auditLog) write(rec *common.AuditRecord) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	rec.Seq = l.seq + 1
+	rec.Prev = l.prev
+	rec.Hash = rec.ComputeHash(l.key)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.seq, l.prev = rec.Seq, rec.Hash
+	return nil
+}
+
+// auditMiddleware records every request made to the proxy, other than those
+// filtered out by account or method.
+type auditMiddleware struct {
+	next            http.Handler
+	log             *auditLog
+	accounts        map[string]bool
+	methods         map[string]bool
+	useForwardedFor bool
+	recordsMetric   tally.Counter
+	errorsMetric    tally.Counter
+}
+
+func (a *auditMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	// Only the client's request is recorded, not the subrequests other
+	// middleware make for it, even those like s3api's that are treated as
+	// the client's own.
+	if ctx == nil || ctx.depth > 0 {
+		a.next.ServeHTTP(writer, request)
+		return
+	}
+	apiReq, account, container, object := getPathParts(request)
+	if !apiReq {
+		account, container, object = "", "", ""
+	}
+	if (a.accounts != nil && !a.accounts[account]) || (a.methods != nil && !a.methods[request.Method]) {
+		a.next.ServeHTTP(writer, request)
+		return
+	}
+	start := time.Now()
+	w := &srv.WebWriter{ResponseWriter: writer, Status: 500}
+	body := &srv.CountingReadCloser{ReadCloser: request.Body}
+	if request.Body != nil {
+		request.Body = body
+	}
+	a.next.ServeHTTP(w, request)
+	rec := &common.AuditRecord{
+		Time:      start.UTC().Format(time.RFC3339Nano),
+		TxId:      ctx.TxId,
+		Identity:  ctx.RemoteUsers,
+		Account:   account,
+		Container: container,
+		Object:    object,
+		Method:    request.Method,
+		Path:      request.URL.Path,
+		Status:    w.Status,
+		BytesIn:   int64(body.ByteCount),
+		BytesOut:  int64(w.ByteCount),
+		SourceIP:  clientIP(request, a.useForwardedFor),
+	}
+	if err := a.log.write(rec); err != nil {
+		ctx.Logger.Error("Unable to write audit record", zap.String("file", a.log.path), zap.Error(err))
+		a.errorsMetric.Inc(1)
+		return
+	}
+	a.recordsMetric.Inc(1)
+}
+
+func auditFilter(value string) map[string]bool {
+	fields := strings.Fields(strings.Replace(value, ",", " ", -1))
+	if len(fields) == 0 {
+		return nil
+	}
+	filter := map[string]bool{}
+	for _, f := range fields {
+		filter[f] = true
+	}
+	return filter
+}
+
+func NewAudit(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	var key []byte
+	if keyFile := config.GetDefault("key_file", ""); keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read audit key: %v", err)
+		}
+		key = []byte(strings.TrimSpace(string(data)))
+	}
+	log, err := getAuditLog(config.GetDefault("log_file", "/var/log/hummingbird/audit.log"), config.GetInt("max_bytes", 100*1024*1024), key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open audit log: %v", err)
+	}
+	methods := auditFilter(strings.ToUpper(config.GetDefault("methods", "")))
+	accounts := auditFilter(config.GetDefault("accounts", ""))
+	useForwardedFor := config.GetBool("use_forwarded_for", false)
+	recordsMetric := metricsScope.Counter("audit_records")
+	errorsMetric := metricsScope.Counter("audit_errors")
+	return func(next http.Handler) http.Handler {
+		return &auditMiddleware{
+			next:            next,
+			log:             log,
+			accounts:        accounts,
+			methods:         methods,
+			useForwardedFor: useForwardedFor,
+			recordsMetric:   recordsMetric,
+			errorsMetric:    errorsMetric,
+		}
+	}, nil
+}
@@ -0,0 +1,183 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func newAuditTestHandler(t *testing.T, config string) http.Handler {
+	conf, err := conf.StringConfig("[filter:audit]\n" + config)
+	require.Nil(t, err)
+	a, err := NewAudit(conf.GetSection("filter:audit"), common.NewTestScope())
+	require.Nil(t, err)
+	return a(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method == "PUT" {
+			w.WriteHeader(201)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(append([]byte("got "), body...))
+	}))
+}
+
+func auditTestRequest(t *testing.T, h http.Handler, method, path, body string) {
+	req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+	require.Nil(t, err)
+	req.RemoteAddr = "1.2.3.4:5678"
+	ctx := NewFakeProxyContext(h)
+	ctx.TxId = "tx1"
+	ctx.RemoteUsers = []string{"a:u"}
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func auditTestRecords(t *testing.T, path string) []common.AuditRecord {
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	var recs []common.AuditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec common.AuditRecord
+		require.Nil(t, json.Unmarshal([]byte(line), &rec))
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestAuditRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	keyFile := filepath.Join(dir, "key")
+	require.Nil(t, ioutil.WriteFile(keyFile, []byte("secret\n"), 0600))
+	h := newAuditTestHandler(t, "log_file = "+path+"\nkey_file = "+keyFile+"\n")
+
+	auditTestRequest(t, h, "PUT", "/v1/a/c/o", "12345")
+	auditTestRequest(t, h, "GET", "/v1/a/c/o", "")
+	recs := auditTestRecords(t, path)
+	require.Equal(t, 2, len(recs))
+	require.Equal(t, int64(1), recs[0].Seq)
+	require.Equal(t, []string{"a:u"}, recs[0].Identity)
+	require.Equal(t, "tx1", recs[0].TxId)
+	require.Equal(t, "c", recs[0].Container)
+	require.Equal(t, "o", recs[0].Object)
+	require.Equal(t, 201, recs[0].Status)
+	require.Equal(t, int64(5), recs[0].BytesIn)
+	require.Equal(t, "1.2.3.4", recs[0].SourceIP)
+	require.Equal(t, 200, recs[1].Status)
+	require.Equal(t, int64(4), recs[1].BytesOut)
+
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	require.Nil(t, (&common.AuditVerifier{Key: []byte("secret")}).Verify(f))
+}
+
+func TestAuditFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	h := newAuditTestHandler(t, "log_file = "+path+"\naccounts = a, b\nmethods = put delete\n")
+	auditTestRequest(t, h, "PUT", "/v1/a/c/o", "")
+	auditTestRequest(t, h, "GET", "/v1/a/c/o", "")
+	auditTestRequest(t, h, "PUT", "/v1/x/c/o", "")
+	auditTestRequest(t, h, "DELETE", "/v1/b/c", "")
+	recs := auditTestRecords(t, path)
+	require.Equal(t, 2, len(recs))
+	require.Equal(t, "PUT", recs[0].Method)
+	require.Equal(t, "b", recs[1].Account)
+}
+
+func TestAuditSubrequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	conf, err := conf.StringConfig("[filter:audit]\nlog_file = " + path + "\n")
+	require.Nil(t, err)
+	a, err := NewAudit(conf.GetSection("filter:audit"), common.NewTestScope())
+	require.Nil(t, err)
+	var h http.Handler
+	h = a(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := GetProxyContext(r)
+		if ctx.depth == 0 {
+			// Like s3api, which makes its subrequests as the client.
+			for _, source := range []string{"-", "slo"} {
+				subreq, err := ctx.newSubrequest("HEAD", "/v1/a/c/other", nil, r, source)
+				require.Nil(t, err)
+				ctx.serveHTTPSubrequest(httptest.NewRecorder(), subreq)
+			}
+		}
+		w.WriteHeader(200)
+	}))
+	auditTestRequest(t, h, "GET", "/v1/a/c/o", "")
+	recs := auditTestRecords(t, path)
+	require.Equal(t, 1, len(recs))
+	require.Equal(t, "o", recs[0].Object)
+}
+
+func TestAuditRotateAndResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	h := newAuditTestHandler(t, "log_file = "+path+"\nmax_bytes = 500\n")
+	for i := 0; i < 5; i++ {
+		auditTestRequest(t, h, "GET", "/v1/a/c/o", "")
+	}
+	rotated, err := filepath.Glob(path + ".*")
+	require.Nil(t, err)
+	require.NotEqual(t, 0, len(rotated))
+
+	// A restarted proxy carries on the chain where it left off, ignoring
+	// other files next to the log.
+	require.Nil(t, ioutil.WriteFile(path+".gz", []byte("junk"), 0600))
+	require.Nil(t, ioutil.WriteFile(path+".old", []byte("junk"), 0600))
+	auditLogsLock.Lock()
+	auditLogs[path].file.Close()
+	delete(auditLogs, path)
+	auditLogsLock.Unlock()
+	h = newAuditTestHandler(t, "log_file = "+path+"\nmax_bytes = 500\n")
+	auditTestRequest(t, h, "GET", "/v1/a/c/o", "")
+
+	rotated, err = rotatedAuditLogs(path)
+	require.Nil(t, err)
+	v := &common.AuditVerifier{}
+	for _, name := range append(rotated, path) {
+		f, err := os.Open(name)
+		require.Nil(t, err)
+		require.Nil(t, v.Verify(f))
+		f.Close()
+	}
+	require.Equal(t, int64(6), v.Records)
+	require.Equal(t, int64(6), v.Seq)
+}
@@ -17,6 +17,7 @@ package middleware
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -49,6 +50,7 @@ type authToken struct {
 	preValidateDur time.Duration
 	preValidations map[string]bool
 	lock           sync.Mutex
+	resellerPrefix string
 }
 
 var authHeaders = []string{"X-Identity-Status",
@@ -248,10 +250,73 @@ func (at *authToken) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			r.Header.Set("X-Identity-Status", "Confirmed")
 			userToken.populateReqHeader(r, "")
 		}
+	} else if ctx.S3Auth != nil {
+		if userToken := at.validateS3(ctx); userToken != nil {
+			r.Header.Set("X-Identity-Status", "Confirmed")
+			userToken.populateReqHeader(r, "")
+			ctx.S3Auth.rewriteAccount(r, at.resellerPrefix+userToken.Project.ID)
+		}
 	}
 	at.next.ServeHTTP(w, r)
 }
 
+// validateS3 has keystone check the signature of a request from the s3api
+// middleware, returning the token for its credentials if it was valid. Valid
+// signatures are cached, so a retried or presigned request isn't checked again.
+func (at *authToken) validateS3(ctx *ProxyContext) *token {
+	if tok := ctx.S3Auth.token; tok != nil && tok.Valid() {
+		return tok
+	}
+	cacheKey := "s3token/" + ctx.S3Auth.Key + "/" + ctx.S3Auth.Signature
+	var cachedToken token
+	if err := ctx.Cache.GetStructured(cacheKey, &cachedToken); err == nil && cachedToken.Project != nil && cachedToken.Valid() {
+		ctx.Logger.Debug("Found cached s3 token", zap.String("key", ctx.S3Auth.Key))
+		ctx.S3Auth.token = &cachedToken
+		return &cachedToken
+	}
+	var creds struct {
+		Credentials struct {
+			Access    string `json:"access"`
+			Signature string `json:"signature"`
+			Token     string `json:"token"`
+		} `json:"credentials"`
+	}
+	creds.Credentials.Access = ctx.S3Auth.Key
+	creds.Credentials.Signature = ctx.S3Auth.Signature
+	creds.Credentials.Token = base64.StdEncoding.EncodeToString([]byte(ctx.S3Auth.StringToSign))
+	body, err := json.Marshal(creds)
+	if err != nil {
+		return nil
+	}
+	if !strings.HasSuffix(at.authURL, "/") {
+		at.authURL += "/"
+	}
+	req, err := http.NewRequest("POST", at.authURL+"v3/s3tokens", bytes.NewBuffer(body))
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", at.userAgent)
+	r, err := at.client.Do(req)
+	if err != nil {
+		ctx.Logger.Debug("Failed to validate s3 credentials", zap.Error(err))
+		return nil
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		ctx.Logger.Debug("Failed to validate s3 credentials", zap.String("status", r.Status))
+		return nil
+	}
+	var resp identityResponse
+	if err = json.NewDecoder(r.Body).Decode(&resp); err != nil || resp.Token == nil || resp.Token.Project == nil || !resp.Token.Valid() {
+		ctx.Logger.Debug("Invalid s3tokens response", zap.Error(err))
+		return nil
+	}
+	at.cacheToken(ctx, cacheKey, resp.Token)
+	ctx.S3Auth.token = resp.Token
+	return resp.Token
+}
+
 func (at *authToken) validate(ctx *ProxyContext, authToken string) (*token, bool) {
 	tok, err := at.doValidate(authToken)
 	if err != nil {
@@ -260,17 +325,23 @@ func (at *authToken) validate(ctx *ProxyContext, authToken string) (*token, bool
 	}
 
 	if tok != nil {
-		ttl := at.cacheDur
-		if expiresIn := tok.ExpiresAt.Sub(time.Now()); expiresIn < ttl && expiresIn > 0 {
-			ttl = expiresIn
-		}
-		tok.MemcacheTtlAt = time.Now().Add(ttl)
-		ctx.Cache.Set(authToken, *tok, int(ttl/time.Second))
+		at.cacheToken(ctx, authToken, tok)
 		return tok, true
 	}
 	return nil, false
 }
 
+// cacheToken caches tok under key for the cache duration, or until the token
+// expires if that's sooner.
+func (at *authToken) cacheToken(ctx *ProxyContext, key string, tok *token) {
+	ttl := at.cacheDur
+	if expiresIn := tok.ExpiresAt.Sub(time.Now()); expiresIn < ttl && expiresIn > 0 {
+		ttl = expiresIn
+	}
+	tok.MemcacheTtlAt = time.Now().Add(ttl)
+	ctx.Cache.Set(key, *tok, int(ttl/time.Second))
+}
+
 func (at *authToken) doValidate(token string) (*token, error) {
 	if !strings.HasSuffix(at.authURL, "/") {
 		at.authURL += "/"
@@ -362,6 +433,7 @@ func NewAuthToken(config conf.Section, metricsScope tally.Scope) (func(http.Hand
 			cacheDur:       tokenCacheDur,
 			preValidateDur: (tokenCacheDur / 10),
 			preValidations: make(map[string]bool),
+			resellerPrefix: config.GetDefault("reseller_prefix", "AUTH_"),
 			identity: &identity{authURL: config.GetDefault("auth_uri", "http://127.0.0.1:5000/"),
 				authPlugin:      config.GetDefault("auth_plugin", "password"),
 				projectDomainID: config.GetDefault("project_domain_id", "default"),
@@ -596,3 +596,39 @@ func TestPreauthCachedToken(t *testing.T) {
 		t.Fatalf("cached token ttl didn't get updated: %v", timeout)
 	}
 }
+
+func TestS3TokenCached(t *testing.T) {
+	posts := 0
+	identityServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v3/s3tokens", r.URL.Path)
+		posts++
+		fmt.Fprintf(w, `{"token": {"expires_at": %q, "project": {"id": "p1"}}}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+	}))
+	defer identityServ.Close()
+	fakeCache := mockTokenMemcacheRing{MockValues: make(map[string]*mockValue)}
+	at := &authToken{
+		cacheDur: time.Minute,
+		identity: &identity{authURL: identityServ.URL, client: &http.Client{Timeout: 5 * time.Second}},
+	}
+	for i := 0; i < 2; i++ {
+		ctx := &ProxyContext{
+			Logger:                 zap.NewNop(),
+			ProxyContextMiddleware: &ProxyContextMiddleware{Cache: &fakeCache},
+			S3Auth:                 &S3AuthInfo{Key: "key", Signature: "sig", StringToSign: "stuff"},
+		}
+		tok := at.validateS3(ctx)
+		require.NotNil(t, tok)
+		require.Equal(t, "p1", tok.Project.ID)
+	}
+	require.Equal(t, 1, posts)
+	require.NotNil(t, fakeCache.MockValues["s3token/key/sig"])
+	require.Equal(t, 60, fakeCache.MockValues["s3token/key/sig"].Timeout)
+
+	ctx := &ProxyContext{
+		Logger:                 zap.NewNop(),
+		ProxyContextMiddleware: &ProxyContextMiddleware{Cache: &fakeCache},
+		S3Auth:                 &S3AuthInfo{Key: "key", Signature: "other", StringToSign: "stuff"},
+	}
+	require.NotNil(t, at.validateS3(ctx))
+	require.Equal(t, 2, posts)
+}
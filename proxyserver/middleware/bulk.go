@@ -8,6 +8,7 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -33,34 +34,57 @@ func NewBulk(config conf.Section, metricsScope tally.Scope) (func(http.Handler)
 	// TODO: We may implement these later:
 	// delete_concurrency
 	// delete_container_retry_count
+	jobs := &bulkJobs{
+		running:                    map[string]chan struct{}{},
+		maxJobs:                    int(config.GetInt("max_async_jobs", 4)),
+		maxDeletesPerJob:           int(config.GetInt("max_deletes_per_async_job", 1000000)),
+		maxFailedDeletes:           maxFailedDeletes,
+		maxContainersPerExtraction: maxContainersPerExtraction,
+		maxFailedExtractions:       maxFailedExtractions,
+		checkpointInterval:         time.Duration(config.GetFloat("async_checkpoint_interval", 10) * float64(time.Second)),
+		staleAfter:                 time.Duration(config.GetInt("async_stale_after", 300)) * time.Second,
+		expireAfter:                time.Duration(config.GetInt("async_job_expiry", 604800)) * time.Second,
+		startedMetric:              metricsScope.Counter("bulk_async_jobs_started"),
+		resumedMetric:              metricsScope.Counter("bulk_async_jobs_resumed"),
+		completedMetric:            metricsScope.Counter("bulk_async_jobs_completed"),
+		cancelledMetric:            metricsScope.Counter("bulk_async_jobs_cancelled"),
+	}
 	RegisterInfo("bulk_upload", map[string]interface{}{
 		"max_containers_per_extraction": maxContainersPerExtraction,
 		"max_failed_extractions":        maxFailedExtractions,
+		"async":                         jobs.maxJobs > 0,
 	})
 	RegisterInfo("bulk_delete", map[string]interface{}{
-		"max_deletes_per_request": maxDeletesPerRequest,
-		"max_failed_deletes":      maxFailedDeletes,
+		"max_deletes_per_request":   maxDeletesPerRequest,
+		"max_failed_deletes":        maxFailedDeletes,
+		"async":                     jobs.maxJobs > 0,
+		"max_deletes_per_async_job": jobs.maxDeletesPerJob,
 	})
-	return bulk(metricsScope, yieldFrequency, maxContainersPerExtraction, maxFailedExtractions, maxDeletesPerRequest, maxFailedDeletes), nil
+	return bulk(metricsScope, yieldFrequency, maxContainersPerExtraction, maxFailedExtractions, maxDeletesPerRequest, maxFailedDeletes, jobs), nil
+}
+
+// bulkTarProcessors are the archive formats extract-archive accepts.
+var bulkTarProcessors = map[string]func(r io.Reader, f func(name string, header http.Header, reader io.Reader)) error{
+	"tar":     processBulkTar,
+	"tar.gz":  processBulkTarGz,
+	"tar.bz2": processBulkTarBz2,
 }
 
-func bulk(metricsScope tally.Scope, yieldFrequency time.Duration, maxContainersPerExtraction, maxFailedExtractions, maxDeletesPerRequest, maxFailedDeletes int) func(next http.Handler) http.Handler {
+func bulk(metricsScope tally.Scope, yieldFrequency time.Duration, maxContainersPerExtraction, maxFailedExtractions, maxDeletesPerRequest, maxFailedDeletes int, jobs *bulkJobs) func(next http.Handler) http.Handler {
 	putRequestsMetric := metricsScope.Counter("bulk_put_requests")
 	deleteRequestsMetric := metricsScope.Counter("bulk_delete_requests")
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			_, async := request.URL.Query()["async"]
+			async = async && jobs != nil && jobs.maxJobs > 0
 			switch request.Method {
 			case "PUT":
-				var f func(r io.Reader, f func(name string, header http.Header, reader io.Reader)) error
-				switch request.URL.Query().Get("extract-archive") {
-				case "tar":
-					f = processBulkTar
-				case "tar.gz":
-					f = processBulkTarGz
-				case "tar.bz2":
-					f = processBulkTarBz2
-				}
-				if f != nil {
+				format := request.URL.Query().Get("extract-archive")
+				if f := bulkTarProcessors[format]; f != nil {
+					if async {
+						jobs.start(writer, request, &bulkJob{Operation: bulkJobExtract, Format: format, ContentType: bulkPutContentType(request)})
+						return
+					}
 					(&bulkPut{
 						next:                       next,
 						requestsMetric:             putRequestsMetric,
@@ -73,6 +97,10 @@ func bulk(metricsScope tally.Scope, yieldFrequency time.Duration, maxContainersP
 				}
 			case "DELETE", "POST":
 				if _, ok := request.URL.Query()["bulk-delete"]; ok {
+					if async {
+						jobs.start(writer, request, &bulkJob{Operation: bulkJobDelete})
+						return
+					}
 					(&bulkDelete{
 						next:                 next,
 						requestsMetric:       deleteRequestsMetric,
@@ -84,11 +112,60 @@ func bulk(metricsScope tally.Scope, yieldFrequency time.Duration, maxContainersP
 				}
 			default:
 			}
+			if id, ok := request.URL.Query()["bulk-job"]; ok && jobs != nil {
+				if _, _, container, _ := getPathSegments(request.URL.Path); container == "" {
+					jobs.ServeHTTP(writer, request, id[0])
+					return
+				}
+			}
 			next.ServeHTTP(writer, request)
 		})
 	}
 }
 
+// bulkResult is how far a bulk request has got. Asynchronous jobs save it
+// with their progress, so everything needed to carry on is exported.
+type bulkResult struct {
+	Processed           int        `json:"processed"`
+	ContainersProcessed int        `json:"containers_processed,omitempty"`
+	NumberDeleted       int        `json:"number_deleted"`
+	NumberNotFound      int        `json:"number_not_found"`
+	NumberFilesCreated  int        `json:"number_files_created"`
+	Errors              [][]string `json:"errors"`
+	FailureStatus       int        `json:"failure_status,omitempty"`
+	FailureBody         string     `json:"failure_body,omitempty"`
+}
+
+func (r *bulkResult) failureStatus() int {
+	if r.FailureStatus == 0 {
+		return http.StatusBadRequest
+	}
+	return r.FailureStatus
+}
+
+var errBulkStopped = errors.New("bulk request stopped")
+
+// bulkStopReader fails once stop is set, so an archive needn't be read to the
+// end after a run is stopped.
+type bulkStopReader struct {
+	io.Reader
+	stop *bool
+}
+
+func (r *bulkStopReader) Read(p []byte) (int, error) {
+	if *r.stop {
+		return 0, errBulkStopped
+	}
+	return r.Reader.Read(p)
+}
+
+func bulkPutContentType(request *http.Request) string {
+	if ok, _ := strconv.ParseBool(request.Header.Get("X-Detect-Content-Type")); ok {
+		return ""
+	}
+	return request.Header.Get("Content-Type")
+}
+
 type bulkPut struct {
 	next                       http.Handler
 	requestsMetric             tally.Counter
@@ -98,65 +175,22 @@ type bulkPut struct {
 	processBodyFunc            func(r io.Reader, f func(name string, header http.Header, reader io.Reader)) error
 }
 
-func (b *bulkPut) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	contentType := request.Header.Get("Content-Type")
-	if ok, _ := strconv.ParseBool(request.Header.Get("X-Detect-Content-Type")); ok {
-		contentType = ""
-	}
-	accept := request.Header.Get("Accept")
-	outputType := "text"
-	if strings.Contains(accept, "/json") {
-		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
-		outputType = "json"
-	} else if strings.Contains(accept, "/xml") {
-		writer.Header().Set("Content-Type", "application/xml; charset=utf-8")
-		outputType = "xml"
-	} else {
-		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	}
-	writer.Header().Set("Transfer-Encoding", "chunked")
-	writer.WriteHeader(http.StatusOK)
-	if outputType == "xml" {
-		writer.Write([]byte(xml.Header))
-	}
-	stopTheSpaces := make(chan struct{})
-	hasEmittedSpaces := make(chan bool)
-	go func() {
-		spacesWereEmitted := false
-		for {
-			select {
-			case <-time.After(b.yieldFrequency):
-				writer.Write([]byte("  "))
-				spacesWereEmitted = true
-			case <-stopTheSpaces:
-				hasEmittedSpaces <- spacesWereEmitted
-				close(hasEmittedSpaces)
-				return
-			}
-		}
-	}()
+// run extracts the archive in body into request's path, skipping the first
+// res.Processed files, which an earlier run already did. If checkpoint isn't
+// nil it's called after each file, and stops the run by returning false.
+func (b *bulkPut) run(request *http.Request, body io.Reader, contentType string, res *bulkResult, checkpoint func() bool) (int, string) {
 	ctx := GetProxyContext(request)
-	numberFilesCreated := 0
-	failures := [][]string{}
-	failureResponseType := http.StatusBadRequest
-	failureResponseBody := ""
+	skip := res.Processed
+	item := 0
+	stopped := false
 	containerPuts := map[string]bool{}
-	processItemFunc := func(name string, header http.Header, reader io.Reader) {
-		if len(failures) >= b.maxFailedExtractions || len(containerPuts) > b.maxContainersPerExtraction {
-			return
-		}
-		subpath := path.Join(request.URL.Path, name)
-		apiRequest, account, container, object := getPathSegments(subpath)
-		if object == "" {
-			return
-		}
-		containerPath := "/" + path.Join(apiRequest, account, container)
+	putItem := func(subpath, containerPath string, header http.Header, reader io.Reader) {
 		if !containerPuts[containerPath] {
 			containerPuts[containerPath] = true
 			if len(containerPuts) > b.maxContainersPerExtraction {
-				failures = append(failures, []string{subpath, httpStatusString(http.StatusBadRequest)})
-				failureResponseType = http.StatusBadRequest
-				failureResponseBody = fmt.Sprintf("More than %d containers to create from tar.", b.maxContainersPerExtraction)
+				res.Errors = append(res.Errors, []string{subpath, httpStatusString(http.StatusBadRequest)})
+				res.FailureStatus = http.StatusBadRequest
+				res.FailureBody = fmt.Sprintf("More than %d containers to create from tar.", b.maxContainersPerExtraction)
 				return
 			}
 			// We continue no matter what because the future object PUT can
@@ -164,20 +198,20 @@ func (b *bulkPut) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 			// but the container already exists.
 			subreq, err := ctx.newSubrequest("PUT", containerPath, reader, request, "bulkput")
 			if err != nil {
-				failures = append(failures, []string{containerPath, httpStatusString(http.StatusInternalServerError)})
+				res.Errors = append(res.Errors, []string{containerPath, httpStatusString(http.StatusInternalServerError)})
 			} else {
 				subrec := httptest.NewRecorder()
 				ctx.serveHTTPSubrequest(subrec, subreq)
 				subresp := subrec.Result()
 				subresp.Body.Close()
 				if subresp.StatusCode/100 != 2 {
-					failures = append(failures, []string{containerPath, httpStatusString(subresp.StatusCode)})
+					res.Errors = append(res.Errors, []string{containerPath, httpStatusString(subresp.StatusCode)})
 				}
 			}
 		}
 		subreq, err := ctx.newSubrequest("PUT", subpath, reader, request, "bulkput")
 		if err != nil {
-			failures = append(failures, []string{subpath, httpStatusString(http.StatusInternalServerError)})
+			res.Errors = append(res.Errors, []string{subpath, httpStatusString(http.StatusInternalServerError)})
 			return
 		}
 		if contentType != "" {
@@ -192,27 +226,85 @@ func (b *bulkPut) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 		subresp := subrec.Result()
 		subresp.Body.Close()
 		if subresp.StatusCode/100 == 5 {
-			failures = append(failures, []string{subpath, httpStatusString(subresp.StatusCode)})
-			failureResponseType = http.StatusBadGateway
+			res.Errors = append(res.Errors, []string{subpath, httpStatusString(subresp.StatusCode)})
+			res.FailureStatus = http.StatusBadGateway
 			return
 		} else if subresp.StatusCode/100 != 2 {
-			failures = append(failures, []string{subpath, httpStatusString(subresp.StatusCode)})
+			res.Errors = append(res.Errors, []string{subpath, httpStatusString(subresp.StatusCode)})
+			return
+		}
+		res.NumberFilesCreated++
+	}
+	processItemFunc := func(name string, header http.Header, reader io.Reader) {
+		if stopped || len(res.Errors) >= b.maxFailedExtractions || len(containerPuts) > b.maxContainersPerExtraction {
+			return
+		}
+		item++
+		subpath := path.Join(request.URL.Path, name)
+		apiRequest, account, container, object := getPathSegments(subpath)
+		if object == "" {
+			return
+		}
+		containerPath := "/" + path.Join(apiRequest, account, container)
+		if item <= skip {
+			containerPuts[containerPath] = true
 			return
 		}
-		numberFilesCreated++
+		putItem(subpath, containerPath, header, reader)
+		res.Processed = item
+		if checkpoint != nil && !checkpoint() {
+			stopped = true
+		}
+	}
+	if err := b.processBodyFunc(&bulkStopReader{Reader: body, stop: &stopped}, processItemFunc); err != nil && !stopped {
+		return http.StatusBadGateway, fmt.Sprintf("Invalid Tar File: %s", err)
+	} else if len(res.Errors) > 0 {
+		return res.failureStatus(), res.FailureBody
+	} else if res.NumberFilesCreated < 1 {
+		return http.StatusBadRequest, "Invalid Tar File: No Valid Files"
+	}
+	return http.StatusCreated, ""
+}
+
+func (b *bulkPut) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	contentType := bulkPutContentType(request)
+	accept := request.Header.Get("Accept")
+	outputType := "text"
+	if strings.Contains(accept, "/json") {
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		outputType = "json"
+	} else if strings.Contains(accept, "/xml") {
+		writer.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		outputType = "xml"
+	} else {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	}
-	responseStatus := http.StatusCreated
-	responseBody := ""
-	if err := b.processBodyFunc(request.Body, processItemFunc); err != nil {
-		responseStatus = http.StatusBadGateway
-		responseBody = fmt.Sprintf("Invalid Tar File: %s", err)
-	} else if len(failures) > 0 {
-		responseStatus = failureResponseType
-		responseBody = failureResponseBody
-	} else if numberFilesCreated < 1 {
-		responseStatus = http.StatusBadRequest
-		responseBody = "Invalid Tar File: No Valid Files"
+	writer.Header().Set("Transfer-Encoding", "chunked")
+	writer.WriteHeader(http.StatusOK)
+	if outputType == "xml" {
+		writer.Write([]byte(xml.Header))
 	}
+	stopTheSpaces := make(chan struct{})
+	hasEmittedSpaces := make(chan bool)
+	go func() {
+		spacesWereEmitted := false
+		for {
+			select {
+			case <-time.After(b.yieldFrequency):
+				writer.Write([]byte("  "))
+				spacesWereEmitted = true
+			case <-stopTheSpaces:
+				hasEmittedSpaces <- spacesWereEmitted
+				close(hasEmittedSpaces)
+				return
+			}
+		}
+	}()
+	ctx := GetProxyContext(request)
+	res := &bulkResult{Errors: [][]string{}}
+	responseStatus, responseBody := b.run(request, request.Body, contentType, res, nil)
+	numberFilesCreated := res.NumberFilesCreated
+	failures := res.Errors
 	close(stopTheSpaces)
 	if <-hasEmittedSpaces {
 		// Not sure why, but the Swift code uses \r\n here and \n everywhere else.
@@ -289,6 +381,104 @@ type bulkDelete struct {
 	maxFailedDeletes     int
 }
 
+// run deletes the objects and containers listed in body, skipping the first
+// res.Processed lines and res.ContainersProcessed containers, which an
+// earlier run already did. If checkpoint isn't nil it's called after each
+// delete, and stops the run by returning false.
+func (b *bulkDelete) run(request *http.Request, body io.Reader, res *bulkResult, checkpoint func() bool) (int, string) {
+	ctx := GetProxyContext(request)
+	apiReq, account, _, _ := getPathSegments(request.URL.Path)
+	skip := res.Processed
+	skipContainers := res.ContainersProcessed
+	tooMany := func() bool {
+		return res.NumberDeleted+res.NumberNotFound+len(res.Errors) > b.maxDeletesPerRequest || len(res.Errors) > b.maxFailedDeletes
+	}
+	deleteItem := func(subpath string) bool {
+		subreq, err := ctx.newSubrequest("DELETE", "/"+path.Join(apiReq, account, subpath), nil, request, "bulkdelete")
+		if err != nil {
+			res.Errors = append(res.Errors, []string{subpath, httpStatusString(http.StatusInternalServerError)})
+			return false
+		}
+		subrec := httptest.NewRecorder()
+		ctx.serveHTTPSubrequest(subrec, subreq)
+		subresp := subrec.Result()
+		subresp.Body.Close()
+		if subresp.StatusCode/100 == 5 {
+			res.Errors = append(res.Errors, []string{subpath, httpStatusString(subresp.StatusCode)})
+			res.FailureStatus = http.StatusBadGateway
+		} else if subresp.StatusCode == http.StatusNotFound {
+			res.NumberNotFound++
+		} else if subresp.StatusCode/100 != 2 {
+			res.Errors = append(res.Errors, []string{subpath, httpStatusString(subresp.StatusCode)})
+		} else {
+			res.NumberDeleted++
+		}
+		return checkpoint == nil || checkpoint()
+	}
+	containersToDelete := []string{}
+	scanner := bufio.NewScanner(body)
+	// "/c/o\n" *3 because everything could be url-encoded excepting the newline
+	maxLineLength := (common.MAX_CONTAINER_NAME_LENGTH+common.MAX_OBJECT_NAME_LENGTH+2)*3 + 1
+	scanner.Buffer(make([]byte, maxLineLength), maxLineLength)
+	carryOn := true
+	for line := 1; carryOn && scanner.Scan(); line++ {
+		if tooMany() {
+			break
+		}
+		subpath := scanner.Text()
+		u, err := url.Parse(subpath)
+		if err != nil {
+			if line > skip {
+				res.Errors = append(res.Errors, []string{subpath, httpStatusString(http.StatusBadRequest)})
+				res.Processed = line
+			}
+			continue
+		}
+		subpath = u.Path
+		subpath = strings.TrimPrefix(subpath, "/")
+		parts := strings.SplitN(subpath, "/", 2)
+		switch len(parts) {
+		case 0:
+			if line > skip {
+				res.Errors = append(res.Errors, []string{subpath, httpStatusString(http.StatusBadRequest)})
+				res.Processed = line
+			}
+			continue
+		case 1:
+			// Containers are deleted last, so they're collected even from the
+			// lines being skipped.
+			containersToDelete = append(containersToDelete, parts[0])
+			if line > skip {
+				res.Processed = line
+			}
+			continue
+		}
+		if line > skip {
+			res.Processed = line
+			carryOn = deleteItem(subpath)
+		}
+	}
+	for i, container := range containersToDelete {
+		if !carryOn || tooMany() {
+			break
+		}
+		if i >= skipContainers {
+			res.ContainersProcessed = i + 1
+			carryOn = deleteItem("/" + container)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return http.StatusBadGateway, fmt.Sprintf("Invalid bulk delete: %s", err)
+	} else if len(res.Errors) > 0 {
+		return res.failureStatus(), res.FailureBody
+	} else if res.NumberDeleted < 1 && res.NumberNotFound < 1 {
+		return http.StatusBadRequest, "Invalid bulk delete."
+	} else if res.NumberDeleted+res.NumberNotFound+len(res.Errors) > b.maxDeletesPerRequest {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Maximum Bulk Deletes: %d per request", b.maxDeletesPerRequest)
+	}
+	return http.StatusOK, ""
+}
+
 func (b *bulkDelete) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	accept := request.Header.Get("Accept")
 	outputType := "text"
@@ -322,105 +512,11 @@ func (b *bulkDelete) ServeHTTP(writer http.ResponseWriter, request *http.Request
 			}
 		}
 	}()
-	ctx := GetProxyContext(request)
-	apiReq, account, _, _ := getPathSegments(request.URL.Path)
-	numberDeleted := 0
-	numberNotFound := 0
-	failures := [][]string{}
-	failureResponseType := http.StatusBadRequest
-	failureResponseBody := ""
-	containersToDelete := []string{}
-	scanner := bufio.NewScanner(request.Body)
-	// "/c/o\n" *3 because everything could be url-encoded excepting the newline
-	maxLineLength := (common.MAX_CONTAINER_NAME_LENGTH+common.MAX_OBJECT_NAME_LENGTH+2)*3 + 1
-	scanner.Buffer(make([]byte, maxLineLength), maxLineLength)
-	for scanner.Scan() {
-		if numberDeleted+numberNotFound+len(failures) > b.maxDeletesPerRequest {
-			break
-		}
-		if len(failures) > b.maxFailedDeletes {
-			break
-		}
-		subpath := scanner.Text()
-		u, err := url.Parse(subpath)
-		if err != nil {
-			failures = append(failures, []string{subpath, httpStatusString(http.StatusBadRequest)})
-			continue
-		}
-		subpath = u.Path
-		subpath = strings.TrimPrefix(subpath, "/")
-		parts := strings.SplitN(subpath, "/", 2)
-		switch len(parts) {
-		case 0:
-			failures = append(failures, []string{subpath, httpStatusString(http.StatusBadRequest)})
-			continue
-		case 1:
-			containersToDelete = append(containersToDelete, parts[0])
-			continue
-		}
-		subreq, err := ctx.newSubrequest("DELETE", "/"+path.Join(apiReq, account, subpath), nil, request, "bulkdelete")
-		if err != nil {
-			failures = append(failures, []string{subpath, httpStatusString(http.StatusInternalServerError)})
-			return
-		}
-		subrec := httptest.NewRecorder()
-		ctx.serveHTTPSubrequest(subrec, subreq)
-		subresp := subrec.Result()
-		subresp.Body.Close()
-		if subresp.StatusCode/100 == 5 {
-			failures = append(failures, []string{subpath, httpStatusString(subresp.StatusCode)})
-			failureResponseType = http.StatusBadGateway
-		} else if subresp.StatusCode == http.StatusNotFound {
-			numberNotFound++
-		} else if subresp.StatusCode/100 != 2 {
-			failures = append(failures, []string{subpath, httpStatusString(subresp.StatusCode)})
-		} else {
-			numberDeleted++
-		}
-	}
-	for _, container := range containersToDelete {
-		if numberDeleted+numberNotFound+len(failures) > b.maxDeletesPerRequest {
-			break
-		}
-		if len(failures) > b.maxFailedDeletes {
-			break
-		}
-		subpath := "/" + container
-		subreq, err := ctx.newSubrequest("DELETE", "/"+path.Join(apiReq, account, subpath), nil, request, "bulkdelete")
-		if err != nil {
-			failures = append(failures, []string{subpath, httpStatusString(http.StatusInternalServerError)})
-			return
-		}
-		subrec := httptest.NewRecorder()
-		ctx.serveHTTPSubrequest(subrec, subreq)
-		subresp := subrec.Result()
-		subresp.Body.Close()
-		if subresp.StatusCode/100 == 5 {
-			failures = append(failures, []string{subpath, httpStatusString(subresp.StatusCode)})
-			failureResponseType = http.StatusBadGateway
-		} else if subresp.StatusCode == http.StatusNotFound {
-			numberNotFound++
-		} else if subresp.StatusCode/100 != 2 {
-			failures = append(failures, []string{subpath, httpStatusString(subresp.StatusCode)})
-		} else {
-			numberDeleted++
-		}
-	}
-	responseStatus := http.StatusOK
-	responseBody := ""
-	if err := scanner.Err(); err != nil {
-		responseStatus = http.StatusBadGateway
-		responseBody = fmt.Sprintf("Invalid bulk delete: %s", err)
-	} else if len(failures) > 0 {
-		responseStatus = failureResponseType
-		responseBody = failureResponseBody
-	} else if numberDeleted < 1 && numberNotFound < 1 {
-		responseStatus = http.StatusBadRequest
-		responseBody = "Invalid bulk delete."
-	} else if numberDeleted+numberNotFound+len(failures) > b.maxDeletesPerRequest {
-		responseStatus = http.StatusRequestEntityTooLarge
-		responseBody = fmt.Sprintf("Maximum Bulk Deletes: %d per request", b.maxDeletesPerRequest)
-	}
+	res := &bulkResult{Errors: [][]string{}}
+	responseStatus, responseBody := b.run(request, request.Body, res, nil)
+	numberDeleted := res.NumberDeleted
+	numberNotFound := res.NumberNotFound
+	failures := res.Errors
 	close(stopTheSpaces)
 	if <-hasEmittedSpaces {
 		// Not sure why, but the Swift code uses \r\n here and \n everywhere else.
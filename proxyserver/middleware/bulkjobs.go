@@ -0,0 +1,436 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+const (
+	// bulkJobsAccount has a container for each account with asynchronous
+	// bulk jobs, holding each job's record, named by its id, its input,
+	// <id>/input, and, when it's been cancelled, <id>/cancel.
+	bulkJobsAccount = ".bulk_jobs"
+
+	bulkJobDelete  = "bulk-delete"
+	bulkJobExtract = "extract-archive"
+
+	bulkJobRunning   = "running"
+	bulkJobComplete  = "complete"
+	bulkJobCancelled = "cancelled"
+	bulkJobFailed    = "failed"
+)
+
+// bulkJob is the record of an asynchronous bulk delete or archive extraction,
+// and what requests for its status get back.
+type bulkJob struct {
+	ID             string `json:"id"`
+	Operation      string `json:"operation"`
+	Path           string `json:"path"`
+	Format         string `json:"format,omitempty"`
+	ContentType    string `json:"content_type,omitempty"`
+	Status         string `json:"status"`
+	Started        int64  `json:"started"`
+	Updated        int64  `json:"updated"`
+	ResponseStatus string `json:"response_status,omitempty"`
+	ResponseBody   string `json:"response_body,omitempty"`
+	bulkResult
+}
+
+func (job *bulkJob) account() string {
+	_, account, _, _ := getPathSegments(job.Path)
+	return account
+}
+
+func (job *bulkJob) finished() bool {
+	return job.Status != bulkJobRunning
+}
+
+func (job *bulkJob) stale(after time.Duration) bool {
+	return time.Since(time.Unix(job.Updated, 0)) >= after
+}
+
+// bulkJobs runs asynchronous bulk jobs in the background. A job's progress is
+// saved every checkpointInterval, so that if its proxy goes away it can be
+// resumed from about where it got to.
+type bulkJobs struct {
+	lock                       sync.Mutex
+	running                    map[string]chan struct{}
+	maxJobs                    int
+	maxDeletesPerJob           int
+	maxFailedDeletes           int
+	maxContainersPerExtraction int
+	maxFailedExtractions       int
+	checkpointInterval         time.Duration
+	staleAfter                 time.Duration
+	expireAfter                time.Duration
+	startedMetric              tally.Counter
+	resumedMetric              tally.Counter
+	completedMetric            tally.Counter
+	cancelledMetric            tally.Counter
+}
+
+// reserve claims one of this proxy's job slots for the job, returning the
+// channel that cancels it.
+func (j *bulkJobs) reserve(id string) (chan struct{}, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if len(j.running) >= j.maxJobs || j.running[id] != nil {
+		return nil, false
+	}
+	cancel := make(chan struct{})
+	j.running[id] = cancel
+	return cancel, true
+}
+
+func (j *bulkJobs) release(id string) {
+	j.lock.Lock()
+	delete(j.running, id)
+	j.lock.Unlock()
+}
+
+// cancelRunning stops the job if this proxy is running it, returning whether
+// it was.
+func (j *bulkJobs) cancelRunning(id string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	cancel := j.running[id]
+	if cancel == nil {
+		return false
+	}
+	select {
+	case <-cancel:
+	default:
+		close(cancel)
+	}
+	return true
+}
+
+func (j *bulkJobs) isRunning(id string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.running[id] != nil
+}
+
+func (j *bulkJobs) runner(job *bulkJob) func(*http.Request, io.Reader, *bulkResult, func() bool) (int, string) {
+	if job.Operation == bulkJobDelete {
+		return (&bulkDelete{
+			maxDeletesPerRequest: j.maxDeletesPerJob,
+			maxFailedDeletes:     j.maxFailedDeletes,
+		}).run
+	}
+	b := &bulkPut{
+		maxContainersPerExtraction: j.maxContainersPerExtraction,
+		maxFailedExtractions:       j.maxFailedExtractions,
+		processBodyFunc:            bulkTarProcessors[job.Format],
+	}
+	return func(request *http.Request, body io.Reader, res *bulkResult, checkpoint func() bool) (int, string) {
+		return b.run(request, body, job.ContentType, res, checkpoint)
+	}
+}
+
+func (j *bulkJobs) load(ctx *ProxyContext, account, id string) (*bulkJob, int) {
+	resp := ctx.C.GetObject(bulkJobsAccount, account, id, http.Header{"X-Trans-Id": {ctx.TxId}})
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, resp.StatusCode
+	}
+	job := &bulkJob{}
+	if err := json.NewDecoder(resp.Body).Decode(job); err != nil {
+		ctx.Logger.Error("Couldn't decode bulk job", zap.String("account", account), zap.String("id", id), zap.Error(err))
+		return nil, http.StatusInternalServerError
+	}
+	return job, resp.StatusCode
+}
+
+// save writes the job's record, which expires expireAfter the job finishes.
+func (j *bulkJobs) save(ctx *ProxyContext, job *bulkJob) int {
+	job.Updated = time.Now().Unix()
+	body, err := json.Marshal(job)
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	header := http.Header{
+		"Content-Length": {strconv.Itoa(len(body))},
+		"Content-Type":   {"application/json"},
+		"X-Timestamp":    {common.GetTimestamp()},
+		"X-Trans-Id":     {ctx.TxId},
+	}
+	if job.finished() && j.expireAfter > 0 {
+		header.Set("X-Delete-At", strconv.FormatInt(time.Now().Add(j.expireAfter).Unix(), 10))
+	}
+	resp := ctx.C.PutObject(bulkJobsAccount, job.account(), job.ID, header, bytes.NewReader(body))
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// finish saves a finished job's record and removes its input.
+func (j *bulkJobs) finish(ctx *ProxyContext, job *bulkJob) {
+	if status := j.save(ctx, job); status/100 != 2 {
+		ctx.Logger.Error("Couldn't save bulk job", zap.String("id", job.ID), zap.Int("status", status))
+	}
+	ctx.deleteHiddenObject(bulkJobsAccount, job.account(), job.ID+"/input")
+	ctx.deleteHiddenObject(bulkJobsAccount, job.account(), job.ID+"/cancel")
+}
+
+func (j *bulkJobs) cancelRequested(ctx *ProxyContext, job *bulkJob) bool {
+	resp := ctx.C.HeadObject(bulkJobsAccount, job.account(), job.ID+"/cancel", http.Header{"X-Trans-Id": {ctx.TxId}})
+	resp.Body.Close()
+	return resp.StatusCode/100 == 2
+}
+
+// work runs the job, with request carrying the identity of whoever started
+// or resumed it.
+func (j *bulkJobs) work(request *http.Request, job *bulkJob, cancel chan struct{}) {
+	defer j.release(job.ID)
+	ctx := GetProxyContext(request)
+	resp := ctx.C.GetObject(bulkJobsAccount, job.account(), job.ID+"/input", http.Header{"X-Trans-Id": {ctx.TxId}})
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		ctx.Logger.Error("Couldn't read bulk job input", zap.String("id", job.ID), zap.Int("status", resp.StatusCode))
+		job.Status = bulkJobFailed
+		job.ResponseStatus = httpStatusString(http.StatusInternalServerError)
+		job.ResponseBody = "The job's input couldn't be read."
+		j.finish(ctx, job)
+		return
+	}
+	cancelled := false
+	lastSave := time.Now()
+	checkpoint := func() bool {
+		select {
+		case <-cancel:
+			cancelled = true
+			return false
+		default:
+		}
+		if time.Since(lastSave) < j.checkpointInterval {
+			return true
+		}
+		lastSave = time.Now()
+		if j.cancelRequested(ctx, job) {
+			cancelled = true
+			return false
+		}
+		if status := j.save(ctx, job); status/100 != 2 {
+			ctx.Logger.Error("Couldn't save bulk job progress", zap.String("id", job.ID), zap.Int("status", status))
+		}
+		return true
+	}
+	responseStatus, responseBody := j.runner(job)(request, resp.Body, &job.bulkResult, checkpoint)
+	if cancelled {
+		job.Status = bulkJobCancelled
+		j.cancelledMetric.Inc(1)
+	} else {
+		job.Status = bulkJobComplete
+		job.ResponseStatus = httpStatusString(responseStatus)
+		job.ResponseBody = responseBody
+		j.completedMetric.Inc(1)
+	}
+	j.finish(ctx, job)
+}
+
+func (j *bulkJobs) send(writer http.ResponseWriter, status int, job *bulkJob) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(status)
+	writer.Write(body)
+}
+
+// authorizeBulkJob checks that the request's user could POST to the account,
+// which is who may start and look after the account's bulk jobs.
+func authorizeBulkJob(writer http.ResponseWriter, request *http.Request, apiReq, account string) bool {
+	ctx := GetProxyContext(request)
+	if ctx.Authorize == nil {
+		return true
+	}
+	check := request.WithContext(request.Context())
+	check.Method = "POST"
+	check.URL = &url.URL{Path: "/" + apiReq + "/" + account}
+	if ok, s := ctx.Authorize(check); !ok {
+		srv.StandardResponse(writer, s)
+		return false
+	}
+	return true
+}
+
+// start stores the request's body and answers with the new job's record,
+// leaving the job running in the background.
+func (j *bulkJobs) start(writer http.ResponseWriter, request *http.Request, job *bulkJob) {
+	ctx := GetProxyContext(request)
+	apiReq, account, _, _ := getPathSegments(request.URL.Path)
+	if account == "" {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid bulk request.")
+		return
+	}
+	if !authorizeBulkJob(writer, request, apiReq, account) {
+		return
+	}
+	job.ID = common.UUID()
+	job.Path = request.URL.Path
+	job.Status = bulkJobRunning
+	job.Started = time.Now().Unix()
+	job.Updated = job.Started
+	job.Errors = [][]string{}
+	cancel, ok := j.reserve(job.ID)
+	if !ok {
+		srv.SimpleErrorResponse(writer, http.StatusServiceUnavailable, "Too many bulk jobs are running, try again later.")
+		return
+	}
+	record, err := json.Marshal(job)
+	if err != nil {
+		j.release(job.ID)
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	if status := ctx.putHiddenObject(bulkJobsAccount, account, job.ID, record); status/100 != 2 {
+		ctx.Logger.Error("Couldn't record bulk job", zap.String("id", job.ID), zap.Int("status", status))
+		j.release(job.ID)
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	header := http.Header{
+		"Content-Type": {"application/octet-stream"},
+		"X-Timestamp":  {common.GetTimestamp()},
+		"X-Trans-Id":   {ctx.TxId},
+	}
+	if request.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(request.ContentLength, 10))
+	}
+	resp := ctx.C.PutObject(bulkJobsAccount, account, job.ID+"/input", header, request.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		ctx.Logger.Error("Couldn't store bulk job input", zap.String("id", job.ID), zap.Int("status", resp.StatusCode))
+		ctx.deleteHiddenObject(bulkJobsAccount, account, job.ID)
+		j.release(job.ID)
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	jobreq, err := ctx.newBackgroundRequest(request.Method, job.Path, request)
+	if err != nil {
+		j.release(job.ID)
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	j.startedMetric.Inc(1)
+	writer.Header().Set("Location", "/"+apiReq+"/"+account+"?bulk-job="+url.QueryEscape(job.ID))
+	j.send(writer, http.StatusAccepted, job)
+	go j.work(jobreq, job, cancel)
+}
+
+// ServeHTTP handles requests for an account's existing job: GET for its
+// status, DELETE to cancel it and POST to resume it.
+func (j *bulkJobs) ServeHTTP(writer http.ResponseWriter, request *http.Request, id string) {
+	ctx := GetProxyContext(request)
+	apiReq, account, _, _ := getPathSegments(request.URL.Path)
+	if !authorizeBulkJob(writer, request, apiReq, account) {
+		return
+	}
+	if id == "" || strings.Contains(id, "/") {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid bulk job id.")
+		return
+	}
+	job, status := j.load(ctx, account, id)
+	if status == http.StatusNotFound {
+		srv.SimpleErrorResponse(writer, http.StatusNotFound, "No such bulk job.")
+		return
+	} else if job == nil {
+		srv.StandardResponse(writer, status)
+		return
+	}
+	switch request.Method {
+	case "GET", "HEAD":
+		j.send(writer, http.StatusOK, job)
+	case "DELETE":
+		j.cancel(writer, request, job)
+	case "POST":
+		j.resume(writer, request, job)
+	default:
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+	}
+}
+
+// cancel stops the job at its next checkpoint, wherever it's running. A job
+// that nothing is running any more is cancelled straight away.
+func (j *bulkJobs) cancel(writer http.ResponseWriter, request *http.Request, job *bulkJob) {
+	ctx := GetProxyContext(request)
+	if job.finished() {
+		srv.SimpleErrorResponse(writer, http.StatusConflict, "Bulk job has already finished.")
+		return
+	}
+	if status := ctx.putHiddenObject(bulkJobsAccount, job.account(), job.ID+"/cancel", nil); status/100 != 2 {
+		ctx.Logger.Error("Couldn't record bulk job cancellation", zap.String("id", job.ID), zap.Int("status", status))
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	if !j.cancelRunning(job.ID) && job.stale(j.staleAfter) {
+		job.Status = bulkJobCancelled
+		j.cancelledMetric.Inc(1)
+		j.finish(ctx, job)
+	}
+	j.send(writer, http.StatusAccepted, job)
+}
+
+// resume restarts a job whose proxy stopped saving its progress, carrying on
+// from its last checkpoint as the user resuming it.
+func (j *bulkJobs) resume(writer http.ResponseWriter, request *http.Request, job *bulkJob) {
+	ctx := GetProxyContext(request)
+	if job.finished() {
+		srv.SimpleErrorResponse(writer, http.StatusConflict, "Bulk job has already finished.")
+		return
+	}
+	if j.isRunning(job.ID) || !job.stale(j.staleAfter) {
+		srv.SimpleErrorResponse(writer, http.StatusConflict, "Bulk job is still running.")
+		return
+	}
+	cancel, ok := j.reserve(job.ID)
+	if !ok {
+		srv.SimpleErrorResponse(writer, http.StatusServiceUnavailable, "Too many bulk jobs are running, try again later.")
+		return
+	}
+	jobreq, err := ctx.newBackgroundRequest(request.Method, job.Path, request)
+	if err != nil {
+		j.release(job.ID)
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	if status := j.save(ctx, job); status/100 != 2 {
+		ctx.Logger.Error("Couldn't save bulk job", zap.String("id", job.ID), zap.Int("status", status))
+		j.release(job.ID)
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	j.resumedMetric.Inc(1)
+	j.send(writer, http.StatusAccepted, job)
+	go j.work(jobreq, job, cancel)
+}
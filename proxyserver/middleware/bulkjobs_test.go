@@ -0,0 +1,337 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/uber-go/tally"
+)
+
+// bulkJobsTestClient keeps the objects written to bulkJobsAccount.
+type bulkJobsTestClient struct {
+	client.ProxyClient
+	lock    sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header
+}
+
+func bulkJobsTestResponse(status int, body []byte) *http.Response {
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(body))}
+}
+
+func (c *bulkJobsTestClient) PutAccount(account string, headers http.Header) *http.Response {
+	return bulkJobsTestResponse(http.StatusCreated, nil)
+}
+
+func (c *bulkJobsTestClient) PutContainer(account string, container string, headers http.Header) *http.Response {
+	return bulkJobsTestResponse(http.StatusCreated, nil)
+}
+
+func (c *bulkJobsTestClient) PutObject(account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	body, err := ioutil.ReadAll(src)
+	if err != nil {
+		return bulkJobsTestResponse(http.StatusInternalServerError, nil)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.objects[container+"/"+obj] = body
+	c.headers[container+"/"+obj] = headers
+	return bulkJobsTestResponse(http.StatusCreated, nil)
+}
+
+func (c *bulkJobsTestClient) GetObject(account string, container string, obj string, headers http.Header) *http.Response {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if body, ok := c.objects[container+"/"+obj]; ok {
+		return bulkJobsTestResponse(http.StatusOK, body)
+	}
+	return bulkJobsTestResponse(http.StatusNotFound, nil)
+}
+
+func (c *bulkJobsTestClient) HeadObject(account string, container string, obj string, headers http.Header) *http.Response {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.objects[container+"/"+obj]; ok {
+		return bulkJobsTestResponse(http.StatusOK, nil)
+	}
+	return bulkJobsTestResponse(http.StatusNotFound, nil)
+}
+
+func (c *bulkJobsTestClient) DeleteObject(account string, container string, obj string, headers http.Header) *http.Response {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.objects[container+"/"+obj]; !ok {
+		return bulkJobsTestResponse(http.StatusNotFound, nil)
+	}
+	delete(c.objects, container+"/"+obj)
+	return bulkJobsTestResponse(http.StatusNoContent, nil)
+}
+
+func (c *bulkJobsTestClient) has(name string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.objects[name]
+	return ok
+}
+
+// bulkJobsTestStore is where the jobs' subrequests end up. When block is set
+// each DELETE waits for it to be closed, after saying so on entered.
+type bulkJobsTestStore struct {
+	lock    sync.Mutex
+	paths   map[string]bool
+	block   chan struct{}
+	entered chan struct{}
+}
+
+func (s *bulkJobsTestStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" && s.block != nil {
+		s.entered <- struct{}{}
+		<-s.block
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch r.Method {
+	case "PUT":
+		s.paths[r.URL.Path] = true
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		if !s.paths[r.URL.Path] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.paths, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *bulkJobsTestStore) has(path string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.paths[path]
+}
+
+type bulkJobsTest struct {
+	t         *testing.T
+	scope     tally.Scope
+	store     *bulkJobsTestStore
+	client    *bulkJobsTestClient
+	handler   http.Handler
+	authorize AuthorizeFunc
+}
+
+func newBulkJobsTest(t *testing.T, configString string, paths ...string) *bulkJobsTest {
+	config, err := conf.StringConfig("[filter:bulk]\n" + configString)
+	require.Nil(t, err)
+	scope := common.NewTestScope()
+	b, err := NewBulk(config.GetSection("filter:bulk"), scope)
+	require.Nil(t, err)
+	store := &bulkJobsTestStore{paths: map[string]bool{}}
+	for _, p := range paths {
+		store.paths[p] = true
+	}
+	return &bulkJobsTest{
+		t:       t,
+		scope:   scope,
+		store:   store,
+		client:  &bulkJobsTestClient{objects: map[string][]byte{}, headers: map[string]http.Header{}},
+		handler: b(store),
+	}
+}
+
+func (bt *bulkJobsTest) request(method, path string, body []byte) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, bytes.NewReader(body))
+	require.Nil(bt.t, err)
+	ctx := NewFakeProxyContext(bt.handler)
+	ctx.C = bt.client
+	ctx.Authorize = bt.authorize
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	rr := httptest.NewRecorder()
+	bt.handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func (bt *bulkJobsTest) job(rr *httptest.ResponseRecorder) *bulkJob {
+	job := &bulkJob{}
+	require.Nil(bt.t, json.Unmarshal(rr.Body.Bytes(), job))
+	return job
+}
+
+// wait polls the job's status until it's finished.
+func (bt *bulkJobsTest) wait(id string) *bulkJob {
+	for i := 0; i < 500; i++ {
+		rr := bt.request("GET", "/v1/a?bulk-job="+id, nil)
+		require.Equal(bt.t, 200, rr.Code)
+		if job := bt.job(rr); job.finished() && !bt.client.has("a/"+id+"/input") {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	bt.t.Fatal("bulk job didn't finish")
+	return nil
+}
+
+func TestBulkDeleteAsync(t *testing.T) {
+	bt := newBulkJobsTest(t, "", "/v1/a/c/o1", "/v1/a/c/o2", "/v1/a/c")
+	rr := bt.request("POST", "/v1/a?bulk-delete&async", []byte("c/o1\nc/o2\nc/o3\nc\n"))
+	require.Equal(t, 202, rr.Code)
+	job := bt.job(rr)
+	require.NotEqual(t, "", job.ID)
+	require.Equal(t, bulkJobDelete, job.Operation)
+	require.Equal(t, bulkJobRunning, job.Status)
+	require.Equal(t, "/v1/a?bulk-job="+job.ID, rr.Header().Get("Location"))
+
+	job = bt.wait(job.ID)
+	require.Equal(t, bulkJobComplete, job.Status)
+	require.Equal(t, "200 OK", job.ResponseStatus)
+	require.Equal(t, 4, job.Processed)
+	require.Equal(t, 3, job.NumberDeleted)
+	require.Equal(t, 1, job.NumberNotFound)
+	require.Equal(t, 0, len(job.Errors))
+	require.False(t, bt.store.has("/v1/a/c/o1"))
+	require.False(t, bt.store.has("/v1/a/c"))
+	require.NotEqual(t, "", bt.client.headers["a/"+job.ID].Get("X-Delete-At"))
+	require.Equal(t, int64(1), bt.scope.Counter("bulk_async_jobs_started").(*common.TestCounter).Value())
+	require.Equal(t, int64(1), bt.scope.Counter("bulk_async_jobs_completed").(*common.TestCounter).Value())
+}
+
+func TestBulkExtractAsync(t *testing.T) {
+	bt := newBulkJobsTest(t, "")
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, name := range []string{"c/x", "c/y"} {
+		require.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: 3, Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte("abc"))
+		require.Nil(t, err)
+	}
+	require.Nil(t, tw.Close())
+	rr := bt.request("PUT", "/v1/a?extract-archive=tar&async", buf.Bytes())
+	require.Equal(t, 202, rr.Code)
+	job := bt.wait(bt.job(rr).ID)
+	require.Equal(t, bulkJobComplete, job.Status)
+	require.Equal(t, "201 Created", job.ResponseStatus)
+	require.Equal(t, 2, job.NumberFilesCreated)
+	require.True(t, bt.store.has("/v1/a/c"))
+	require.True(t, bt.store.has("/v1/a/c/x"))
+	require.True(t, bt.store.has("/v1/a/c/y"))
+}
+
+func TestBulkJobCancel(t *testing.T) {
+	bt := newBulkJobsTest(t, "max_async_jobs = 1", "/v1/a/c/o1", "/v1/a/c/o2")
+	bt.store.block = make(chan struct{})
+	bt.store.entered = make(chan struct{}, 2)
+	rr := bt.request("POST", "/v1/a?bulk-delete&async", []byte("c/o1\nc/o2\n"))
+	require.Equal(t, 202, rr.Code)
+	id := bt.job(rr).ID
+	<-bt.store.entered
+
+	rr = bt.request("POST", "/v1/a?bulk-delete&async", []byte("c/o2\n"))
+	require.Equal(t, 503, rr.Code)
+	rr = bt.request("POST", "/v1/a?bulk-job="+id, nil)
+	require.Equal(t, 409, rr.Code)
+
+	rr = bt.request("DELETE", "/v1/a?bulk-job="+id, nil)
+	require.Equal(t, 202, rr.Code)
+	require.True(t, bt.client.has("a/"+id+"/cancel"))
+	close(bt.store.block)
+	job := bt.wait(id)
+	require.Equal(t, bulkJobCancelled, job.Status)
+	require.Equal(t, 1, job.Processed)
+	require.Equal(t, 1, job.NumberDeleted)
+	require.True(t, bt.store.has("/v1/a/c/o2"))
+	require.False(t, bt.client.has("a/"+id+"/cancel"))
+	require.Equal(t, int64(1), bt.scope.Counter("bulk_async_jobs_cancelled").(*common.TestCounter).Value())
+
+	rr = bt.request("DELETE", "/v1/a?bulk-job="+id, nil)
+	require.Equal(t, 409, rr.Code)
+}
+
+func TestBulkJobResume(t *testing.T) {
+	bt := newBulkJobsTest(t, "async_stale_after = 60", "/v1/a/c/o3")
+	job := &bulkJob{ID: "job1", Operation: bulkJobDelete, Path: "/v1/a", Status: bulkJobRunning, Updated: time.Now().Unix()}
+	job.Processed = 2
+	job.NumberDeleted = 2
+	job.Errors = [][]string{}
+	record, err := json.Marshal(job)
+	require.Nil(t, err)
+	bt.client.objects["a/job1"] = record
+	bt.client.objects["a/job1/input"] = []byte("c/o1\nc/o2\nc/o3\n")
+
+	rr := bt.request("POST", "/v1/a?bulk-job=job1", nil)
+	require.Equal(t, 409, rr.Code)
+
+	job.Updated = time.Now().Add(-time.Hour).Unix()
+	record, err = json.Marshal(job)
+	require.Nil(t, err)
+	bt.client.objects["a/job1"] = record
+	rr = bt.request("POST", "/v1/a?bulk-job=job1", nil)
+	require.Equal(t, 202, rr.Code)
+	job = bt.wait("job1")
+	require.Equal(t, bulkJobComplete, job.Status)
+	require.Equal(t, 3, job.Processed)
+	require.Equal(t, 3, job.NumberDeleted)
+	require.Equal(t, 0, job.NumberNotFound)
+	require.False(t, bt.store.has("/v1/a/c/o3"))
+	require.Equal(t, int64(1), bt.scope.Counter("bulk_async_jobs_resumed").(*common.TestCounter).Value())
+
+	rr = bt.request("POST", "/v1/a?bulk-job=job1", nil)
+	require.Equal(t, 409, rr.Code)
+}
+
+func TestBulkJobRequests(t *testing.T) {
+	bt := newBulkJobsTest(t, "", "/v1/a/c/o1")
+	rr := bt.request("GET", "/v1/a?bulk-job=nope", nil)
+	require.Equal(t, 404, rr.Code)
+	rr = bt.request("GET", "/v1/a?bulk-job=nope/input", nil)
+	require.Equal(t, 400, rr.Code)
+
+	var method string
+	bt.authorize = func(r *http.Request) (bool, int) {
+		method = r.Method
+		return false, http.StatusForbidden
+	}
+	rr = bt.request("DELETE", "/v1/a?bulk-delete&async", []byte("c/o1\n"))
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, "POST", method)
+	rr = bt.request("GET", "/v1/a?bulk-job=nope", nil)
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 0, len(bt.client.objects))
+}
+
+func TestBulkAsyncDisabled(t *testing.T) {
+	bt := newBulkJobsTest(t, "max_async_jobs = 0", "/v1/a/c/o1")
+	rr := bt.request("POST", "/v1/a?bulk-delete&async", []byte("c/o1\n"))
+	require.Equal(t, 200, rr.Code)
+	require.True(t, strings.Contains(rr.Body.String(), "Number Deleted: 1\n"))
+	require.Equal(t, 0, len(bt.client.objects))
+}
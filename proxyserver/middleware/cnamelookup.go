@@ -0,0 +1,209 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// CNAMEResolver finds the target of a host name's CNAME record. It returns
+// the name itself, or an empty string, if the name doesn't have one.
+type CNAMEResolver interface {
+	LookupCNAME(host string) (string, error)
+}
+
+var cnameResolvers = map[string]func(conf.Section) (CNAMEResolver, error){
+	"dns": newDNSResolver,
+}
+
+// RegisterCNAMEResolver makes a CNAMEResolver available to the cname_lookup
+// middleware's resolver option. It is meant to be called from an init
+// function.
+func RegisterCNAMEResolver(name string, constructor func(conf.Section) (CNAMEResolver, error)) {
+	cnameResolvers[name] = constructor
+}
+
+// dnsResolver looks up CNAMEs with the system's resolver, or with the
+// nameservers given in the config.
+type dnsResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+}
+
+func newDNSResolver(config conf.Section) (CNAMEResolver, error) {
+	r := &dnsResolver{
+		resolver: net.DefaultResolver,
+		timeout:  time.Duration(config.GetFloat("lookup_timeout", 5) * float64(time.Second)),
+	}
+	var nameservers []string
+	for _, ns := range strings.Split(config.GetDefault("nameservers", ""), ",") {
+		if ns = strings.TrimSpace(ns); ns == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			ns = net.JoinHostPort(ns, "53")
+		}
+		nameservers = append(nameservers, ns)
+	}
+	if len(nameservers) > 0 {
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				var err error
+				for _, ns := range nameservers {
+					var conn net.Conn
+					if conn, err = d.DialContext(ctx, network, ns); err == nil {
+						return conn, nil
+					}
+				}
+				return nil, err
+			},
+		}
+	}
+	return r, nil
+}
+
+func (r *dnsResolver) LookupCNAME(host string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	cname, err := r.resolver.LookupCNAME(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(cname, "."), nil
+}
+
+// cnameLookup lets customers point their own domains at a container with a
+// CNAME record, by replacing a request's host with the storage domain host
+// the CNAME leads to, for domain_remap to turn into a path.
+type cnameLookup struct {
+	next           http.Handler
+	storageDomains []string
+	lookupDepth    int
+	cacheTime      int
+	resolver       CNAMEResolver
+	lookupsMetric  tally.Counter
+	failuresMetric tally.Counter
+}
+
+func (c *cnameLookup) lookup(ctx *ProxyContext, name string) (string, error) {
+	key := "cname-" + strings.ToLower(name)
+	var target string
+	if ctx != nil && ctx.Cache != nil {
+		if err := ctx.Cache.GetStructured(key, &target); err == nil && target != "" {
+			return target, nil
+		}
+	}
+	c.lookupsMetric.Inc(1)
+	target, err := c.resolver.LookupCNAME(name)
+	if err != nil {
+		return "", err
+	}
+	if target != "" && ctx != nil && ctx.Cache != nil && c.cacheTime > 0 {
+		ctx.Cache.Set(key, target, c.cacheTime)
+	}
+	return target, nil
+}
+
+func (c *cnameLookup) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	host, port := hostName(request)
+	if host == "" || net.ParseIP(host) != nil {
+		c.next.ServeHTTP(writer, request)
+		return
+	}
+	if _, ok := inStorageDomain(host, c.storageDomains); ok {
+		c.next.ServeHTTP(writer, request)
+		return
+	}
+	for _, d := range c.storageDomains {
+		if strings.EqualFold(strings.TrimSuffix(host, "."), d[1:]) {
+			c.next.ServeHTTP(writer, request)
+			return
+		}
+	}
+	name := host
+	for i := 0; i < c.lookupDepth; i++ {
+		target, err := c.lookup(ctx, name)
+		if err != nil && ctx != nil {
+			ctx.Logger.Debug("CNAME lookup failed", zap.String("host", name), zap.Error(err))
+		}
+		if err != nil || target == "" || strings.EqualFold(target, name) {
+			c.failuresMetric.Inc(1)
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "CNAME lookup failed to resolve to a valid domain")
+			return
+		}
+		if _, ok := inStorageDomain(target, c.storageDomains); ok {
+			if port != "" {
+				target = net.JoinHostPort(target, port)
+			}
+			request.Host = target
+			c.next.ServeHTTP(writer, request)
+			return
+		}
+		name = target
+	}
+	c.failuresMetric.Inc(1)
+	srv.SimpleErrorResponse(writer, http.StatusBadRequest, fmt.Sprintf("CNAME lookup failed after %d tries", c.lookupDepth))
+}
+
+func NewCNAMELookup(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	storageDomains := storageDomainList(config.GetDefault("storage_domain", ""))
+	if len(storageDomains) == 0 {
+		return nil, fmt.Errorf("cname_lookup needs a storage_domain")
+	}
+	name := config.GetDefault("resolver", "dns")
+	constructor, ok := cnameResolvers[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown CNAME resolver %q", name)
+	}
+	resolver, err := constructor(config)
+	if err != nil {
+		return nil, err
+	}
+	lookupDepth := int(config.GetInt("lookup_depth", 1))
+	if lookupDepth < 1 {
+		lookupDepth = 1
+	}
+	cacheTime := int(config.GetInt("cache_time", 300))
+	RegisterInfo("cname_lookup", map[string]interface{}{
+		"lookup_depth": lookupDepth,
+	})
+	lookupsMetric := metricsScope.Counter("cname_lookups")
+	failuresMetric := metricsScope.Counter("cname_lookup_failures")
+	return func(next http.Handler) http.Handler {
+		return &cnameLookup{
+			next:           next,
+			storageDomains: storageDomains,
+			lookupDepth:    lookupDepth,
+			cacheTime:      cacheTime,
+			resolver:       resolver,
+			lookupsMetric:  lookupsMetric,
+			failuresMetric: failuresMetric,
+		}
+	}, nil
+}
@@ -0,0 +1,122 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+type fakeCNAMEResolver struct {
+	records map[string]string
+	lookups []string
+}
+
+func (r *fakeCNAMEResolver) LookupCNAME(host string) (string, error) {
+	r.lookups = append(r.lookups, host)
+	if target, ok := r.records[host]; ok {
+		return target, nil
+	}
+	return "", errors.New("no such host")
+}
+
+var testCNAMEResolver = &fakeCNAMEResolver{records: map[string]string{
+	"www.customer.com":   "c.auth-a.example.com",
+	"customer.com":       "www.customer.com",
+	"plain.customer.com": "plain.customer.com",
+	"away.customer.com":  "somewhere.else.com",
+}}
+
+func init() {
+	RegisterCNAMEResolver("test", func(conf.Section) (CNAMEResolver, error) {
+		return testCNAMEResolver, nil
+	})
+}
+
+func cnameTestRequest(t *testing.T, config, host string, mc *test.FakeMemcacheRing) (*httptest.ResponseRecorder, string) {
+	c, err := conf.StringConfig("[filter:cname_lookup]\nstorage_domain = example.com\nresolver = test\n" + config)
+	require.Nil(t, err)
+	cl, err := NewCNAMELookup(c.GetSection("filter:cname_lookup"), common.NewTestScope())
+	require.Nil(t, err)
+	var gotHost string
+	h := cl(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+	}))
+	req, err := http.NewRequest("GET", "/index.html", nil)
+	require.Nil(t, err)
+	req.Host = host
+	ctx := NewFakeProxyContext(h)
+	ctx.Cache = mc
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec, gotHost
+}
+
+func TestCNAMELookup(t *testing.T) {
+	mc := &test.FakeMemcacheRing{}
+	rec, host := cnameTestRequest(t, "", "www.customer.com:8080", mc)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "c.auth-a.example.com:8080", host)
+	require.Equal(t, []interface{}{"c.auth-a.example.com"}, mc.MockSetValues)
+
+	// Hosts in the storage domain, and addresses, are left alone.
+	for _, h := range []string{"c.auth-a.example.com", "example.com", "127.0.0.1:8080", "[::1]:8080"} {
+		rec, host = cnameTestRequest(t, "", h, mc)
+		require.Equal(t, 200, rec.Code)
+		require.Equal(t, h, host)
+	}
+
+	for _, h := range []string{"plain.customer.com", "away.customer.com", "unknown.customer.com"} {
+		rec, _ = cnameTestRequest(t, "", h, mc)
+		require.Equal(t, 400, rec.Code, h)
+	}
+
+	// Chains of CNAMEs are followed as far as lookup_depth allows.
+	rec, _ = cnameTestRequest(t, "", "customer.com", mc)
+	require.Equal(t, 400, rec.Code)
+	require.Equal(t, "CNAME lookup failed after 1 tries", rec.Body.String())
+	rec, host = cnameTestRequest(t, "lookup_depth = 2\n", "customer.com", mc)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "c.auth-a.example.com", host)
+}
+
+func TestCNAMELookupCached(t *testing.T) {
+	testCNAMEResolver.lookups = nil
+	mc := &test.FakeMemcacheRing{MockGetStructured: map[string][]byte{"cname-cached.customer.com": []byte(`"c.auth-b.example.com"`)}}
+	rec, host := cnameTestRequest(t, "", "cached.customer.com", mc)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "c.auth-b.example.com", host)
+	require.Nil(t, testCNAMEResolver.lookups)
+	require.Nil(t, mc.MockSetValues)
+}
+
+func TestCNAMELookupConfig(t *testing.T) {
+	_, err := NewCNAMELookup(conf.Section{}, common.NewTestScope())
+	require.NotNil(t, err)
+	c, err := conf.StringConfig("[filter:cname_lookup]\nstorage_domain = example.com\nresolver = crystal-ball\n")
+	require.Nil(t, err)
+	_, err = NewCNAMELookup(c.GetSection("filter:cname_lookup"), common.NewTestScope())
+	require.NotNil(t, err)
+}
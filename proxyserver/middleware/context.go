@@ -16,11 +16,14 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -31,19 +34,13 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"go.uber.org/zap"
 )
 
 var (
-	serverInfo     = make(map[string]interface{})
-	sil            sync.Mutex
-	excludeHeaders = []string{
-		"X-Account-Sysmeta-",
-		"X-Container-Sysmeta-",
-		"X-Object-Sysmeta-",
-		"X-Object-Transient-Sysmeta-",
-		"X-Backend-",
-	}
+	serverInfo = make(map[string]interface{})
+	sil        sync.Mutex
 )
 
 func RegisterInfo(name string, data interface{}) {
@@ -63,6 +60,7 @@ type AccountInfo struct {
 	ContainerCount int64
 	ObjectCount    int64
 	ObjectBytes    int64
+	PolicyBytes    map[string]int64
 	Metadata       map[string]string
 	SysMetadata    map[string]string
 	StatusCode     int `json:"status"`
@@ -84,16 +82,24 @@ type ProxyContext struct {
 	C                client.ProxyClient
 	Authorize        AuthorizeFunc
 	RemoteUsers      []string
+	S3Auth           *S3AuthInfo
 	StorageOwner     bool
+	ResellerRequest  bool
 	ACL              string
 	subrequestCopy   subrequestCopy
 	Logger           *zap.Logger
 	TxId             string
+	Span             *tracing.Span
 	responseSent     time.Time
 	status           int
 	accountInfoCache map[string]*AccountInfo
 	depth            int
 	Source           string
+	// remappedPrefix is what domain_remap added to the front of the path.
+	remappedPrefix string
+	// ratelimited is set once ratelimit has charged the request, and passed
+	// on to its subrequests so they aren't charged again.
+	ratelimited bool
 }
 
 func GetProxyContext(r *http.Request) *ProxyContext {
@@ -107,6 +113,15 @@ func (ctx *ProxyContext) Response() (time.Time, int) {
 	return ctx.responseSent, ctx.status
 }
 
+// clientPath returns the request's path as the client sent it, before
+// domain_remap added the account and container to it.
+func (ctx *ProxyContext) clientPath(request *http.Request) string {
+	if ctx.remappedPrefix == "" || !strings.HasPrefix(request.URL.Path, ctx.remappedPrefix) {
+		return request.URL.Path
+	}
+	return "/" + strings.TrimPrefix(request.URL.Path[len(ctx.remappedPrefix):], "/")
+}
+
 func (ctx *ProxyContext) addSubrequestCopy(f subrequestCopy) {
 	if ctx.subrequestCopy == nil {
 		ctx.subrequestCopy = f
@@ -140,6 +155,21 @@ func getPathSegments(requestPath string) (string, string, string, string) {
 	}
 }
 
+// clientIP returns the address of the client, which is the first address in
+// X-Forwarded-For when the proxy is behind a load balancer that can be trusted
+// to set it.
+func clientIP(request *http.Request, useForwardedFor bool) string {
+	if useForwardedFor {
+		if xff := request.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
+
 func (ctx *ProxyContext) GetAccountInfo(account string) (*AccountInfo, error) {
 	key := fmt.Sprintf("account/%s", account)
 	ai := ctx.accountInfoCache[key]
@@ -159,6 +189,7 @@ func (ctx *ProxyContext) GetAccountInfo(account string) (*AccountInfo, error) {
 			return nil, fmt.Errorf("%d error retrieving info for account %s", resp.StatusCode, account)
 		}
 		ai = &AccountInfo{
+			PolicyBytes: make(map[string]int64),
 			Metadata:    make(map[string]string),
 			SysMetadata: make(map[string]string),
 			StatusCode:  resp.StatusCode,
@@ -178,6 +209,10 @@ func (ctx *ProxyContext) GetAccountInfo(account string) (*AccountInfo, error) {
 				ai.Metadata[k[15:]] = resp.Header.Get(k)
 			} else if strings.HasPrefix(k, "X-Account-Sysmeta-") {
 				ai.SysMetadata[k[18:]] = resp.Header.Get(k)
+			} else if strings.HasPrefix(k, "X-Account-Storage-Policy-") && strings.HasSuffix(k, "-Bytes-Used") && len(k) > 36 {
+				if used, err := strconv.ParseInt(resp.Header.Get(k), 10, 64); err == nil {
+					ai.PolicyBytes[strings.ToLower(k[25:len(k)-11])] = used
+				}
 			}
 		}
 		ctx.Cache.Set(key, ai, 30)
@@ -205,6 +240,39 @@ func (ctx *ProxyContext) AutoCreateAccount(account string, headers http.Header)
 	}
 }
 
+// putHiddenObject writes an object, usually empty, to a hidden account used
+// for bookkeeping, creating the account and container the first time.
+func (ctx *ProxyContext) putHiddenObject(account, container, name string, body []byte) int {
+	put := func() int {
+		resp := ctx.C.PutObject(account, container, name, http.Header{
+			"Content-Length": {strconv.Itoa(len(body))},
+			"Content-Type":   {"text/plain"},
+			"X-Timestamp":    {common.GetTimestamp()},
+			"X-Trans-Id":     {ctx.TxId},
+		}, bytes.NewReader(body))
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	status := put()
+	if status == http.StatusNotFound {
+		header := http.Header{"X-Timestamp": {common.GetTimestamp()}, "X-Trans-Id": {ctx.TxId}}
+		ctx.C.PutAccount(account, header).Body.Close()
+		ctx.C.PutContainer(account, container, header).Body.Close()
+		status = put()
+	}
+	return status
+}
+
+// deleteHiddenObject removes an object written by putHiddenObject.
+func (ctx *ProxyContext) deleteHiddenObject(account, container, name string) int {
+	resp := ctx.C.DeleteObject(account, container, name, http.Header{
+		"X-Timestamp": {common.GetTimestamp()},
+		"X-Trans-Id":  {ctx.TxId},
+	})
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
 func (ctx *ProxyContext) newSubrequest(method, urlStr string, body io.Reader, req *http.Request, source string) (*http.Request, error) {
 	if source == "" {
 		panic("Programmer error: You must supply the source with newSubrequest. If you want the subrequest to be treated a user request (billing, quotas, etc.) you can set the source to \"-\"")
@@ -220,6 +288,7 @@ func (ctx *ProxyContext) newSubrequest(method, urlStr string, body io.Reader, re
 		ProxyContextMiddleware: ctx.ProxyContextMiddleware,
 		Authorize:              ctx.Authorize,
 		RemoteUsers:            ctx.RemoteUsers,
+		S3Auth:                 ctx.S3Auth,
 		subrequestCopy:         ctx.subrequestCopy,
 		Logger:                 ctx.Logger.With(zap.String("src", source)),
 		C:                      ctx.C,
@@ -227,7 +296,9 @@ func (ctx *ProxyContext) newSubrequest(method, urlStr string, body io.Reader, re
 		accountInfoCache:       ctx.accountInfoCache,
 		status:                 500,
 		depth:                  ctx.depth + 1,
+		ratelimited:            ctx.ratelimited,
 		Source:                 source,
+		Span:                   ctx.Span,
 	}
 	subreq = subreq.WithContext(context.WithValue(req.Context(), "proxycontext", subctx))
 	if subctx.subrequestCopy != nil {
@@ -237,6 +308,9 @@ func (ctx *ProxyContext) newSubrequest(method, urlStr string, body io.Reader, re
 		subreq.Header.Set("Referer", v)
 	}
 	subreq.Header.Set("X-Trans-Id", subctx.TxId)
+	if v := req.Header.Get("Traceparent"); v != "" {
+		subreq.Header.Set("Traceparent", v)
+	}
 	subreq.Header.Set("X-Timestamp", common.GetTimestamp())
 	return subreq, nil
 }
@@ -253,6 +327,36 @@ func (ctx *ProxyContext) serveHTTPSubrequest(writer http.ResponseWriter, subreq
 	ctx.next.ServeHTTP(subwriter, subreq)
 }
 
+// newBackgroundRequest returns a request for path with the identity of req,
+// for work that carries on after req has been answered, like asynchronous
+// bulk jobs. Its context is never cancelled and it starts with empty caches,
+// and its subrequests are authorized as req's would be.
+func (ctx *ProxyContext) newBackgroundRequest(method, path string, req *http.Request) (*http.Request, error) {
+	bgreq, err := http.NewRequest(method, (&url.URL{Path: path}).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Header {
+		bgreq.Header[k] = append([]string(nil), v...)
+	}
+	transId := common.GetTransactionId()
+	logr := ctx.log.With(zap.String("txn", transId))
+	bgctx := &ProxyContext{
+		ProxyContextMiddleware: ctx.ProxyContextMiddleware,
+		Authorize:              ctx.Authorize,
+		RemoteUsers:            ctx.RemoteUsers,
+		S3Auth:                 ctx.S3Auth,
+		subrequestCopy:         ctx.subrequestCopy,
+		Logger:                 logr,
+		C:                      client.NewProxyClient(ctx.proxyDirectClient, ctx.Cache, make(map[string]*client.ContainerInfo), logr),
+		TxId:                   transId,
+		accountInfoCache:       make(map[string]*AccountInfo),
+		status:                 500,
+	}
+	bgreq.Header.Set("X-Trans-Id", transId)
+	return bgreq.WithContext(context.WithValue(context.Background(), "proxycontext", bgctx)), nil
+}
+
 func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	if !srv.ValidateRequest(writer, request) {
 		return
@@ -286,14 +390,8 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 		}
 	}
 
-	for k := range request.Header {
-		for _, ex := range excludeHeaders {
-			if strings.HasPrefix(k, ex) || k == "X-Timestamp" {
-				delete(request.Header, k)
-			}
-		}
-	}
-
+	// Only andrewd's own backend requests may say they're migrating a container.
+	request.Header.Del(common.PolicyMigrationHeader)
 	transId := common.GetTransactionId()
 	request.Header.Set("X-Trans-Id", transId)
 	writer.Header().Set("X-Trans-Id", transId)
@@ -309,6 +407,15 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 		accountInfoCache:       make(map[string]*AccountInfo),
 		C:                      client.NewProxyClient(m.proxyDirectClient, m.Cache, make(map[string]*client.ContainerInfo), logr),
 	}
+	ctx.Span = tracing.Default().StartSpanFromHeader(request.Method, tracing.KindServer, request.Header)
+	ctx.Span.SetAttribute("http.method", request.Method)
+	ctx.Span.SetAttribute("http.target", request.URL.Path)
+	ctx.Span.SetAttribute("txn", transId)
+	ctx.Span.Inject(request.Header)
+	defer func() {
+		ctx.Span.SetStatus(ctx.status)
+		ctx.Span.Finish()
+	}()
 	// we'll almost certainly need the AccountInfo and ContainerInfo for the current path, so pre-fetch them in parallel.
 	apiRequest, account, container, _ := getPathParts(request)
 	if apiRequest && account != "" {
@@ -328,17 +435,6 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 		wg.Wait()
 	}
 	newWriter := srv.NewCustomWriter(writer, func(w http.ResponseWriter, status int) int {
-		// strip out any bad headers before calling real WriteHeader
-		for k := range w.Header() {
-			if k == "X-Account-Sysmeta-Project-Domain-Id" {
-				w.Header().Set("X-Account-Project-Domain-Id", w.Header().Get(k))
-			}
-			for _, ex := range excludeHeaders {
-				if strings.HasPrefix(k, ex) {
-					delete(w.Header(), k)
-				}
-			}
-		}
 		if status == http.StatusUnauthorized && w.Header().Get("Www-Authenticate") == "" {
 			if account != "" {
 				w.Header().Set("Www-Authenticate", fmt.Sprintf("Swift realm=\"%s\"", common.Urlencode(account)))
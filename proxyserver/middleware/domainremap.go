@@ -0,0 +1,159 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+// domainRemap turns requests for container.AUTH-account.<storage domain>/path
+// into requests for /v1/AUTH_account/container/path, so that static websites
+// can be served from their own host names.
+type domainRemap struct {
+	next                  http.Handler
+	storageDomains        []string
+	pathRoot              string
+	resellerPrefixes      []string
+	defaultResellerPrefix string
+	remapsMetric          tally.Counter
+}
+
+// storageDomainList parses a storage_domain setting into its domains, each
+// with a leading dot.
+func storageDomainList(value string) []string {
+	var domains []string
+	for _, d := range strings.Split(value, ",") {
+		if d = strings.ToLower(strings.Trim(strings.TrimSpace(d), ".")); d != "" {
+			domains = append(domains, "."+d)
+		}
+	}
+	return domains
+}
+
+// hostName returns the request's host without its port, and the port.
+func hostName(request *http.Request) (string, string) {
+	if host, port, err := net.SplitHostPort(request.Host); err == nil {
+		return host, port
+	}
+	return request.Host, ""
+}
+
+// inStorageDomain returns the part of host before whichever of the storage
+// domains it's in, and whether it was in one.
+func inStorageDomain(host string, domains []string) (string, bool) {
+	lower := strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range domains {
+		if strings.HasSuffix(lower, d) {
+			return host[:len(lower)-len(d)], true
+		}
+	}
+	return "", false
+}
+
+func (d *domainRemap) account(name string) string {
+	if i := strings.Index(name, "-"); i > 0 {
+		for _, prefix := range d.resellerPrefixes {
+			if strings.EqualFold(name[:i], prefix) {
+				return prefix + "_" + name[i+1:]
+			}
+		}
+	}
+	if d.defaultResellerPrefix != "" {
+		return d.defaultResellerPrefix + "_" + name
+	}
+	return ""
+}
+
+func (d *domainRemap) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	host, _ := hostName(request)
+	if net.ParseIP(host) != nil {
+		d.next.ServeHTTP(writer, request)
+		return
+	}
+	sub, ok := inStorageDomain(host, d.storageDomains)
+	if !ok || sub == "" {
+		d.next.ServeHTTP(writer, request)
+		return
+	}
+	parts := strings.Split(sub, ".")
+	var container string
+	switch len(parts) {
+	case 1:
+	case 2:
+		container = parts[0]
+	default:
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Bad domain in host header")
+		return
+	}
+	account := d.account(parts[len(parts)-1])
+	if account == "" {
+		d.next.ServeHTTP(writer, request)
+		return
+	}
+	prefix := "/" + d.pathRoot + "/" + account
+	if container != "" {
+		prefix += "/" + container
+	}
+	// Clients that already use the full path don't get it twice.
+	if request.URL.Path == prefix || strings.HasPrefix(request.URL.Path, prefix+"/") {
+		d.next.ServeHTTP(writer, request)
+		return
+	}
+	request.URL.Path = prefix + request.URL.Path
+	request.URL.RawPath = ""
+	if ctx != nil {
+		ctx.remappedPrefix = prefix
+	}
+	d.remapsMetric.Inc(1)
+	d.next.ServeHTTP(writer, request)
+}
+
+func NewDomainRemap(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	storageDomains := storageDomainList(config.GetDefault("storage_domain", ""))
+	if len(storageDomains) == 0 {
+		return nil, fmt.Errorf("domain_remap needs a storage_domain")
+	}
+	pathRoot := strings.Trim(config.GetDefault("path_root", "v1"), "/")
+	var resellerPrefixes []string
+	for _, p := range strings.Split(config.GetDefault("reseller_prefixes", "AUTH"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			resellerPrefixes = append(resellerPrefixes, p)
+		}
+	}
+	defaultResellerPrefix := config.GetDefault("default_reseller_prefix", "")
+	RegisterInfo("domain_remap", map[string]interface{}{
+		"default_reseller_prefix": defaultResellerPrefix,
+	})
+	remapsMetric := metricsScope.Counter("domain_remaps")
+	return func(next http.Handler) http.Handler {
+		return &domainRemap{
+			next:                  next,
+			storageDomains:        storageDomains,
+			pathRoot:              pathRoot,
+			resellerPrefixes:      resellerPrefixes,
+			defaultResellerPrefix: defaultResellerPrefix,
+			remapsMetric:          remapsMetric,
+		}
+	}, nil
+}
@@ -0,0 +1,80 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func domainRemapTestRequest(t *testing.T, config, host, path string) (*httptest.ResponseRecorder, string, string) {
+	c, err := conf.StringConfig("[filter:domain_remap]\n" + config)
+	require.Nil(t, err)
+	section := c.GetSection("filter:domain_remap")
+	dr, err := NewDomainRemap(section, common.NewTestScope())
+	require.Nil(t, err)
+	var gotPath, gotClientPath string
+	h := dr(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotClientPath = GetProxyContext(r).clientPath(r)
+	}))
+	req, err := http.NewRequest("GET", path, nil)
+	require.Nil(t, err)
+	req.Host = host
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", NewFakeProxyContext(h)))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec, gotPath, gotClientPath
+}
+
+func TestDomainRemap(t *testing.T) {
+	config := "storage_domain = example.com, .example.net\nreseller_prefixes = AUTH, SERVICE\n"
+	for _, tc := range []struct {
+		host, path, want, client string
+	}{
+		{"c.auth-a.example.com", "/", "/v1/AUTH_a/c/", "/"},
+		{"c.AUTH-a.example.com:8080", "/dir/index.html", "/v1/AUTH_a/c/dir/index.html", "/dir/index.html"},
+		{"c.service-a-b.example.net.", "/o", "/v1/SERVICE_a-b/c/o", "/o"},
+		{"auth-a.example.com", "/c/o", "/v1/AUTH_a/c/o", "/c/o"},
+		{"c.auth-a.example.com", "/v1/AUTH_a/c/o", "/v1/AUTH_a/c/o", "/v1/AUTH_a/c/o"},
+		{"c.other-a.example.com", "/o", "/o", "/o"},
+		{"example.com", "/v1/AUTH_a", "/v1/AUTH_a", "/v1/AUTH_a"},
+		{"c.auth-a.elsewhere.com", "/o", "/o", "/o"},
+		{"127.0.0.1:8080", "/v1/AUTH_a", "/v1/AUTH_a", "/v1/AUTH_a"},
+	} {
+		rec, path, client := domainRemapTestRequest(t, config, tc.host, tc.path)
+		require.Equal(t, 200, rec.Code, tc.host)
+		require.Equal(t, tc.want, path, tc.host)
+		require.Equal(t, tc.client, client, tc.host)
+	}
+
+	rec, _, _ := domainRemapTestRequest(t, config, "www.c.auth-a.example.com", "/")
+	require.Equal(t, 400, rec.Code)
+
+	_, path, _ := domainRemapTestRequest(t, "storage_domain = example.com\ndefault_reseller_prefix = AUTH\n", "c.a.example.com", "/o")
+	require.Equal(t, "/v1/AUTH_a/c/o", path)
+	_, path, _ = domainRemapTestRequest(t, "storage_domain = example.com\npath_root = v2\n", "c.auth-a.example.com", "/o")
+	require.Equal(t, "/v2/AUTH_a/c/o", path)
+
+	_, err := NewDomainRemap(conf.Section{}, common.NewTestScope())
+	require.NotNil(t, err)
+}
@@ -0,0 +1,96 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+// excludeHeaders are the header namespaces only the proxy and the backend
+// servers may use.
+var excludeHeaders = []string{
+	"X-Account-Sysmeta-",
+	"X-Container-Sysmeta-",
+	"X-Object-Sysmeta-",
+	"X-Object-Transient-Sysmeta-",
+	"X-Backend-",
+}
+
+func isExcludedHeader(k string) bool {
+	for _, ex := range excludeHeaders {
+		if strings.HasPrefix(k, ex) {
+			return true
+		}
+	}
+	return false
+}
+
+// gatekeeper keeps clients from sending or seeing the internal headers.
+// Subrequests from other middleware, which all come from newSubrequest, may
+// use them, including the ones with a Source of "-" that are otherwise
+// treated as client requests.
+type gatekeeper struct {
+	next            http.Handler
+	requestsMetric  tally.Counter
+	responsesMetric tally.Counter
+}
+
+func (g *gatekeeper) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if ctx := GetProxyContext(request); ctx != nil && (ctx.Source != "" || ctx.depth > 0) {
+		g.next.ServeHTTP(writer, request)
+		return
+	}
+	removed := false
+	for k := range request.Header {
+		if isExcludedHeader(k) {
+			delete(request.Header, k)
+			removed = true
+		}
+	}
+	if removed {
+		g.requestsMetric.Inc(1)
+	}
+	writer = srv.NewCustomWriter(writer, func(w http.ResponseWriter, status int) int {
+		removed := false
+		for k := range w.Header() {
+			if k == "X-Account-Sysmeta-Project-Domain-Id" {
+				w.Header().Set("X-Account-Project-Domain-Id", w.Header().Get(k))
+			}
+			if isExcludedHeader(k) {
+				delete(w.Header(), k)
+				removed = true
+			}
+		}
+		if removed {
+			g.responsesMetric.Inc(1)
+		}
+		return status
+	})
+	g.next.ServeHTTP(writer, request)
+}
+
+func NewGatekeeper(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	requestsMetric := metricsScope.Counter("gatekeeper_requests")
+	responsesMetric := metricsScope.Counter("gatekeeper_responses")
+	return func(next http.Handler) http.Handler {
+		return &gatekeeper{next: next, requestsMetric: requestsMetric, responsesMetric: responsesMetric}
+	}, nil
+}
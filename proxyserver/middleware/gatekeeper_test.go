@@ -0,0 +1,67 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func TestGatekeeper(t *testing.T) {
+	gk, err := NewGatekeeper(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	var got http.Header
+	var h http.Handler
+	h = gk(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/a/c/o" {
+			subreq, err := GetProxyContext(r).newSubrequest("HEAD", "/v1/a/c/sub", nil, r, "-")
+			require.Nil(t, err)
+			subreq.Header.Set("X-Object-Sysmeta-Sub", "yes")
+			subrec := httptest.NewRecorder()
+			GetProxyContext(r).serveHTTPSubrequest(subrec, subreq)
+			require.Equal(t, "yes", subrec.Header().Get("X-Object-Sysmeta-Sub"))
+			got = r.Header
+		}
+		for k, v := range r.Header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("X-Backend-Timestamp", "1")
+		w.Header().Set("X-Account-Sysmeta-Project-Domain-Id", "d")
+		w.WriteHeader(200)
+	}))
+	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
+	require.Nil(t, err)
+	for _, k := range []string{"X-Backend-Storage-Policy-Index", "X-Object-Sysmeta-Slo-Etag", "X-Object-Transient-Sysmeta-Crypto-Meta", "X-Container-Sysmeta-Versions-Location", "X-Account-Sysmeta-Core-Access-Control", "X-Object-Meta-Color"} {
+		req.Header.Set(k, "1")
+	}
+	ctx := NewFakeProxyContext(h)
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	require.Equal(t, http.Header{"X-Object-Meta-Color": {"1"}}, got)
+	require.Equal(t, "1", rec.Header().Get("X-Object-Meta-Color"))
+	require.Equal(t, "d", rec.Header().Get("X-Account-Project-Domain-Id"))
+	for k := range rec.Header() {
+		require.False(t, isExcludedHeader(k), k)
+	}
+}
@@ -0,0 +1,504 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// jwtKeySetMinRefresh is how often a token signed with an unknown key may
+// cause the key set to be reloaded early.
+const jwtKeySetMinRefresh = 10 * time.Second
+
+// jwk is a JSON Web Key, as found in a JWKS.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func jwkInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter %q", value)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey returns the key as an *rsa.PublicKey or *ecdsa.PublicKey.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := jwkInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := jwkInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := jwkInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := jwkInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC key is not on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// parseJWKS returns the signing keys in a JWKS by their key ids. Keys of
+// types that can't be used are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable keys")
+	}
+	return keys, nil
+}
+
+// jwtKeySet is the keys tokens are checked against, from a JWKS file or URL
+// that's reloaded every refresh.
+type jwtKeySet struct {
+	lock       sync.Mutex
+	file       string
+	url        string
+	client     *http.Client
+	refresh    time.Duration
+	loaded     time.Time
+	refreshing bool
+	keys       map[string]crypto.PublicKey
+}
+
+// fetch reads the key set. It's called without the lock held, since the JWKS
+// url may be slow to answer.
+func (ks *jwtKeySet) fetch() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if ks.file != "" {
+		if data, err = ioutil.ReadFile(ks.file); err != nil {
+			return nil, err
+		}
+	} else {
+		resp, err := ks.client.Get(ks.url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %d", ks.url, resp.StatusCode)
+		}
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	return parseJWKS(data)
+}
+
+// reload fetches the key set and swaps it in. Failed reloads are logged and
+// the keys already loaded are kept.
+func (ks *jwtKeySet) reload(logger *zap.Logger) {
+	keys, err := ks.fetch()
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.refreshing = false
+	if err != nil {
+		logger.Error("Unable to reload JWKS", zap.String("file", ks.file), zap.String("url", ks.url), zap.Error(err))
+		return
+	}
+	ks.keys = keys
+}
+
+// key returns the key with the given id, reloading the key set if it's due
+// or if the key isn't known, as happens just after keys are rotated. A known
+// key is returned straight away while a due reload happens in the background;
+// an unknown one waits for the reload.
+func (ks *jwtKeySet) key(kid string, logger *zap.Logger) (crypto.PublicKey, error) {
+	ks.lock.Lock()
+	key, ok := ks.keys[kid]
+	since := time.Since(ks.loaded)
+	due := !ks.refreshing && (since > ks.refresh || (!ok && since > jwtKeySetMinRefresh))
+	if due {
+		ks.loaded = time.Now()
+		ks.refreshing = true
+	}
+	ks.lock.Unlock()
+	if due && ok {
+		go ks.reload(logger)
+	} else if due {
+		ks.reload(logger)
+		ks.lock.Lock()
+		key, ok = ks.keys[kid]
+		ks.lock.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// jwtIdentity is who a token says its bearer is, cached by the hash of the
+// token until it expires.
+type jwtIdentity struct {
+	Account string
+	User    string
+	Groups  []string
+	Expires int64
+}
+
+type jwtAuth struct {
+	next               http.Handler
+	keys               *jwtKeySet
+	reseller           string
+	resellers          []string
+	issuer             string
+	audience           string
+	accountClaim       string
+	userClaim          string
+	groupsClaim        string
+	operatorGroups     []string
+	resellerAdminGroup string
+	leeway             int64
+	cacheTime          int64
+	validMetric        tally.Counter
+	invalidMetric      tally.Counter
+}
+
+func jwtClaimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// validate checks a token's signature and claims, returning who it
+// identifies.
+func (j *jwtAuth) validate(token string, logger *zap.Logger) (*jwtIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if data, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return nil, errors.New("malformed token header")
+	} else if err = json.Unmarshal(data, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	key, err := j.keys.key(header.Kid, logger)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("RS256 token signed with a non-RSA key")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], signature); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("ES256 token signed with a non-EC key")
+		}
+		if len(signature) != 64 || !ecdsa.Verify(pub, sum[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	var claims map[string]interface{}
+	if data, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, errors.New("malformed token claims")
+	} else if err = json.Unmarshal(data, &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	now := time.Now().Unix()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	} else if int64(exp)+j.leeway < now {
+		return nil, errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && int64(nbf)-j.leeway > now {
+		return nil, errors.New("token is not valid yet")
+	}
+	if j.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.issuer {
+			return nil, fmt.Errorf("token issued by %q", iss)
+		}
+	}
+	if j.audience != "" && !common.StringInSlice(j.audience, jwtClaimStrings(claims["aud"])) {
+		return nil, errors.New("token is for another audience")
+	}
+	identity := &jwtIdentity{Groups: jwtClaimStrings(claims[j.groupsClaim]), Expires: int64(exp)}
+	identity.Account, _ = claims[j.accountClaim].(string)
+	identity.User, _ = claims[j.userClaim].(string)
+	if identity.Account == "" || identity.User == "" || strings.Contains(identity.Account, "/") {
+		return nil, errors.New("token has no account or user")
+	}
+	return identity, nil
+}
+
+// identify returns the identity for a token, from the cache if it's been
+// seen before.
+func (j *jwtAuth) identify(ctx *ProxyContext, token string) (*jwtIdentity, error) {
+	key := fmt.Sprintf("jwt:%x", sha256.Sum256([]byte(token)))
+	var identity jwtIdentity
+	if err := ctx.Cache.GetStructured(key, &identity); err == nil && identity.Expires+j.leeway >= time.Now().Unix() {
+		return &identity, nil
+	}
+	id, err := j.validate(token, ctx.Logger)
+	if err != nil {
+		j.invalidMetric.Inc(1)
+		return nil, err
+	}
+	j.validMetric.Inc(1)
+	ttl := id.Expires + j.leeway - time.Now().Unix()
+	if ttl > j.cacheTime {
+		ttl = j.cacheTime
+	}
+	if ttl > 0 {
+		ctx.Cache.Set(key, id, int(ttl))
+	}
+	return id, nil
+}
+
+// bearerToken returns the token from an Authorization: Bearer header, or an
+// X-Auth-Token that looks like a JWT.
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	if token := r.Header.Get("X-Auth-Token"); strings.Count(token, ".") == 2 {
+		return token
+	}
+	return ""
+}
+
+func (j *jwtAuth) getReseller(account string) (string, bool) {
+	for _, r := range j.resellers {
+		if strings.HasPrefix(account, r) {
+			return r, true
+		}
+	}
+	return "", false
+}
+
+func (j *jwtAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	if ctx == nil || ctx.Authorize != nil {
+		j.next.ServeHTTP(writer, request)
+		return
+	}
+	pathParts, err := common.ParseProxyPath(request.URL.Path)
+	if err != nil {
+		j.next.ServeHTTP(writer, request)
+		return
+	}
+	if _, ok := j.getReseller(pathParts["account"]); !ok {
+		j.next.ServeHTTP(writer, request)
+		return
+	}
+	if token := bearerToken(request); token != "" {
+		identity, err := j.identify(ctx, token)
+		if err != nil {
+			ctx.Logger.Debug("Invalid JWT", zap.Error(err))
+			ctx.Authorize = func(r *http.Request) (bool, int) {
+				return false, http.StatusUnauthorized
+			}
+		} else {
+			ctx.RemoteUsers = append([]string{identity.Account, identity.Account + ":" + identity.User}, identity.Groups...)
+			ctx.Authorize = func(r *http.Request) (bool, int) {
+				return j.authorize(r, identity)
+			}
+		}
+	} else {
+		ctx.Authorize = func(r *http.Request) (bool, int) {
+			return j.authorize(r, nil)
+		}
+	}
+	j.next.ServeHTTP(writer, request)
+}
+
+// authorize allows a request by its identity, which is nil for anonymous
+// requests. Reseller admins own every account, the operators of an account
+// own it, and anyone else is allowed by the container's ACLs.
+func (j *jwtAuth) authorize(r *http.Request, identity *jwtIdentity) (bool, int) {
+	pathParts, err := common.ParseProxyPath(r.URL.Path)
+	if err != nil {
+		return false, http.StatusNotFound
+	}
+	if r.Method == "OPTIONS" {
+		return true, http.StatusOK
+	}
+	if _, ok := j.getReseller(pathParts["account"]); !ok {
+		return false, http.StatusUnauthorized
+	}
+	ctx := GetProxyContext(r)
+	if ctx == nil {
+		return false, http.StatusUnauthorized
+	}
+	s := http.StatusUnauthorized
+	if identity != nil {
+		s = http.StatusForbidden
+		if j.resellerAdminGroup != "" && common.StringInSlice(j.resellerAdminGroup, identity.Groups) &&
+			!strings.HasPrefix(pathParts["account"], ".") {
+			ctx.StorageOwner = true
+			ctx.ResellerRequest = true
+			return true, http.StatusOK
+		}
+		if pathParts["account"] == j.reseller+identity.Account &&
+			(pathParts["container"] != "" || (r.Method != "PUT" && r.Method != "DELETE")) {
+			operator := len(j.operatorGroups) == 0
+			for _, g := range j.operatorGroups {
+				if common.StringInSlice(g, identity.Groups) {
+					operator = true
+				}
+			}
+			if operator {
+				ctx.StorageOwner = true
+				return true, http.StatusOK
+			}
+		}
+	}
+	referrers, roles := ParseACL(ctx.ACL)
+	if auth, _ := AuthorizeUnconfirmedIdentity(r, pathParts["object"], referrers, roles); auth {
+		return true, http.StatusOK
+	}
+	if identity != nil {
+		for _, ru := range ctx.RemoteUsers {
+			if common.StringInSlice(ru, roles) {
+				return true, http.StatusOK
+			}
+		}
+	}
+	return false, s
+}
+
+func NewJWTAuth(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	keys := &jwtKeySet{
+		file:    config.GetDefault("jwks_file", ""),
+		url:     config.GetDefault("jwks_url", ""),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		refresh: time.Duration(config.GetInt("jwks_refresh", 3600)) * time.Second,
+		loaded:  time.Now(),
+	}
+	if (keys.file == "") == (keys.url == "") {
+		return nil, errors.New("jwtauth needs one of jwks_file or jwks_url")
+	}
+	var err error
+	if keys.keys, err = keys.fetch(); err != nil {
+		if keys.file != "" {
+			return nil, fmt.Errorf("Unable to load JWKS: %v", err)
+		}
+		// The JWKS url may just be unreachable for now, so it's tried again
+		// by the first request rather than failing startup.
+		keys.loaded = time.Time{}
+	}
+	resellerPrefixes, _ := conf.ReadResellerOptions(config, map[string][]string{})
+	j := &jwtAuth{
+		keys:               keys,
+		reseller:           resellerPrefixes[0],
+		resellers:          resellerPrefixes,
+		issuer:             config.GetDefault("issuer", ""),
+		audience:           config.GetDefault("audience", ""),
+		accountClaim:       config.GetDefault("account_claim", "sub"),
+		userClaim:          config.GetDefault("user_claim", "sub"),
+		groupsClaim:        config.GetDefault("groups_claim", "groups"),
+		operatorGroups:     strings.Fields(config.GetDefault("operator_groups", "")),
+		resellerAdminGroup: config.GetDefault("reseller_admin_group", ""),
+		leeway:             config.GetInt("leeway", 60),
+		cacheTime:          config.GetInt("cache_time", 300),
+		validMetric:        metricsScope.Counter("jwtauth_valid_tokens"),
+		invalidMetric:      metricsScope.Counter("jwtauth_invalid_tokens"),
+	}
+	return func(next http.Handler) http.Handler {
+		jj := *j
+		jj.next = next
+		return &jj
+	}, nil
+}
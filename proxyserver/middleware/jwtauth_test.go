@@ -0,0 +1,293 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func jwtTestB64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func jwtTestToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.Nil(t, err)
+	payload, err := json.Marshal(claims)
+	require.Nil(t, err)
+	signed := jwtTestB64(header) + "." + jwtTestB64(payload)
+	sum := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		require.Nil(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		require.Nil(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + jwtTestB64(sig)
+}
+
+func jwtTestJWKS(t *testing.T, path string, keys map[string]crypto.Signer) {
+	var jwks []map[string]string
+	for kid, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			jwks = append(jwks, map[string]string{"kty": "RSA", "kid": kid, "use": "sig",
+				"n": jwtTestB64(k.N.Bytes()), "e": jwtTestB64(big.NewInt(int64(k.E)).Bytes())})
+		case *ecdsa.PrivateKey:
+			jwks = append(jwks, map[string]string{"kty": "EC", "kid": kid, "crv": "P-256",
+				"x": jwtTestB64(k.X.Bytes()), "y": jwtTestB64(k.Y.Bytes())})
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{"keys": jwks})
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, data, 0600))
+}
+
+func newJWTAuthTestHandler(t *testing.T, jwksFile string) *jwtAuth {
+	config, err := conf.StringConfig(fmt.Sprintf("[filter:jwtauth]\njwks_file = %s\nissuer = https://idp\naudience = hummingbird\nreseller_admin_group = admins\n", jwksFile))
+	require.Nil(t, err)
+	j, err := NewJWTAuth(config.GetSection("filter:jwtauth"), common.NewTestScope())
+	require.Nil(t, err)
+	return j(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).(*jwtAuth)
+}
+
+func jwtTestClaims(sub string, groups ...string) map[string]interface{} {
+	return map[string]interface{}{"sub": sub, "iss": "https://idp", "aud": []string{"hummingbird"},
+		"exp": time.Now().Unix() + 600, "groups": groups}
+}
+
+// jwtTestAuthorize passes a request with the token through the middleware,
+// then authorizes it.
+func jwtTestAuthorize(t *testing.T, handler *jwtAuth, ctx *ProxyContext, method, path, token string) (bool, int) {
+	req, err := http.NewRequest(method, path, nil)
+	require.Nil(t, err)
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	ctx.Authorize = nil
+	ctx.RemoteUsers = nil
+	ctx.StorageOwner = false
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	require.NotNil(t, ctx.Authorize)
+	return ctx.Authorize(req)
+}
+
+func TestJWTAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	jwtTestJWKS(t, jwksFile, map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey})
+	handler := newJWTAuthTestHandler(t, jwksFile)
+	ctx := newTempAuthTestContext(handler)
+
+	token := jwtTestToken(t, "RS256", "rsa", rsaKey, jwtTestClaims("alice", "dev"))
+	ok, _ := jwtTestAuthorize(t, handler, ctx, "GET", "/v1/AUTH_alice/c", token)
+	require.True(t, ok)
+	require.True(t, ctx.StorageOwner)
+	require.Equal(t, []string{"alice", "alice:alice", "dev"}, ctx.RemoteUsers)
+	require.Equal(t, 1, len(ctx.Cache.(*test.FakeMemcacheRing).MockSetValues))
+	ok, s := jwtTestAuthorize(t, handler, ctx, "DELETE", "/v1/AUTH_alice", token)
+	require.False(t, ok)
+	require.Equal(t, 403, s)
+
+	token = jwtTestToken(t, "ES256", "ec", ecKey, jwtTestClaims("alice"))
+	ok, _ = jwtTestAuthorize(t, handler, ctx, "PUT", "/v1/AUTH_alice/c/o", token)
+	require.True(t, ok)
+
+	// Other accounts are only reachable through ACLs or by reseller admins.
+	ok, s = jwtTestAuthorize(t, handler, ctx, "GET", "/v1/AUTH_bob/c", token)
+	require.False(t, ok)
+	require.Equal(t, 403, s)
+	ctx.ACL = "dev,alice:alice"
+	req, err := http.NewRequest("GET", "/v1/AUTH_bob/c/o", nil)
+	require.Nil(t, err)
+	ok, _ = ctx.Authorize(req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx)))
+	require.True(t, ok)
+	require.False(t, ctx.StorageOwner)
+	ctx.ACL = ""
+	token = jwtTestToken(t, "RS256", "rsa", rsaKey, jwtTestClaims("carol", "admins"))
+	ok, _ = jwtTestAuthorize(t, handler, ctx, "PUT", "/v1/AUTH_bob", token)
+	require.True(t, ok)
+	require.True(t, ctx.StorageOwner)
+
+	// Anonymous requests get the container's referrer ACLs.
+	ok, s = jwtTestAuthorize(t, handler, ctx, "GET", "/v1/AUTH_bob/c/o", "")
+	require.False(t, ok)
+	require.Equal(t, 401, s)
+	ctx.ACL = ".r:*"
+	req, err = http.NewRequest("GET", "/v1/AUTH_bob/c/o", nil)
+	require.Nil(t, err)
+	ok, _ = ctx.Authorize(req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx)))
+	require.True(t, ok)
+	ctx.ACL = ""
+
+	expired := jwtTestClaims("alice")
+	expired["exp"] = time.Now().Unix() - 120
+	wrongAudience := jwtTestClaims("alice")
+	wrongAudience["aud"] = "other"
+	wrongIssuer := jwtTestClaims("alice")
+	wrongIssuer["iss"] = "https://elsewhere"
+	noExpiry := jwtTestClaims("alice")
+	delete(noExpiry, "exp")
+	good := jwtTestToken(t, "RS256", "rsa", rsaKey, jwtTestClaims("alice"))
+	parts := []byte(good)
+	for name, token := range map[string]string{
+		"expired":        jwtTestToken(t, "RS256", "rsa", rsaKey, expired),
+		"wrong audience": jwtTestToken(t, "RS256", "rsa", rsaKey, wrongAudience),
+		"wrong issuer":   jwtTestToken(t, "RS256", "rsa", rsaKey, wrongIssuer),
+		"no expiry":      jwtTestToken(t, "RS256", "rsa", rsaKey, noExpiry),
+		"wrong key type": jwtTestToken(t, "ES256", "rsa", ecKey, jwtTestClaims("alice")),
+		"unknown key":    jwtTestToken(t, "RS256", "other", rsaKey, jwtTestClaims("alice")),
+		"none":           jwtTestB64([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + jwtTestB64([]byte(`{"sub":"alice"}`)) + ".",
+		"bad signature":  string(parts[:len(parts)-4]) + "AAAA",
+		"garbage":        "a.b.c",
+	} {
+		ok, s = jwtTestAuthorize(t, handler, ctx, "GET", "/v1/AUTH_alice/c", token)
+		require.False(t, ok, name)
+		require.Equal(t, 401, s, name)
+		require.Empty(t, ctx.RemoteUsers, name)
+	}
+}
+
+func TestJWTAuthCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	jwtTestJWKS(t, jwksFile, map[string]crypto.Signer{"rsa": rsaKey})
+	handler := newJWTAuthTestHandler(t, jwksFile)
+	ctx := newTempAuthTestContext(handler)
+	mc := ctx.Cache.(*test.FakeMemcacheRing)
+
+	// A cached identity is used without checking the token again.
+	token := "not.a.jwt"
+	identity, err := json.Marshal(&jwtIdentity{Account: "dave", User: "dave", Expires: time.Now().Unix() + 60})
+	require.Nil(t, err)
+	mc.MockGetStructured[fmt.Sprintf("jwt:%x", sha256.Sum256([]byte(token)))] = identity
+	ok, _ := jwtTestAuthorize(t, handler, ctx, "GET", "/v1/AUTH_dave/c", token)
+	require.True(t, ok)
+	require.Equal(t, []string{"dave", "dave:dave"}, ctx.RemoteUsers)
+
+	// Unless it's expired.
+	identity, err = json.Marshal(&jwtIdentity{Account: "dave", User: "dave", Expires: time.Now().Unix() - 120})
+	require.Nil(t, err)
+	mc.MockGetStructured[fmt.Sprintf("jwt:%x", sha256.Sum256([]byte(token)))] = identity
+	ok, s := jwtTestAuthorize(t, handler, ctx, "GET", "/v1/AUTH_dave/c", token)
+	require.False(t, ok)
+	require.Equal(t, 401, s)
+}
+
+func TestJWTAuthKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	jwtTestJWKS(t, jwksFile, map[string]crypto.Signer{"old": oldKey})
+	handler := newJWTAuthTestHandler(t, jwksFile)
+	ctx := newTempAuthTestContext(handler)
+
+	jwtTestJWKS(t, jwksFile, map[string]crypto.Signer{"old": oldKey, "new": newKey})
+	token := jwtTestToken(t, "ES256", "new", newKey, jwtTestClaims("alice"))
+	// The key set was just loaded, so an unknown key doesn't reload it yet.
+	ok, _ := jwtTestAuthorize(t, handler, ctx, "GET", "/v1/AUTH_alice/c", token)
+	require.False(t, ok)
+	handler.keys.loaded = time.Now().Add(-time.Minute)
+	ok, _ = jwtTestAuthorize(t, handler, ctx, "GET", "/v1/AUTH_alice/c", token)
+	require.True(t, ok)
+
+	// A key set that fails to load keeps the keys it had.
+	require.Nil(t, ioutil.WriteFile(jwksFile, []byte("junk"), 0600))
+	handler.keys.loaded = time.Now().Add(-2 * time.Hour)
+	ok, _ = jwtTestAuthorize(t, handler, ctx, "GET", "/v1/AUTH_alice/c", jwtTestToken(t, "ES256", "old", oldKey, jwtTestClaims("alice")))
+	require.True(t, ok)
+}
+
+func TestJWTAuthURLUnavailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	jwtTestJWKS(t, jwksFile, map[string]crypto.Signer{"ec": key})
+	available := false
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, jwksFile)
+	}))
+	defer idp.Close()
+	config, err := conf.StringConfig(fmt.Sprintf("[filter:jwtauth]\njwks_url = %s\nissuer = https://idp\naudience = hummingbird\n", idp.URL))
+	require.Nil(t, err)
+	// The JWKS url being down doesn't stop the proxy starting.
+	j, err := NewJWTAuth(config.GetSection("filter:jwtauth"), common.NewTestScope())
+	require.Nil(t, err)
+	handler := j(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).(*jwtAuth)
+	ctx := newTempAuthTestContext(handler)
+
+	available = true
+	ok, _ := jwtTestAuthorize(t, handler, ctx, "GET", "/v1/AUTH_alice/c", jwtTestToken(t, "ES256", "ec", key, jwtTestClaims("alice")))
+	require.True(t, ok)
+}
+
+func TestJWTAuthConfig(t *testing.T) {
+	_, err := NewJWTAuth(conf.Section{}, common.NewTestScope())
+	require.NotNil(t, err)
+	_, err = parseJWKS([]byte(`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`))
+	require.NotNil(t, err)
+}
@@ -123,8 +123,9 @@ func (sw *xloIdentifyWriter) Write(b []byte) (int, error) {
 type xloForwardBodyWriter struct {
 	http.ResponseWriter
 	// If constructed with status != 0 xloForwardBodyWriter will call x.ResponseWriter.WriteHeader.
-	status int
-	header http.Header
+	status  int
+	header  http.Header
+	written int64
 }
 
 func (x *xloForwardBodyWriter) Header() http.Header {
@@ -143,7 +144,9 @@ func (x *xloForwardBodyWriter) WriteHeader(status int) {
 }
 
 func (x *xloForwardBodyWriter) Write(b []byte) (int, error) {
-	return x.ResponseWriter.Write(b)
+	n, err := x.ResponseWriter.Write(b)
+	x.written += int64(n)
+	return n, err
 }
 
 type xloCaptureWriter struct {
@@ -256,6 +259,14 @@ func (xlo *xloMiddleware) feedOutSegments(sw *xloIdentifyWriter, request *http.R
 				zap.String("Segment404", "404"), zap.Int("sw2.status", sw2.status))
 			break
 		}
+		if sw2.written != subReqEnd-subReqStart {
+			// The object client resumes interrupted GETs from other nodes, so
+			// this means none could finish the segment. Carrying on would
+			// send the following segments at the wrong offsets.
+			ctx.Logger.Error("short segment read", zap.String("path", newPath),
+				zap.Int64("expected", subReqEnd-subReqStart), zap.Int64("written", sw2.written))
+			return
+		}
 		reqRange.Start -= segLen
 		reqRange.End -= segLen
 	}
@@ -161,6 +161,52 @@ func TestGetSlo(t *testing.T) {
 	require.Equal(t, "123456789", string(body))
 }
 
+func TestGetSloShortSegment(t *testing.T) {
+	var paths []string
+	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		paths = append(paths, request.URL.Path)
+		if request.Method == "GET" {
+			switch request.URL.Path {
+			case "/v1/a/c/o":
+				writer.Header().Set("X-Static-Large-Object", "True")
+				writer.Header().Set("Content-Type", "app/html")
+				writer.WriteHeader(200)
+				writer.Write([]byte(simpleManifest))
+			case "/v1/a/hat/a":
+				writer.Header().Set("Content-Type", "octet")
+				writer.Header().Set("Etag", "\"202cb962ac59075b964b07152d234b70\"")
+				writer.WriteHeader(200)
+				writer.Write([]byte("123"))
+			case "/v1/a/hat/b":
+				// The backend died part way through and couldn't be resumed.
+				writer.Header().Set("Content-Type", "octet")
+				writer.Header().Set("Etag", "\"250cf8b51c773f3f8dc8b4be867a9a02\"")
+				writer.WriteHeader(200)
+				writer.Write([]byte("4"))
+			case "/v1/a/hat/c":
+				writer.Header().Set("Content-Type", "octet")
+				writer.Header().Set("Etag", "\"68053af2923e00204c3ca7c6a3150cf7\"")
+				writer.WriteHeader(200)
+				writer.Write([]byte("789"))
+			}
+		}
+	})
+	sm := newTestXLOMiddleware(next)
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v1/a/c/o", nil)
+	require.Nil(t, err)
+	fakeContext := NewFakeProxyContext(next)
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", fakeContext))
+
+	sm.ServeHTTP(w, req)
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	require.Equal(t, "9", resp.Header.Get("Content-Length"))
+	require.Equal(t, "1234", string(body))
+	require.Equal(t, []string{"/v1/a/c/o", "/v1/a/hat/a", "/v1/a/hat/b"}, paths)
+}
+
 func TestGetSloRangeRequest(t *testing.T) {
 	var paths []string
 	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
@@ -0,0 +1,142 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+const (
+	clientLifecycleHeader       = "X-Container-Lifecycle"
+	clientRemoveLifecycleHeader = "X-Remove-Container-Lifecycle"
+)
+
+// lifecycleMiddleware keeps a container's lifecycle rules, given in the
+// X-Container-Lifecycle header, in its sysmeta for andrewd to apply.
+type lifecycleMiddleware struct {
+	next                http.Handler
+	policies            conf.PolicyList
+	rulesUpdatesMetric  tally.Counter
+	rulesRemovalsMetric tally.Counter
+}
+
+func (l *lifecycleMiddleware) checkRules(value string) error {
+	rules, err := common.ParseLifecycleRules(value)
+	if err != nil {
+		return err
+	}
+	for i, rule := range rules {
+		if rule.StoragePolicy == "" {
+			continue
+		}
+		if policy := l.policies.NameLookup(rule.StoragePolicy); policy == nil {
+			return fmt.Errorf("Lifecycle rule %d: invalid storage_policy %q", i, rule.StoragePolicy)
+		} else if policy.Deprecated {
+			return fmt.Errorf("Lifecycle rule %d: storage policy %q is deprecated", i, rule.StoragePolicy)
+		}
+	}
+	return nil
+}
+
+func (l *lifecycleMiddleware) handleUpdate(writer http.ResponseWriter, request *http.Request, account, container string) {
+	value, set := request.Header[clientLifecycleHeader]
+	remove := request.Header.Get(clientRemoveLifecycleHeader) != ""
+	if !set && !remove {
+		l.next.ServeHTTP(writer, request)
+		return
+	}
+	if set && value[0] != "" {
+		if err := l.checkRules(value[0]); err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+		request.Header.Set(common.LifecycleSysmeta, value[0])
+	} else {
+		// Setting the rules to nothing removes them, like X-Remove-Container-Lifecycle.
+		set = false
+		request.Header.Set(common.LifecycleSysmeta, "")
+	}
+	request.Header.Del(clientLifecycleHeader)
+	request.Header.Del(clientRemoveLifecycleHeader)
+	ctx := GetProxyContext(request)
+	record := common.LifecycleRecord(account, container)
+	l.next.ServeHTTP(srv.NewCustomWriter(writer, func(w http.ResponseWriter, status int) int {
+		if status/100 != 2 {
+			return status
+		}
+		if set {
+			l.rulesUpdatesMetric.Inc(1)
+			if s := ctx.putHiddenObject(common.LifecycleAccount, common.LifecycleContainer, record, nil); s/100 != 2 {
+				ctx.Logger.Error("Couldn't record container lifecycle rules", zap.String("record", record), zap.Int("status", s))
+				return http.StatusServiceUnavailable
+			}
+		} else {
+			l.rulesRemovalsMetric.Inc(1)
+			ctx.deleteHiddenObject(common.LifecycleAccount, common.LifecycleContainer, record)
+		}
+		return status
+	}), request)
+}
+
+func (l *lifecycleMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	apiReq, account, container, object := getPathParts(request)
+	if !apiReq || account == "" || container == "" || object != "" {
+		l.next.ServeHTTP(writer, request)
+		return
+	}
+	switch request.Method {
+	case "PUT", "POST":
+		if GetProxyContext(request) == nil {
+			srv.StandardResponse(writer, 500)
+			return
+		}
+		l.handleUpdate(writer, request, account, container)
+	case "GET", "HEAD":
+		l.next.ServeHTTP(srv.NewCustomWriter(writer, func(w http.ResponseWriter, status int) int {
+			if rules := w.Header().Get(common.LifecycleSysmeta); rules != "" {
+				w.Header().Set(clientLifecycleHeader, rules)
+			}
+			return status
+		}), request)
+	default:
+		l.next.ServeHTTP(writer, request)
+	}
+}
+
+func NewLifecycle(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	policies, err := conf.GetPolicies()
+	if err != nil {
+		return nil, err
+	}
+	RegisterInfo("lifecycle", map[string]interface{}{"max_rules": common.MaxLifecycleRules})
+	rulesUpdatesMetric := metricsScope.Counter("lifecycle_rules_updates")
+	rulesRemovalsMetric := metricsScope.Counter("lifecycle_rules_removals")
+	return func(next http.Handler) http.Handler {
+		return &lifecycleMiddleware{
+			next:                next,
+			policies:            policies,
+			rulesUpdatesMetric:  rulesUpdatesMetric,
+			rulesRemovalsMetric: rulesRemovalsMetric,
+		}
+	}, nil
+}
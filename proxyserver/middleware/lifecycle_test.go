@@ -0,0 +1,115 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+// lifecycleTestContainer is a container server that keeps the sysmeta it's
+// sent.
+type lifecycleTestContainer struct {
+	status  int
+	sysmeta string
+}
+
+func (c *lifecycleTestContainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "PUT", "POST":
+		if v, ok := r.Header[common.LifecycleSysmeta]; ok {
+			c.sysmeta = v[0]
+		}
+		w.WriteHeader(c.status)
+	default:
+		if c.sysmeta != "" {
+			w.Header().Set(common.LifecycleSysmeta, c.sysmeta)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func lifecycleTestRequest(t *testing.T, handler http.Handler, c *multipartTestClient, method string, headers map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/v1/a/c", nil)
+	require.Nil(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	ctx := NewFakeProxyContext(handler)
+	ctx.C = c
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestLifecycleRules(t *testing.T) {
+	l, err := NewLifecycle(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	container := &lifecycleTestContainer{status: http.StatusNoContent}
+	c := &multipartTestClient{records: map[string]bool{}}
+	handler := l(container)
+	rules := `[{"prefix": "logs/", "expire_after_days": 30}]`
+
+	rr := lifecycleTestRequest(t, handler, c, "POST", map[string]string{"X-Container-Lifecycle": rules})
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	require.Equal(t, rules, container.sysmeta)
+	require.True(t, c.records["a/c"])
+
+	rr = lifecycleTestRequest(t, handler, c, "HEAD", nil)
+	require.Equal(t, rules, rr.Header().Get("X-Container-Lifecycle"))
+
+	rr = lifecycleTestRequest(t, handler, c, "POST", map[string]string{"X-Remove-Container-Lifecycle": "x"})
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	require.Equal(t, "", container.sysmeta)
+	require.False(t, c.records["a/c"])
+	rr = lifecycleTestRequest(t, handler, c, "HEAD", nil)
+	require.Equal(t, "", rr.Header().Get("X-Container-Lifecycle"))
+
+	// Nothing is recorded if the container update fails.
+	container.status = http.StatusNotFound
+	rr = lifecycleTestRequest(t, handler, c, "POST", map[string]string{"X-Container-Lifecycle": rules})
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.False(t, c.records["a/c"])
+}
+
+func TestLifecycleInvalidRules(t *testing.T) {
+	l, err := NewLifecycle(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	container := &lifecycleTestContainer{status: http.StatusCreated}
+	c := &multipartTestClient{records: map[string]bool{}}
+	handler := l(container)
+	for _, rules := range []string{
+		`nope`,
+		`[{"prefix": "logs/"}]`,
+		`[{"transition_after_days": 7, "storage_policy": "no-such-policy"}]`,
+	} {
+		rr := lifecycleTestRequest(t, handler, c, "PUT", map[string]string{"X-Container-Lifecycle": rules})
+		require.Equal(t, http.StatusBadRequest, rr.Code, rules)
+	}
+	require.Equal(t, "", container.sysmeta)
+	require.Equal(t, 0, len(c.records))
+
+	rr := lifecycleTestRequest(t, handler, c, "PUT", map[string]string{"X-Container-Lifecycle": `[{"transition_after_days": 7, "storage_policy": "Policy-0"}]`})
+	require.Equal(t, http.StatusCreated, rr.Code)
+	require.True(t, c.records["a/c"])
+}
@@ -0,0 +1,507 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+// The multipart middleware lets clients upload an object in parts, in any
+// order, and have the proxy assemble them into an SLO when they're done:
+//
+//   POST   /v1/a/c/o?uploads                         initiate an upload
+//   PUT    /v1/a/c/o?upload_id=X&part_number=N       upload part N
+//   GET    /v1/a/c/o?upload_id=X                     list the parts uploaded
+//   POST   /v1/a/c/o?upload_id=X                     complete the upload
+//   DELETE /v1/a/c/o?upload_id=X                     abort the upload
+//   GET    /v1/a/c?uploads                           list uploads in progress
+//
+// Parts are kept in the hidden common.MultipartSegmentsContainer(c), under
+// <object>/<upload id>/<part number>, with an empty <object>/<upload id>
+// object marking the upload as in progress. Each upload is also recorded in
+// common.MultipartUploadsAccount so andrewd can clean up abandoned ones.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+const (
+	multipartMaxCompleteBodySize = 2 * 1024 * 1024
+	multipartInitiatedSysmeta    = "X-Object-Sysmeta-Multipart-Initiated"
+	multipartContentTypeSysmeta  = "X-Object-Sysmeta-Multipart-Content-Type"
+)
+
+const multipartUploadIdPattern = `[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`
+
+var (
+	multipartUploadIdRegex     = regexp.MustCompile(`^` + multipartUploadIdPattern + `$`)
+	multipartUploadMarkerRegex = regexp.MustCompile(`^(.+)/(` + multipartUploadIdPattern + `)$`)
+)
+
+// multipartListingItem is an entry in a json container listing.
+type multipartListingItem struct {
+	Name         string `json:"name"`
+	Hash         string `json:"hash"`
+	Bytes        int64  `json:"bytes"`
+	LastModified string `json:"last_modified"`
+}
+
+type multipartPart struct {
+	PartNumber   int    `json:"part_number"`
+	Etag         string `json:"etag,omitempty"`
+	SizeBytes    int64  `json:"size_bytes,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	name         string
+}
+
+type multipartUpload struct {
+	Object       string `json:"object"`
+	UploadId     string `json:"upload_id"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+type multipartMiddleware struct {
+	next                  http.Handler
+	minPartSize           int64
+	initiatedMetric       tally.Counter
+	completedMetric       tally.Counter
+	abortedMetric         tally.Counter
+	partPutRequestsMetric tally.Counter
+}
+
+// multipartRequest holds the state of a multipart upload request being served.
+type multipartRequest struct {
+	*multipartMiddleware
+	ctx       *ProxyContext
+	writer    http.ResponseWriter
+	request   *http.Request
+	account   string
+	container string
+	object    string
+}
+
+func (m *multipartRequest) path(container, object string) string {
+	p := "/v1/" + common.Urlencode(m.account) + "/" + common.Urlencode(container)
+	if object != "" {
+		p += "/" + common.Urlencode(object)
+	}
+	return p
+}
+
+func (m *multipartRequest) segmentsContainer() string {
+	return common.MultipartSegmentsContainer(m.container)
+}
+
+func (m *multipartRequest) markerName(uploadId string) string {
+	return m.object + "/" + uploadId
+}
+
+// do serves a subrequest, returning its buffered response.
+func (m *multipartRequest) do(method, path string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	subreq, err := m.ctx.newSubrequest(method, path, body, m.request, "-")
+	if err != nil {
+		m.ctx.Logger.Error("Couldn't create http.Request", zap.Error(err))
+		rec.Code = http.StatusInternalServerError
+		return rec
+	}
+	for k, v := range header {
+		subreq.Header[k] = v
+	}
+	if b, ok := body.(*bytes.Reader); ok {
+		subreq.Header.Set("Content-Length", strconv.Itoa(b.Len()))
+	}
+	m.ctx.serveHTTPSubrequest(rec, subreq)
+	return rec
+}
+
+func (m *multipartRequest) sendJSON(status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		srv.StandardResponse(m.writer, http.StatusInternalServerError)
+		return
+	}
+	m.writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	m.writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	m.writer.WriteHeader(status)
+	m.writer.Write(body)
+}
+
+// getListing fetches all of a json container listing with the given prefix.
+func (m *multipartRequest) getListing(container, prefix string) ([]multipartListingItem, int) {
+	var items []multipartListingItem
+	marker := ""
+	for {
+		params := url.Values{"format": {"json"}, "prefix": {prefix}, "marker": {marker}}
+		rec := m.do("GET", m.path(container, "")+"?"+params.Encode(), http.NoBody, nil)
+		if rec.Code/100 != 2 {
+			return nil, rec.Code
+		}
+		var page []multipartListingItem
+		if rec.Body.Len() > 0 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				m.ctx.Logger.Error("Couldn't parse listing", zap.String("container", container), zap.Error(err))
+				return nil, http.StatusInternalServerError
+			}
+		}
+		items = append(items, page...)
+		if len(page) < common.CONTAINER_LISTING_LIMIT {
+			return items, http.StatusOK
+		}
+		marker = page[len(page)-1].Name
+	}
+}
+
+// checkUpload returns the response to a HEAD of the upload's marker object.
+func (m *multipartRequest) checkUpload(uploadId string) (*httptest.ResponseRecorder, bool) {
+	if !multipartUploadIdRegex.MatchString(uploadId) {
+		srv.SimpleErrorResponse(m.writer, http.StatusNotFound, "No such upload")
+		return nil, false
+	}
+	rec := m.do("HEAD", m.path(m.segmentsContainer(), m.markerName(uploadId)), http.NoBody, nil)
+	if rec.Code == http.StatusNotFound {
+		srv.SimpleErrorResponse(m.writer, http.StatusNotFound, "No such upload")
+		return nil, false
+	} else if rec.Code/100 != 2 {
+		srv.StandardResponse(m.writer, rec.Code)
+		return nil, false
+	}
+	return rec, true
+}
+
+// getParts returns the parts uploaded so far, ordered by part number.
+func (m *multipartRequest) getParts(uploadId string) ([]multipartPart, int) {
+	prefix := m.markerName(uploadId) + "/"
+	items, status := m.getListing(m.segmentsContainer(), prefix)
+	if status/100 != 2 {
+		return nil, status
+	}
+	var parts []multipartPart
+	for _, item := range items {
+		if n, err := strconv.Atoi(strings.TrimPrefix(item.Name, prefix)); err == nil {
+			parts = append(parts, multipartPart{PartNumber: n, Etag: item.Hash, SizeBytes: item.Bytes, LastModified: item.LastModified, name: item.Name})
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts, status
+}
+
+// recordUpload notes the upload in common.MultipartUploadsAccount.
+func (m *multipartRequest) recordUpload(name string) bool {
+	if status := m.ctx.putHiddenObject(common.MultipartUploadsAccount, common.MultipartUploadsContainer, name, nil); status/100 != 2 {
+		m.ctx.Logger.Error("Couldn't record multipart upload", zap.String("record", name), zap.Int("status", status))
+		return false
+	}
+	return true
+}
+
+// removeUpload deletes the upload's marker, its record and the given parts.
+func (m *multipartRequest) removeUpload(uploadId string, marker http.Header, parts []multipartPart) {
+	for _, part := range parts {
+		m.do("DELETE", m.path(m.segmentsContainer(), part.name), http.NoBody, nil)
+	}
+	m.do("DELETE", m.path(m.segmentsContainer(), m.markerName(uploadId)), http.NoBody, nil)
+	if initiated, err := strconv.ParseInt(marker.Get(multipartInitiatedSysmeta), 10, 64); err == nil {
+		name := common.MultipartUploadRecord(time.Unix(initiated, 0), m.account, m.container, m.object, uploadId)
+		m.ctx.deleteHiddenObject(common.MultipartUploadsAccount, common.MultipartUploadsContainer, name)
+	}
+}
+
+func (m *multipartRequest) initiate() {
+	m.initiatedMetric.Inc(1)
+	rec := m.do("HEAD", m.path(m.container, ""), http.NoBody, nil)
+	if rec.Code/100 != 2 {
+		srv.StandardResponse(m.writer, rec.Code)
+		return
+	}
+	segHeader := http.Header{}
+	if policy := rec.Header().Get("X-Storage-Policy"); policy != "" {
+		segHeader.Set("X-Storage-Policy", policy)
+	}
+	if rec = m.do("PUT", m.path(m.segmentsContainer(), ""), http.NoBody, segHeader); rec.Code/100 != 2 {
+		srv.StandardResponse(m.writer, rec.Code)
+		return
+	}
+	uploadId := common.UUID()
+	initiated := time.Now()
+	if !m.recordUpload(common.MultipartUploadRecord(initiated, m.account, m.container, m.object, uploadId)) {
+		srv.StandardResponse(m.writer, http.StatusServiceUnavailable)
+		return
+	}
+	header := http.Header{"Content-Length": {"0"}}
+	for k, v := range m.request.Header {
+		if strings.HasPrefix(k, "X-Object-Meta-") || common.StringInSlice(k, []string{"Content-Encoding", "Content-Disposition"}) {
+			header[k] = v
+		}
+	}
+	if ct := m.request.Header.Get("Content-Type"); ct != "" {
+		header.Set(multipartContentTypeSysmeta, ct)
+	}
+	header.Set(multipartInitiatedSysmeta, strconv.FormatInt(initiated.Unix(), 10))
+	if rec = m.do("PUT", m.path(m.segmentsContainer(), m.markerName(uploadId)), http.NoBody, header); rec.Code/100 != 2 {
+		srv.StandardResponse(m.writer, rec.Code)
+		return
+	}
+	m.writer.Header().Set("X-Upload-Id", uploadId)
+	m.sendJSON(http.StatusOK, &multipartUpload{Object: m.object, UploadId: uploadId})
+}
+
+func (m *multipartRequest) uploadPart(uploadId string, partNumber string) {
+	m.partPutRequestsMetric.Inc(1)
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > maxManifestLen {
+		srv.SimpleErrorResponse(m.writer, http.StatusBadRequest, fmt.Sprintf("part_number must be an integer between 1 and %d", maxManifestLen))
+		return
+	}
+	if _, ok := m.checkUpload(uploadId); !ok {
+		return
+	}
+	subreq, err := m.ctx.newSubrequest("PUT", m.path(m.segmentsContainer(), fmt.Sprintf("%s/%d", m.markerName(uploadId), n)), http.NoBody, m.request, "-")
+	if err != nil {
+		srv.StandardResponse(m.writer, http.StatusInternalServerError)
+		return
+	}
+	for _, k := range []string{"Content-Length", "Transfer-Encoding", "Etag"} {
+		if v := m.request.Header.Get(k); v != "" {
+			subreq.Header.Set(k, v)
+		}
+	}
+	subreq.Body = m.request.Body
+	subreq.ContentLength = m.request.ContentLength
+	subreq.TransferEncoding = m.request.TransferEncoding
+	rec := httptest.NewRecorder()
+	m.ctx.serveHTTPSubrequest(rec, subreq)
+	if rec.Code/100 != 2 {
+		srv.StandardResponse(m.writer, rec.Code)
+		return
+	}
+	m.writer.Header().Set("Etag", rec.Header().Get("Etag"))
+	srv.StandardResponse(m.writer, http.StatusCreated)
+}
+
+func (m *multipartRequest) listParts(uploadId string) {
+	if _, ok := m.checkUpload(uploadId); !ok {
+		return
+	}
+	parts, status := m.getParts(uploadId)
+	if status/100 != 2 {
+		srv.StandardResponse(m.writer, status)
+		return
+	}
+	if parts == nil {
+		parts = []multipartPart{}
+	}
+	m.sendJSON(http.StatusOK, parts)
+}
+
+func (m *multipartRequest) listUploads() {
+	items, status := m.getListing(m.segmentsContainer(), m.request.URL.Query().Get("prefix"))
+	if status == http.StatusNotFound {
+		items = nil
+	} else if status/100 != 2 {
+		srv.StandardResponse(m.writer, status)
+		return
+	}
+	uploads := []multipartUpload{}
+	for _, item := range items {
+		if match := multipartUploadMarkerRegex.FindStringSubmatch(item.Name); match != nil {
+			uploads = append(uploads, multipartUpload{Object: match[1], UploadId: match[2], LastModified: item.LastModified})
+		}
+	}
+	m.sendJSON(http.StatusOK, uploads)
+}
+
+// complete puts an SLO manifest of the upload's parts at the object, either
+// all of the parts or those listed in the request body.
+func (m *multipartRequest) complete(uploadId string) {
+	marker, ok := m.checkUpload(uploadId)
+	if !ok {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(m.request.Body, multipartMaxCompleteBodySize+1))
+	if err != nil || len(body) > multipartMaxCompleteBodySize {
+		srv.SimpleErrorResponse(m.writer, http.StatusBadRequest, "Invalid list of parts")
+		return
+	}
+	var requested []multipartPart
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &requested); err != nil || len(requested) == 0 {
+			srv.SimpleErrorResponse(m.writer, http.StatusBadRequest, "Invalid list of parts")
+			return
+		}
+	}
+	parts, status := m.getParts(uploadId)
+	if status/100 != 2 {
+		srv.StandardResponse(m.writer, status)
+		return
+	}
+	if requested == nil {
+		requested = parts
+	}
+	if len(requested) == 0 {
+		srv.SimpleErrorResponse(m.writer, http.StatusBadRequest, "No parts have been uploaded")
+		return
+	}
+	if len(requested) > maxManifestLen {
+		srv.SimpleErrorResponse(m.writer, http.StatusBadRequest, fmt.Sprintf("An upload may be completed with at most %d parts", maxManifestLen))
+		return
+	}
+	uploaded := map[int]multipartPart{}
+	for _, part := range parts {
+		uploaded[part.PartNumber] = part
+	}
+	used := map[int]bool{}
+	var manifest []sloPutManifest
+	for i, p := range requested {
+		if i > 0 && p.PartNumber <= requested[i-1].PartNumber {
+			srv.SimpleErrorResponse(m.writer, http.StatusBadRequest, "Parts must be listed in ascending order")
+			return
+		}
+		part, ok := uploaded[p.PartNumber]
+		if !ok || (p.Etag != "" && strings.Trim(p.Etag, "\"") != part.Etag) {
+			srv.SimpleErrorResponse(m.writer, http.StatusBadRequest, fmt.Sprintf("Part %d has not been uploaded", p.PartNumber))
+			return
+		}
+		if i < len(requested)-1 && part.SizeBytes < m.minPartSize {
+			srv.SimpleErrorResponse(m.writer, http.StatusBadRequest, fmt.Sprintf("Part %d is smaller than the minimum part size of %d bytes", p.PartNumber, m.minPartSize))
+			return
+		}
+		used[p.PartNumber] = true
+		manifest = append(manifest, sloPutManifest{Path: "/" + m.segmentsContainer() + "/" + part.name, Etag: part.Etag, SizeBytes: part.SizeBytes})
+	}
+	manifestBody, err := json.Marshal(manifest)
+	if err != nil {
+		srv.StandardResponse(m.writer, http.StatusInternalServerError)
+		return
+	}
+	header := http.Header{}
+	for k, v := range marker.Header() {
+		if strings.HasPrefix(k, "X-Object-Meta-") || common.StringInSlice(k, []string{"Content-Encoding", "Content-Disposition"}) {
+			header[k] = v
+		}
+	}
+	if ct := marker.Header().Get(multipartContentTypeSysmeta); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	rec := m.do("PUT", m.path(m.container, m.object)+"?multipart-manifest=put", bytes.NewReader(manifestBody), header)
+	if rec.Code/100 != 2 {
+		// Pass on why the manifest was rejected, which is probably more
+		// useful than anything we can say.
+		for k := range rec.Header() {
+			m.writer.Header().Set(k, rec.Header().Get(k))
+		}
+		m.writer.WriteHeader(rec.Code)
+		m.writer.Write(rec.Body.Bytes())
+		return
+	}
+	m.completedMetric.Inc(1)
+	var unused []multipartPart
+	for _, part := range parts {
+		if !used[part.PartNumber] {
+			unused = append(unused, part)
+		}
+	}
+	m.removeUpload(uploadId, marker.Header(), unused)
+	m.writer.Header().Set("Etag", rec.Header().Get("Etag"))
+	srv.StandardResponse(m.writer, http.StatusCreated)
+}
+
+func (m *multipartRequest) abort(uploadId string) {
+	marker, ok := m.checkUpload(uploadId)
+	if !ok {
+		return
+	}
+	parts, status := m.getParts(uploadId)
+	if status/100 != 2 {
+		srv.StandardResponse(m.writer, status)
+		return
+	}
+	m.abortedMetric.Inc(1)
+	m.removeUpload(uploadId, marker.Header(), parts)
+	srv.StandardResponse(m.writer, http.StatusNoContent)
+}
+
+func (mm *multipartMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	apiReq, account, container, object := getPathParts(request)
+	query := request.URL.Query()
+	_, uploads := query["uploads"]
+	_, hasUploadId := query["upload_id"]
+	if !apiReq || container == "" || (!uploads && !hasUploadId) {
+		mm.next.ServeHTTP(writer, request)
+		return
+	}
+	ctx := GetProxyContext(request)
+	if ctx == nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	m := &multipartRequest{multipartMiddleware: mm, ctx: ctx, writer: writer, request: request, account: account, container: container, object: object}
+	uploadId := query.Get("upload_id")
+	switch {
+	case object == "" && uploads && request.Method == "GET":
+		m.listUploads()
+	case object == "":
+		mm.next.ServeHTTP(writer, request)
+	case uploads && request.Method == "POST":
+		m.initiate()
+	case hasUploadId && request.Method == "PUT" && query.Get("part_number") != "":
+		m.uploadPart(uploadId, query.Get("part_number"))
+	case hasUploadId && request.Method == "GET":
+		m.listParts(uploadId)
+	case hasUploadId && request.Method == "POST":
+		m.complete(uploadId)
+	case hasUploadId && request.Method == "DELETE":
+		m.abort(uploadId)
+	default:
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid multipart upload request")
+	}
+}
+
+func NewMultipart(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	minPartSize := config.GetInt("min_part_size", 1048576)
+	if minPartSize < 1 {
+		return nil, fmt.Errorf("min_part_size must be at least 1")
+	}
+	RegisterInfo("multipart", map[string]interface{}{"max_parts": maxManifestLen, "min_part_size": minPartSize})
+	initiatedMetric := metricsScope.Counter("multipart_uploads_initiated")
+	completedMetric := metricsScope.Counter("multipart_uploads_completed")
+	abortedMetric := metricsScope.Counter("multipart_uploads_aborted")
+	partPutRequestsMetric := metricsScope.Counter("multipart_part_PUT_requests")
+	return func(next http.Handler) http.Handler {
+		return &multipartMiddleware{
+			next:                  next,
+			minPartSize:           minPartSize,
+			initiatedMetric:       initiatedMetric,
+			completedMetric:       completedMetric,
+			abortedMetric:         abortedMetric,
+			partPutRequestsMetric: partPutRequestsMetric,
+		}
+	}, nil
+}
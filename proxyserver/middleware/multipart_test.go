@@ -0,0 +1,280 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+// multipartTestStore is a bare bones account of containers and objects for
+// multipart tests, with just enough listing support for the middleware.
+type multipartTestStore struct {
+	containers map[string]bool
+	objects    map[string]*symlinkTestObject
+	manifests  map[string][]sloPutManifest
+}
+
+func newMultipartTestStore() *multipartTestStore {
+	return &multipartTestStore{
+		containers: map[string]bool{"/v1/a/c": true},
+		objects:    map[string]*symlinkTestObject{},
+		manifests:  map[string][]sloPutManifest{},
+	}
+}
+
+func (s *multipartTestStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, account, container, object := getPathParts(r)
+	if object == "" {
+		path := "/v1/" + account + "/" + container
+		switch r.Method {
+		case "PUT":
+			s.containers[path] = true
+			w.WriteHeader(http.StatusCreated)
+		case "HEAD":
+			if !s.containers[path] {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "GET":
+			if !s.containers[path] {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			prefix := path + "/" + r.URL.Query().Get("prefix")
+			items := []multipartListingItem{}
+			for name, obj := range s.objects {
+				if strings.HasPrefix(name, prefix) {
+					size, _ := strconv.ParseInt(obj.header.Get("Content-Length"), 10, 64)
+					items = append(items, multipartListingItem{Name: name[len(path)+1:], Hash: strings.Trim(obj.header.Get("Etag"), "\""), Bytes: size})
+				}
+			}
+			sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+			json.NewEncoder(w).Encode(items)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	switch {
+	case r.Method == "PUT" && r.URL.Query().Get("multipart-manifest") == "put":
+		var manifest []sloPutManifest
+		if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.manifests[r.URL.Path] = manifest
+		s.objects[r.URL.Path] = &symlinkTestObject{header: http.Header{"Content-Type": {r.Header.Get("Content-Type")}, "X-Object-Meta-Color": {r.Header.Get("X-Object-Meta-Color")}}}
+		w.Header().Set("Etag", "\"manifestetag\"")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "DELETE":
+		if s.objects[r.URL.Path] == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		symlinkTestStore(s.objects).ServeHTTP(w, r)
+	}
+}
+
+// multipartTestClient keeps track of the upload records written to
+// common.MultipartUploadsAccount.
+type multipartTestClient struct {
+	client.ProxyClient
+	records map[string]bool
+}
+
+func (c *multipartTestClient) PutObject(account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	c.records[obj] = true
+	return &http.Response{StatusCode: http.StatusCreated, Body: ioutil.NopCloser(strings.NewReader(""))}
+}
+
+func (c *multipartTestClient) DeleteObject(account string, container string, obj string, headers http.Header) *http.Response {
+	delete(c.records, obj)
+	return &http.Response{StatusCode: http.StatusNoContent, Body: ioutil.NopCloser(strings.NewReader(""))}
+}
+
+type multipartTest struct {
+	t       *testing.T
+	store   *multipartTestStore
+	client  *multipartTestClient
+	handler http.Handler
+}
+
+func newMultipartTest(t *testing.T, configString string) *multipartTest {
+	config, err := conf.StringConfig("[filter:multipart]\n" + configString)
+	require.Nil(t, err)
+	m, err := NewMultipart(config.GetSection("filter:multipart"), common.NewTestScope())
+	require.Nil(t, err)
+	store := newMultipartTestStore()
+	return &multipartTest{t: t, store: store, client: &multipartTestClient{records: map[string]bool{}}, handler: m(store)}
+}
+
+func (mt *multipartTest) request(method, path string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	require.Nil(mt.t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	ctx := NewFakeProxyContext(mt.handler)
+	ctx.C = mt.client
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	rr := httptest.NewRecorder()
+	mt.handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func (mt *multipartTest) initiate(headers map[string]string) string {
+	rr := mt.request("POST", "/v1/a/c/o?uploads", "", headers)
+	require.Equal(mt.t, 200, rr.Code)
+	var upload multipartUpload
+	require.Nil(mt.t, json.Unmarshal(rr.Body.Bytes(), &upload))
+	require.Equal(mt.t, "o", upload.Object)
+	require.Equal(mt.t, upload.UploadId, rr.Header().Get("X-Upload-Id"))
+	return upload.UploadId
+}
+
+func TestMultipartUpload(t *testing.T) {
+	mt := newMultipartTest(t, "min_part_size = 3")
+	uploadId := mt.initiate(map[string]string{"Content-Type": "text/plain", "X-Object-Meta-Color": "blue"})
+	require.True(t, mt.store.containers["/v1/a/.c+segments"])
+	require.NotNil(t, mt.store.objects["/v1/a/.c+segments/o/"+uploadId])
+	require.Equal(t, 1, len(mt.client.records))
+
+	rr := mt.request("PUT", "/v1/a/c/o?upload_id="+uploadId+"&part_number=2", "def", nil)
+	require.Equal(t, 201, rr.Code)
+	require.Equal(t, fmt.Sprintf("\"%x\"", md5.Sum([]byte("def"))), rr.Header().Get("Etag"))
+	rr = mt.request("PUT", "/v1/a/c/o?upload_id="+uploadId+"&part_number=1", "abc", nil)
+	require.Equal(t, 201, rr.Code)
+	rr = mt.request("PUT", "/v1/a/c/o?upload_id="+uploadId+"&part_number=10", "g", nil)
+	require.Equal(t, 201, rr.Code)
+
+	rr = mt.request("GET", "/v1/a/c/o?upload_id="+uploadId, "", nil)
+	require.Equal(t, 200, rr.Code)
+	var parts []multipartPart
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &parts))
+	require.Equal(t, 3, len(parts))
+	require.Equal(t, []int{1, 2, 10}, []int{parts[0].PartNumber, parts[1].PartNumber, parts[2].PartNumber})
+	require.Equal(t, int64(3), parts[0].SizeBytes)
+
+	rr = mt.request("GET", "/v1/a/c?uploads", "", nil)
+	require.Equal(t, 200, rr.Code)
+	var uploads []multipartUpload
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &uploads))
+	require.Equal(t, 1, len(uploads))
+	require.Equal(t, uploadId, uploads[0].UploadId)
+
+	rr = mt.request("POST", "/v1/a/c/o?upload_id="+uploadId, `[{"part_number": 1}, {"part_number": 2}]`, nil)
+	require.Equal(t, 201, rr.Code)
+	require.Equal(t, "\"manifestetag\"", rr.Header().Get("Etag"))
+	manifest := mt.store.manifests["/v1/a/c/o"]
+	require.Equal(t, 2, len(manifest))
+	require.Equal(t, "/.c+segments/o/"+uploadId+"/1", manifest[0].Path)
+	require.Equal(t, "/.c+segments/o/"+uploadId+"/2", manifest[1].Path)
+	require.Equal(t, int64(3), manifest[1].SizeBytes)
+	require.Equal(t, "text/plain", mt.store.objects["/v1/a/c/o"].header.Get("Content-Type"))
+	require.Equal(t, "blue", mt.store.objects["/v1/a/c/o"].header.Get("X-Object-Meta-Color"))
+
+	// The unused part, the marker and the record are gone; the used parts stay.
+	require.Nil(t, mt.store.objects["/v1/a/.c+segments/o/"+uploadId+"/10"])
+	require.Nil(t, mt.store.objects["/v1/a/.c+segments/o/"+uploadId])
+	require.NotNil(t, mt.store.objects["/v1/a/.c+segments/o/"+uploadId+"/1"])
+	require.Equal(t, 0, len(mt.client.records))
+
+	rr = mt.request("GET", "/v1/a/c/o?upload_id="+uploadId, "", nil)
+	require.Equal(t, 404, rr.Code)
+}
+
+func TestMultipartCompleteErrors(t *testing.T) {
+	mt := newMultipartTest(t, "min_part_size = 3")
+	uploadId := mt.initiate(nil)
+	rr := mt.request("POST", "/v1/a/c/o?upload_id="+uploadId, "", nil)
+	require.Equal(t, 400, rr.Code)
+	require.Contains(t, rr.Body.String(), "No parts")
+
+	mt.request("PUT", "/v1/a/c/o?upload_id="+uploadId+"&part_number=1", "a", nil)
+	mt.request("PUT", "/v1/a/c/o?upload_id="+uploadId+"&part_number=2", "bcd", nil)
+	rr = mt.request("POST", "/v1/a/c/o?upload_id="+uploadId, "", nil)
+	require.Equal(t, 400, rr.Code)
+	require.Contains(t, rr.Body.String(), "minimum part size")
+	rr = mt.request("POST", "/v1/a/c/o?upload_id="+uploadId, `[{"part_number": 2}, {"part_number": 1}]`, nil)
+	require.Equal(t, 400, rr.Code)
+	require.Contains(t, rr.Body.String(), "ascending")
+	rr = mt.request("POST", "/v1/a/c/o?upload_id="+uploadId, `[{"part_number": 3}]`, nil)
+	require.Equal(t, 400, rr.Code)
+	rr = mt.request("POST", "/v1/a/c/o?upload_id="+uploadId, `[{"part_number": 2, "etag": "nope"}]`, nil)
+	require.Equal(t, 400, rr.Code)
+	rr = mt.request("POST", "/v1/a/c/o?upload_id="+uploadId, `not json`, nil)
+	require.Equal(t, 400, rr.Code)
+	require.Nil(t, mt.store.objects["/v1/a/c/o"])
+
+	// A single small part is fine, since it's the last one.
+	rr = mt.request("POST", "/v1/a/c/o?upload_id="+uploadId, `[{"part_number": 1}]`, nil)
+	require.Equal(t, 201, rr.Code)
+}
+
+func TestMultipartBadRequests(t *testing.T) {
+	mt := newMultipartTest(t, "")
+	rr := mt.request("POST", "/v1/a/nope/o?uploads", "", nil)
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, 0, len(mt.client.records))
+
+	uploadId := mt.initiate(nil)
+	for _, n := range []string{"0", "1001", "x"} {
+		rr = mt.request("PUT", "/v1/a/c/o?upload_id="+uploadId+"&part_number="+n, "a", nil)
+		require.Equal(t, 400, rr.Code)
+	}
+	rr = mt.request("PUT", "/v1/a/c/o?upload_id=not-an-upload&part_number=1", "a", nil)
+	require.Equal(t, 404, rr.Code)
+	rr = mt.request("PUT", "/v1/a/c/o?upload_id="+common.UUID()+"&part_number=1", "a", nil)
+	require.Equal(t, 404, rr.Code)
+	rr = mt.request("PUT", "/v1/a/c/o?upload_id="+uploadId, "a", nil)
+	require.Equal(t, 400, rr.Code)
+}
+
+func TestMultipartAbort(t *testing.T) {
+	mt := newMultipartTest(t, "")
+	uploadId := mt.initiate(nil)
+	mt.request("PUT", "/v1/a/c/o?upload_id="+uploadId+"&part_number=1", "abc", nil)
+	mt.request("PUT", "/v1/a/c/o?upload_id="+uploadId+"&part_number=2", "def", nil)
+	rr := mt.request("DELETE", "/v1/a/c/o?upload_id="+uploadId, "", nil)
+	require.Equal(t, 204, rr.Code)
+	require.Equal(t, 0, len(mt.store.objects))
+	require.Equal(t, 0, len(mt.client.records))
+	rr = mt.request("DELETE", "/v1/a/c/o?upload_id="+uploadId, "", nil)
+	require.Equal(t, 404, rr.Code)
+	rr = mt.request("GET", "/v1/a/c?uploads", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "[]", rr.Body.String())
+}
@@ -0,0 +1,345 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// NotificationEvent is what's sent to webhooks for each object PUT, POST and
+// DELETE made through the proxy.
+type NotificationEvent struct {
+	Event     string `json:"event"`
+	Account   string `json:"account"`
+	Container string `json:"container"`
+	Object    string `json:"object"`
+	Etag      string `json:"etag,omitempty"`
+	Size      int64  `json:"size"`
+	Timestamp string `json:"timestamp"`
+	TxId      string `json:"trans_id"`
+}
+
+// webhookSink delivers events to a webhook from its own spool directory, so
+// that events survive proxy restarts and webhook outages.
+type webhookSink struct {
+	url           string
+	dir           string
+	failedDir     string
+	client        *http.Client
+	batchSize     int
+	maxAttempts   int
+	retryInterval time.Duration
+	attempts      map[string]int
+	wake          chan struct{}
+	logger        srv.LowLevelLogger
+
+	deliveredMetric      tally.Counter
+	deliveryErrorsMetric tally.Counter
+	droppedMetric        tally.Counter
+}
+
+// spool writes the event to the sink's spool directory. Spooled file names
+// start with the event's timestamp, so they're delivered in about the order
+// they happened.
+func (s *webhookSink) spool(event *NotificationEvent, data []byte) error {
+	f, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(s.dir, fmt.Sprintf("%s-%s.json", event.Timestamp, common.UUID())))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// spooled returns the names of the events waiting in the spool, oldest first.
+func (s *webhookSink) spooled() ([]string, error) {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	spooled := names[:0]
+	for _, name := range names {
+		if strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".") {
+			spooled = append(spooled, name)
+		}
+	}
+	sort.Strings(spooled)
+	return spooled, nil
+}
+
+// fail moves a spooled event that can't be delivered to the failed directory.
+func (s *webhookSink) fail(name string) {
+	delete(s.attempts, name)
+	if err := os.Rename(filepath.Join(s.dir, name), filepath.Join(s.failedDir, name)); err != nil {
+		s.logger.Error("Unable to move undeliverable event", zap.String("url", s.url), zap.String("event", name), zap.Error(err))
+	}
+	s.droppedMetric.Inc(1)
+}
+
+// post sends a batch of events to the webhook as a JSON list.
+func (s *webhookSink) post(events []json.RawMessage) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// deliver sends everything in the spool to the webhook, in batches, returning
+// false if it should be retried later.
+func (s *webhookSink) deliver() bool {
+	names, err := s.spooled()
+	if err != nil {
+		s.logger.Error("Unable to list notification spool", zap.String("dir", s.dir), zap.Error(err))
+		return false
+	}
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > s.batchSize {
+			batch = batch[:s.batchSize]
+		}
+		names = names[len(batch):]
+		events := make([]json.RawMessage, 0, len(batch))
+		sent := make([]string, 0, len(batch))
+		for _, name := range batch {
+			data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil || !json.Valid(data) {
+				s.logger.Error("Unable to read spooled event", zap.String("event", name), zap.Error(err))
+				s.fail(name)
+				continue
+			}
+			events = append(events, data)
+			sent = append(sent, name)
+		}
+		if len(events) == 0 {
+			continue
+		}
+		if err := s.post(events); err != nil {
+			s.logger.Error("Unable to deliver events", zap.String("url", s.url), zap.Int("events", len(events)), zap.Error(err))
+			s.deliveryErrorsMetric.Inc(1)
+			for _, name := range sent {
+				s.attempts[name]++
+				if s.maxAttempts > 0 && s.attempts[name] >= s.maxAttempts {
+					s.fail(name)
+				}
+			}
+			return false
+		}
+		for _, name := range sent {
+			delete(s.attempts, name)
+			if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+				s.logger.Error("Unable to remove delivered event", zap.String("event", name), zap.Error(err))
+			}
+		}
+		s.deliveredMetric.Inc(int64(len(sent)))
+	}
+	return true
+}
+
+func (s *webhookSink) run() {
+	for {
+		if s.deliver() {
+			select {
+			case <-s.wake:
+			case <-time.After(s.retryInterval):
+			}
+		} else {
+			time.Sleep(s.retryInterval)
+		}
+	}
+}
+
+// notificationsMiddleware spools an event for each successful object PUT,
+// POST and DELETE to every configured webhook.
+type notificationsMiddleware struct {
+	next              http.Handler
+	sinks             []*webhookSink
+	start             sync.Once
+	eventsMetric      tally.Counter
+	spoolErrorsMetric tally.Counter
+}
+
+// run starts delivering, including whatever was left in the spools by an
+// earlier run of the proxy.
+func (n *notificationsMiddleware) run(logger srv.LowLevelLogger) {
+	for _, sink := range n.sinks {
+		sink.logger = logger
+		go sink.run()
+	}
+}
+
+func (n *notificationsMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	if ctx == nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	n.start.Do(func() {
+		if ctx.ProxyContextMiddleware != nil && ctx.log != nil {
+			n.run(ctx.log)
+		} else {
+			n.run(zap.NewNop())
+		}
+	})
+	apiReq, account, container, object := getPathParts(request)
+	if !apiReq || object == "" || (request.Method != "PUT" && request.Method != "POST" && request.Method != "DELETE") {
+		n.next.ServeHTTP(writer, request)
+		return
+	}
+	var body *srv.CountingReadCloser
+	if request.Method == "PUT" && request.Body != nil {
+		body = &srv.CountingReadCloser{ReadCloser: request.Body}
+		request.Body = body
+	}
+	var etag string
+	var status int
+	n.next.ServeHTTP(srv.NewCustomWriter(writer, func(w http.ResponseWriter, s int) int {
+		status = s
+		etag = strings.Trim(w.Header().Get("Etag"), "\"")
+		return s
+	}), request)
+	if status/100 != 2 {
+		return
+	}
+	event := &NotificationEvent{
+		Event:     request.Method,
+		Account:   account,
+		Container: container,
+		Object:    object,
+		Timestamp: request.Header.Get("X-Timestamp"),
+		TxId:      ctx.TxId,
+	}
+	if event.Timestamp == "" {
+		event.Timestamp = common.GetTimestamp()
+	}
+	if request.Method == "PUT" {
+		event.Etag = etag
+		if body != nil {
+			event.Size = int64(body.ByteCount)
+		}
+	}
+	n.eventsMetric.Inc(1)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, sink := range n.sinks {
+		if err := sink.spool(event, data); err != nil {
+			ctx.Logger.Error("Unable to spool notification", zap.String("url", sink.url), zap.Error(err))
+			n.spoolErrorsMetric.Inc(1)
+		}
+	}
+}
+
+func NewNotifications(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	urls := strings.Fields(strings.Replace(config.GetDefault("webhook_urls", ""), ",", " ", -1))
+	if len(urls) == 0 {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	spoolDir := config.GetDefault("spool_dir", "/var/spool/hummingbird/notifications")
+	timeout := time.Duration(config.GetFloat("timeout", 10) * float64(time.Second))
+	batchSize := int(config.GetInt("batch_size", 100))
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	var sinks []*webhookSink
+	for _, url := range urls {
+		dir := filepath.Join(spoolDir, fmt.Sprintf("%x", md5.Sum([]byte(url))))
+		failedDir := filepath.Join(dir, "failed")
+		if err := os.MkdirAll(failedDir, 0755); err != nil {
+			return nil, fmt.Errorf("Unable to create notification spool: %v", err)
+		}
+		sinks = append(sinks, &webhookSink{
+			url:                  url,
+			dir:                  dir,
+			failedDir:            failedDir,
+			client:               &http.Client{Timeout: timeout},
+			batchSize:            batchSize,
+			maxAttempts:          int(config.GetInt("max_attempts", 20)),
+			retryInterval:        time.Duration(config.GetFloat("retry_interval", 30) * float64(time.Second)),
+			attempts:             map[string]int{},
+			wake:                 make(chan struct{}, 1),
+			logger:               zap.NewNop(),
+			deliveredMetric:      metricsScope.Counter("notifications_delivered"),
+			deliveryErrorsMetric: metricsScope.Counter("notifications_delivery_errors"),
+			droppedMetric:        metricsScope.Counter("notifications_dropped"),
+		})
+	}
+	eventsMetric := metricsScope.Counter("notifications_events")
+	spoolErrorsMetric := metricsScope.Counter("notifications_spool_errors")
+	return func(next http.Handler) http.Handler {
+		return &notificationsMiddleware{
+			next:              next,
+			sinks:             sinks,
+			eventsMetric:      eventsMetric,
+			spoolErrorsMetric: spoolErrorsMetric,
+		}
+	}, nil
+}
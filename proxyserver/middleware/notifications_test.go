@@ -0,0 +1,134 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+// notificationsTestWebhook records the events POSTed to it, failing while
+// status is set to something other than 200.
+type notificationsTestWebhook struct {
+	sync.Mutex
+	status int
+	events []NotificationEvent
+}
+
+func (h *notificationsTestWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	if h.status != 200 {
+		w.WriteHeader(h.status)
+		return
+	}
+	var events []NotificationEvent
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	h.events = append(h.events, events...)
+	w.WriteHeader(200)
+}
+
+func newNotificationsTestHandler(t *testing.T, url, spoolDir string) *notificationsMiddleware {
+	config, err := conf.StringConfig("[filter:notifications]\nwebhook_urls = " + url + "\nspool_dir = " + spoolDir + "\nmax_attempts = 2\nbatch_size = 2\n")
+	require.Nil(t, err)
+	n, err := NewNotifications(config.GetSection("filter:notifications"), common.NewTestScope())
+	require.Nil(t, err)
+	handler := n(symlinkTestStore{}).(*notificationsMiddleware)
+	// Delivery is done by the test instead of in the background.
+	handler.start.Do(func() {})
+	return handler
+}
+
+func TestNotifications(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(spoolDir)
+	webhook := &notificationsTestWebhook{status: 200}
+	ts := httptest.NewServer(webhook)
+	defer ts.Close()
+	handler := newNotificationsTestHandler(t, ts.URL, spoolDir)
+	sink := handler.sinks[0]
+
+	rr := symlinkTestRequest(t, handler, "PUT", "/v1/a/c/o", "stuff", map[string]string{"X-Timestamp": "1500000000.00000"})
+	require.Equal(t, 201, rr.Code)
+	rr = symlinkTestRequest(t, handler, "PUT", "/v1/a/c", "", nil)
+	require.Equal(t, 201, rr.Code)
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/o", "", nil)
+	require.Equal(t, 200, rr.Code)
+	rr = symlinkTestRequest(t, handler, "DELETE", "/v1/a/c/o", "", map[string]string{"X-Timestamp": "1500000001.00000"})
+	require.Equal(t, 405, rr.Code)
+	spooled, err := sink.spooled()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(spooled))
+
+	require.True(t, sink.deliver())
+	require.Equal(t, 1, len(webhook.events))
+	event := webhook.events[0]
+	require.Equal(t, "PUT", event.Event)
+	require.Equal(t, "a", event.Account)
+	require.Equal(t, "c", event.Container)
+	require.Equal(t, "o", event.Object)
+	require.Equal(t, "c13d88cb4cb02003daedb8a84e5d272a", event.Etag)
+	require.Equal(t, int64(5), event.Size)
+	require.Equal(t, "1500000000.00000", event.Timestamp)
+	spooled, err = sink.spooled()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(spooled))
+
+	// Events stay spooled while the webhook is failing, and are moved aside
+	// after max_attempts.
+	webhook.status = 503
+	for i, name := range []string{"o1", "o2", "o3"} {
+		rr = symlinkTestRequest(t, handler, "PUT", "/v1/a/c/"+name, "", map[string]string{"X-Timestamp": fmt.Sprintf("150000001%d.00000", i)})
+		require.Equal(t, 201, rr.Code)
+	}
+	require.False(t, sink.deliver())
+	spooled, err = sink.spooled()
+	require.Nil(t, err)
+	require.Equal(t, 3, len(spooled))
+	require.False(t, sink.deliver())
+	spooled, err = sink.spooled()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(spooled))
+	failed, err := ioutil.ReadDir(sink.failedDir)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(failed))
+
+	webhook.status = 200
+	require.True(t, sink.deliver())
+	require.Equal(t, 2, len(webhook.events))
+	require.Equal(t, "o3", webhook.events[1].Object)
+}
+
+func TestNotificationsDisabled(t *testing.T) {
+	n, err := NewNotifications(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	store := symlinkTestStore{}
+	require.Equal(t, http.Handler(store), n(store))
+}
@@ -16,8 +16,11 @@
 package middleware
 
 import (
+	"crypto/md5"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/troubling/hummingbird/common"
@@ -32,18 +35,43 @@ const rateBuffer = int64(5 * time.Second)
 const maxSleep = int64(60 * time.Second)
 const nsPerSecond = int64(1000000000)
 
+// memcacheErrorBackoff is how long limits are skipped after memcache fails,
+// so that requests aren't slowed by every one of them timing out.
+const memcacheErrorBackoff = int64(5 * time.Second)
+
 var writeMethods = map[string]bool{"PUT": true, "DELETE": true, "POST": true}
 
-// will sleep on write requests if the client starts to exceed the
+// ratelimitOverrides are the limits reseller admins can set for an account
+// with X-Account-Ratelimit-<name>, which is kept as
+// X-Account-Sysmeta-Ratelimit-<name>.
+var ratelimitOverrides = []string{"Account-Writes", "Container-Writes", "Reads", "Listings", "Bytes"}
+
+// will sleep on requests if the client starts to exceed the
 // specified rate. The maximum rate allowed per sec is only as
 // accurate as the clocks in the proxy layer- meaning if your clocks
 // are accurate to 1/100 of a second then the max reliable rate/sec
 // you can set is 100/sec.
+//
+// Each limit is a token bucket kept in memcache as a running clock: every
+// request moves it forward by its cost, and up to rateBuffer of time the
+// clock has fallen behind can be spent in a burst.
 
 type ratelimiter struct {
-	accountLimit   int64
-	containerLimit int64
-	next           http.Handler
+	accountLimit    int64
+	containerLimit  int64
+	readLimit       int64
+	listingLimit    int64
+	bytesLimit      int64
+	userLimit       int64
+	ipLimit         int64
+	reject          bool
+	useForwardedFor bool
+	memcacheDown    int64
+	next            http.Handler
+
+	sleepsMetric         tally.Counter
+	rejectionsMetric     tally.Counter
+	memcacheErrorsMetric tally.Counter
 }
 
 var sleep = func(s time.Duration) {
@@ -56,8 +84,13 @@ var nowNano = func() int64 {
 
 // returns int64 of ns to sleep before serving request
 func (r *ratelimiter) getSleepTime(mc ring.MemcacheRing, key string, ratePs int64) (int64, error) {
-	nsPerRequest := nsPerSecond / ratePs
-	runningTime, err := mc.Incr(key, nsPerRequest, 3600)
+	return r.chargeTime(mc, key, nsPerSecond/ratePs)
+}
+
+// chargeTime moves the key's clock forward by cost ns, returning how many ns
+// to sleep before the request fits within the limit.
+func (r *ratelimiter) chargeTime(mc ring.MemcacheRing, key string, cost int64) (int64, error) {
+	runningTime, err := mc.Incr(key, cost, 3600)
 	if err != nil {
 		return 0, err
 	}
@@ -65,9 +98,9 @@ func (r *ratelimiter) getSleepTime(mc ring.MemcacheRing, key string, ratePs int6
 	now := nowNano()
 	if int64(now-runningTime) > rateBuffer {
 		// nothing has happened in a while, set new clocktime
-		mc.Set(key, now+nsPerRequest, 3600)
+		mc.Set(key, now+cost, 3600)
 	} else {
-		sleepTime = runningTime - now - nsPerRequest
+		sleepTime = runningTime - now - cost
 		if sleepTime < 0 {
 			sleepTime = 0
 		}
@@ -75,58 +108,236 @@ func (r *ratelimiter) getSleepTime(mc ring.MemcacheRing, key string, ratePs int6
 	return sleepTime, nil
 }
 
-func (r *ratelimiter) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+// byteCost returns how long transferring the bytes takes at the rate.
+func byteCost(bytes int64, ratePs int64) int64 {
+	return int64(float64(bytes) / float64(ratePs) * float64(nsPerSecond))
+}
+
+// rateLimit is a key to charge and how much to charge it, in ns.
+type rateLimit struct {
+	key  string
+	cost int64
+}
+
+// accountLimit returns the account's override for a limit, or the default.
+func accountLimit(ai *AccountInfo, name string, dfl int64) int64 {
+	if ai != nil {
+		if v, err := strconv.ParseInt(ai.SysMetadata["Ratelimit-"+name], 10, 64); err == nil && v >= 0 {
+			return v
+		}
+	}
+	return dfl
+}
+
+// setOverrides lets reseller admins set an account's limits, moving them into
+// sysmeta. It returns false if it has already responded.
+func (r *ratelimiter) setOverrides(writer http.ResponseWriter, request *http.Request) bool {
+	var values map[string]string
+	for _, name := range ratelimitOverrides {
+		if v, ok := request.Header["X-Account-Ratelimit-"+name]; ok && len(v) > 0 {
+			if values == nil {
+				values = map[string]string{}
+			}
+			values[name] = v[0]
+		} else if _, ok := request.Header["X-Remove-Account-Ratelimit-"+name]; ok {
+			if values == nil {
+				values = map[string]string{}
+			}
+			values[name] = ""
+		}
+	}
+	if values == nil {
+		return true
+	}
+	if !authorizeReseller(writer, request) {
+		return false
+	}
+	for name, v := range values {
+		if v != "" {
+			if limit, err := strconv.ParseInt(v, 10, 64); err != nil || limit < 0 {
+				srv.SimpleErrorResponse(writer, http.StatusBadRequest, fmt.Sprintf("Invalid ratelimit %s.", name))
+				return false
+			}
+		}
+		request.Header.Del("X-Account-Ratelimit-" + name)
+		request.Header.Del("X-Remove-Account-Ratelimit-" + name)
+		request.Header.Set("X-Account-Sysmeta-Ratelimit-"+name, v)
+	}
+	return true
+}
+
+// limits returns the limits that apply to the request, and the account's
+// bandwidth limit.
+func (r *ratelimiter) limits(ctx *ProxyContext, request *http.Request, account, container, object string) ([]rateLimit, int64) {
+	var limits []rateLimit
+	add := func(key string, limit int64) {
+		if limit > 0 {
+			limits = append(limits, rateLimit{key: key, cost: nsPerSecond / limit})
+		}
+	}
+	ai, err := ctx.GetAccountInfo(account)
+	if err != nil {
+		ai = nil
+	}
 	isWrite := writeMethods[request.Method]
+	if isWrite && container != "" {
+		if object == "" {
+			add(fmt.Sprintf("ratelimit/%s", account), accountLimit(ai, "Account-Writes", r.accountLimit))
+		} else {
+			add(fmt.Sprintf("ratelimit/%s/%s", account, container), accountLimit(ai, "Container-Writes", r.containerLimit))
+		}
+	} else if request.Method == "GET" && object == "" {
+		add(fmt.Sprintf("ratelimit-listings/%s", account), accountLimit(ai, "Listings", r.listingLimit))
+	} else if (request.Method == "GET" || request.Method == "HEAD") && object != "" {
+		add(fmt.Sprintf("ratelimit-reads/%s", account), accountLimit(ai, "Reads", r.readLimit))
+	}
+	bytesLimit := accountLimit(ai, "Bytes", r.bytesLimit)
+	if bytesLimit > 0 {
+		// Uploads are charged up front; downloads, whose size isn't known
+		// yet, just wait for earlier transfers and are charged afterwards.
+		var cost int64
+		if request.ContentLength > 0 {
+			cost = byteCost(request.ContentLength, bytesLimit)
+		}
+		limits = append(limits, rateLimit{key: fmt.Sprintf("ratelimit-bytes/%s", account), cost: cost})
+	}
+	if len(ctx.RemoteUsers) > 0 {
+		add(fmt.Sprintf("ratelimit-user/%s", ctx.RemoteUsers[0]), r.userLimit)
+	} else if token := request.Header.Get("X-Auth-Token"); token != "" {
+		add(fmt.Sprintf("ratelimit-token/%x", md5.Sum([]byte(token))), r.userLimit)
+	}
+	add(fmt.Sprintf("ratelimit-ip/%s", clientIP(request, r.useForwardedFor)), r.ipLimit)
+	return limits, bytesLimit
+}
+
+// memcacheFailed logs the error and stops limiting for a while.
+func (r *ratelimiter) memcacheFailed(ctx *ProxyContext, err error) {
+	ctx.Logger.Debug("Ratelimiter errored while getting sleep time", zap.Error(err))
+	r.memcacheErrorsMetric.Inc(1)
+	atomic.StoreInt64(&r.memcacheDown, nowNano()+memcacheErrorBackoff)
+}
+
+func (r *ratelimiter) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	pathParts, err := common.ParseProxyPath(request.URL.Path)
-	if !isWrite || err != nil || pathParts["container"] == "" {
+	ctx := GetProxyContext(request)
+	// Subrequests of a request that's already been limited, like SLO segment
+	// GETs, aren't limited again, much like Swift's swift.ratelimit.handled.
+	// Those of requests that never came through here, like s3api's, are the
+	// client's requests and are limited.
+	if err != nil || ctx == nil || pathParts["account"] == "" || (ctx.depth > 0 && ctx.ratelimited) {
 		r.next.ServeHTTP(writer, request)
 		return
 	}
-	ctx := GetProxyContext(request)
-	if ctx == nil {
-		ctx.Logger.Debug("Error ratelimiter getting ctx")
+	ctx.ratelimited = true
+	if pathParts["container"] == "" && (request.Method == "PUT" || request.Method == "POST") {
+		if !r.setOverrides(writer, request) {
+			return
+		}
+	}
+	if atomic.LoadInt64(&r.memcacheDown) > nowNano() {
+		r.next.ServeHTTP(writer, request)
 		return
 	}
-	limit := int64(0)
-	var ratekey string
-	if pathParts["object"] == "" {
-		ratekey = fmt.Sprintf(
-			"ratelimit/%s", pathParts["account"])
-		limit = r.accountLimit
-	} else {
-		ratekey = fmt.Sprintf(
-			"ratelimit/%s/%s", pathParts["account"], pathParts["container"])
-		limit = r.containerLimit
-	}
-	if limit > 0 {
-		sleepTime, err := r.getSleepTime(ctx.Cache, ratekey, limit)
-		if err == nil {
-			if sleepTime > maxSleep {
-				sleep(time.Second)
-				srv.StandardResponse(writer, 498)
-				return
-			}
-			sleep(time.Duration(sleepTime))
-		} else {
-			if ctx := GetProxyContext(request); ctx != nil {
-				ctx.Logger.Debug("Ratelimiter errored while getting sleep time", zap.Error(err))
-			}
+	limits, bytesLimit := r.limits(ctx, request, pathParts["account"], pathParts["container"], pathParts["object"])
+	sleepTime := int64(0)
+	for i, limit := range limits {
+		limitSleep, err := r.chargeTime(ctx.Cache, limit.key, limit.cost)
+		if err != nil {
+			r.memcacheFailed(ctx, err)
+			limits = limits[:i]
+			sleepTime = 0
+			bytesLimit = 0
+			break
+		}
+		if limitSleep > sleepTime {
+			sleepTime = limitSleep
+		}
+	}
+	if sleepTime > 0 && r.reject {
+		// Rejected requests don't count against the limits.
+		for _, limit := range limits {
+			ctx.Cache.Decr(limit.key, limit.cost, 3600)
+		}
+		r.rejectionsMetric.Inc(1)
+		writer.Header().Set("Retry-After", strconv.FormatInt((sleepTime+nsPerSecond-1)/nsPerSecond, 10))
+		srv.StandardResponse(writer, http.StatusTooManyRequests)
+		return
+	} else if sleepTime > maxSleep {
+		sleep(time.Second)
+		srv.StandardResponse(writer, 498)
+		return
+	} else if sleepTime > 0 {
+		r.sleepsMetric.Inc(1)
+		sleep(time.Duration(sleepTime))
+	}
+	if bytesLimit <= 0 {
+		r.next.ServeHTTP(writer, request)
+		return
+	}
+	w := &srv.WebWriter{ResponseWriter: writer, Status: 500}
+	var body *srv.CountingReadCloser
+	if request.Body != nil {
+		body = &srv.CountingReadCloser{ReadCloser: request.Body}
+		request.Body = body
+	}
+	r.next.ServeHTTP(w, request)
+	// Whatever wasn't charged up front is charged now.
+	transferred := int64(w.ByteCount)
+	if body != nil {
+		prepaid := request.ContentLength
+		if prepaid < 0 {
+			prepaid = 0
+		}
+		if int64(body.ByteCount) > prepaid {
+			transferred += int64(body.ByteCount) - prepaid
+		}
+	}
+	if transferred > 0 {
+		if _, err := ctx.Cache.Incr(fmt.Sprintf("ratelimit-bytes/%s", pathParts["account"]), byteCost(transferred, bytesLimit), 3600); err != nil {
+			r.memcacheFailed(ctx, err)
 		}
 	}
-	r.next.ServeHTTP(writer, request)
 }
 
 func NewRatelimiter(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
-
 	accLimit := int64(config.GetInt("account_db_max_writes_per_sec", 0))
 	contLimit := int64(config.GetInt("container_db_max_writes_per_sec", 0))
-	//TODO: add account metadata global-write-ratelimit ratelimiter
-	RegisterInfo("ratelimit", map[string]interface{}{"account_ratelimit": accLimit, "container_ratelimits": [][]int64{{contLimit}}, "max_sleep_time_seconds": float64(60.0)})
+	readLimit := int64(config.GetInt("account_max_reads_per_sec", 0))
+	listingLimit := int64(config.GetInt("account_max_listings_per_sec", 0))
+	bytesLimit := int64(config.GetInt("account_max_bytes_per_sec", 0))
+	userLimit := int64(config.GetInt("user_max_requests_per_sec", 0))
+	ipLimit := int64(config.GetInt("ip_max_requests_per_sec", 0))
+	reject := config.GetDefault("ratelimit_action", "sleep") == "reject"
+	useForwardedFor := config.GetBool("use_forwarded_for", false)
+	RegisterInfo("ratelimit", map[string]interface{}{
+		"account_ratelimit":         accLimit,
+		"container_ratelimits":      [][]int64{{contLimit}},
+		"max_sleep_time_seconds":    float64(60.0),
+		"account_read_ratelimit":    readLimit,
+		"account_listing_ratelimit": listingLimit,
+		"account_bytes_ratelimit":   bytesLimit,
+		"user_ratelimit":            userLimit,
+		"ip_ratelimit":              ipLimit,
+		"reject":                    reject,
+	})
+	sleepsMetric := metricsScope.Counter("ratelimit_sleeps")
+	rejectionsMetric := metricsScope.Counter("ratelimit_rejections")
+	memcacheErrorsMetric := metricsScope.Counter("ratelimit_memcache_errors")
 	return func(next http.Handler) http.Handler {
 		return &ratelimiter{
-			accountLimit:   accLimit,
-			containerLimit: contLimit,
-			next:           next,
+			accountLimit:         accLimit,
+			containerLimit:       contLimit,
+			readLimit:            readLimit,
+			listingLimit:         listingLimit,
+			bytesLimit:           bytesLimit,
+			userLimit:            userLimit,
+			ipLimit:              ipLimit,
+			reject:               reject,
+			useForwardedFor:      useForwardedFor,
+			next:                 next,
+			sleepsMetric:         sleepsMetric,
+			rejectionsMetric:     rejectionsMetric,
+			memcacheErrorsMetric: memcacheErrorsMetric,
 		}
 	}, nil
 }
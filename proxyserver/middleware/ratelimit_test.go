@@ -16,11 +16,17 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/test"
 )
 
@@ -75,52 +81,199 @@ func TestGetSleepTime(t *testing.T) {
 	assert.Equal(t, fakeMr.MockSetValues[0], now+nsPerSecond/1000)
 }
 
-/*
-TODO:
-need to figure out a decent way to put the FakeMemcacheRing
-into the request's context
+// ratelimitTestCache keeps counters like memcache, failing with err when set.
+type ratelimitTestCache struct {
+	test.FakeMemcacheRing
+	values map[string]int64
+	err    error
+}
+
+func (c *ratelimitTestCache) Incr(key string, delta int64, timeout int) (int64, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.values[key] += delta
+	return c.values[key], nil
+}
 
-func TestServeHTTP(t *testing.T) {
-	fakeMr := test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000}}
+func (c *ratelimitTestCache) Decr(key string, delta int64, timeout int) (int64, error) {
+	c.values[key] -= delta
+	return c.values[key], nil
+}
 
-	rt := ratelimiter{accountLimit: 10, containerLimit: 100, mc: &fakeMr}
+func (c *ratelimitTestCache) Set(key string, value interface{}, timeout int) error {
+	if v, ok := value.(int64); ok {
+		c.values[key] = v
+	}
+	return nil
+}
+
+func newRatelimitTestHandler(t *testing.T, config string, next http.Handler) (*ratelimiter, *ProxyContext, *ratelimitTestCache) {
+	conf, err := conf.StringConfig("[filter:ratelimit]\n" + config)
+	require.Nil(t, err)
+	rl, err := NewRatelimiter(conf.GetSection("filter:ratelimit"), common.NewTestScope())
+	require.Nil(t, err)
+	if next == nil {
+		next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		})
+	}
+	h := rl(next).(*ratelimiter)
+	cache := &ratelimitTestCache{values: map[string]int64{}}
+	ctx := NewFakeProxyContext(h)
+	ctx.Cache = cache
+	ctx.C = &accountQuotaTestClient{accountHeaders: http.Header{}}
+	return h, ctx, cache
+}
+
+func ratelimitTestRequest(t *testing.T, h http.Handler, ctx *ProxyContext, method, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, nil)
+	require.Nil(t, err)
+	req.RemoteAddr = "1.2.3.4:5678"
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	ctx.accountInfoCache = nil
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func fakeRatelimitClock() (*sleeper, func()) {
 	oldSleep := sleep
 	oldNowNano := nowNano
-	defer func() {
-		sleep = oldSleep
-		nowNano = oldNowNano
-	}()
-	s := sleeper{}
+	s := &sleeper{}
 	sleep = s.fakeSleep
 	nowNano = fakeNowNano
-	fakeWriter := test.MockResponseWriter{}
-	rt.next = FakeHandler{}
+	return s, func() {
+		sleep = oldSleep
+		nowNano = oldNowNano
+	}
+}
 
-	req, _ := http.NewRequest("GET", "/v/a/co", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 0)
-	assert.Equal(t, len(fakeMr.MockIncrKeys), 0)
+func TestRatelimitKeys(t *testing.T) {
+	_, restore := fakeRatelimitClock()
+	defer restore()
+	h, ctx, cache := newRatelimitTestHandler(t, "account_db_max_writes_per_sec = 10\ncontainer_db_max_writes_per_sec = 10\naccount_max_reads_per_sec = 10\naccount_max_listings_per_sec = 10\nuser_max_requests_per_sec = 10\nip_max_requests_per_sec = 10\n", nil)
 
-	req, _ = http.NewRequest("PUT", "/v/a/c", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 1)
+	ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c/o", map[string]string{"X-Auth-Token": "t"})
+	ratelimitTestRequest(t, h, ctx, "HEAD", "/v1/a/c/o", nil)
+	ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c", nil)
+	ratelimitTestRequest(t, h, ctx, "GET", "/v1/a", nil)
+	ratelimitTestRequest(t, h, ctx, "PUT", "/v1/a/c/o", nil)
+	ratelimitTestRequest(t, h, ctx, "DELETE", "/v1/a/c", nil)
+	ctx.RemoteUsers = []string{"a:u"}
+	ratelimitTestRequest(t, h, ctx, "POST", "/v1/a/c/o", nil)
+	keys := map[string]int64{}
+	for k, v := range cache.values {
+		keys[k] = (v - now) / (nsPerSecond / 10)
+	}
+	require.Equal(t, map[string]int64{
+		"ratelimit-reads/a":    2,
+		"ratelimit-listings/a": 2,
+		"ratelimit/a/c":        2,
+		"ratelimit/a":          1,
+		"ratelimit-token/e358efa489f58062f10dd7316b65649e": 1,
+		"ratelimit-user/a:u":   1,
+		"ratelimit-ip/1.2.3.4": 7,
+	}, keys)
+}
 
-	rt.accountLimit = 0
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 1)
+func TestRatelimitSleepOrReject(t *testing.T) {
+	s, restore := fakeRatelimitClock()
+	defer restore()
+	h, ctx, cache := newRatelimitTestHandler(t, "account_max_reads_per_sec = 1\n", nil)
+	require.Equal(t, 200, ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c/o", nil).Code)
+	require.Equal(t, 200, ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c/o", nil).Code)
+	require.Equal(t, []time.Duration{time.Second}, s.SleepVals)
 
-	req, _ = http.NewRequest("PUT", "/v/a/c/o", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 2)
+	h.reject = true
+	w := ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c/o", nil)
+	require.Equal(t, 429, w.Code)
+	require.Equal(t, "2", w.Header().Get("Retry-After"))
+	// Rejected requests don't push the clock further ahead.
+	require.Equal(t, now+2*nsPerSecond, cache.values["ratelimit-reads/a"])
+	require.Equal(t, 1, len(s.SleepVals))
+}
 
-	assert.Equal(t, fakeMr.MockIncrKeys[0], "ratelimit/a")
-	assert.Equal(t, fakeMr.MockIncrKeys[1], "ratelimit/a/c")
+func TestRatelimitOverrides(t *testing.T) {
+	s, restore := fakeRatelimitClock()
+	defer restore()
+	var got http.Header
+	h, ctx, cache := newRatelimitTestHandler(t, "account_max_reads_per_sec = 1\n", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.WriteHeader(204)
+	}))
+	ctx.C.(*accountQuotaTestClient).accountHeaders.Set("X-Account-Sysmeta-Ratelimit-Reads", "0")
+	for i := 0; i < 3; i++ {
+		ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c/o", nil)
+	}
+	require.Equal(t, 0, len(s.SleepVals))
+	require.Equal(t, 0, len(cache.values))
+
+	ctx.Authorize = func(r *http.Request) (bool, int) { return true, 200 }
+	require.Equal(t, 403, ratelimitTestRequest(t, h, ctx, "POST", "/v1/a", map[string]string{"X-Account-Ratelimit-Reads": "100"}).Code)
+	ctx.Authorize = func(r *http.Request) (bool, int) {
+		GetProxyContext(r).ResellerRequest = true
+		return true, 200
+	}
+	require.Equal(t, 400, ratelimitTestRequest(t, h, ctx, "POST", "/v1/a", map[string]string{"X-Account-Ratelimit-Reads": "fast"}).Code)
+	require.Equal(t, 204, ratelimitTestRequest(t, h, ctx, "POST", "/v1/a", map[string]string{"X-Account-Ratelimit-Reads": "100", "X-Remove-Account-Ratelimit-Bytes": "x"}).Code)
+	require.Equal(t, "100", got.Get("X-Account-Sysmeta-Ratelimit-Reads"))
+	require.Equal(t, []string{""}, got["X-Account-Sysmeta-Ratelimit-Bytes"])
+	require.Equal(t, "", got.Get("X-Account-Ratelimit-Reads"))
+}
+
+func TestRatelimitBandwidth(t *testing.T) {
+	s, restore := fakeRatelimitClock()
+	defer restore()
+	h, ctx, _ := newRatelimitTestHandler(t, "account_max_bytes_per_sec = 10\n", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("01234567890123456789"))
+	}))
+	require.Equal(t, 200, ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c/o", nil).Code)
+	require.Equal(t, 0, len(s.SleepVals))
+	// The next request waits for the 20 bytes sent at 10 bytes a second.
+	require.Equal(t, 200, ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c/o", nil).Code)
+	require.Equal(t, []time.Duration{2 * time.Second}, s.SleepVals)
+}
+
+func TestRatelimitMemcacheDown(t *testing.T) {
+	s, restore := fakeRatelimitClock()
+	defer restore()
+	h, ctx, cache := newRatelimitTestHandler(t, "account_max_reads_per_sec = 1\n", nil)
+	cache.err = errors.New("memcache is down")
+	require.Equal(t, 200, ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c/o", nil).Code)
+	require.Equal(t, now+memcacheErrorBackoff, h.memcacheDown)
+	// Memcache isn't tried again for a while.
+	cache.err = nil
+	require.Equal(t, 200, ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c/o", nil).Code)
+	require.Equal(t, 0, len(cache.values))
+	require.Equal(t, 0, len(s.SleepVals))
+}
 
-	fakeMr = test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000 + MaxSleep}}
-	rt.mc = &fakeMr
-	req, _ = http.NewRequest("PUT", "/v/a/c/o", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 3)
-	assert.Equal(t, s.SleepVals[len(s.SleepVals)-1], time.Second)
+func TestRatelimitSloGet(t *testing.T) {
+	s, restore := fakeRatelimitClock()
+	defer restore()
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/a/c/o":
+			w.Header().Set("X-Static-Large-Object", "True")
+			w.WriteHeader(200)
+			w.Write([]byte(simpleManifest))
+		case "/v1/a/hat/a", "/v1/a/hat/b", "/v1/a/hat/c":
+			w.WriteHeader(200)
+			w.Write([]byte("123"))
+		}
+	})
+	h, ctx, cache := newRatelimitTestHandler(t, "account_max_reads_per_sec = 10\nip_max_requests_per_sec = 10\naccount_max_bytes_per_sec = 10\n", newTestXLOMiddleware(backend))
+	w := ratelimitTestRequest(t, h, ctx, "GET", "/v1/a/c/o", nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "123123123", w.Body.String())
+	// The segment GETs aren't charged as requests or bytes of their own.
+	require.Equal(t, now+nsPerSecond/10, cache.values["ratelimit-reads/a"])
+	require.Equal(t, now+nsPerSecond/10, cache.values["ratelimit-ip/1.2.3.4"])
+	require.Equal(t, now+byteCost(9, 10), cache.values["ratelimit-bytes/a"])
+	require.Equal(t, 0, len(s.SleepVals))
 }
-*/
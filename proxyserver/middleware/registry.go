@@ -0,0 +1,102 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/uber-go/tally"
+)
+
+// Constructor builds a middleware from its [filter:<name>] config section.
+type Constructor func(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error)
+
+var (
+	registry     = map[string]Constructor{}
+	registryLock sync.RWMutex
+)
+
+// RegisterMiddleware makes a middleware available to the proxy pipeline under
+// name, which is also the name of its config section after "filter:". It is
+// meant to be called from an init function, and panics if name is already
+// taken.
+func RegisterMiddleware(name string, construct Constructor) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if construct == nil {
+		panic("middleware: RegisterMiddleware constructor is nil")
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("middleware: RegisterMiddleware called twice for %q", name))
+	}
+	registry[name] = construct
+}
+
+// GetMiddleware returns the constructor registered under name.
+func GetMiddleware(name string) (Constructor, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	construct, ok := registry[name]
+	return construct, ok
+}
+
+// RegisteredMiddleware returns the names of all registered middleware.
+func RegisteredMiddleware() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterMiddleware("catch_errors", NewCatchError)
+	RegisterMiddleware("gatekeeper", NewGatekeeper)
+	RegisterMiddleware("healthcheck", NewHealthcheck)
+	RegisterMiddleware("proxy-logging", NewRequestLogger)
+	RegisterMiddleware("cname_lookup", NewCNAMELookup)
+	RegisterMiddleware("domain_remap", NewDomainRemap)
+	RegisterMiddleware("crossdomain", NewCrossDomain)
+	RegisterMiddleware("cors", NewCors)
+	RegisterMiddleware("formpost", NewFormPost)
+	RegisterMiddleware("tempurl", NewTempURL)
+	RegisterMiddleware("s3api", NewS3Api)
+	RegisterMiddleware("tempauth", NewTempAuth)
+	RegisterMiddleware("authtoken", NewAuthToken)
+	RegisterMiddleware("keystoneauth", NewKeystoneAuth)
+	RegisterMiddleware("jwtauth", NewJWTAuth)
+	RegisterMiddleware("bulk", NewBulk)
+	RegisterMiddleware("multirange", NewMultirange)
+	RegisterMiddleware("ratelimit", NewRatelimiter)
+	RegisterMiddleware("audit", NewAudit)
+	RegisterMiddleware("staticweb", NewStaticWeb)
+	RegisterMiddleware("copy", NewCopyMiddleware)
+	RegisterMiddleware("multipart", NewMultipart)
+	RegisterMiddleware("container-quotas", NewContainerQuota)
+	RegisterMiddleware("account_quotas", NewAccountQuota)
+	RegisterMiddleware("lifecycle", NewLifecycle)
+	RegisterMiddleware("versioned_writes", NewVersionedWrites)
+	RegisterMiddleware("slo", NewXlo)
+	RegisterMiddleware("symlink", NewSymlink)
+	RegisterMiddleware("notifications", NewNotifications)
+}
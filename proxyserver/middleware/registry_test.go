@@ -0,0 +1,37 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterMiddleware(t *testing.T) {
+	construct, ok := GetMiddleware("tempauth")
+	require.True(t, ok)
+	require.NotNil(t, construct)
+	_, ok = GetMiddleware("nothere")
+	require.False(t, ok)
+	require.Contains(t, RegisteredMiddleware(), "slo")
+
+	RegisterMiddleware("test-registered", NewHealthcheck)
+	_, ok = GetMiddleware("test-registered")
+	require.True(t, ok)
+	require.Panics(t, func() { RegisterMiddleware("test-registered", NewHealthcheck) })
+	require.Panics(t, func() { RegisterMiddleware("test-nil", nil) })
+}
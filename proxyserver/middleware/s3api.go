@@ -0,0 +1,1540 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+// The s3api middleware serves S3 requests by translating them into Swift
+// subrequests. It must come before the auth middleware in the pipeline: it
+// only parses the request's signature, and its subrequests use the access key
+// as their account until tempauth or authtoken validates the signature and
+// swaps in the real account.
+//
+// Multipart uploads keep their parts in a <bucket>+segments container, under
+// <key>/<upload id>/<part number>, with an empty <key>/<upload id> object
+// marking the upload as in progress. Completing the upload puts an SLO
+// manifest of the parts at the key.
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+const (
+	s3Xmlns           = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3SegmentsSuffix  = "+segments"
+	s3MaxPartNumber   = 10000
+	s3MaxXMLBodySize  = 2 * 1024 * 1024
+	s3SwiftListingMax = 10000
+)
+
+var s3UploadIdRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+var s3ErrorInfo = map[string]struct {
+	status  int
+	message string
+}{
+	"AccessDenied":                      {http.StatusForbidden, "Access Denied."},
+	"AuthorizationHeaderMalformed":      {http.StatusBadRequest, "The authorization header is malformed."},
+	"AuthorizationQueryParametersError": {http.StatusBadRequest, "The authorization query parameters are malformed."},
+	"BadDigest":                         {http.StatusBadRequest, "The Content-MD5 you specified did not match what we received."},
+	"BucketAlreadyOwnedByYou":           {http.StatusConflict, "Your previous request to create the named bucket succeeded and you already own it."},
+	"BucketNotEmpty":                    {http.StatusConflict, "The bucket you tried to delete is not empty."},
+	"EntityTooLarge":                    {http.StatusBadRequest, "Your proposed upload exceeds the maximum allowed object size."},
+	"EntityTooSmall":                    {http.StatusBadRequest, "Your proposed upload is smaller than the minimum allowed object size."},
+	"InternalError":                     {http.StatusInternalServerError, "We encountered an internal error. Please try again."},
+	"InvalidArgument":                   {http.StatusBadRequest, "Invalid Argument."},
+	"InvalidBucketName":                 {http.StatusBadRequest, "The specified bucket is not valid."},
+	"InvalidDigest":                     {http.StatusBadRequest, "The Content-MD5 you specified is not valid."},
+	"InvalidLocationConstraint":         {http.StatusBadRequest, "The specified location constraint is not valid."},
+	"InvalidPart":                       {http.StatusBadRequest, "One or more of the specified parts could not be found."},
+	"InvalidPartOrder":                  {http.StatusBadRequest, "The list of parts was not in ascending order."},
+	"InvalidRange":                      {http.StatusRequestedRangeNotSatisfiable, "The requested range is not satisfiable."},
+	"InvalidRequest":                    {http.StatusBadRequest, "Invalid Request."},
+	"MalformedXML":                      {http.StatusBadRequest, "The XML you provided was not well-formed or did not validate against our published schema."},
+	"MethodNotAllowed":                  {http.StatusMethodNotAllowed, "The specified method is not allowed against this resource."},
+	"MissingContentLength":              {http.StatusLengthRequired, "You must provide the Content-Length HTTP header."},
+	"NoSuchBucket":                      {http.StatusNotFound, "The specified bucket does not exist."},
+	"NoSuchKey":                         {http.StatusNotFound, "The specified key does not exist."},
+	"NoSuchUpload":                      {http.StatusNotFound, "The specified multipart upload does not exist."},
+	"NotImplemented":                    {http.StatusNotImplemented, "A header or query you provided implies functionality that is not implemented."},
+	"PreconditionFailed":                {http.StatusPreconditionFailed, "At least one of the preconditions you specified did not hold."},
+	"RequestTimeTooSkewed":              {http.StatusForbidden, "The difference between the request time and the current time is too large."},
+	"ServiceUnavailable":                {http.StatusServiceUnavailable, "Please reduce your request rate."},
+	"SignatureDoesNotMatch":             {http.StatusForbidden, "The request signature we calculated does not match the signature you provided. Check your key and signing method."},
+	"XAmzContentSHA256Mismatch":         {http.StatusBadRequest, "The provided 'x-amz-content-sha256' header does not match what was computed."},
+}
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+func newS3Error(code string) *s3Error {
+	return &s3Error{Code: code, Message: s3ErrorInfo[code].message}
+}
+
+func newS3ErrorMessage(code, message string) *s3Error {
+	return &s3Error{Code: code, Message: message}
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *s3Error) status() int {
+	if info, ok := s3ErrorInfo[e.Code]; ok {
+		return info.status
+	}
+	return http.StatusBadRequest
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestId string
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   s3Owner
+	Buckets struct {
+		Bucket []s3Bucket
+	}
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	Owner        *s3Owner `xml:",omitempty"`
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	MaxKeys               int
+	Delimiter             string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3LocationConstraint struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+type s3CreateBucketConfiguration struct {
+	XMLName            xml.Name `xml:"CreateBucketConfiguration"`
+	LocationConstraint string
+}
+
+type s3CopyObjectResult struct {
+	XMLName      xml.Name
+	Xmlns        string `xml:"xmlns,attr"`
+	LastModified string
+	ETag         string
+}
+
+type s3DeleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool
+	Objects []struct {
+		Key       string
+		VersionId string
+	} `xml:"Object"`
+}
+
+type s3Deleted struct {
+	Key string
+}
+
+type s3DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Deleted []s3Deleted
+	Errors  []s3DeleteError `xml:"Error"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type s3Part struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type s3ListPartsResult struct {
+	XMLName              xml.Name `xml:"ListPartsResult"`
+	Xmlns                string   `xml:"xmlns,attr"`
+	Bucket               string
+	Key                  string
+	UploadId             string
+	Initiator            s3Owner
+	Owner                s3Owner
+	StorageClass         string
+	PartNumberMarker     int
+	NextPartNumberMarker int
+	MaxParts             int
+	IsTruncated          bool
+	Parts                []s3Part `xml:"Part"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type s3Upload struct {
+	Key          string
+	UploadId     string
+	Initiator    s3Owner
+	Owner        s3Owner
+	StorageClass string
+	Initiated    string
+}
+
+type s3ListMultipartUploadsResult struct {
+	XMLName            xml.Name `xml:"ListMultipartUploadsResult"`
+	Xmlns              string   `xml:"xmlns,attr"`
+	Bucket             string
+	KeyMarker          string
+	UploadIdMarker     string
+	NextKeyMarker      string
+	NextUploadIdMarker string
+	Prefix             string
+	MaxUploads         int
+	IsTruncated        bool
+	Uploads            []s3Upload `xml:"Upload"`
+}
+
+// s3ListingItem is an entry in a Swift json account or container listing.
+type s3ListingItem struct {
+	Name         string `json:"name"`
+	Subdir       string `json:"subdir"`
+	Hash         string `json:"hash"`
+	Bytes        int64  `json:"bytes"`
+	LastModified string `json:"last_modified"`
+}
+
+type s3ApiHandler struct {
+	next                  http.Handler
+	location              string
+	storageDomain         string
+	clockSkew             time.Duration
+	maxBucketListing      int
+	maxPartsListing       int
+	maxMultiDeleteObjects int
+	minSegmentSize        int64
+	requestsMetric        tally.Counter
+}
+
+// s3Request holds the state of an S3 request being served.
+type s3Request struct {
+	*s3ApiHandler
+	ctx     *ProxyContext
+	writer  http.ResponseWriter
+	request *http.Request
+	bucket  string
+	object  string
+}
+
+func (h *s3ApiHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	if ctx == nil || !isS3Signed(request) || request.URL.Path == "/v1" || strings.HasPrefix(request.URL.Path, "/v1/") ||
+		strings.HasPrefix(request.URL.Path, "/auth/") {
+		h.next.ServeHTTP(writer, request)
+		return
+	}
+	h.requestsMetric.Inc(1)
+	writer.Header().Set("X-Amz-Request-Id", ctx.TxId)
+	s := &s3Request{s3ApiHandler: h, ctx: ctx, writer: writer, request: request}
+	resource := request.URL.EscapedPath()
+	if bucket := h.hostBucket(request.Host); bucket != "" {
+		s.bucket = bucket
+		s.object = strings.TrimPrefix(request.URL.Path, "/")
+		resource = "/" + bucket + resource
+	} else {
+		parts := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/"), "/", 2)
+		s.bucket = parts[0]
+		if len(parts) > 1 {
+			s.object = parts[1]
+		}
+	}
+	s3Auth, s3Err := parseS3Auth(request, resource, h.clockSkew, time.Now())
+	if s3Err != nil {
+		s.sendError(s3Err)
+		return
+	}
+	ctx.S3Auth = s3Auth
+	query := request.URL.Query()
+	switch {
+	case s.bucket == "":
+		if request.Method != "GET" {
+			s.sendError(newS3Error("MethodNotAllowed"))
+			return
+		}
+		s.listBuckets()
+	case s.object == "":
+		s.serveBucket(query)
+	default:
+		s.serveObject(query)
+	}
+}
+
+// hostBucket returns the bucket of a virtual hosted style request, if
+// storage_domain is configured.
+func (h *s3ApiHandler) hostBucket(host string) string {
+	if h.storageDomain == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.HasSuffix(host, "."+h.storageDomain) {
+		return strings.TrimSuffix(host, "."+h.storageDomain)
+	}
+	return ""
+}
+
+func (s *s3Request) serveBucket(query url.Values) {
+	switch s.request.Method {
+	case "GET":
+		if s.unsupportedSubresource(query, "location", "uploads") {
+			return
+		}
+		if _, ok := query["location"]; ok {
+			s.getBucketLocation()
+		} else if _, ok := query["uploads"]; ok {
+			s.listMultipartUploads(query)
+		} else {
+			s.listObjects(query, query.Get("list-type") == "2")
+		}
+	case "HEAD":
+		s.headBucket()
+	case "PUT":
+		if !s.unsupportedSubresource(query) {
+			s.putBucket()
+		}
+	case "DELETE":
+		if !s.unsupportedSubresource(query) {
+			s.deleteBucket()
+		}
+	case "POST":
+		if _, ok := query["delete"]; ok {
+			s.deleteObjects()
+		} else {
+			s.sendError(newS3Error("NotImplemented"))
+		}
+	default:
+		s.sendError(newS3Error("MethodNotAllowed"))
+	}
+}
+
+func (s *s3Request) serveObject(query url.Values) {
+	_, isUpload := query["uploadId"]
+	switch s.request.Method {
+	case "GET", "HEAD":
+		if s.unsupportedSubresource(query, "uploadId", "response-cache-control", "response-content-disposition",
+			"response-content-encoding", "response-content-language", "response-content-type", "response-expires") {
+			return
+		}
+		if isUpload && s.request.Method == "GET" {
+			s.listParts(query)
+		} else {
+			s.getObject(query)
+		}
+	case "PUT":
+		if s.unsupportedSubresource(query, "uploadId", "partNumber") {
+			return
+		}
+		if isUpload {
+			s.uploadPart(query)
+		} else {
+			s.putObject()
+		}
+	case "POST":
+		if _, ok := query["uploads"]; ok {
+			s.initiateMultipartUpload()
+		} else if isUpload {
+			s.completeMultipartUpload(query.Get("uploadId"))
+		} else {
+			s.sendError(newS3Error("NotImplemented"))
+		}
+	case "DELETE":
+		if s.unsupportedSubresource(query, "uploadId") {
+			return
+		}
+		if isUpload {
+			s.abortMultipartUpload(query.Get("uploadId"))
+		} else {
+			s.deleteObject()
+		}
+	default:
+		s.sendError(newS3Error("MethodNotAllowed"))
+	}
+}
+
+// unsupportedSubresource sends a NotImplemented error, returning true, if the
+// request asks for a subresource other than those given.
+func (s *s3Request) unsupportedSubresource(query url.Values, supported ...string) bool {
+	for k := range query {
+		if s3V2Subresources[k] && !common.StringInSlice(k, supported) {
+			s.sendError(newS3ErrorMessage("NotImplemented", fmt.Sprintf("The %s subresource is not implemented.", k)))
+			return true
+		}
+	}
+	return false
+}
+
+func (s *s3Request) owner() s3Owner {
+	return s3Owner{ID: s.ctx.S3Auth.Key, DisplayName: s.ctx.S3Auth.Key}
+}
+
+func (s *s3Request) swiftPath(container, object string) string {
+	account := s.ctx.S3Auth.Account
+	if account == "" {
+		account = s.ctx.S3Auth.Key
+	}
+	p := "/v1/" + common.Urlencode(account)
+	if container != "" {
+		p += "/" + common.Urlencode(container)
+	}
+	if object != "" {
+		p += "/" + common.Urlencode(object)
+	}
+	return p
+}
+
+func (s *s3Request) newSubrequest(method, path string, body io.Reader, header http.Header) (*http.Request, error) {
+	subreq, err := s.ctx.newSubrequest(method, path, body, s.request, "-")
+	if err != nil {
+		s.ctx.Logger.Error("Couldn't create http.Request", zap.Error(err))
+		return nil, err
+	}
+	for k, v := range header {
+		subreq.Header[k] = v
+	}
+	return subreq, nil
+}
+
+// do serves a Swift subrequest, returning its buffered response.
+func (s *s3Request) do(method, path string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	subreq, err := s.newSubrequest(method, path, body, header)
+	if err != nil {
+		rec.Code = http.StatusInternalServerError
+		return rec
+	}
+	if body != nil && body != http.NoBody {
+		if b, ok := body.(*bytes.Reader); ok {
+			subreq.Header.Set("Content-Length", strconv.Itoa(b.Len()))
+		}
+	}
+	s.ctx.serveHTTPSubrequest(rec, subreq)
+	return rec
+}
+
+// doWithBody serves a Swift subrequest carrying the S3 request's body.
+func (s *s3Request) doWithBody(method, path string, header http.Header) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	subreq, err := s.newSubrequest(method, path, http.NoBody, header)
+	if err != nil {
+		rec.Code = http.StatusInternalServerError
+		return rec
+	}
+	subreq.Body = s.request.Body
+	subreq.ContentLength = s.request.ContentLength
+	subreq.TransferEncoding = s.request.TransferEncoding
+	if cl := s.request.Header.Get("Content-Length"); cl != "" {
+		subreq.Header.Set("Content-Length", cl)
+	}
+	if te := s.request.Header.Get("Transfer-Encoding"); te != "" {
+		subreq.Header.Set("Transfer-Encoding", te)
+	}
+	s.ctx.serveHTTPSubrequest(rec, subreq)
+	return rec
+}
+
+func (s *s3Request) payloadMismatch() bool {
+	v, ok := s.request.Body.(*s3PayloadVerifier)
+	return ok && v.mismatch
+}
+
+// getListing fetches a page of a Swift json listing.
+func (s *s3Request) getListing(path string, params url.Values) ([]s3ListingItem, int) {
+	params.Set("format", "json")
+	rec := s.do("GET", path+"?"+params.Encode(), http.NoBody, nil)
+	if rec.Code/100 != 2 {
+		return nil, rec.Code
+	}
+	var items []s3ListingItem
+	if rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil {
+			s.ctx.Logger.Error("Couldn't parse listing", zap.String("path", path), zap.Error(err))
+			return nil, http.StatusInternalServerError
+		}
+	}
+	return items, rec.Code
+}
+
+// errorForStatus maps the status of a failed Swift subrequest to an S3 error.
+func (s *s3Request) errorForStatus(status int, notFound string) *s3Error {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		if s.ctx.S3Auth.Account == "" {
+			return newS3Error("SignatureDoesNotMatch")
+		}
+		return newS3Error("AccessDenied")
+	case http.StatusNotFound:
+		return newS3Error(notFound)
+	case http.StatusLengthRequired:
+		return newS3Error("MissingContentLength")
+	case http.StatusPreconditionFailed:
+		return newS3Error("PreconditionFailed")
+	case http.StatusRequestEntityTooLarge:
+		return newS3Error("EntityTooLarge")
+	case http.StatusRequestedRangeNotSatisfiable:
+		return newS3Error("InvalidRange")
+	case http.StatusUnprocessableEntity:
+		return newS3Error("BadDigest")
+	case http.StatusServiceUnavailable:
+		return newS3Error("ServiceUnavailable")
+	}
+	return newS3Error("InternalError")
+}
+
+func (s *s3Request) sendError(e *s3Error) {
+	s.ctx.Logger.Debug("s3api error", zap.String("code", e.Code), zap.String("message", e.Message))
+	body, err := xml.Marshal(&s3ErrorResponse{Code: e.Code, Message: e.Message, Resource: s.request.URL.Path, RequestId: s.ctx.TxId})
+	if err != nil {
+		body = nil
+	}
+	s.writer.Header().Set("Content-Type", "application/xml")
+	s.writer.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(body)))
+	s.writer.WriteHeader(e.status())
+	if s.request.Method != "HEAD" {
+		io.WriteString(s.writer, xml.Header)
+		s.writer.Write(body)
+	}
+}
+
+func (s *s3Request) sendXML(v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		s.ctx.Logger.Error("Couldn't marshal s3 response", zap.Error(err))
+		s.sendError(newS3Error("InternalError"))
+		return
+	}
+	s.writer.Header().Set("Content-Type", "application/xml")
+	s.writer.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(body)))
+	s.writer.WriteHeader(http.StatusOK)
+	io.WriteString(s.writer, xml.Header)
+	s.writer.Write(body)
+}
+
+func (s *s3Request) sendStatus(status int) {
+	s.writer.Header().Set("Content-Length", "0")
+	s.writer.WriteHeader(status)
+}
+
+// readXML decodes the request body into v.
+func (s *s3Request) readXML(v interface{}) *s3Error {
+	body, err := ioutil.ReadAll(io.LimitReader(s.request.Body, s3MaxXMLBodySize+1))
+	if s.payloadMismatch() {
+		return newS3Error("XAmzContentSHA256Mismatch")
+	}
+	if err != nil {
+		return newS3Error("InternalError")
+	}
+	if len(body) > s3MaxXMLBodySize {
+		return newS3Error("EntityTooLarge")
+	}
+	if contentMD5 := s.request.Header.Get("Content-Md5"); contentMD5 != "" {
+		sum := md5.Sum(body)
+		if base64.StdEncoding.EncodeToString(sum[:]) != contentMD5 {
+			return newS3Error("BadDigest")
+		}
+	}
+	if err = xml.Unmarshal(body, v); err != nil {
+		return newS3Error("MalformedXML")
+	}
+	return nil
+}
+
+func s3Timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// s3ListingTimestamp converts a Swift listing's last_modified to S3's format.
+func s3ListingTimestamp(lastModified string) string {
+	t, err := time.Parse("2006-01-02T15:04:05", lastModified)
+	if err != nil {
+		return lastModified
+	}
+	return s3Timestamp(t)
+}
+
+func s3ETag(etag string) string {
+	return "\"" + strings.Trim(etag, "\"") + "\""
+}
+
+func validS3BucketName(name string) bool {
+	if len(name) < 3 || len(name) > 63 || strings.Contains(name, "..") {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		alnum := ('a' <= c && c <= 'z') || ('0' <= c && c <= '9')
+		if !alnum && ((c != '-' && c != '.') || i == 0 || i == len(name)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// swiftObjectHeaders translates the headers of an S3 object write to Swift's.
+func swiftObjectHeaders(src http.Header) (http.Header, *s3Error) {
+	header := http.Header{}
+	for k, v := range src {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			header["X-Object-Meta-"+k[len("X-Amz-Meta-"):]] = v
+		} else if common.StringInSlice(k, []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language", "Cache-Control", "Expires"}) {
+			header[k] = v
+		}
+	}
+	if contentMD5 := src.Get("Content-Md5"); contentMD5 != "" {
+		sum, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(sum) != md5.Size {
+			return nil, newS3Error("InvalidDigest")
+		}
+		header.Set("Etag", hex.EncodeToString(sum))
+	}
+	return header, nil
+}
+
+// s3ObjectWriter passes a Swift object response through as an S3 one,
+// replacing any error with an S3 error.
+type s3ObjectWriter struct {
+	http.ResponseWriter
+	s      *s3Request
+	query  url.Values
+	failed bool
+}
+
+func (w *s3ObjectWriter) WriteHeader(status int) {
+	header := w.Header()
+	if status/100 != 2 && status != http.StatusNotModified {
+		w.failed = true
+		for k := range header {
+			if k != "X-Trans-Id" && k != "X-Openstack-Request-Id" && k != "X-Amz-Request-Id" {
+				delete(header, k)
+			}
+		}
+		w.s.sendError(w.s.errorForStatus(status, "NoSuchKey"))
+		return
+	}
+	if etag := header.Get("X-Object-Sysmeta-S3api-Etag"); etag != "" {
+		header.Set("Etag", s3ETag(etag))
+	} else if etag := header.Get("Etag"); etag != "" {
+		header.Set("Etag", s3ETag(etag))
+	}
+	for k, v := range header {
+		if strings.HasPrefix(k, "X-Object-Meta-") {
+			header["X-Amz-Meta-"+k[len("X-Object-Meta-"):]] = v
+			delete(header, k)
+		} else if strings.HasPrefix(k, "X-Object-Sysmeta-") {
+			delete(header, k)
+		}
+	}
+	header.Del("X-Static-Large-Object")
+	for param, h := range map[string]string{
+		"response-cache-control":       "Cache-Control",
+		"response-content-disposition": "Content-Disposition",
+		"response-content-encoding":    "Content-Encoding",
+		"response-content-language":    "Content-Language",
+		"response-content-type":        "Content-Type",
+		"response-expires":             "Expires",
+	} {
+		if v := w.query.Get(param); v != "" {
+			header.Set(h, v)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *s3ObjectWriter) Write(b []byte) (int, error) {
+	if w.failed {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (s *s3Request) listBuckets() {
+	result := &s3ListAllMyBucketsResult{Xmlns: s3Xmlns, Owner: s.owner()}
+	marker := ""
+	for {
+		items, status := s.getListing(s.swiftPath("", ""), url.Values{"marker": {marker}})
+		if status == http.StatusNotFound {
+			break
+		}
+		if status/100 != 2 {
+			s.sendError(s.errorForStatus(status, "AccessDenied"))
+			return
+		}
+		for _, item := range items {
+			if !strings.HasSuffix(item.Name, s3SegmentsSuffix) {
+				result.Buckets.Bucket = append(result.Buckets.Bucket, s3Bucket{Name: item.Name, CreationDate: s3ListingTimestamp(item.LastModified)})
+			}
+		}
+		if len(items) < s3SwiftListingMax {
+			break
+		}
+		marker = items[len(items)-1].Name
+	}
+	s.sendXML(result)
+}
+
+func (s *s3Request) getBucketLocation() {
+	rec := s.do("HEAD", s.swiftPath(s.bucket, ""), http.NoBody, nil)
+	if rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	location := s.location
+	if location == "us-east-1" {
+		// as with S3, the default region is reported as an empty constraint.
+		location = ""
+	}
+	s.sendXML(&s3LocationConstraint{Xmlns: s3Xmlns, Location: location})
+}
+
+func (s *s3Request) headBucket() {
+	rec := s.do("HEAD", s.swiftPath(s.bucket, ""), http.NoBody, nil)
+	if rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	s.sendStatus(http.StatusOK)
+}
+
+func (s *s3Request) putBucket() {
+	if !validS3BucketName(s.bucket) {
+		s.sendError(newS3Error("InvalidBucketName"))
+		return
+	}
+	if s.request.ContentLength != 0 {
+		config := &s3CreateBucketConfiguration{}
+		if e := s.readXML(config); e != nil {
+			s.sendError(e)
+			return
+		}
+		if config.LocationConstraint != "" && config.LocationConstraint != s.location {
+			s.sendError(newS3Error("InvalidLocationConstraint"))
+			return
+		}
+	}
+	header := http.Header{}
+	switch s.request.Header.Get("X-Amz-Acl") {
+	case "", "private":
+	case "public-read":
+		header.Set("X-Container-Read", ".r:*,.rlistings")
+	default:
+		s.sendError(newS3ErrorMessage("NotImplemented", "Only the private and public-read canned ACLs are supported."))
+		return
+	}
+	rec := s.do("PUT", s.swiftPath(s.bucket, ""), http.NoBody, header)
+	if rec.Code == http.StatusAccepted {
+		s.sendError(newS3Error("BucketAlreadyOwnedByYou"))
+		return
+	}
+	if rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	s.writer.Header().Set("Location", "/"+s.bucket)
+	s.sendStatus(http.StatusOK)
+}
+
+func (s *s3Request) deleteBucket() {
+	rec := s.do("DELETE", s.swiftPath(s.bucket, ""), http.NoBody, nil)
+	if rec.Code == http.StatusConflict {
+		s.sendError(newS3Error("BucketNotEmpty"))
+		return
+	}
+	if rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	// the segments container goes too, if no uploads are left in it.
+	s.do("DELETE", s.swiftPath(s.bucket+s3SegmentsSuffix, ""), http.NoBody, nil)
+	s.sendStatus(http.StatusNoContent)
+}
+
+func (s *s3Request) listObjects(query url.Values, v2 bool) {
+	maxKeys := s.maxBucketListing
+	if mk := query.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			s.sendError(newS3ErrorMessage("InvalidArgument", "Provided max-keys not an integer or within integer range."))
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		s.sendError(newS3ErrorMessage("InvalidArgument", "Invalid Encoding Method specified in Request."))
+		return
+	}
+	encode := func(s string) string {
+		if encodingType == "url" {
+			return s3URIEncode(s, false)
+		}
+		return s
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	result := &s3ListBucketResult{
+		Xmlns:        s3Xmlns,
+		Name:         s.bucket,
+		Prefix:       encode(prefix),
+		MaxKeys:      maxKeys,
+		Delimiter:    encode(delimiter),
+		EncodingType: encodingType,
+	}
+	var marker string
+	if v2 {
+		marker = query.Get("start-after")
+		result.StartAfter = encode(marker)
+		if token, ok := query["continuation-token"]; ok {
+			m, err := base64.StdEncoding.DecodeString(token[0])
+			if err != nil {
+				s.sendError(newS3ErrorMessage("InvalidArgument", "The continuation token provided is incorrect."))
+				return
+			}
+			result.ContinuationToken = token[0]
+			marker = string(m)
+		}
+	} else {
+		marker = query.Get("marker")
+		m := encode(marker)
+		result.Marker = &m
+	}
+	params := url.Values{"limit": {strconv.Itoa(maxKeys + 1)}, "marker": {marker}, "prefix": {prefix}}
+	if delimiter != "" {
+		params.Set("delimiter", delimiter)
+	}
+	items, status := s.getListing(s.swiftPath(s.bucket, ""), params)
+	if status/100 != 2 {
+		s.sendError(s.errorForStatus(status, "NoSuchBucket"))
+		return
+	}
+	if len(items) > maxKeys {
+		result.IsTruncated = true
+		items = items[:maxKeys]
+	}
+	var owner *s3Owner
+	if !v2 || query.Get("fetch-owner") == "true" {
+		o := s.owner()
+		owner = &o
+	}
+	last := ""
+	for _, item := range items {
+		if item.Subdir != "" {
+			last = item.Subdir
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(item.Subdir)})
+			continue
+		}
+		last = item.Name
+		result.Contents = append(result.Contents, s3Object{
+			Key:          encode(item.Name),
+			LastModified: s3ListingTimestamp(item.LastModified),
+			ETag:         s3ETag(item.Hash),
+			Size:         item.Bytes,
+			Owner:        owner,
+			StorageClass: "STANDARD",
+		})
+	}
+	if v2 {
+		keyCount := len(items)
+		result.KeyCount = &keyCount
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+		}
+	} else if result.IsTruncated && delimiter != "" {
+		result.NextMarker = encode(last)
+	}
+	s.sendXML(result)
+}
+
+func (s *s3Request) deleteObjects() {
+	req := &s3DeleteRequest{}
+	if e := s.readXML(req); e != nil {
+		s.sendError(e)
+		return
+	}
+	if len(req.Objects) == 0 || len(req.Objects) > s.maxMultiDeleteObjects {
+		s.sendError(newS3Error("MalformedXML"))
+		return
+	}
+	if rec := s.do("HEAD", s.swiftPath(s.bucket, ""), http.NoBody, nil); rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	result := &s3DeleteResult{Xmlns: s3Xmlns}
+	for _, obj := range req.Objects {
+		if obj.VersionId != "" && obj.VersionId != "null" {
+			result.Errors = append(result.Errors, s3DeleteError{Key: obj.Key, Code: "NotImplemented", Message: "Versions are not supported."})
+			continue
+		}
+		if status := s.deleteSwiftObject(s.bucket, obj.Key); status/100 != 2 && status != http.StatusNotFound {
+			e := s.errorForStatus(status, "NoSuchKey")
+			result.Errors = append(result.Errors, s3DeleteError{Key: obj.Key, Code: e.Code, Message: e.Message})
+		} else if !req.Quiet {
+			result.Deleted = append(result.Deleted, s3Deleted{Key: obj.Key})
+		}
+	}
+	s.sendXML(result)
+}
+
+// deleteSwiftObject deletes an object, along with its parts if it was a
+// multipart upload.
+func (s *s3Request) deleteSwiftObject(bucket, key string) int {
+	path := s.swiftPath(bucket, key)
+	rec := s.do("HEAD", path, http.NoBody, nil)
+	if rec.Code/100 != 2 {
+		return rec.Code
+	}
+	if common.LooksTrue(rec.Header().Get("X-Static-Large-Object")) {
+		path += "?multipart-manifest=delete"
+	}
+	return s.do("DELETE", path, http.NoBody, nil).Code
+}
+
+func (s *s3Request) getObject(query url.Values) {
+	header := http.Header{}
+	for _, k := range []string{"Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if v := s.request.Header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	subreq, err := s.newSubrequest(s.request.Method, s.swiftPath(s.bucket, s.object), http.NoBody, header)
+	if err != nil {
+		s.sendError(newS3Error("InternalError"))
+		return
+	}
+	s.ctx.serveHTTPSubrequest(&s3ObjectWriter{ResponseWriter: s.writer, s: s, query: query}, subreq)
+}
+
+func (s *s3Request) putObject() {
+	if copySource := s.request.Header.Get("X-Amz-Copy-Source"); copySource != "" {
+		s.copyObject(copySource)
+		return
+	}
+	if s.request.ContentLength < 0 && s.request.Header.Get("Transfer-Encoding") != "chunked" {
+		s.sendError(newS3Error("MissingContentLength"))
+		return
+	}
+	header, e := swiftObjectHeaders(s.request.Header)
+	if e != nil {
+		s.sendError(e)
+		return
+	}
+	rec := s.doWithBody("PUT", s.swiftPath(s.bucket, s.object), header)
+	if s.payloadMismatch() {
+		s.sendError(newS3Error("XAmzContentSHA256Mismatch"))
+		return
+	}
+	if rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	s.writer.Header().Set("Etag", s3ETag(rec.Header().Get("Etag")))
+	s.sendStatus(http.StatusOK)
+}
+
+// copySourceHeader turns x-amz-copy-source into the X-Copy-From the copy
+// middleware expects.
+func copySourceHeader(copySource string) (string, *s3Error) {
+	if i := strings.Index(copySource, "?"); i >= 0 {
+		if v, err := url.ParseQuery(copySource[i+1:]); err != nil || (v.Get("versionId") != "" && v.Get("versionId") != "null") {
+			return "", newS3ErrorMessage("NotImplemented", "Copying object versions is not supported.")
+		}
+		copySource = copySource[:i]
+	}
+	decoded, err := url.QueryUnescape(strings.Replace(copySource, "+", "%2B", -1))
+	if err != nil {
+		return "", newS3ErrorMessage("InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey.")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(decoded, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", newS3ErrorMessage("InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey.")
+	}
+	return "/" + common.Urlencode(parts[0]) + "/" + common.Urlencode(parts[1]), nil
+}
+
+// copyHeaders returns the Swift headers for an S3 copy from copySource.
+func (s *s3Request) copyHeaders(copySource string) (http.Header, *s3Error) {
+	copyFrom, e := copySourceHeader(copySource)
+	if e != nil {
+		return nil, e
+	}
+	header := http.Header{}
+	for amz, h := range map[string]string{
+		"X-Amz-Copy-Source-If-Match":            "If-Match",
+		"X-Amz-Copy-Source-If-Modified-Since":   "If-Modified-Since",
+		"X-Amz-Copy-Source-If-Unmodified-Since": "If-Unmodified-Since",
+	} {
+		if v := s.request.Header.Get(amz); v != "" {
+			header.Set(h, v)
+		}
+	}
+	if s.request.Header.Get("X-Amz-Copy-Source-If-None-Match") != "" {
+		return nil, newS3ErrorMessage("NotImplemented", "x-amz-copy-source-if-none-match is not supported.")
+	}
+	header.Set("X-Copy-From", copyFrom)
+	header.Set("Content-Length", "0")
+	// a copy is a plain object, whatever the etag of its source.
+	header.Set("X-Object-Sysmeta-S3api-Etag", "")
+	return header, nil
+}
+
+func (s *s3Request) copyObject(copySource string) {
+	header, e := s.copyHeaders(copySource)
+	if e != nil {
+		s.sendError(e)
+		return
+	}
+	switch s.request.Header.Get("X-Amz-Metadata-Directive") {
+	case "", "COPY":
+		if header.Get("X-Copy-From") == "/"+common.Urlencode(s.bucket)+"/"+common.Urlencode(s.object) {
+			s.sendError(newS3ErrorMessage("InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata."))
+			return
+		}
+	case "REPLACE":
+		meta, e := swiftObjectHeaders(s.request.Header)
+		if e != nil {
+			s.sendError(e)
+			return
+		}
+		meta.Del("Etag")
+		for k, v := range meta {
+			header[k] = v
+		}
+		header.Set("X-Fresh-Metadata", "true")
+	default:
+		s.sendError(newS3ErrorMessage("InvalidArgument", "Unknown metadata directive."))
+		return
+	}
+	rec := s.do("PUT", s.swiftPath(s.bucket, s.object), http.NoBody, header)
+	if rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchKey"))
+		return
+	}
+	lastModified := time.Now()
+	if t, err := http.ParseTime(rec.Header().Get("Last-Modified")); err == nil {
+		lastModified = t
+	}
+	s.sendXML(&s3CopyObjectResult{XMLName: xml.Name{Local: "CopyObjectResult"}, Xmlns: s3Xmlns, LastModified: s3Timestamp(lastModified), ETag: s3ETag(rec.Header().Get("Etag"))})
+}
+
+func (s *s3Request) deleteObject() {
+	if status := s.deleteSwiftObject(s.bucket, s.object); status/100 != 2 && status != http.StatusNotFound {
+		s.sendError(s.errorForStatus(status, "NoSuchKey"))
+		return
+	}
+	s.sendStatus(http.StatusNoContent)
+}
+
+func (s *s3Request) segmentsContainer() string {
+	return s.bucket + s3SegmentsSuffix
+}
+
+// checkUpload returns the response to a HEAD of the upload's marker object.
+func (s *s3Request) checkUpload(uploadId string) (*httptest.ResponseRecorder, *s3Error) {
+	if !s3UploadIdRegex.MatchString(uploadId) {
+		return nil, newS3Error("NoSuchUpload")
+	}
+	rec := s.do("HEAD", s.swiftPath(s.segmentsContainer(), s.object+"/"+uploadId), http.NoBody, nil)
+	if rec.Code/100 != 2 {
+		return nil, s.errorForStatus(rec.Code, "NoSuchUpload")
+	}
+	return rec, nil
+}
+
+type s3PartItem struct {
+	number int
+	item   s3ListingItem
+}
+
+// getParts returns the parts uploaded so far, ordered by part number.
+func (s *s3Request) getParts(uploadId string) ([]s3PartItem, *s3Error) {
+	prefix := s.object + "/" + uploadId + "/"
+	var parts []s3PartItem
+	marker := ""
+	for {
+		items, status := s.getListing(s.swiftPath(s.segmentsContainer(), ""), url.Values{"prefix": {prefix}, "marker": {marker}})
+		if status/100 != 2 {
+			return nil, s.errorForStatus(status, "NoSuchUpload")
+		}
+		for _, item := range items {
+			if n, err := strconv.Atoi(strings.TrimPrefix(item.Name, prefix)); err == nil {
+				parts = append(parts, s3PartItem{number: n, item: item})
+			}
+		}
+		if len(items) < s3SwiftListingMax {
+			break
+		}
+		marker = items[len(items)-1].Name
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].number < parts[j].number })
+	return parts, nil
+}
+
+func (s *s3Request) initiateMultipartUpload() {
+	header, e := swiftObjectHeaders(s.request.Header)
+	if e != nil {
+		s.sendError(e)
+		return
+	}
+	header.Del("Etag")
+	if ct := header.Get("Content-Type"); ct != "" {
+		header.Set("X-Object-Sysmeta-S3api-Content-Type", ct)
+	}
+	rec := s.do("HEAD", s.swiftPath(s.bucket, ""), http.NoBody, nil)
+	if rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	segHeader := http.Header{}
+	if policy := rec.Header().Get("X-Storage-Policy"); policy != "" {
+		segHeader.Set("X-Storage-Policy", policy)
+	}
+	if rec = s.do("PUT", s.swiftPath(s.segmentsContainer(), ""), http.NoBody, segHeader); rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	uploadId := common.UUID()
+	header.Set("Content-Length", "0")
+	if rec = s.do("PUT", s.swiftPath(s.segmentsContainer(), s.object+"/"+uploadId), http.NoBody, header); rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	s.sendXML(&s3InitiateMultipartUploadResult{Xmlns: s3Xmlns, Bucket: s.bucket, Key: s.object, UploadId: uploadId})
+}
+
+func (s *s3Request) uploadPart(query url.Values) {
+	partNumber, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		s.sendError(newS3ErrorMessage("InvalidArgument", fmt.Sprintf("Part number must be an integer between 1 and %d, inclusive.", s3MaxPartNumber)))
+		return
+	}
+	uploadId := query.Get("uploadId")
+	if _, e := s.checkUpload(uploadId); e != nil {
+		s.sendError(e)
+		return
+	}
+	partPath := s.swiftPath(s.segmentsContainer(), fmt.Sprintf("%s/%s/%d", s.object, uploadId, partNumber))
+	if copySource := s.request.Header.Get("X-Amz-Copy-Source"); copySource != "" {
+		if s.request.Header.Get("X-Amz-Copy-Source-Range") != "" {
+			s.sendError(newS3ErrorMessage("NotImplemented", "x-amz-copy-source-range is not supported."))
+			return
+		}
+		header, e := s.copyHeaders(copySource)
+		if e != nil {
+			s.sendError(e)
+			return
+		}
+		header.Set("X-Fresh-Metadata", "true")
+		rec := s.do("PUT", partPath, http.NoBody, header)
+		if rec.Code/100 != 2 {
+			s.sendError(s.errorForStatus(rec.Code, "NoSuchKey"))
+			return
+		}
+		s.sendXML(&s3CopyObjectResult{XMLName: xml.Name{Local: "CopyPartResult"}, Xmlns: s3Xmlns, LastModified: s3Timestamp(time.Now()), ETag: s3ETag(rec.Header().Get("Etag"))})
+		return
+	}
+	if s.request.ContentLength < 0 && s.request.Header.Get("Transfer-Encoding") != "chunked" {
+		s.sendError(newS3Error("MissingContentLength"))
+		return
+	}
+	header := http.Header{}
+	if contentMD5 := s.request.Header.Get("Content-Md5"); contentMD5 != "" {
+		sum, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(sum) != md5.Size {
+			s.sendError(newS3Error("InvalidDigest"))
+			return
+		}
+		header.Set("Etag", hex.EncodeToString(sum))
+	}
+	rec := s.doWithBody("PUT", partPath, header)
+	if s.payloadMismatch() {
+		s.sendError(newS3Error("XAmzContentSHA256Mismatch"))
+		return
+	}
+	if rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchUpload"))
+		return
+	}
+	s.writer.Header().Set("Etag", s3ETag(rec.Header().Get("Etag")))
+	s.sendStatus(http.StatusOK)
+}
+
+func (s *s3Request) listParts(query url.Values) {
+	uploadId := query.Get("uploadId")
+	if _, e := s.checkUpload(uploadId); e != nil {
+		s.sendError(e)
+		return
+	}
+	maxParts := s.maxPartsListing
+	if mp := query.Get("max-parts"); mp != "" {
+		n, err := strconv.Atoi(mp)
+		if err != nil || n < 0 {
+			s.sendError(newS3ErrorMessage("InvalidArgument", "Provided max-parts not an integer or within integer range."))
+			return
+		}
+		if n < maxParts {
+			maxParts = n
+		}
+	}
+	partMarker := 0
+	if pm := query.Get("part-number-marker"); pm != "" {
+		n, err := strconv.Atoi(pm)
+		if err != nil || n < 0 {
+			s.sendError(newS3ErrorMessage("InvalidArgument", "Provided part-number-marker not an integer or within integer range."))
+			return
+		}
+		partMarker = n
+	}
+	parts, e := s.getParts(uploadId)
+	if e != nil {
+		s.sendError(e)
+		return
+	}
+	result := &s3ListPartsResult{
+		Xmlns:            s3Xmlns,
+		Bucket:           s.bucket,
+		Key:              s.object,
+		UploadId:         uploadId,
+		Initiator:        s.owner(),
+		Owner:            s.owner(),
+		StorageClass:     "STANDARD",
+		PartNumberMarker: partMarker,
+		MaxParts:         maxParts,
+	}
+	for _, part := range parts {
+		if part.number <= partMarker {
+			continue
+		}
+		if len(result.Parts) == maxParts {
+			result.IsTruncated = true
+			break
+		}
+		result.Parts = append(result.Parts, s3Part{
+			PartNumber:   part.number,
+			LastModified: s3ListingTimestamp(part.item.LastModified),
+			ETag:         s3ETag(part.item.Hash),
+			Size:         part.item.Bytes,
+		})
+		result.NextPartNumberMarker = part.number
+	}
+	s.sendXML(result)
+}
+
+func (s *s3Request) completeMultipartUpload(uploadId string) {
+	marker, e := s.checkUpload(uploadId)
+	if e != nil {
+		s.sendError(e)
+		return
+	}
+	req := &s3CompleteMultipartUpload{}
+	if e := s.readXML(req); e != nil {
+		s.sendError(e)
+		return
+	}
+	if len(req.Parts) == 0 {
+		s.sendError(newS3Error("MalformedXML"))
+		return
+	}
+	if len(req.Parts) > maxManifestLen {
+		s.sendError(newS3ErrorMessage("InvalidRequest", fmt.Sprintf("An upload may be completed with at most %d parts.", maxManifestLen)))
+		return
+	}
+	parts, e := s.getParts(uploadId)
+	if e != nil {
+		s.sendError(e)
+		return
+	}
+	uploaded := map[int]s3ListingItem{}
+	for _, part := range parts {
+		uploaded[part.number] = part.item
+	}
+	var manifest []sloPutManifest
+	used := map[int]bool{}
+	s3Etag := md5.New()
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			s.sendError(newS3Error("InvalidPartOrder"))
+			return
+		}
+		item, ok := uploaded[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, "\"") != item.Hash {
+			s.sendError(newS3Error("InvalidPart"))
+			return
+		}
+		if i < len(req.Parts)-1 && item.Bytes < s.minSegmentSize {
+			s.sendError(newS3Error("EntityTooSmall"))
+			return
+		}
+		sum, err := hex.DecodeString(item.Hash)
+		if err != nil {
+			s.sendError(newS3Error("InvalidPart"))
+			return
+		}
+		s3Etag.Write(sum)
+		used[p.PartNumber] = true
+		manifest = append(manifest, sloPutManifest{Path: "/" + s.segmentsContainer() + "/" + item.Name, Etag: item.Hash, SizeBytes: item.Bytes})
+	}
+	etag := fmt.Sprintf("%x-%d", s3Etag.Sum(nil), len(req.Parts))
+	header := http.Header{}
+	for k, v := range marker.Header() {
+		if strings.HasPrefix(k, "X-Object-Meta-") || common.StringInSlice(k, []string{"Content-Encoding", "Content-Disposition", "Content-Language", "Cache-Control", "Expires"}) {
+			header[k] = v
+		}
+	}
+	if ct := marker.Header().Get("X-Object-Sysmeta-S3api-Content-Type"); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	header.Set("X-Object-Sysmeta-S3api-Etag", etag)
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		s.sendError(newS3Error("InternalError"))
+		return
+	}
+	rec := s.do("PUT", s.swiftPath(s.bucket, s.object)+"?multipart-manifest=put", bytes.NewReader(body), header)
+	if rec.Code == http.StatusBadRequest {
+		s.ctx.Logger.Debug("multipart manifest rejected", zap.String("response", rec.Body.String()))
+		s.sendError(newS3Error("InvalidPart"))
+		return
+	}
+	if rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	// parts uploaded but left out of the upload would otherwise be orphaned.
+	for _, part := range parts {
+		if !used[part.number] {
+			s.do("DELETE", s.swiftPath(s.segmentsContainer(), part.item.Name), http.NoBody, nil)
+		}
+	}
+	s.do("DELETE", s.swiftPath(s.segmentsContainer(), s.object+"/"+uploadId), http.NoBody, nil)
+	s.sendXML(&s3CompleteMultipartUploadResult{
+		Xmlns:    s3Xmlns,
+		Location: fmt.Sprintf("http://%s/%s/%s", s.request.Host, s.bucket, s.object),
+		Bucket:   s.bucket,
+		Key:      s.object,
+		ETag:     s3ETag(etag),
+	})
+}
+
+func (s *s3Request) abortMultipartUpload(uploadId string) {
+	if _, e := s.checkUpload(uploadId); e != nil {
+		s.sendError(e)
+		return
+	}
+	parts, e := s.getParts(uploadId)
+	if e != nil {
+		s.sendError(e)
+		return
+	}
+	for _, part := range parts {
+		s.do("DELETE", s.swiftPath(s.segmentsContainer(), part.item.Name), http.NoBody, nil)
+	}
+	if rec := s.do("DELETE", s.swiftPath(s.segmentsContainer(), s.object+"/"+uploadId), http.NoBody, nil); rec.Code/100 != 2 && rec.Code != http.StatusNotFound {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchUpload"))
+		return
+	}
+	s.sendStatus(http.StatusNoContent)
+}
+
+func (s *s3Request) listMultipartUploads(query url.Values) {
+	maxUploads := s.maxBucketListing
+	if mu := query.Get("max-uploads"); mu != "" {
+		n, err := strconv.Atoi(mu)
+		if err != nil || n < 0 {
+			s.sendError(newS3ErrorMessage("InvalidArgument", "Provided max-uploads not an integer or within integer range."))
+			return
+		}
+		if n < maxUploads {
+			maxUploads = n
+		}
+	}
+	keyMarker, uploadIdMarker := query.Get("key-marker"), query.Get("upload-id-marker")
+	result := &s3ListMultipartUploadsResult{
+		Xmlns:          s3Xmlns,
+		Bucket:         s.bucket,
+		KeyMarker:      keyMarker,
+		UploadIdMarker: uploadIdMarker,
+		Prefix:         query.Get("prefix"),
+		MaxUploads:     maxUploads,
+	}
+	if rec := s.do("HEAD", s.swiftPath(s.bucket, ""), http.NoBody, nil); rec.Code/100 != 2 {
+		s.sendError(s.errorForStatus(rec.Code, "NoSuchBucket"))
+		return
+	}
+	marker := ""
+	for !result.IsTruncated {
+		items, status := s.getListing(s.swiftPath(s.segmentsContainer(), ""), url.Values{"prefix": {result.Prefix}, "marker": {marker}})
+		if status == http.StatusNotFound {
+			break
+		}
+		if status/100 != 2 {
+			s.sendError(s.errorForStatus(status, "NoSuchBucket"))
+			return
+		}
+		for _, item := range items {
+			i := strings.LastIndex(item.Name, "/")
+			if i < 0 || !s3UploadIdRegex.MatchString(item.Name[i+1:]) {
+				continue
+			}
+			key, uploadId := item.Name[:i], item.Name[i+1:]
+			if key < keyMarker || (key == keyMarker && (uploadIdMarker == "" || uploadId <= uploadIdMarker)) {
+				continue
+			}
+			if len(result.Uploads) == maxUploads {
+				result.IsTruncated = true
+				break
+			}
+			result.Uploads = append(result.Uploads, s3Upload{
+				Key:          key,
+				UploadId:     uploadId,
+				Initiator:    s.owner(),
+				Owner:        s.owner(),
+				StorageClass: "STANDARD",
+				Initiated:    s3ListingTimestamp(item.LastModified),
+			})
+			result.NextKeyMarker, result.NextUploadIdMarker = key, uploadId
+		}
+		if len(items) < s3SwiftListingMax {
+			break
+		}
+		marker = items[len(items)-1].Name
+	}
+	s.sendXML(result)
+}
+
+func NewS3Api(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	location := config.GetDefault("location", "us-east-1")
+	maxBucketListing := int(config.GetInt("max_bucket_listing", 1000))
+	maxPartsListing := int(config.GetInt("max_parts_listing", 1000))
+	maxMultiDeleteObjects := int(config.GetInt("max_multi_delete_objects", 1000))
+	RegisterInfo("s3api", map[string]interface{}{
+		"location":                 location,
+		"max_bucket_listing":       maxBucketListing,
+		"max_parts_listing":        maxPartsListing,
+		"max_multi_delete_objects": maxMultiDeleteObjects,
+		"max_upload_part_num":      maxManifestLen,
+	})
+	requestsMetric := metricsScope.Counter("s3api_requests")
+	return func(next http.Handler) http.Handler {
+		return &s3ApiHandler{
+			next:                  next,
+			location:              location,
+			storageDomain:         config.GetDefault("storage_domain", ""),
+			clockSkew:             time.Duration(config.GetInt("allowable_clock_skew", 900)) * time.Second,
+			maxBucketListing:      maxBucketListing,
+			maxPartsListing:       maxPartsListing,
+			maxMultiDeleteObjects: maxMultiDeleteObjects,
+			minSegmentSize:        config.GetInt("min_segment_size", 5242880),
+			requestsMetric:        requestsMetric,
+		}
+	}, nil
+}
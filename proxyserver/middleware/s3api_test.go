@@ -0,0 +1,639 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+type fakeSwiftObject struct {
+	data     []byte
+	header   http.Header
+	modified time.Time
+	segments []string
+}
+
+// fakeSwift is an in memory Swift cluster that enforces the Authorize func
+// set by the auth middleware, for testing the s3api middleware against.
+type fakeSwift struct {
+	containers map[string]map[string]*fakeSwiftObject
+	modified   map[string]time.Time
+}
+
+func newFakeSwift() *fakeSwift {
+	return &fakeSwift{containers: map[string]map[string]*fakeSwiftObject{}, modified: map[string]time.Time{}}
+}
+
+func (f *fakeSwift) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	if ctx.Authorize == nil {
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if ok, status := ctx.Authorize(request); !ok {
+		writer.WriteHeader(status)
+		return
+	}
+	_, _, container, object := getPathSegments(request.URL.Path)
+	switch {
+	case container == "":
+		f.serveAccount(writer, request)
+	case object == "":
+		f.serveContainer(writer, request, container)
+	default:
+		f.serveObject(writer, request, container, object)
+	}
+}
+
+func (f *fakeSwift) writeListing(writer http.ResponseWriter, request *http.Request, names []string, item func(string) map[string]interface{}) {
+	query := request.URL.Query()
+	prefix, delimiter, marker := query.Get("prefix"), query.Get("delimiter"), query.Get("marker")
+	limit := 10000
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil {
+		limit = l
+	}
+	sort.Strings(names)
+	listing := []map[string]interface{}{}
+	for _, name := range names {
+		if len(listing) == limit {
+			break
+		}
+		if name <= marker || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				subdir := name[:len(prefix)+i+len(delimiter)]
+				if subdir > marker && (len(listing) == 0 || listing[len(listing)-1]["subdir"] != subdir) {
+					listing = append(listing, map[string]interface{}{"subdir": subdir})
+				}
+				continue
+			}
+		}
+		listing = append(listing, item(name))
+	}
+	body, _ := json.Marshal(listing)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(body)
+}
+
+func (f *fakeSwift) serveAccount(writer http.ResponseWriter, request *http.Request) {
+	var names []string
+	for name := range f.containers {
+		names = append(names, name)
+	}
+	f.writeListing(writer, request, names, func(name string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "count": len(f.containers[name]), "bytes": 0,
+			"last_modified": f.modified[name].UTC().Format("2006-01-02T15:04:05.000000")}
+	})
+}
+
+func (f *fakeSwift) serveContainer(writer http.ResponseWriter, request *http.Request, container string) {
+	objects, ok := f.containers[container]
+	switch request.Method {
+	case "PUT":
+		if ok {
+			writer.WriteHeader(http.StatusAccepted)
+			return
+		}
+		f.containers[container] = map[string]*fakeSwiftObject{}
+		f.modified[container] = time.Now()
+		writer.WriteHeader(http.StatusCreated)
+		return
+	}
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch request.Method {
+	case "HEAD":
+		writer.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if len(objects) > 0 {
+			writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		delete(f.containers, container)
+		writer.WriteHeader(http.StatusNoContent)
+	case "GET":
+		var names []string
+		for name := range objects {
+			names = append(names, name)
+		}
+		f.writeListing(writer, request, names, func(name string) map[string]interface{} {
+			obj := objects[name]
+			return map[string]interface{}{"name": name, "bytes": len(obj.data), "hash": obj.header.Get("Etag"),
+				"content_type": obj.header.Get("Content-Type"), "last_modified": obj.modified.UTC().Format("2006-01-02T15:04:05.000000")}
+		})
+	}
+}
+
+func (f *fakeSwift) getObject(path string) *fakeSwiftObject {
+	_, _, container, object := getPathSegments("/v1/a" + path)
+	if objects, ok := f.containers[container]; ok {
+		return objects[object]
+	}
+	return nil
+}
+
+func (f *fakeSwift) serveObject(writer http.ResponseWriter, request *http.Request, container, object string) {
+	objects, ok := f.containers[container]
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	obj := objects[object]
+	switch request.Method {
+	case "PUT":
+		f.putObject(writer, request, objects, object)
+	case "GET", "HEAD":
+		if obj == nil {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range obj.header {
+			writer.Header()[k] = v
+		}
+		writer.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		writer.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		writer.WriteHeader(http.StatusOK)
+		if request.Method == "GET" {
+			writer.Write(obj.data)
+		}
+	case "DELETE":
+		if obj == nil {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if request.URL.Query().Get("multipart-manifest") == "delete" {
+			for _, seg := range obj.segments {
+				_, _, c, o := getPathSegments("/v1/a" + seg)
+				delete(f.containers[c], o)
+			}
+		}
+		delete(objects, object)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeSwift) putObject(writer http.ResponseWriter, request *http.Request, objects map[string]*fakeSwiftObject, object string) {
+	obj := &fakeSwiftObject{header: http.Header{}, modified: time.Now()}
+	if copyFrom := request.Header.Get("X-Copy-From"); copyFrom != "" {
+		unescaped, _ := url.PathUnescape(copyFrom)
+		src := f.getObject(unescaped)
+		if src == nil {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if etag := request.Header.Get("If-Match"); etag != "" && strings.Trim(etag, "\"") != src.header.Get("Etag") {
+			writer.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		obj.data = src.data
+		if !common.LooksTrue(request.Header.Get("X-Fresh-Metadata")) {
+			for k, v := range src.header {
+				obj.header[k] = v
+			}
+		}
+		obj.header.Del("X-Static-Large-Object")
+		obj.header.Set("Etag", fmt.Sprintf("%x", md5.Sum(obj.data)))
+	} else if request.URL.Query().Get("multipart-manifest") == "put" {
+		var manifest []sloPutManifest
+		if err := json.NewDecoder(request.Body).Decode(&manifest); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		etags := md5.New()
+		for _, seg := range manifest {
+			segObj := f.getObject(seg.Path)
+			if segObj == nil || segObj.header.Get("Etag") != seg.Etag || int64(len(segObj.data)) != seg.SizeBytes {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			obj.data = append(obj.data, segObj.data...)
+			obj.segments = append(obj.segments, seg.Path)
+			io.WriteString(etags, seg.Etag)
+		}
+		obj.header.Set("X-Static-Large-Object", "True")
+		obj.header.Set("Etag", fmt.Sprintf("%x", etags.Sum(nil)))
+	} else {
+		data, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(499)
+			return
+		}
+		obj.data = data
+		obj.header.Set("Etag", fmt.Sprintf("%x", md5.Sum(data)))
+		if etag := request.Header.Get("Etag"); etag != "" && etag != obj.header.Get("Etag") {
+			writer.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	for k, v := range request.Header {
+		if strings.HasPrefix(k, "X-Object-Meta-") || strings.HasPrefix(k, "X-Object-Sysmeta-") || k == "Content-Type" {
+			if v[0] == "" {
+				obj.header.Del(k)
+			} else {
+				obj.header[k] = v
+			}
+		}
+	}
+	objects[object] = obj
+	writer.Header().Set("Etag", obj.header.Get("Etag"))
+	writer.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+	writer.WriteHeader(http.StatusCreated)
+}
+
+type s3TestCluster struct {
+	t       *testing.T
+	swift   *fakeSwift
+	handler http.Handler
+}
+
+func newS3TestCluster(t *testing.T, s3Config string) *s3TestCluster {
+	config, err := conf.StringConfig("[filter:s3api]\n" + s3Config + "\n[filter:tempauth]\nuser_test_tester = testing .admin\nuser_test_reader = reading\n")
+	require.Nil(t, err)
+	s3api, err := NewS3Api(config.GetSection("filter:s3api"), common.NewTestScope())
+	require.Nil(t, err)
+	tempauth, err := NewTempAuth(config.GetSection("filter:tempauth"), common.NewTestScope())
+	require.Nil(t, err)
+	swift := newFakeSwift()
+	return &s3TestCluster{t: t, swift: swift, handler: s3api(tempauth(swift))}
+}
+
+// do signs and serves an S3 request.
+func (c *s3TestCluster) do(method, path string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	return c.doAs("test:tester", "testing", method, path, body, header)
+}
+
+func (c *s3TestCluster) doAs(key, secret, method, path string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://localhost:8080"+path, bytes.NewReader(body))
+	require.Nil(c.t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("X-Amz-Date", time.Now().UTC().Format(s3V4DateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	credential := fmt.Sprintf("%s/%s/us-east-1/s3/aws4_request", key, time.Now().UTC().Format("20060102"))
+	authHeader := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s,SignedHeaders=host;x-amz-content-sha256;x-amz-date,Signature=", credential)
+	req.Header.Set("Authorization", authHeader+"unsigned")
+	s3Auth, s3Err := parseS3Auth(req, "", time.Minute, time.Now())
+	require.Nil(c.t, s3Err)
+	req.Header.Set("Authorization", authHeader+s3Auth.sign(secret))
+	ctx := NewFakeProxyContext(c.handler)
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func s3ErrorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	var e s3ErrorResponse
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &e))
+	return e.Code
+}
+
+func TestS3ApiAuth(t *testing.T) {
+	c := newS3TestCluster(t, "")
+	rec := c.doAs("test:tester", "wrong", "GET", "/", nil, nil)
+	require.Equal(t, 403, rec.Code)
+	require.Equal(t, "SignatureDoesNotMatch", s3ErrorCode(t, rec))
+
+	rec = c.doAs("nobody", "testing", "GET", "/", nil, nil)
+	require.Equal(t, 403, rec.Code)
+	require.Equal(t, "SignatureDoesNotMatch", s3ErrorCode(t, rec))
+
+	rec = c.do("PUT", "/bucket", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	// a valid user without rights on the account
+	rec = c.doAs("test:reader", "reading", "GET", "/bucket", nil, nil)
+	require.Equal(t, 403, rec.Code)
+	require.Equal(t, "AccessDenied", s3ErrorCode(t, rec))
+
+	// requests that aren't S3 signed pass through
+	req, err := http.NewRequest("GET", "http://localhost:8080/v1/AUTH_test", nil)
+	require.Nil(t, err)
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", NewFakeProxyContext(c.handler)))
+	rec = httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+	require.Equal(t, 401, rec.Code)
+}
+
+func TestS3ApiBuckets(t *testing.T) {
+	c := newS3TestCluster(t, "")
+	rec := c.do("PUT", "/bucket", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "/bucket", rec.Header().Get("Location"))
+	rec = c.do("PUT", "/bucket", nil, nil)
+	require.Equal(t, 409, rec.Code)
+	require.Equal(t, "BucketAlreadyOwnedByYou", s3ErrorCode(t, rec))
+	rec = c.do("PUT", "/Bad_Bucket", nil, nil)
+	require.Equal(t, 400, rec.Code)
+	require.Equal(t, "InvalidBucketName", s3ErrorCode(t, rec))
+	rec = c.do("PUT", "/elsewhere", []byte("<CreateBucketConfiguration><LocationConstraint>eu-west-1</LocationConstraint></CreateBucketConfiguration>"), nil)
+	require.Equal(t, 400, rec.Code)
+	require.Equal(t, "InvalidLocationConstraint", s3ErrorCode(t, rec))
+	rec = c.do("PUT", "/bucket2", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	c.swift.containers["bucket2+segments"] = map[string]*fakeSwiftObject{}
+
+	rec = c.do("GET", "/", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	var buckets s3ListAllMyBucketsResult
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &buckets))
+	require.Equal(t, "test:tester", buckets.Owner.ID)
+	require.Equal(t, 2, len(buckets.Buckets.Bucket))
+	require.Equal(t, "bucket", buckets.Buckets.Bucket[0].Name)
+	require.Equal(t, "bucket2", buckets.Buckets.Bucket[1].Name)
+
+	rec = c.do("HEAD", "/bucket", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	rec = c.do("HEAD", "/nothere", nil, nil)
+	require.Equal(t, 404, rec.Code)
+	rec = c.do("GET", "/bucket?location", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	require.Contains(t, rec.Body.String(), "<LocationConstraint")
+	rec = c.do("GET", "/bucket?acl", nil, nil)
+	require.Equal(t, 501, rec.Code)
+	require.Equal(t, "NotImplemented", s3ErrorCode(t, rec))
+
+	rec = c.do("PUT", "/bucket/obj", []byte("data"), nil)
+	require.Equal(t, 200, rec.Code)
+	rec = c.do("DELETE", "/bucket", nil, nil)
+	require.Equal(t, 409, rec.Code)
+	require.Equal(t, "BucketNotEmpty", s3ErrorCode(t, rec))
+	rec = c.do("DELETE", "/bucket2", nil, nil)
+	require.Equal(t, 204, rec.Code)
+	_, ok := c.swift.containers["bucket2+segments"]
+	require.False(t, ok)
+	rec = c.do("DELETE", "/bucket2", nil, nil)
+	require.Equal(t, 404, rec.Code)
+	require.Equal(t, "NoSuchBucket", s3ErrorCode(t, rec))
+}
+
+func TestS3ApiObjects(t *testing.T) {
+	c := newS3TestCluster(t, "")
+	require.Equal(t, 200, c.do("PUT", "/bucket", nil, nil).Code)
+	rec := c.do("PUT", "/nothere/obj", []byte("data"), nil)
+	require.Equal(t, 404, rec.Code)
+	require.Equal(t, "NoSuchBucket", s3ErrorCode(t, rec))
+
+	sum := md5.Sum([]byte("hello world"))
+	rec = c.do("PUT", "/bucket/dir/hello", []byte("hello world"), map[string]string{
+		"Content-Type":     "text/plain",
+		"Content-Md5":      base64.StdEncoding.EncodeToString(sum[:]),
+		"X-Amz-Meta-Color": "blue",
+	})
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, fmt.Sprintf("\"%x\"", sum), rec.Header().Get("Etag"))
+	rec = c.do("PUT", "/bucket/bad", []byte("hello world"), map[string]string{"Content-Md5": base64.StdEncoding.EncodeToString(sum[:4])})
+	require.Equal(t, 400, rec.Code)
+	require.Equal(t, "InvalidDigest", s3ErrorCode(t, rec))
+	rec = c.do("PUT", "/bucket/bad", []byte("goodbye"), map[string]string{"Content-Md5": base64.StdEncoding.EncodeToString(sum[:])})
+	require.Equal(t, 400, rec.Code)
+	require.Equal(t, "BadDigest", s3ErrorCode(t, rec))
+
+	rec = c.do("GET", "/bucket/dir/hello?response-content-type=application/x-test", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "hello world", rec.Body.String())
+	require.Equal(t, fmt.Sprintf("\"%x\"", sum), rec.Header().Get("Etag"))
+	require.Equal(t, "blue", rec.Header().Get("X-Amz-Meta-Color"))
+	require.Equal(t, "", rec.Header().Get("X-Object-Meta-Color"))
+	require.Equal(t, "application/x-test", rec.Header().Get("Content-Type"))
+	rec = c.do("HEAD", "/bucket/dir/hello", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	rec = c.do("GET", "/bucket/nothere", nil, nil)
+	require.Equal(t, 404, rec.Code)
+	require.Equal(t, "NoSuchKey", s3ErrorCode(t, rec))
+
+	rec = c.do("PUT", "/bucket/copy", nil, map[string]string{"X-Amz-Copy-Source": "/bucket/dir/hello"})
+	require.Equal(t, 200, rec.Code)
+	var copyResult s3CopyObjectResult
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &copyResult))
+	require.Equal(t, fmt.Sprintf("\"%x\"", sum), copyResult.ETag)
+	require.Equal(t, "blue", c.swift.containers["bucket"]["copy"].header.Get("X-Object-Meta-Color"))
+	rec = c.do("PUT", "/bucket/copy", nil, map[string]string{
+		"X-Amz-Copy-Source":        "bucket/copy",
+		"X-Amz-Metadata-Directive": "REPLACE",
+		"X-Amz-Meta-Shape":         "round",
+	})
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "", c.swift.containers["bucket"]["copy"].header.Get("X-Object-Meta-Color"))
+	require.Equal(t, "round", c.swift.containers["bucket"]["copy"].header.Get("X-Object-Meta-Shape"))
+	rec = c.do("PUT", "/bucket/copy", nil, map[string]string{"X-Amz-Copy-Source": "/bucket/copy"})
+	require.Equal(t, 400, rec.Code)
+	require.Equal(t, "InvalidRequest", s3ErrorCode(t, rec))
+	rec = c.do("PUT", "/bucket/copy2", nil, map[string]string{"X-Amz-Copy-Source": "/bucket/copy", "X-Amz-Copy-Source-If-Match": "\"nope\""})
+	require.Equal(t, 412, rec.Code)
+	require.Equal(t, "PreconditionFailed", s3ErrorCode(t, rec))
+
+	rec = c.do("DELETE", "/bucket/copy", nil, nil)
+	require.Equal(t, 204, rec.Code)
+	rec = c.do("DELETE", "/bucket/copy", nil, nil)
+	require.Equal(t, 204, rec.Code)
+	_, ok := c.swift.containers["bucket"]["copy"]
+	require.False(t, ok)
+}
+
+func TestS3ApiListObjects(t *testing.T) {
+	c := newS3TestCluster(t, "")
+	require.Equal(t, 200, c.do("PUT", "/bucket", nil, nil).Code)
+	for _, key := range []string{"a", "b/1", "b/2", "c d", "e"} {
+		require.Equal(t, 200, c.do("PUT", "/bucket/"+key, []byte(key), nil).Code)
+	}
+
+	rec := c.do("GET", "/bucket?delimiter=/&max-keys=2", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	var result s3ListBucketResult
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &result))
+	require.True(t, result.IsTruncated)
+	require.Equal(t, 1, len(result.Contents))
+	require.Equal(t, "a", result.Contents[0].Key)
+	require.Equal(t, int64(1), result.Contents[0].Size)
+	require.NotNil(t, result.Contents[0].Owner)
+	require.Equal(t, []s3CommonPrefix{{Prefix: "b/"}}, result.CommonPrefixes)
+	require.Equal(t, "b/", result.NextMarker)
+
+	rec = c.do("GET", "/bucket?delimiter=/&marker=b/", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	result = s3ListBucketResult{}
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &result))
+	require.False(t, result.IsTruncated)
+	require.Equal(t, 2, len(result.Contents))
+	require.Equal(t, "c d", result.Contents[0].Key)
+
+	var keys []string
+	token := ""
+	for {
+		path := "/bucket?list-type=2&max-keys=2&encoding-type=url"
+		if token != "" {
+			path += "&continuation-token=" + url.QueryEscape(token)
+		}
+		rec = c.do("GET", path, nil, nil)
+		require.Equal(t, 200, rec.Code)
+		result = s3ListBucketResult{}
+		require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &result))
+		require.NotNil(t, result.KeyCount)
+		for _, obj := range result.Contents {
+			require.Nil(t, obj.Owner)
+			keys = append(keys, obj.Key)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	require.Equal(t, []string{"a", "b/1", "b/2", "c%20d", "e"}, keys)
+
+	rec = c.do("GET", "/bucket?list-type=2&prefix=b/&start-after=b/1&fetch-owner=true", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	result = s3ListBucketResult{}
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &result))
+	require.Equal(t, 1, len(result.Contents))
+	require.Equal(t, "b/2", result.Contents[0].Key)
+	require.NotNil(t, result.Contents[0].Owner)
+
+	rec = c.do("POST", "/bucket?delete", []byte("<Delete><Object><Key>a</Key></Object><Object><Key>b/1</Key></Object><Object><Key>zz</Key></Object></Delete>"), nil)
+	require.Equal(t, 200, rec.Code)
+	var deleted s3DeleteResult
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &deleted))
+	require.Equal(t, 3, len(deleted.Deleted))
+	require.Equal(t, 0, len(deleted.Errors))
+	require.Equal(t, 3, len(c.swift.containers["bucket"]))
+
+	rec = c.do("GET", "/nothere", nil, nil)
+	require.Equal(t, 404, rec.Code)
+	require.Equal(t, "NoSuchBucket", s3ErrorCode(t, rec))
+}
+
+func TestS3ApiMultipartUpload(t *testing.T) {
+	c := newS3TestCluster(t, "min_segment_size = 5")
+	require.Equal(t, 200, c.do("PUT", "/bucket", nil, nil).Code)
+	rec := c.do("POST", "/bucket/big?uploads", nil, map[string]string{"Content-Type": "text/plain", "X-Amz-Meta-Color": "red"})
+	require.Equal(t, 200, rec.Code)
+	var initiated s3InitiateMultipartUploadResult
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &initiated))
+	require.Equal(t, "big", initiated.Key)
+	uploadId := initiated.UploadId
+
+	parts := []string{"first part ", "second part ", "third"}
+	var etags []string
+	for i, part := range parts {
+		rec = c.do("PUT", fmt.Sprintf("/bucket/big?partNumber=%d&uploadId=%s", i+1, uploadId), []byte(part), nil)
+		require.Equal(t, 200, rec.Code)
+		etags = append(etags, rec.Header().Get("Etag"))
+	}
+	rec = c.do("PUT", "/bucket/big?partNumber=1&uploadId=00000000-0000-0000-0000-000000000000", []byte("x"), nil)
+	require.Equal(t, 404, rec.Code)
+	require.Equal(t, "NoSuchUpload", s3ErrorCode(t, rec))
+
+	rec = c.do("GET", "/bucket/big?uploadId="+uploadId+"&max-parts=2", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	var listed s3ListPartsResult
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &listed))
+	require.True(t, listed.IsTruncated)
+	require.Equal(t, 2, len(listed.Parts))
+	require.Equal(t, etags[1], listed.Parts[1].ETag)
+	require.Equal(t, 2, listed.NextPartNumberMarker)
+
+	rec = c.do("GET", "/bucket?uploads", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	var uploads s3ListMultipartUploadsResult
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &uploads))
+	require.Equal(t, 1, len(uploads.Uploads))
+	require.Equal(t, uploadId, uploads.Uploads[0].UploadId)
+
+	complete := func(key string, numbers ...int) *httptest.ResponseRecorder {
+		body := "<CompleteMultipartUpload>"
+		for _, n := range numbers {
+			body += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", n, etags[n-1])
+		}
+		return c.do("POST", "/bucket/"+key+"?uploadId="+uploadId, []byte(body+"</CompleteMultipartUpload>"), nil)
+	}
+	rec = complete("big", 2, 1)
+	require.Equal(t, 400, rec.Code)
+	require.Equal(t, "InvalidPartOrder", s3ErrorCode(t, rec))
+	rec = complete("big", 1, 3)
+	require.Equal(t, 200, rec.Code)
+	var completed s3CompleteMultipartUploadResult
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &completed))
+	s3Etag := md5.New()
+	for _, n := range []int{0, 2} {
+		sum := md5.Sum([]byte(parts[n]))
+		s3Etag.Write(sum[:])
+	}
+	require.Equal(t, fmt.Sprintf("\"%x-2\"", s3Etag.Sum(nil)), completed.ETag)
+	// the marker and the unused part are gone
+	require.Equal(t, 2, len(c.swift.containers["bucket+segments"]))
+
+	rec = c.do("GET", "/bucket/big", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "first part third", rec.Body.String())
+	require.Equal(t, completed.ETag, rec.Header().Get("Etag"))
+	require.Equal(t, "red", rec.Header().Get("X-Amz-Meta-Color"))
+	require.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	require.Equal(t, "", rec.Header().Get("X-Object-Sysmeta-S3api-Etag"))
+
+	rec = c.do("DELETE", "/bucket/big", nil, nil)
+	require.Equal(t, 204, rec.Code)
+	require.Equal(t, 0, len(c.swift.containers["bucket+segments"]))
+
+	rec = c.do("POST", "/bucket/small?uploads", nil, nil)
+	require.Equal(t, 200, rec.Code)
+	require.Nil(t, xml.Unmarshal(rec.Body.Bytes(), &initiated))
+	uploadId = initiated.UploadId
+	etags = nil
+	for i, part := range []string{"tiny", "parts"} {
+		rec = c.do("PUT", fmt.Sprintf("/bucket/small?partNumber=%d&uploadId=%s", i+1, uploadId), []byte(part), nil)
+		require.Equal(t, 200, rec.Code)
+		etags = append(etags, rec.Header().Get("Etag"))
+	}
+	rec = complete("big", 1, 2)
+	require.Equal(t, 404, rec.Code)
+	require.Equal(t, "NoSuchUpload", s3ErrorCode(t, rec))
+	rec = complete("small", 1, 2)
+	require.Equal(t, 400, rec.Code)
+	require.Equal(t, "EntityTooSmall", s3ErrorCode(t, rec))
+
+	rec = c.do("DELETE", "/bucket/small?uploadId="+uploadId, nil, nil)
+	require.Equal(t, 204, rec.Code)
+	require.Equal(t, 0, len(c.swift.containers["bucket+segments"]))
+	rec = c.do("DELETE", "/bucket/small?uploadId="+uploadId, nil, nil)
+	require.Equal(t, 404, rec.Code)
+	require.Equal(t, "NoSuchUpload", s3ErrorCode(t, rec))
+}
@@ -0,0 +1,365 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3V4Algorithm       = "AWS4-HMAC-SHA256"
+	s3V4DateFormat      = "20060102T150405Z"
+	s3UnsignedPayload   = "UNSIGNED-PAYLOAD"
+	s3StreamingPayload  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3MaxPresignExpires = 604800
+)
+
+// subresources that are part of the v2 canonicalized resource.
+var s3V2Subresources = map[string]bool{
+	"acl": true, "cors": true, "delete": true, "lifecycle": true, "location": true,
+	"logging": true, "notification": true, "partNumber": true, "policy": true,
+	"requestPayment": true, "response-cache-control": true,
+	"response-content-disposition": true, "response-content-encoding": true,
+	"response-content-language": true, "response-content-type": true,
+	"response-expires": true, "restore": true, "tagging": true, "torrent": true,
+	"uploadId": true, "uploads": true, "versionId": true, "versioning": true,
+	"versions": true, "website": true,
+}
+
+// S3AuthInfo holds the credentials an S3 request was signed with. The s3api
+// middleware fills it in, leaving it to the auth middleware to look up the
+// secret for Key, validate the signature and set Account.
+type S3AuthInfo struct {
+	Key          string
+	Signature    string
+	StringToSign string
+	// Account is the account the credentials belong to, set by the auth
+	// middleware once the signature has been validated.
+	Account string
+	// v4 credential scope; date is empty for v2 signatures
+	date    string
+	region  string
+	service string
+	// the keystone token the credentials were validated to, so subrequests
+	// needn't validate them again
+	token *token
+}
+
+// ValidateSignature returns true if the request was signed with secret.
+func (s *S3AuthInfo) ValidateSignature(secret string) bool {
+	return hmac.Equal([]byte(s.sign(secret)), []byte(s.Signature))
+}
+
+// sign returns the signature of StringToSign with secret.
+func (s *S3AuthInfo) sign(secret string) string {
+	if s.date == "" {
+		mac := hmac.New(sha1.New, []byte(secret))
+		io.WriteString(mac, s.StringToSign)
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	key := hmacSHA256([]byte("AWS4"+secret), s.date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, s.StringToSign))
+}
+
+// rewriteAccount replaces the access key the s3api middleware uses as the
+// account in its subrequest paths with the real account.
+func (s *S3AuthInfo) rewriteAccount(request *http.Request, account string) {
+	s.Account = account
+	apiRequest, pathAccount, _, _ := getPathSegments(request.URL.Path)
+	if pathAccount != s.Key {
+		return
+	}
+	prefix := "/" + apiRequest + "/" + pathAccount
+	request.URL.Path = "/" + apiRequest + "/" + account + request.URL.Path[len(prefix):]
+	request.URL.RawPath = ""
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
+
+// s3URIEncode encodes s the way AWS signatures expect: everything but the
+// unreserved characters is percent encoded, and slashes optionally left alone.
+func s3URIEncode(s string, encodeSlash bool) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// parseS3Date parses a Date or x-amz-date header, which clients send with
+// either a zone name or a numeric offset.
+func parseS3Date(date string) (time.Time, error) {
+	t, err := http.ParseTime(date)
+	if err != nil {
+		t, err = time.Parse(time.RFC1123Z, date)
+	}
+	return t, err
+}
+
+func isS3Signed(request *http.Request) bool {
+	auth := request.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "AWS ") || strings.HasPrefix(auth, s3V4Algorithm+" ") {
+		return true
+	}
+	query := request.URL.Query()
+	return query.Get("AWSAccessKeyId") != "" || query.Get("X-Amz-Credential") != ""
+}
+
+// parseS3Auth builds the S3AuthInfo for a signed request. resource is the
+// path of the request with any virtual hosted bucket put back in front of it,
+// as v2 signatures are made over it.
+func parseS3Auth(request *http.Request, resource string, skew time.Duration, now time.Time) (*S3AuthInfo, *s3Error) {
+	auth := request.Header.Get("Authorization")
+	query := request.URL.Query()
+	switch {
+	case strings.HasPrefix(auth, "AWS "):
+		return parseS3V2Auth(request, resource, skew, now)
+	case strings.HasPrefix(auth, s3V4Algorithm+" "):
+		return parseS3V4Auth(request, skew, now)
+	case query.Get("AWSAccessKeyId") != "":
+		return parseS3V2Auth(request, resource, skew, now)
+	case query.Get("X-Amz-Credential") != "":
+		return parseS3V4Auth(request, skew, now)
+	}
+	return nil, newS3Error("AccessDenied")
+}
+
+func parseS3V2Auth(request *http.Request, resource string, skew time.Duration, now time.Time) (*S3AuthInfo, *s3Error) {
+	s3Auth := &S3AuthInfo{}
+	query := request.URL.Query()
+	var date string
+	if auth := request.Header.Get("Authorization"); auth != "" {
+		creds := strings.TrimPrefix(auth, "AWS ")
+		i := strings.LastIndex(creds, ":")
+		if i <= 0 {
+			return nil, newS3Error("AccessDenied")
+		}
+		s3Auth.Key, s3Auth.Signature = creds[:i], creds[i+1:]
+		dateHeader := request.Header.Get("X-Amz-Date")
+		if dateHeader == "" {
+			dateHeader = request.Header.Get("Date")
+			date = dateHeader
+		}
+		t, err := parseS3Date(dateHeader)
+		if err != nil {
+			return nil, newS3ErrorMessage("AccessDenied", "AWS authentication requires a valid Date or x-amz-date header")
+		}
+		if t.Before(now.Add(-skew)) || t.After(now.Add(skew)) {
+			return nil, newS3Error("RequestTimeTooSkewed")
+		}
+	} else {
+		s3Auth.Key, s3Auth.Signature = query.Get("AWSAccessKeyId"), query.Get("Signature")
+		date = query.Get("Expires")
+		expires, err := strconv.ParseInt(date, 10, 64)
+		if err != nil || s3Auth.Signature == "" {
+			return nil, newS3ErrorMessage("AccessDenied", "Query-string authentication requires the Signature, Expires and AWSAccessKeyId parameters")
+		}
+		if now.Unix() > expires {
+			return nil, newS3ErrorMessage("AccessDenied", "Request has expired")
+		}
+	}
+	var amzHeaders []string
+	for k := range request.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			amzHeaders = append(amzHeaders, lk)
+		}
+	}
+	sort.Strings(amzHeaders)
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s\n%s\n%s\n%s\n", request.Method, request.Header.Get("Content-Md5"), request.Header.Get("Content-Type"), date)
+	for _, k := range amzHeaders {
+		var values []string
+		for _, v := range request.Header[http.CanonicalHeaderKey(k)] {
+			values = append(values, strings.TrimSpace(v))
+		}
+		fmt.Fprintf(buf, "%s:%s\n", k, strings.Join(values, ","))
+	}
+	buf.WriteString(resource)
+	var subresources []string
+	for k := range query {
+		if s3V2Subresources[k] {
+			subresources = append(subresources, k)
+		}
+	}
+	sort.Strings(subresources)
+	for i, k := range subresources {
+		if i == 0 {
+			buf.WriteByte('?')
+		} else {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(k)
+		if v := query.Get(k); v != "" {
+			buf.WriteString("=" + v)
+		}
+	}
+	s3Auth.StringToSign = buf.String()
+	return s3Auth, nil
+}
+
+func parseS3V4Auth(request *http.Request, skew time.Duration, now time.Time) (*S3AuthInfo, *s3Error) {
+	s3Auth := &S3AuthInfo{}
+	query := request.URL.Query()
+	var credential, signedHeaders, amzDate, payloadHash string
+	presigned := false
+	if auth := request.Header.Get("Authorization"); auth != "" {
+		for _, field := range strings.Split(strings.TrimPrefix(auth, s3V4Algorithm+" "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				s3Auth.Signature = kv[1]
+			}
+		}
+		amzDate = request.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			if t, err := parseS3Date(request.Header.Get("Date")); err == nil {
+				amzDate = t.UTC().Format(s3V4DateFormat)
+			}
+		}
+		payloadHash = request.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return nil, newS3ErrorMessage("InvalidRequest", "Missing required header for this request: x-amz-content-sha256")
+		}
+	} else {
+		presigned = true
+		if query.Get("X-Amz-Algorithm") != s3V4Algorithm {
+			return nil, newS3ErrorMessage("AuthorizationQueryParametersError", "X-Amz-Algorithm only supports \"AWS4-HMAC-SHA256\"")
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		s3Auth.Signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = s3UnsignedPayload
+	}
+	if credential == "" || signedHeaders == "" || s3Auth.Signature == "" {
+		return nil, newS3ErrorMessage("AccessDenied", "AWS4-HMAC-SHA256 authentication requires Credential, SignedHeaders and Signature")
+	}
+	scope := strings.Split(credential, "/")
+	if len(scope) < 5 || scope[len(scope)-1] != "aws4_request" {
+		return nil, newS3ErrorMessage("AuthorizationHeaderMalformed", "The credential scope is malformed")
+	}
+	s3Auth.Key = strings.Join(scope[:len(scope)-4], "/")
+	s3Auth.date, s3Auth.region, s3Auth.service = scope[len(scope)-4], scope[len(scope)-3], scope[len(scope)-2]
+	t, err := time.Parse(s3V4DateFormat, amzDate)
+	if err != nil {
+		return nil, newS3ErrorMessage("AccessDenied", "AWS authentication requires a valid Date or x-amz-date header")
+	}
+	if !strings.HasPrefix(amzDate, s3Auth.date) {
+		return nil, newS3ErrorMessage("AuthorizationHeaderMalformed", "The credential date does not match the request date")
+	}
+	if presigned {
+		expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+		if err != nil || expires < 0 || expires > s3MaxPresignExpires {
+			return nil, newS3ErrorMessage("AuthorizationQueryParametersError", "X-Amz-Expires must be between 0 and 604800 seconds")
+		}
+		if now.After(t.Add(time.Duration(expires) * time.Second)) {
+			return nil, newS3ErrorMessage("AccessDenied", "Request has expired")
+		}
+	} else if t.Before(now.Add(-skew)) || t.After(now.Add(skew)) {
+		return nil, newS3Error("RequestTimeTooSkewed")
+	}
+	if payloadHash == s3StreamingPayload {
+		return nil, newS3ErrorMessage("NotImplemented", "Chunked payload signing is not supported")
+	}
+
+	var queryParts []string
+	for k, vs := range query {
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			queryParts = append(queryParts, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	sort.Strings(queryParts)
+	canonical := &bytes.Buffer{}
+	fmt.Fprintf(canonical, "%s\n%s\n%s\n", request.Method, s3URIEncode(request.URL.Path, false), strings.Join(queryParts, "&"))
+	for _, h := range strings.Split(signedHeaders, ";") {
+		var value string
+		if h == "host" {
+			value = request.Host
+		} else if h == "content-length" {
+			value = strconv.FormatInt(request.ContentLength, 10)
+		} else {
+			var values []string
+			for _, v := range request.Header[http.CanonicalHeaderKey(h)] {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+		fmt.Fprintf(canonical, "%s:%s\n", h, value)
+	}
+	fmt.Fprintf(canonical, "\n%s\n%s", signedHeaders, payloadHash)
+	canonicalHash := sha256.Sum256(canonical.Bytes())
+	s3Auth.StringToSign = fmt.Sprintf("%s\n%s\n%s\n%x", s3V4Algorithm, amzDate, strings.Join(scope[len(scope)-4:], "/"), canonicalHash)
+
+	if payloadHash != s3UnsignedPayload && request.Body != nil && request.Body != http.NoBody {
+		request.Body = &s3PayloadVerifier{ReadCloser: request.Body, hash: sha256.New(), expected: strings.ToLower(payloadHash)}
+	}
+	return s3Auth, nil
+}
+
+// s3PayloadVerifier fails the read that would reach the end of a request body
+// that doesn't match its x-amz-content-sha256, so the PUT is never committed.
+type s3PayloadVerifier struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+	mismatch bool
+}
+
+func (v *s3PayloadVerifier) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.expected {
+		v.mismatch = true
+		return n, fmt.Errorf("x-amz-content-sha256 mismatch")
+	}
+	return n, err
+}
@@ -163,14 +163,14 @@ func (s *staticWebHandler) handleDirectory(writer http.ResponseWriter, request *
 			s.ctx.serveHTTPSubrequest(subrec, subreq)
 			subresp := subrec.Result()
 			if subresp.StatusCode >= 200 && subresp.StatusCode <= 399 {
-				writer.Header().Set("Location", request.URL.Path+"/")
+				writer.Header().Set("Location", s.ctx.clientPath(request)+"/")
 				srv.StandardResponse(writer, http.StatusMovedPermanently)
 				return
 			}
 		}
 		if s.webListings {
 			if s.object == "" {
-				writer.Header().Set("Location", request.URL.Path+"/")
+				writer.Header().Set("Location", s.ctx.clientPath(request)+"/")
 				srv.StandardResponse(writer, http.StatusMovedPermanently)
 				return
 			}
@@ -199,7 +199,7 @@ func (s *staticWebHandler) handleDirectory(writer http.ResponseWriter, request *
 				s.handleError(writer, request, http.StatusNotFound, nil)
 				return
 			}
-			writer.Header().Set("Location", request.URL.Path+"/")
+			writer.Header().Set("Location", s.ctx.clientPath(request)+"/")
 			srv.StandardResponse(writer, http.StatusMovedPermanently)
 			return
 		}
@@ -231,7 +231,7 @@ func (s *staticWebHandler) handleDirectory(writer http.ResponseWriter, request *
 			return
 		}
 	}
-	label := request.URL.Path
+	label := s.ctx.clientPath(request)
 	if s.webListingsLabel != "" {
 		label = s.webListingsLabel + "/" + s.object
 	}
@@ -0,0 +1,348 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+const (
+	symlinkTargetSysmeta        = "X-Object-Sysmeta-Symlink-Target"
+	symlinkTargetAccountSysmeta = "X-Object-Sysmeta-Symlink-Target-Account"
+	symlinkTargetEtagSysmeta    = "X-Object-Sysmeta-Symlink-Target-Etag"
+	symlinkTargetBytesSysmeta   = "X-Object-Sysmeta-Symlink-Target-Bytes"
+	symlinkContentType          = "application/symlink"
+)
+
+type symlinkMiddleware struct {
+	next              http.Handler
+	symloopMax        int
+	putRequestsMetric tally.Counter
+	getRequestsMetric tally.Counter
+}
+
+// symlinkWriter passes a response through unless it's for a symlink, in which
+// case it notes the link's target and throws the response away.
+type symlinkWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	wroteHeader bool
+	// isLink is set if the response was for a symlink.
+	isLink  bool
+	account string
+	target  string
+	etag    string
+	// location and expectEtags, if set, are the Content-Location to send and
+	// the etags that a successful response must have.
+	location    string
+	expectEtags []string
+	failed      bool
+}
+
+func (sw *symlinkWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *symlinkWriter) WriteHeader(status int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+	if target := sw.header.Get(symlinkTargetSysmeta); target != "" {
+		sw.isLink = true
+		sw.target = target
+		sw.account = sw.header.Get(symlinkTargetAccountSysmeta)
+		sw.etag = sw.header.Get(symlinkTargetEtagSysmeta)
+		return
+	}
+	if status/100 == 2 {
+		etag := strings.Trim(sw.header.Get("Etag"), "\"")
+		for _, expected := range sw.expectEtags {
+			if etag != expected {
+				sw.failed = true
+				srv.SimpleErrorResponse(sw.ResponseWriter, http.StatusConflict, fmt.Sprintf("Object Etag %q does not match X-Symlink-Target-Etag header %q", etag, expected))
+				return
+			}
+		}
+	}
+	CopyItems(sw.ResponseWriter.Header(), sw.header)
+	if sw.location != "" {
+		sw.ResponseWriter.Header().Set("Content-Location", sw.location)
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *symlinkWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.isLink || sw.failed {
+		return len(b), nil
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// symlinkGetWriter shows a symlink's target in the X-Symlink-Target headers,
+// for requests with ?symlink=get.
+type symlinkGetWriter struct {
+	http.ResponseWriter
+}
+
+func (sw *symlinkGetWriter) WriteHeader(status int) {
+	header := sw.Header()
+	if target := header.Get(symlinkTargetSysmeta); target != "" {
+		header.Set("X-Symlink-Target", target)
+		header.Set("X-Symlink-Target-Account", header.Get(symlinkTargetAccountSysmeta))
+		if etag := header.Get(symlinkTargetEtagSysmeta); etag != "" {
+			header.Set("X-Symlink-Target-Etag", etag)
+			header.Set("X-Symlink-Target-Bytes", header.Get(symlinkTargetBytesSysmeta))
+		}
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// symlinkTarget parses an X-Symlink-Target header value, which must be of the
+// form container/object and may be URL encoded.
+func symlinkTarget(value string) (string, string, error) {
+	target, err := url.PathUnescape(value)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("X-Symlink-Target header must be of the form <container name>/<object name>")
+	}
+	return parts[0], parts[1], nil
+}
+
+// stripSymlinkParams removes any symlink_* parameters a client put in the
+// request's Content-Type so they can't be mistaken for the ones this
+// middleware adds. It returns false if the Content-Type can't be parsed.
+func stripSymlinkParams(request *http.Request) bool {
+	contentType := request.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "symlink_") {
+		return true
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for k := range params {
+		if strings.HasPrefix(k, "symlink_") {
+			delete(params, k)
+		}
+	}
+	request.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	return true
+}
+
+func (s *symlinkMiddleware) handlePut(writer http.ResponseWriter, request *http.Request, account string) {
+	s.putRequestsMetric.Inc(1)
+	if request.ContentLength != 0 {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Symlink requests require a zero byte body")
+		return
+	}
+	container, object, err := symlinkTarget(request.Header.Get("X-Symlink-Target"))
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	targetAccount := account
+	if v := request.Header.Get("X-Symlink-Target-Account"); v != "" {
+		if targetAccount, err = url.PathUnescape(v); err == nil {
+			_, err = common.CheckNameFormat(request, targetAccount, "Account")
+		}
+		if err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, fmt.Sprintf("Invalid X-Symlink-Target-Account: %s", err))
+			return
+		}
+	}
+	contentType := request.Header.Get("Content-Type")
+	params := map[string]string{
+		"symlink_target":         common.Urlencode(container + "/" + object),
+		"symlink_target_account": common.Urlencode(targetAccount),
+	}
+	if etag := strings.Trim(request.Header.Get("X-Symlink-Target-Etag"), "\""); etag != "" {
+		ctx := GetProxyContext(request)
+		targetPath := fmt.Sprintf("/v1/%s/%s/%s", targetAccount, container, object)
+		subreq, err := ctx.newSubrequest("HEAD", common.Urlencode(targetPath), http.NoBody, request, "symlink")
+		if err != nil {
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		cw := &xloCaptureWriter{header: make(http.Header)}
+		ctx.serveHTTPSubrequest(cw, subreq)
+		if cw.status == http.StatusNotFound {
+			srv.SimpleErrorResponse(writer, http.StatusConflict, "X-Symlink-Target does not exist")
+			return
+		} else if cw.status/100 != 2 {
+			srv.StandardResponse(writer, cw.status)
+			return
+		}
+		if targetEtag := strings.Trim(cw.header.Get("Etag"), "\""); targetEtag != etag {
+			srv.SimpleErrorResponse(writer, http.StatusConflict, fmt.Sprintf("Object Etag %q does not match X-Symlink-Target-Etag header %q", targetEtag, etag))
+			return
+		}
+		bytes := cw.header.Get("Content-Length")
+		if _, err := strconv.ParseInt(bytes, 10, 64); err != nil {
+			bytes = "0"
+		}
+		if contentType == "" {
+			contentType = cw.header.Get("Content-Type")
+		}
+		request.Header.Set(symlinkTargetEtagSysmeta, etag)
+		request.Header.Set(symlinkTargetBytesSysmeta, bytes)
+		params["symlink_target_etag"] = etag
+		params["symlink_target_bytes"] = bytes
+	}
+	if contentType == "" {
+		contentType = symlinkContentType
+	}
+	mediaType, ctParams, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, fmt.Sprintf("Invalid Content-Type: %s", err))
+		return
+	}
+	for k, v := range params {
+		ctParams[k] = v
+	}
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set(symlinkTargetSysmeta, params["symlink_target"])
+	request.Header.Set(symlinkTargetAccountSysmeta, params["symlink_target_account"])
+	request.Header.Set("X-Object-Sysmeta-Container-Update-Override-Content-Type", mime.FormatMediaType(mediaType, ctParams))
+	for _, h := range []string{"X-Symlink-Target", "X-Symlink-Target-Account", "X-Symlink-Target-Etag"} {
+		request.Header.Del(h)
+	}
+	s.next.ServeHTTP(writer, request)
+}
+
+// handleGet follows symlinks until it finds something that isn't one, up to
+// symloopMax links.
+func (s *symlinkMiddleware) handleGet(writer http.ResponseWriter, request *http.Request) {
+	visited := map[string]bool{request.URL.Path: true}
+	var expectEtags []string
+	var location string
+	req := request
+	for hops := 0; ; hops++ {
+		sw := &symlinkWriter{ResponseWriter: writer, header: make(http.Header), location: location, expectEtags: expectEtags}
+		s.next.ServeHTTP(sw, req)
+		if !sw.isLink {
+			return
+		}
+		if hops == 0 {
+			s.getRequestsMetric.Inc(1)
+		}
+		if hops >= s.symloopMax {
+			srv.SimpleErrorResponse(writer, http.StatusConflict, fmt.Sprintf("Too many levels of symbolic links, maximum allowed is %d", s.symloopMax))
+			return
+		}
+		account, err := url.PathUnescape(sw.account)
+		if err != nil {
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		container, object, err := symlinkTarget(sw.target)
+		if err != nil {
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		targetPath := fmt.Sprintf("/v1/%s/%s/%s", account, container, object)
+		if visited[targetPath] {
+			srv.SimpleErrorResponse(writer, http.StatusConflict, "Symlink loop detected")
+			return
+		}
+		visited[targetPath] = true
+		if sw.etag != "" {
+			expectEtags = append(expectEtags, sw.etag)
+		}
+		location = common.Urlencode(targetPath)
+		req = new(http.Request)
+		*req = *request
+		u := *request.URL
+		u.Path = targetPath
+		u.RawPath = ""
+		req.URL = &u
+	}
+}
+
+func (s *symlinkMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	apiReq, account, container, object := getPathParts(request)
+	if !apiReq || account == "" || container == "" || object == "" {
+		s.next.ServeHTTP(writer, request)
+		return
+	}
+	if GetProxyContext(request) == nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	hasTarget := request.Header.Get("X-Symlink-Target") != ""
+	if (request.Method == "PUT" || request.Method == "POST") && !stripSymlinkParams(request) {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid Content-Type")
+		return
+	}
+	switch request.Method {
+	case "PUT":
+		if hasTarget {
+			s.handlePut(writer, request, account)
+			return
+		}
+		if request.Header.Get("X-Symlink-Target-Account") != "" || request.Header.Get("X-Symlink-Target-Etag") != "" {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "X-Symlink-Target header is required")
+			return
+		}
+	case "GET", "HEAD":
+		if request.URL.Query().Get("symlink") == "get" {
+			s.next.ServeHTTP(&symlinkGetWriter{ResponseWriter: writer}, request)
+		} else {
+			s.handleGet(writer, request)
+		}
+		return
+	default:
+		if hasTarget {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "X-Symlink-Target header must be PUT")
+			return
+		}
+	}
+	s.next.ServeHTTP(writer, request)
+}
+
+func NewSymlink(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	symloopMax := int(config.GetInt("symloop_max", 2))
+	if symloopMax < 1 {
+		return nil, fmt.Errorf("symloop_max must be at least 1")
+	}
+	RegisterInfo("symlink", map[string]interface{}{"symloop_max": symloopMax, "static_links": true})
+	putRequestsMetric := metricsScope.Counter("symlink_PUT_requests")
+	getRequestsMetric := metricsScope.Counter("symlink_GET_requests")
+	return func(next http.Handler) http.Handler {
+		return &symlinkMiddleware{
+			next:              next,
+			symloopMax:        symloopMax,
+			putRequestsMetric: putRequestsMetric,
+			getRequestsMetric: getRequestsMetric,
+		}
+	}, nil
+}
@@ -0,0 +1,231 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+type symlinkTestObject struct {
+	header http.Header
+	body   string
+}
+
+// symlinkTestStore is a bare bones object store for symlink tests, keeping
+// the headers of each PUT like an object server would.
+type symlinkTestStore map[string]*symlinkTestObject
+
+func (s symlinkTestStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		header := http.Header{}
+		for k := range r.Header {
+			header.Set(k, r.Header.Get(k))
+		}
+		header.Set("Etag", fmt.Sprintf("\"%x\"", md5.Sum(body)))
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+		s[r.URL.Path] = &symlinkTestObject{header: header, body: string(body)}
+		w.Header().Set("Etag", header.Get("Etag"))
+		w.WriteHeader(http.StatusCreated)
+	case "GET", "HEAD":
+		obj := s[r.URL.Path]
+		if obj == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k := range obj.header {
+			w.Header().Set(k, obj.header.Get(k))
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			w.Write([]byte(obj.body))
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func symlinkTestRequest(t *testing.T, handler http.Handler, method, path string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	require.Nil(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", NewFakeProxyContext(handler)))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func newSymlinkTestHandler(t *testing.T, store symlinkTestStore) http.Handler {
+	s, err := NewSymlink(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	return s(store)
+}
+
+func TestSymlinkPutAndGet(t *testing.T) {
+	store := symlinkTestStore{}
+	handler := newSymlinkTestHandler(t, store)
+	rr := symlinkTestRequest(t, handler, "PUT", "/v1/a/c/o", "stuff", map[string]string{"Content-Type": "text/plain"})
+	require.Equal(t, 201, rr.Code)
+
+	rr = symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link", "", map[string]string{"X-Symlink-Target": "c/o"})
+	require.Equal(t, 201, rr.Code)
+	link := store["/v1/a/c/link"]
+	require.Equal(t, "c/o", link.header.Get("X-Object-Sysmeta-Symlink-Target"))
+	require.Equal(t, "a", link.header.Get("X-Object-Sysmeta-Symlink-Target-Account"))
+	require.Equal(t, "application/symlink", link.header.Get("Content-Type"))
+	require.Equal(t, `application/symlink; symlink_target="c/o"; symlink_target_account=a`, link.header.Get("X-Object-Sysmeta-Container-Update-Override-Content-Type"))
+	require.Equal(t, "", link.header.Get("X-Symlink-Target"))
+
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/link", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "stuff", rr.Body.String())
+	require.Equal(t, "text/plain", rr.Header().Get("Content-Type"))
+	require.Equal(t, "/v1/a/c/o", rr.Header().Get("Content-Location"))
+
+	rr = symlinkTestRequest(t, handler, "HEAD", "/v1/a/c/link", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "5", rr.Header().Get("Content-Length"))
+
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/link?symlink=get", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "", rr.Body.String())
+	require.Equal(t, "c/o", rr.Header().Get("X-Symlink-Target"))
+	require.Equal(t, "a", rr.Header().Get("X-Symlink-Target-Account"))
+
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/o", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "", rr.Header().Get("Content-Location"))
+}
+
+func TestSymlinkPutErrors(t *testing.T) {
+	store := symlinkTestStore{}
+	handler := newSymlinkTestHandler(t, store)
+	rr := symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link", "stuff", map[string]string{"X-Symlink-Target": "c/o"})
+	require.Equal(t, 400, rr.Code)
+	rr = symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link", "", map[string]string{"X-Symlink-Target": "c"})
+	require.Equal(t, 400, rr.Code)
+	rr = symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link", "", map[string]string{"X-Symlink-Target-Account": "b"})
+	require.Equal(t, 400, rr.Code)
+	rr = symlinkTestRequest(t, handler, "POST", "/v1/a/c/link", "", map[string]string{"X-Symlink-Target": "c/o"})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 0, len(store))
+}
+
+func TestSymlinkStripsClientParams(t *testing.T) {
+	store := symlinkTestStore{}
+	handler := newSymlinkTestHandler(t, store)
+	rr := symlinkTestRequest(t, handler, "PUT", "/v1/a/c/o", "stuff", map[string]string{"Content-Type": `text/plain; charset=utf-8; symlink_target="c/x"; symlink_target_bytes=X`})
+	require.Equal(t, 201, rr.Code)
+	require.Equal(t, "text/plain; charset=utf-8", store["/v1/a/c/o"].header.Get("Content-Type"))
+
+	rr = symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link", "", map[string]string{"X-Symlink-Target": "c/o", "Content-Type": "text/plain; symlink_target_etag=abc"})
+	require.Equal(t, 201, rr.Code)
+	require.Equal(t, `text/plain; symlink_target="c/o"; symlink_target_account=a`, store["/v1/a/c/link"].header.Get("X-Object-Sysmeta-Container-Update-Override-Content-Type"))
+
+	rr = symlinkTestRequest(t, handler, "PUT", "/v1/a/c/bad", "stuff", map[string]string{"Content-Type": `text/plain; symlink_target="c/x`})
+	require.Equal(t, 400, rr.Code)
+	require.NotContains(t, store, "/v1/a/c/bad")
+}
+
+func TestSymlinkOtherAccount(t *testing.T) {
+	store := symlinkTestStore{}
+	handler := newSymlinkTestHandler(t, store)
+	symlinkTestRequest(t, handler, "PUT", "/v1/b/c2/o", "other", nil)
+	rr := symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link", "", map[string]string{"X-Symlink-Target": "c2/o", "X-Symlink-Target-Account": "b"})
+	require.Equal(t, 201, rr.Code)
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/link", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "other", rr.Body.String())
+	require.Equal(t, "/v1/b/c2/o", rr.Header().Get("Content-Location"))
+}
+
+func TestSymlinkChainsAndLoops(t *testing.T) {
+	store := symlinkTestStore{}
+	handler := newSymlinkTestHandler(t, store)
+	symlinkTestRequest(t, handler, "PUT", "/v1/a/c/o", "stuff", nil)
+	symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link1", "", map[string]string{"X-Symlink-Target": "c/o"})
+	symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link2", "", map[string]string{"X-Symlink-Target": "c/link1"})
+	symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link3", "", map[string]string{"X-Symlink-Target": "c/link2"})
+
+	rr := symlinkTestRequest(t, handler, "GET", "/v1/a/c/link2", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "stuff", rr.Body.String())
+
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/link3", "", nil)
+	require.Equal(t, 409, rr.Code)
+	require.Contains(t, rr.Body.String(), "maximum allowed is 2")
+
+	symlinkTestRequest(t, handler, "PUT", "/v1/a/c/loop1", "", map[string]string{"X-Symlink-Target": "c/loop2"})
+	symlinkTestRequest(t, handler, "PUT", "/v1/a/c/loop2", "", map[string]string{"X-Symlink-Target": "c/loop1"})
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/loop1", "", nil)
+	require.Equal(t, 409, rr.Code)
+	require.Contains(t, rr.Body.String(), "loop")
+
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/missing", "", nil)
+	require.Equal(t, 404, rr.Code)
+	symlinkTestRequest(t, handler, "PUT", "/v1/a/c/dangling", "", map[string]string{"X-Symlink-Target": "c/missing"})
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/dangling", "", nil)
+	require.Equal(t, 404, rr.Code)
+}
+
+func TestSymlinkStatic(t *testing.T) {
+	store := symlinkTestStore{}
+	handler := newSymlinkTestHandler(t, store)
+	symlinkTestRequest(t, handler, "PUT", "/v1/a/c/o", "stuff", map[string]string{"Content-Type": "text/plain"})
+	etag := strings.Trim(store["/v1/a/c/o"].header.Get("Etag"), "\"")
+
+	rr := symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link", "", map[string]string{"X-Symlink-Target": "c/o", "X-Symlink-Target-Etag": "nope"})
+	require.Equal(t, 409, rr.Code)
+	rr = symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link", "", map[string]string{"X-Symlink-Target": "c/missing", "X-Symlink-Target-Etag": etag})
+	require.Equal(t, 409, rr.Code)
+	require.Nil(t, store["/v1/a/c/link"])
+
+	rr = symlinkTestRequest(t, handler, "PUT", "/v1/a/c/link", "", map[string]string{"X-Symlink-Target": "c/o", "X-Symlink-Target-Etag": etag})
+	require.Equal(t, 201, rr.Code)
+	link := store["/v1/a/c/link"]
+	require.Equal(t, "text/plain", link.header.Get("Content-Type"))
+	require.Equal(t, fmt.Sprintf(`text/plain; symlink_target="c/o"; symlink_target_account=a; symlink_target_bytes=5; symlink_target_etag=%s`, etag),
+		link.header.Get("X-Object-Sysmeta-Container-Update-Override-Content-Type"))
+
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/link", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "stuff", rr.Body.String())
+
+	rr = symlinkTestRequest(t, handler, "HEAD", "/v1/a/c/link?symlink=get", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, etag, rr.Header().Get("X-Symlink-Target-Etag"))
+	require.Equal(t, "5", rr.Header().Get("X-Symlink-Target-Bytes"))
+
+	symlinkTestRequest(t, handler, "PUT", "/v1/a/c/o", "changed", nil)
+	rr = symlinkTestRequest(t, handler, "GET", "/v1/a/c/link", "", nil)
+	require.Equal(t, 409, rr.Code)
+	require.NotContains(t, rr.Body.String(), "changed")
+}
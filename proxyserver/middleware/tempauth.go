@@ -43,7 +43,10 @@ type tempAuth struct {
 	resellers    []string
 	reseller     string
 	accountRules map[string]map[string][]string
-	next         http.Handler
+	// userStore is the hidden account keeping the users added through the
+	// admin API, if enabled.
+	userStore string
+	next      http.Handler
 }
 
 func (ta *tempAuth) getUser(account, user, key string) *testUser {
@@ -81,6 +84,12 @@ func (ta *tempAuth) getUserGroups(tu *testUser) []string {
 	return groups
 }
 
+// userTokenKey returns the cache key of the token last given to an account's
+// user.
+func userTokenKey(account, user string) string {
+	return "authuser:" + account + ":" + user
+}
+
 func (ta *tempAuth) handleGetToken(writer http.ResponseWriter, request *http.Request) {
 
 	if request.Method != "GET" {
@@ -102,20 +111,28 @@ func (ta *tempAuth) handleGetToken(writer http.ResponseWriter, request *http.Req
 	if password == "" {
 		password = request.Header.Get("X-Storage-Pass")
 	}
+	ctx := GetProxyContext(request)
+	if ctx == nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
 	tUser := ta.getUser(account, user, password)
+	if tUser == nil && ta.userStore != "" && password != "" {
+		if su, status := ta.getStoredUser(ctx, account, user); status == http.StatusOK && checkUserKey(su.Key, password) {
+			tUser = su.testUser(account, user, ta.reseller)
+		} else if status != http.StatusOK && status != http.StatusNotFound {
+			srv.StandardResponse(writer, http.StatusServiceUnavailable)
+			return
+		}
+	}
 	if tUser == nil {
 		srv.StandardResponse(writer, 401)
 		return
 	}
 	var token string
-	ctx := GetProxyContext(request)
-	if ctx == nil {
-		srv.StandardResponse(writer, 500)
-		return
-	}
 	var prevToken string
 	userGroups := ta.getUserGroups(tUser)
-	if err := ctx.Cache.GetStructured("authuser:"+user, &prevToken); err == nil {
+	if err := ctx.Cache.GetStructured(userTokenKey(account, user), &prevToken); err == nil {
 		var ca cachedAuth
 		if err = ctx.Cache.GetStructured("auth:"+prevToken, &ca); err == nil {
 			if ca.Expires > time.Now().Unix() && len(userGroups) == len(ca.Groups) {
@@ -135,7 +152,7 @@ func (ta *tempAuth) handleGetToken(writer http.ResponseWriter, request *http.Req
 		token = ta.reseller + common.UUID()
 		now := time.Now().Unix()
 		ctx.Cache.Set("auth:"+token, &cachedAuth{Expires: now + 86400, Groups: userGroups}, 86400)
-		if err := ctx.Cache.Set("authuser:"+user, &token, 86400); err != nil {
+		if err := ctx.Cache.Set(userTokenKey(account, user), &token, 86400); err != nil {
 			ctx.Logger.Debug("Error setting tempauth token", zap.Error(err))
 			srv.SimpleErrorResponse(writer, 500, "Error setting token")
 			return
@@ -171,6 +188,9 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 	if request.URL.Path == "/auth/v1.0" {
 		ta.handleGetToken(writer, request)
 		return
+	} else if strings.HasPrefix(request.URL.Path, userStoreAdminPrefix) {
+		ta.handleUserAdmin(writer, request)
+		return
 	} else if strings.HasPrefix(request.URL.Path, "/v1") || strings.HasPrefix(request.URL.Path, "/V1") {
 		token := request.Header.Get("X-Auth-Token")
 		if token == "" {
@@ -187,7 +207,9 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 				ta.next.ServeHTTP(writer, request)
 				return
 			}
-			if token != "" && strings.HasPrefix(token, ta.reseller) {
+			if token == "" && ctx.S3Auth != nil {
+				ta.authorizeS3(ctx, request)
+			} else if token != "" && strings.HasPrefix(token, ta.reseller) {
 				if curReseller, ok := ta.getReseller(pathParts["account"]); ok && curReseller == ta.reseller {
 					var ca cachedAuth
 					if err := ctx.Cache.GetStructured("auth:"+token, &ca); err != nil {
@@ -220,10 +242,45 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 				}
 			}
 		}
+		if apiReq, account, container, _ := getPathParts(request); apiReq && account != "" && container == "" {
+			switch request.Method {
+			case "PUT", "POST":
+				if !setAccountACL(writer, request) {
+					return
+				}
+			case "GET", "HEAD":
+				writer = srv.NewCustomWriter(writer, func(w http.ResponseWriter, status int) int {
+					if acl := w.Header().Get(accountACLSysmeta); acl != "" && ctx.StorageOwner {
+						w.Header().Set(accountACLHeader, acl)
+					}
+					return status
+				})
+			}
+		}
 	}
 	ta.next.ServeHTTP(writer, request)
 }
 
+// authorizeS3 validates the signature of a request from the s3api middleware,
+// whose access key is the account:user of a tempauth user and whose secret
+// is the user's password.
+func (ta *tempAuth) authorizeS3(ctx *ProxyContext, request *http.Request) {
+	if i := strings.LastIndex(ctx.S3Auth.Key, ":"); i > 0 {
+		account, user := ctx.S3Auth.Key[:i], ctx.S3Auth.Key[i+1:]
+		for _, tu := range ta.testUsers {
+			if tu.Account == account && tu.Username == user && ctx.S3Auth.ValidateSignature(tu.Password) {
+				ctx.S3Auth.rewriteAccount(request, tu.AccountID)
+				ctx.RemoteUsers = ta.getUserGroups(&tu)
+				ctx.Authorize = ta.authorize
+				return
+			}
+		}
+	}
+	ctx.Authorize = func(r *http.Request) (bool, int) {
+		return false, http.StatusForbidden
+	}
+}
+
 func (ta *tempAuth) authorize(r *http.Request) (bool, int) {
 	pathParts, err := common.ParseProxyPath(r.URL.Path)
 	if err != nil {
@@ -248,6 +305,7 @@ func (ta *tempAuth) authorize(r *http.Request) (bool, int) {
 		!common.StringInSlice(pathParts["account"], ta.resellers) &&
 		!strings.HasPrefix(pathParts["account"], ".") {
 		ctx.StorageOwner = true
+		ctx.ResellerRequest = true
 		return true, http.StatusOK
 	}
 	if common.StringInSlice(pathParts["account"], ctx.RemoteUsers) &&
@@ -269,6 +327,14 @@ func (ta *tempAuth) authorize(r *http.Request) (bool, int) {
 			}
 		}
 	}
+	if ai, err := ctx.GetAccountInfo(pathParts["account"]); err == nil && ai.SysMetadata["Core-Access-Control"] != "" {
+		if acl, err := parseAccountACL(ai.SysMetadata["Core-Access-Control"]); err == nil {
+			if allowed, owner := acl.allows(r, pathParts["container"], ctx.RemoteUsers); allowed {
+				ctx.StorageOwner = owner
+				return true, http.StatusOK
+			}
+		}
+	}
 	referrers, roles := ParseACL(ctx.ACL)
 	if auth, _ := AuthorizeUnconfirmedIdentity(r, pathParts["object"], referrers, roles); auth {
 		return true, http.StatusOK
@@ -316,7 +382,11 @@ func NewTempAuth(config conf.Section, metricsScope tally.Scope) (func(http.Handl
 
 		users = append(users, testUser{account, user, valparts[0], groups, url, accountID})
 	}
-	RegisterInfo("tempauth", map[string]interface{}{"account_acls": false})
+	userStore := ""
+	if config.GetBool("user_store", false) {
+		userStore = config.GetDefault("user_store_account", ".auth")
+	}
+	RegisterInfo("tempauth", map[string]interface{}{"account_acls": true})
 	return func(next http.Handler) http.Handler {
 		return &tempAuth{
 			next:         next,
@@ -324,6 +394,7 @@ func NewTempAuth(config conf.Section, metricsScope tally.Scope) (func(http.Handl
 			resellers:    resellerPrefixes,
 			reseller:     reseller,
 			accountRules: accountRules,
+			userStore:    userStore,
 		}
 	}, nil
 }
@@ -18,12 +18,17 @@ package middleware
 import (
 	"context"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
 	"github.com/troubling/hummingbird/common/test"
 )
 
@@ -120,6 +125,42 @@ func TestHandleGetToken(t *testing.T) {
 	require.Equal(t, "test:tester", cData.Groups[1])
 }
 
+func TestHandleGetTokenPerAccount(t *testing.T) {
+	passthrough := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	ta := &tempAuth{
+		reseller:  "AUTH_",
+		resellers: []string{"AUTH_"},
+		next:      passthrough,
+		testUsers: []testUser{
+			{Account: "test", Username: "tester", Password: "testing"},
+			{Account: "other", Username: "tester", Password: "testing"},
+		},
+	}
+	fakeContext := NewFakeProxyContext(passthrough)
+	fakeMr := &test.FakeMemcacheRing{MockGetStructured: map[string][]byte{}}
+	fakeContext.Cache = fakeMr
+	// The same named user in another account has a token cached.
+	fakeMr.MockGetStructured["authuser:other:tester"], _ = json.Marshal("AUTH_othertoken")
+	fakeMr.MockGetStructured["auth:AUTH_othertoken"], _ = json.Marshal(&cachedAuth{Groups: []string{"other", "other:tester"}, Expires: time.Now().Unix() + 100})
+	getToken := func(user string) string {
+		req, err := http.NewRequest("GET", "/auth/v1.0", nil)
+		require.Nil(t, err)
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", fakeContext))
+		req.Header.Set("X-Auth-User", user)
+		req.Header.Set("X-Auth-Key", "testing")
+		rr := httptest.NewRecorder()
+		ta.handleGetToken(rr, req)
+		require.Equal(t, 200, rr.Code)
+		return rr.Header().Get("X-Auth-Token")
+	}
+	require.Equal(t, "AUTH_othertoken", getToken("other:tester"))
+	token := getToken("test:tester")
+	require.NotEqual(t, "AUTH_othertoken", token)
+	require.True(t, strings.HasPrefix(token, "AUTH_"))
+}
+
 func TestHandleGetTokenFail(t *testing.T) {
 	theHeader := make(http.Header, 1)
 	fakeWriter := test.MockResponseWriter{SaveHeader: &theHeader, StatusMap: map[string]int{"a": 12}}
@@ -190,7 +231,7 @@ func TestAuthorize(t *testing.T) {
 	require.False(t, ok)
 	require.Equal(t, 401, st)
 
-	fakeContext := NewFakeProxyContext(passthrough)
+	fakeContext := newTempAuthTestContext(passthrough)
 	authReq, _ = http.NewRequest("GET", "/v1/AUTH_test", nil)
 	authReq = authReq.WithContext(context.WithValue(authReq.Context(), "proxycontext", fakeContext))
 	fakeContext.RemoteUsers = []string{"AUTH_test"}
@@ -214,7 +255,7 @@ func TestAuthorize(t *testing.T) {
 	ok, st = ta.authorize(authReq)
 	require.Equal(t, 200, st)
 
-	fakeContext = NewFakeProxyContext(passthrough)
+	fakeContext = newTempAuthTestContext(passthrough)
 	fakeContext.RemoteUsers = []string{"AUTH_test"}
 	authReq, _ = http.NewRequest("GET", "/v1/AUTH_test/c/o", nil)
 	authReq = authReq.WithContext(context.WithValue(authReq.Context(), "proxycontext", fakeContext))
@@ -251,7 +292,7 @@ func TestAuthorizeAcl(t *testing.T) {
 		next:      passthrough,
 		testUsers: []testUser{tu},
 	}
-	fakeContext := NewFakeProxyContext(passthrough)
+	fakeContext := newTempAuthTestContext(passthrough)
 	fakeContext.RemoteUsers = []string{"test", "test:tester3"}
 	authReq, _ := http.NewRequest("GET", "/v1/AUTH_test/c/o", nil)
 	authReq = authReq.WithContext(context.WithValue(authReq.Context(), "proxycontext", fakeContext))
@@ -341,3 +382,237 @@ func TestServeHTTP(t *testing.T) {
 	require.False(t, ctx.Authorize == nil)
 	require.Equal(t, "hat", fakeContext.RemoteUsers[0])
 }
+
+// tempAuthTestClient is just enough of a cluster for the user store and
+// account ACLs: the headers of every account and the objects written.
+type tempAuthTestClient struct {
+	client.ProxyClient
+	accountHeaders http.Header
+	objects        map[string][]byte
+}
+
+func newTempAuthTestClient() *tempAuthTestClient {
+	return &tempAuthTestClient{accountHeaders: http.Header{}, objects: map[string][]byte{}}
+}
+
+func tempAuthTestResponse(status int, body string) *http.Response {
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(body))}
+}
+
+func (c *tempAuthTestClient) HeadAccount(account string, headers http.Header) *http.Response {
+	resp := tempAuthTestResponse(204, "")
+	for k := range c.accountHeaders {
+		resp.Header.Set(k, c.accountHeaders.Get(k))
+	}
+	resp.Header.Set("X-Account-Container-Count", "0")
+	resp.Header.Set("X-Account-Object-Count", "0")
+	resp.Header.Set("X-Account-Bytes-Used", "0")
+	return resp
+}
+
+func (c *tempAuthTestClient) PutObject(account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	body, _ := ioutil.ReadAll(src)
+	c.objects[account+"/"+container+"/"+obj] = body
+	return tempAuthTestResponse(201, "")
+}
+
+func (c *tempAuthTestClient) GetObject(account string, container string, obj string, headers http.Header) *http.Response {
+	if body, ok := c.objects[account+"/"+container+"/"+obj]; ok {
+		return tempAuthTestResponse(200, string(body))
+	}
+	return tempAuthTestResponse(404, "")
+}
+
+func (c *tempAuthTestClient) DeleteObject(account string, container string, obj string, headers http.Header) *http.Response {
+	if _, ok := c.objects[account+"/"+container+"/"+obj]; ok {
+		delete(c.objects, account+"/"+container+"/"+obj)
+		return tempAuthTestResponse(204, "")
+	}
+	return tempAuthTestResponse(404, "")
+}
+
+func (c *tempAuthTestClient) GetContainer(account string, container string, options map[string]string, headers http.Header) *http.Response {
+	prefix := account + "/" + container + "/"
+	names := []map[string]string{}
+	for path := range c.objects {
+		if strings.HasPrefix(path, prefix) && path[len(prefix):] > options["marker"] {
+			names = append(names, map[string]string{"name": path[len(prefix):]})
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i]["name"] < names[j]["name"] })
+	body, _ := json.Marshal(names)
+	return tempAuthTestResponse(200, string(body))
+}
+
+func newTempAuthTestContext(next http.Handler) *ProxyContext {
+	ctx := NewFakeProxyContext(next)
+	ctx.Cache = &test.FakeMemcacheRing{MockGetStructured: map[string][]byte{}}
+	ctx.C = newTempAuthTestClient()
+	return ctx
+}
+
+func TestUserKeyHash(t *testing.T) {
+	hashed, err := hashUserKey("secret")
+	require.Nil(t, err)
+	require.False(t, strings.Contains(hashed, "secret"))
+	require.True(t, checkUserKey(hashed, "secret"))
+	require.False(t, checkUserKey(hashed, "secret2"))
+	again, err := hashUserKey("secret")
+	require.Nil(t, err)
+	require.NotEqual(t, hashed, again)
+	require.False(t, checkUserKey("secret", "secret"))
+	require.False(t, checkUserKey("pbkdf2-sha256$0$00$00", ""))
+}
+
+func TestUserStore(t *testing.T) {
+	passthrough := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	ta := &tempAuth{
+		reseller:  "AUTH_",
+		resellers: []string{"AUTH_"},
+		next:      passthrough,
+		userStore: ".auth",
+	}
+	ctx := newTempAuthTestContext(passthrough)
+	mc := ctx.Cache.(*test.FakeMemcacheRing)
+	for token, groups := range map[string][]string{
+		"AUTH_reseller": {".reseller_admin"},
+		"AUTH_admin":    {"test", "test:admin", "AUTH_test"},
+		"AUTH_other":    {"other", "other:admin", "AUTH_other"},
+	} {
+		mc.MockGetStructured["auth:"+token], _ = json.Marshal(&cachedAuth{Groups: groups, Expires: time.Now().Unix() + 100})
+	}
+	request := func(method, path, token string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		require.Nil(t, err)
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+		if token != "" {
+			req.Header.Set("X-Auth-Token", token)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		ta.ServeHTTP(rr, req)
+		return rr
+	}
+	getToken := func(user, key string) int {
+		return request("GET", "/auth/v1.0", "", map[string]string{"X-Auth-User": user, "X-Auth-Key": key}).Code
+	}
+
+	require.Equal(t, 401, request("PUT", "/auth/v2/test/bob", "", map[string]string{"X-Auth-User-Key": "k"}).Code)
+	require.Equal(t, 403, request("PUT", "/auth/v2/test/bob", "AUTH_other", map[string]string{"X-Auth-User-Key": "k"}).Code)
+	require.Equal(t, 400, request("PUT", "/auth/v2/test/bob", "AUTH_admin", nil).Code)
+	require.Equal(t, 403, request("PUT", "/auth/v2/test/bob", "AUTH_admin", map[string]string{"X-Auth-User-Key": "k", "X-Auth-User-Groups": ".reseller_admin"}).Code)
+	// Account admins can't give users another account's identity.
+	for _, groups := range []string{"AUTH_other", "test:eng, AUTH_test", "other:admin", "other", "eng", ".super"} {
+		require.Equal(t, 403, request("PUT", "/auth/v2/test/bob", "AUTH_admin", map[string]string{"X-Auth-User-Key": "k", "X-Auth-User-Groups": groups}).Code, groups)
+	}
+	require.Equal(t, 201, request("PUT", "/auth/v2/test/bob", "AUTH_admin", map[string]string{"X-Auth-User-Key": "bobkey", "X-Auth-User-Groups": ".admin, test:eng, test:ops"}).Code)
+	require.Equal(t, 201, request("PUT", "/auth/v2/test/root", "AUTH_reseller", map[string]string{"X-Auth-User-Key": "rootkey", "X-Auth-User-Groups": ".reseller_admin"}).Code)
+	stored := string(ctx.C.(*tempAuthTestClient).objects[".auth/test/bob"])
+	require.False(t, strings.Contains(stored, "bobkey"))
+
+	require.Equal(t, 200, getToken("test:bob", "bobkey"))
+	ca := mc.MockSetValues[len(mc.MockSetValues)-2].(*cachedAuth)
+	require.Equal(t, []string{"test", "test:bob", "test:eng", "test:ops", "AUTH_test"}, ca.Groups)
+	require.Equal(t, 401, getToken("test:bob", "nope"))
+	require.Equal(t, 401, getToken("test:nobody", "bobkey"))
+
+	rr := request("GET", "/auth/v2/test", "AUTH_admin", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, `[{"name":"bob","groups":[".admin","test:eng","test:ops"]},{"name":"root","groups":[".reseller_admin"]}]`, rr.Body.String())
+	rr = request("GET", "/auth/v2/test/bob", "AUTH_admin", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, `{"groups":[".admin","test:eng","test:ops"],"name":"bob"}`, rr.Body.String())
+	// Only reseller admins can change reseller admins.
+	require.Equal(t, 403, request("DELETE", "/auth/v2/test/root", "AUTH_admin", nil).Code)
+
+	require.Equal(t, 204, request("POST", "/auth/v2/test/bob", "AUTH_admin", map[string]string{"X-Auth-User-Key": "newkey"}).Code)
+	require.Equal(t, 401, getToken("test:bob", "bobkey"))
+	require.Equal(t, 200, getToken("test:bob", "newkey"))
+	rr = request("GET", "/auth/v2/test/bob", "AUTH_admin", nil)
+	require.Equal(t, `{"groups":[".admin","test:eng","test:ops"],"name":"bob"}`, rr.Body.String())
+	require.Equal(t, 404, request("POST", "/auth/v2/test/nobody", "AUTH_admin", map[string]string{"X-Auth-User-Key": "k"}).Code)
+
+	require.Equal(t, 204, request("DELETE", "/auth/v2/test/bob", "AUTH_admin", nil).Code)
+	require.Equal(t, 401, getToken("test:bob", "newkey"))
+	require.Equal(t, 404, request("DELETE", "/auth/v2/test/bob", "AUTH_admin", nil).Code)
+
+	ta.userStore = ""
+	require.Equal(t, 404, request("GET", "/auth/v2/test", "AUTH_reseller", nil).Code)
+}
+
+func TestAccountACL(t *testing.T) {
+	for _, bad := range []string{"", "[]", `{"admin": "bob"}`, `{"write": ["bob"]}`, `{} {}`} {
+		_, err := parseAccountACL(bad)
+		require.NotNil(t, err, bad)
+	}
+
+	// The account keeps the sysmeta it's given, and returns it with HEADs.
+	sysmeta := ""
+	passthrough := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			sysmeta = r.Header.Get(accountACLSysmeta)
+		}
+		w.Header().Set(accountACLSysmeta, sysmeta)
+		w.WriteHeader(204)
+	})
+	ta := &tempAuth{
+		reseller:  "AUTH_",
+		resellers: []string{"AUTH_"},
+		next:      passthrough,
+	}
+	ctx := newTempAuthTestContext(passthrough)
+	request := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "/v1/AUTH_test", nil)
+		require.Nil(t, err)
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		ta.ServeHTTP(rr, req)
+		return rr
+	}
+	require.Equal(t, 400, request("POST", map[string]string{accountACLHeader: `{"admin": "bob"}`}).Code)
+	rr := request("POST", map[string]string{accountACLHeader: `{"read-only": ["test:ro"], "admin": ["test:bob"]}`})
+	require.Equal(t, 204, rr.Code)
+	require.Equal(t, `{"admin":["test:bob"],"read-only":["test:ro"]}`, sysmeta)
+	// Only the account's owners see its ACL.
+	rr = request("HEAD", nil)
+	require.Equal(t, "", rr.Header().Get(accountACLHeader))
+	ctx.StorageOwner = true
+	rr = request("HEAD", nil)
+	require.Equal(t, `{"admin":["test:bob"],"read-only":["test:ro"]}`, rr.Header().Get(accountACLHeader))
+	ctx.StorageOwner = false
+
+	ctx.C.(*tempAuthTestClient).accountHeaders.Set(accountACLSysmeta, `{"admin":["test:bob"],"read-write":["test:rw"],"read-only":["test:ro"]}`)
+	authorize := func(method, path string, groups ...string) (bool, bool) {
+		req, err := http.NewRequest(method, path, nil)
+		require.Nil(t, err)
+		actx := newTempAuthTestContext(passthrough)
+		actx.C = ctx.C
+		actx.RemoteUsers = groups
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", actx))
+		ok, _ := ta.authorize(req)
+		return ok, actx.StorageOwner
+	}
+	ok, owner := authorize("POST", "/v1/AUTH_test", "test", "test:bob")
+	require.True(t, ok)
+	require.True(t, owner)
+	ok, _ = authorize("DELETE", "/v1/AUTH_test", "test", "test:bob")
+	require.False(t, ok)
+	ok, owner = authorize("PUT", "/v1/AUTH_test/c/o", "test", "test:rw")
+	require.True(t, ok)
+	require.False(t, owner)
+	ok, _ = authorize("POST", "/v1/AUTH_test", "test", "test:rw")
+	require.False(t, ok)
+	ok, _ = authorize("GET", "/v1/AUTH_test/c", "test", "test:ro")
+	require.True(t, ok)
+	ok, _ = authorize("PUT", "/v1/AUTH_test/c/o", "test", "test:ro")
+	require.False(t, ok)
+	ok, _ = authorize("GET", "/v1/AUTH_test/c", "test", "test:nobody")
+	require.False(t, ok)
+}
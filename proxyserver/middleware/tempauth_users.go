@@ -0,0 +1,413 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+const (
+	userStoreKeyIterations = 10000
+	userStoreAdminPrefix   = "/auth/v2/"
+	accountACLHeader       = "X-Account-Access-Control"
+	accountACLSysmeta      = "X-Account-Sysmeta-Core-Access-Control"
+)
+
+// storedUser is a tempauth user kept in the cluster, as an object named for
+// the user in a container named for the user's account, in the user store's
+// hidden account.
+type storedUser struct {
+	Key    string   `json:"key"`
+	Groups []string `json:"groups"`
+}
+
+// testUser returns the stored user as one from the tempauth config.
+func (su *storedUser) testUser(account, user, reseller string) *testUser {
+	return &testUser{Account: account, Username: user, Roles: su.Groups, AccountID: reseller + account}
+}
+
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	binary.Write(mac, binary.BigEndian, uint32(1))
+	u := mac.Sum(nil)
+	key := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// hashUserKey returns a salted hash of a user's key for the user store.
+func hashUserKey(key string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%x$%x", userStoreKeyIterations, salt, pbkdf2SHA256([]byte(key), salt, userStoreKeyIterations)), nil
+}
+
+// checkUserKey returns whether key matches a hash from hashUserKey.
+func checkUserKey(hashed, key string) bool {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	sum, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sum, pbkdf2SHA256([]byte(key), salt, iterations))
+}
+
+// getStoredUser returns a user from the user store, or the status of trying
+// to read it.
+func (ta *tempAuth) getStoredUser(ctx *ProxyContext, account, user string) (*storedUser, int) {
+	resp := ctx.C.GetObject(ta.userStore, account, user, http.Header{"X-Trans-Id": {ctx.TxId}})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+	var su storedUser
+	if err := json.NewDecoder(resp.Body).Decode(&su); err != nil {
+		ctx.Logger.Error("Invalid user in user store", zap.String("account", account), zap.String("user", user), zap.Error(err))
+		return nil, http.StatusInternalServerError
+	}
+	return &su, http.StatusOK
+}
+
+// listStoredUsers returns the names of an account's users in the user store.
+func (ta *tempAuth) listStoredUsers(ctx *ProxyContext, account string) ([]string, int) {
+	var users []string
+	marker := ""
+	for {
+		resp := ctx.C.GetContainer(ta.userStore, account, map[string]string{"format": "json", "marker": marker}, http.Header{"X-Trans-Id": {ctx.TxId}})
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return users, http.StatusOK
+		} else if resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			return nil, resp.StatusCode
+		}
+		var page []struct {
+			Name string `json:"name"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, http.StatusInternalServerError
+		}
+		if len(page) == 0 {
+			return users, http.StatusOK
+		}
+		for _, p := range page {
+			users = append(users, p.Name)
+		}
+		marker = page[len(page)-1].Name
+	}
+}
+
+// invalidateTokens forgets the token given to a user, so that a deleted user
+// or an old key can't be used any more.
+func (ta *tempAuth) invalidateTokens(ctx *ProxyContext, account, user string) {
+	var token string
+	if err := ctx.Cache.GetStructured(userTokenKey(account, user), &token); err == nil {
+		ctx.Cache.Delete("auth:" + token)
+	}
+	ctx.Cache.Delete(userTokenKey(account, user))
+}
+
+// userGroupAllowed returns whether an account's admin may give one of its
+// users the group. Groups become the user's identities and ACLs match them
+// against account names as well as users, so apart from .admin only the
+// account's own name and groups within it, <account>:<name>, are allowed.
+func (ta *tempAuth) userGroupAllowed(account, group string) bool {
+	if group == ".admin" || group == account {
+		return true
+	}
+	if i := strings.Index(group, ":"); i >= 0 {
+		return group[:i] == account
+	}
+	return false
+}
+
+// handleUserAdmin serves the user store's admin API:
+//
+//	GET    /auth/v2/<account>         lists the account's users and their groups
+//	GET    /auth/v2/<account>/<user>  returns the user's groups
+//	PUT    /auth/v2/<account>/<user>  creates or replaces a user
+//	POST   /auth/v2/<account>/<user>  changes a user's key or groups
+//	DELETE /auth/v2/<account>/<user>  deletes a user
+//
+// A user's key is given by X-Auth-User-Key and groups by X-Auth-User-Groups,
+// a comma separated list that may include .admin and .reseller_admin.
+// Reseller admins may manage any user, and an account's admins may manage
+// the account's users other than reseller admins, giving them only groups
+// that userGroupAllowed allows.
+func (ta *tempAuth) handleUserAdmin(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	if ctx == nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	if ta.userStore == "" {
+		srv.StandardResponse(writer, http.StatusNotFound)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(request.URL.Path, userStoreAdminPrefix), "/")
+	if len(parts) > 2 || parts[0] == "" || (len(parts) == 2 && (parts[1] == "" || strings.Contains(parts[1], ":"))) {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	account, user := parts[0], ""
+	if len(parts) == 2 {
+		user = parts[1]
+	}
+	token := request.Header.Get("X-Auth-Token")
+	var ca cachedAuth
+	if token == "" {
+		srv.StandardResponse(writer, http.StatusUnauthorized)
+		return
+	} else if err := ctx.Cache.GetStructured("auth:"+token, &ca); err != nil {
+		srv.StandardResponse(writer, http.StatusUnauthorized)
+		return
+	}
+	resellerAdmin := common.StringInSlice(".reseller_admin", ca.Groups)
+	if !resellerAdmin && !common.StringInSlice(ta.reseller+account, ca.Groups) {
+		srv.StandardResponse(writer, http.StatusForbidden)
+		return
+	}
+	if user == "" {
+		if request.Method != "GET" && request.Method != "HEAD" {
+			srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+			return
+		}
+		names, status := ta.listStoredUsers(ctx, account)
+		if status != http.StatusOK {
+			srv.StandardResponse(writer, status)
+			return
+		}
+		type listedUser struct {
+			Name   string   `json:"name"`
+			Groups []string `json:"groups"`
+		}
+		users := []listedUser{}
+		for _, name := range names {
+			if su, status := ta.getStoredUser(ctx, account, name); status == http.StatusOK {
+				users = append(users, listedUser{Name: name, Groups: su.Groups})
+			} else if status != http.StatusNotFound {
+				srv.StandardResponse(writer, status)
+				return
+			}
+		}
+		body, _ := json.Marshal(users)
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		writer.WriteHeader(http.StatusOK)
+		if request.Method == "GET" {
+			writer.Write(body)
+		}
+		return
+	}
+	existing, status := ta.getStoredUser(ctx, account, user)
+	if status != http.StatusOK && status != http.StatusNotFound {
+		srv.StandardResponse(writer, status)
+		return
+	}
+	if existing != nil && !resellerAdmin && common.StringInSlice(".reseller_admin", existing.Groups) {
+		srv.StandardResponse(writer, http.StatusForbidden)
+		return
+	}
+	switch request.Method {
+	case "GET", "HEAD":
+		if existing == nil {
+			srv.StandardResponse(writer, http.StatusNotFound)
+			return
+		}
+		body, _ := json.Marshal(map[string]interface{}{"name": user, "groups": existing.Groups})
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		writer.WriteHeader(http.StatusOK)
+		if request.Method == "GET" {
+			writer.Write(body)
+		}
+	case "PUT", "POST":
+		su := &storedUser{Groups: []string{}}
+		if request.Method == "POST" {
+			if existing == nil {
+				srv.StandardResponse(writer, http.StatusNotFound)
+				return
+			}
+			su = existing
+		}
+		if key := request.Header.Get("X-Auth-User-Key"); key != "" {
+			hashed, err := hashUserKey(key)
+			if err != nil {
+				srv.StandardResponse(writer, http.StatusInternalServerError)
+				return
+			}
+			su.Key = hashed
+		} else if request.Method == "PUT" {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "X-Auth-User-Key is required")
+			return
+		}
+		if _, ok := request.Header["X-Auth-User-Groups"]; ok {
+			su.Groups = []string{}
+			for _, group := range strings.Split(request.Header.Get("X-Auth-User-Groups"), ",") {
+				if group = strings.TrimSpace(group); group != "" && !common.StringInSlice(group, su.Groups) {
+					su.Groups = append(su.Groups, group)
+				}
+			}
+		}
+		if !resellerAdmin {
+			for _, group := range su.Groups {
+				if !ta.userGroupAllowed(account, group) {
+					srv.StandardResponse(writer, http.StatusForbidden)
+					return
+				}
+			}
+		}
+		body, _ := json.Marshal(su)
+		if status := ctx.putHiddenObject(ta.userStore, account, user, body); status/100 != 2 {
+			srv.StandardResponse(writer, status)
+			return
+		}
+		ta.invalidateTokens(ctx, account, user)
+		if request.Method == "PUT" {
+			srv.StandardResponse(writer, http.StatusCreated)
+		} else {
+			srv.StandardResponse(writer, http.StatusNoContent)
+		}
+	case "DELETE":
+		if existing == nil {
+			srv.StandardResponse(writer, http.StatusNotFound)
+			return
+		}
+		if status := ctx.deleteHiddenObject(ta.userStore, account, user); status/100 != 2 && status != http.StatusNotFound {
+			srv.StandardResponse(writer, status)
+			return
+		}
+		ta.invalidateTokens(ctx, account, user)
+		srv.StandardResponse(writer, http.StatusNoContent)
+	default:
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+	}
+}
+
+// accountACL is an account's X-Account-Access-Control, listing the groups
+// given each level of access to everything in the account.
+type accountACL struct {
+	Admin     []string `json:"admin,omitempty"`
+	ReadWrite []string `json:"read-write,omitempty"`
+	ReadOnly  []string `json:"read-only,omitempty"`
+}
+
+// parseAccountACL parses an X-Account-Access-Control value, rejecting any
+// access level it doesn't know about.
+func parseAccountACL(value string) (*accountACL, error) {
+	var acl accountACL
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&acl); err != nil {
+		return nil, fmt.Errorf("Invalid X-Account-Access-Control: %v", err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("Invalid X-Account-Access-Control")
+	}
+	return &acl, nil
+}
+
+// allows returns whether the account ACL grants any of the groups the
+// request, and whether it makes them the account's owner.
+func (acl *accountACL) allows(r *http.Request, container string, groups []string) (allowed bool, owner bool) {
+	inACL := func(list []string) bool {
+		for _, g := range groups {
+			if common.StringInSlice(g, list) {
+				return true
+			}
+		}
+		return false
+	}
+	if inACL(acl.Admin) {
+		// Admins can do anything but create or delete the account itself.
+		if container != "" || (r.Method != "PUT" && r.Method != "DELETE") {
+			return true, true
+		}
+	}
+	if inACL(acl.ReadWrite) {
+		if container != "" || r.Method == "GET" || r.Method == "HEAD" {
+			return true, false
+		}
+	}
+	if inACL(acl.ReadOnly) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// setAccountACL moves a valid X-Account-Access-Control given to an account PUT
+// or POST into the account's sysmeta, returning false if it's not valid.
+func setAccountACL(writer http.ResponseWriter, request *http.Request) bool {
+	value, ok := request.Header[accountACLHeader]
+	if !ok {
+		if _, ok = request.Header["X-Remove-Account-Access-Control"]; ok {
+			request.Header.Del("X-Remove-Account-Access-Control")
+			request.Header.Set(accountACLSysmeta, "")
+		}
+		return true
+	}
+	request.Header.Del(accountACLHeader)
+	if len(value) == 0 || value[0] == "" {
+		request.Header.Set(accountACLSysmeta, "")
+		return true
+	}
+	acl, err := parseAccountACL(value[0])
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, err.Error())
+		return false
+	}
+	normalized, _ := json.Marshal(acl)
+	request.Header.Set(accountACLSysmeta, string(normalized))
+	return true
+}
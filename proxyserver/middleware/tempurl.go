@@ -17,11 +17,12 @@ package middleware
 
 import (
 	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/hex"
 	"fmt"
+	"hash"
+	"net"
 	"net/http"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -74,24 +75,35 @@ func (w *tuWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
-func checkhmac(key, sig []byte, method, path string, expires time.Time) bool {
+func checkhmac(newHash func() hash.Hash, key, sig []byte, method, path, ipRange string, expires time.Time) bool {
 	if method == "HEAD" {
 		for _, meth := range []string{"HEAD", "GET", "POST", "PUT"} {
-			mac := hmac.New(sha1.New, key)
-			fmt.Fprintf(mac, "%s\n%d\n%s", meth, expires.Unix(), path)
-			if hmac.Equal(sig, mac.Sum(nil)) {
+			if hmac.Equal(sig, common.TempURLHMAC(newHash, key, meth, expires.Unix(), path, ipRange)) {
 				return true
 			}
 		}
 		return false
 	} else {
-		mac := hmac.New(sha1.New, key)
-		fmt.Fprintf(mac, "%s\n%d\n%s", method, expires.Unix(), path)
-		return hmac.Equal(sig, mac.Sum(nil))
+		return hmac.Equal(sig, common.TempURLHMAC(newHash, key, method, expires.Unix(), path, ipRange))
 	}
 }
 
-func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
+// inIPRange returns whether ip is in ipRange, which is either an address or a
+// CIDR network.
+func inIPRange(ip, ipRange string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if strings.Contains(ipRange, "/") {
+		_, network, err := net.ParseCIDR(ipRange)
+		return err == nil && network.Contains(addr)
+	}
+	rangeAddr := net.ParseIP(ipRange)
+	return rangeAddr != nil && rangeAddr.Equal(addr)
+}
+
+func tempurl(allowedDigests map[string]bool, useForwardedFor bool, requestsMetric tally.Counter) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			if request.Method == "OPTIONS" {
@@ -124,12 +136,6 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 				return
 			}
 
-			sigb, err := hex.DecodeString(sig)
-			if err != nil {
-				srv.StandardResponse(writer, 401)
-				return
-			}
-
 			apiReq, account, container, obj := getPathParts(request)
 			if !apiReq || account == "" || container == "" {
 				srv.StandardResponse(writer, 401)
@@ -141,6 +147,19 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 				return
 			}
 
+			digest, sigb, err := common.ParseTempURLSig(sig)
+			if err != nil || !allowedDigests[digest] {
+				srv.StandardResponse(writer, 401)
+				return
+			}
+			newHash := common.TempURLDigests[digest]
+
+			ipRange := q.Get("temp_url_ip_range")
+			if ipRange != "" && !inIPRange(clientIP(request, useForwardedFor), ipRange) {
+				srv.StandardResponse(writer, 401)
+				return
+			}
+
 			path := ""
 			if _, hasPrefix := q["temp_url_prefix"]; hasPrefix {
 				prefix := q.Get("temp_url_prefix")
@@ -155,14 +174,14 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 
 			scope := SCOPE_INVALID
 			if ai, err := ctx.GetAccountInfo(account); err == nil {
-				if key, ok := ai.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
+				if key, ok := ai.Metadata["Temp-Url-Key"]; ok && checkhmac(newHash, []byte(key), sigb, request.Method, path, ipRange, expires) {
 					scope = SCOPE_ACCOUNT
-				} else if key, ok := ai.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
+				} else if key, ok := ai.Metadata["Temp-Url-Key-2"]; ok && checkhmac(newHash, []byte(key), sigb, request.Method, path, ipRange, expires) {
 					scope = SCOPE_ACCOUNT
 				} else if ci, err := ctx.C.GetContainerInfo(account, container); err == nil {
-					if key, ok := ci.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
+					if key, ok := ci.Metadata["Temp-Url-Key"]; ok && checkhmac(newHash, []byte(key), sigb, request.Method, path, ipRange, expires) {
 						scope = SCOPE_CONTAINER
-					} else if key, ok := ci.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
+					} else if key, ok := ci.Metadata["Temp-Url-Key-2"]; ok && checkhmac(newHash, []byte(key), sigb, request.Method, path, ipRange, expires) {
 						scope = SCOPE_CONTAINER
 					}
 				}
@@ -196,12 +215,28 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 }
 
 func NewTempURL(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	allowedDigests := map[string]bool{}
+	var digestNames []string
+	for _, name := range strings.Fields(strings.Replace(config.GetDefault("allowed_digests", "sha1 sha256 sha512"), ",", " ", -1)) {
+		if _, ok := common.TempURLDigests[name]; !ok {
+			return nil, fmt.Errorf("Unknown tempurl digest %q", name)
+		}
+		if !allowedDigests[name] {
+			allowedDigests[name] = true
+			digestNames = append(digestNames, name)
+		}
+	}
+	if len(digestNames) == 0 {
+		return nil, fmt.Errorf("tempurl needs at least one allowed digest")
+	}
+	sort.Strings(digestNames)
 	RegisterInfo("tempurl", map[string]interface{}{
 		"methods":                 []string{"GET", "HEAD", "PUT", "POST", "DELETE"},
 		"incoming_remove_headers": []string{"x-timestamp"},
 		"incoming_allow_headers":  []string{},
+		"allowed_digests":         digestNames,
 		"outgoing_remove_headers": []string{"x-object-meta-*"}, "outgoing_allow_headers": []string{"x-object-meta-public-*"},
 	})
 	requestsMetric := metricsScope.Counter("tempurl_requests")
-	return tempurl(requestsMetric), nil
+	return tempurl(allowedDigests, config.GetBool("use_forwarded_for", false), requestsMetric), nil
 }
@@ -17,7 +17,12 @@ package middleware
 
 import (
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -26,9 +31,12 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/troubling/hummingbird/client"
 	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
 	"go.uber.org/zap"
 )
 
+var testTempURLDigests = map[string]bool{"sha1": true, "sha256": true, "sha512": true}
+
 func TestDispositionFormat(t *testing.T) {
 	require.Equal(t, "inline; filename=\"a.txt\"; filename*=UTF-8''a.txt", dispositionFormat("inline", "a.txt"))
 	require.Equal(t, "attachment; filename=\"%25.txt\"; filename*=UTF-8''%25.txt", dispositionFormat("attachment", "%.txt"))
@@ -51,20 +59,20 @@ func TestCheckHmac(t *testing.T) {
 	// test cases generated by example python code
 	sig, err := hex.DecodeString("6deb0c7da21f396f1368681dc0bd57df0d1c4369")
 	require.Nil(t, err)
-	require.True(t, checkhmac([]byte("mykey"), sig, "GET",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.True(t, checkhmac(sha1.New, []byte("mykey"), sig, "GET",
+		"/v1/AUTH_account/container/object", "", time.Unix(1493709631, 0).In(time.UTC)))
 
 	// sig is actually for a POST, but make sure we can HEAD with it.
 	sig, err = hex.DecodeString("1ad2301fcc4e525ee0167298c0fbb426e90fb3b1")
 	require.Nil(t, err)
-	require.True(t, checkhmac([]byte("mykey"), sig, "HEAD",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.True(t, checkhmac(sha1.New, []byte("mykey"), sig, "HEAD",
+		"/v1/AUTH_account/container/object", "", time.Unix(1493709631, 0).In(time.UTC)))
 
 	// sig is actually for a POST, but make sure we can HEAD with it.
 	sig, err = hex.DecodeString("1111111111111111111111111111111111111111")
 	require.Nil(t, err)
-	require.False(t, checkhmac([]byte("mykey"), sig, "HEAD",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.False(t, checkhmac(sha1.New, []byte("mykey"), sig, "HEAD",
+		"/v1/AUTH_account/container/object", "", time.Unix(1493709631, 0).In(time.UTC)))
 }
 
 func TestTuWriter(t *testing.T) {
@@ -102,7 +110,7 @@ func TestTempurlMiddlewarePassOptions(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -122,7 +130,7 @@ func TestTempurlMiddlewarePassAlreadyAuthorized(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -137,7 +145,7 @@ func TestTempurlMiddlewarePassNoQuery(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -147,7 +155,7 @@ func TestTempurlMiddleware401OnlySig(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -157,7 +165,7 @@ func TestTempurlMiddleware401Expired(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -167,7 +175,7 @@ func TestTempurlMiddleware401BadSig(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -177,7 +185,7 @@ func TestTempurlMiddleware401NoContainer(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -188,7 +196,7 @@ func TestTempurlMiddleware400PuttingManifest(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 400, w.Result().StatusCode)
 }
@@ -206,7 +214,7 @@ func TestTempurlMiddleware401NoKeys(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -224,7 +232,7 @@ func TestTempurlMiddleware401WrongKeys(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -253,7 +261,7 @@ func TestTempurlMiddlewareContainerKey(t *testing.T) {
 		require.True(t, ok)
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
@@ -276,7 +284,7 @@ func TestTempurlMiddlewarePath(t *testing.T) {
 		require.True(t, ok)
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
@@ -306,7 +314,66 @@ func TestTempurlMiddlewareAccountKey(t *testing.T) {
 		require.False(t, ok)
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(testTempURLDigests, false, common.NewTestScope().Counter("test_tempurl"))(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
+
+func tempurlTestStatus(t *testing.T, digests map[string]bool, query string) int {
+	r := httptest.NewRequest("GET", "/v1/a/c/o?"+query, nil)
+	ctx := &ProxyContext{
+		C: client.NewProxyClient(&client.ProxyDirectClient{}, nil, map[string]*client.ContainerInfo{
+			"container/a/c": {Metadata: map[string]string{"Temp-Url-Key": "mykey"}},
+		}, zap.NewNop()),
+		accountInfoCache: map[string]*AccountInfo{"account/a": {Metadata: map[string]string{}}},
+	}
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(200)
+	})
+	tempurl(digests, false, common.NewTestScope().Counter("test_tempurl"))(handler).ServeHTTP(w, r)
+	return w.Result().StatusCode
+}
+
+func TestTempurlMiddlewareDigests(t *testing.T) {
+	sha256Sig := common.TempURLHMAC(sha256.New, []byte("mykey"), "GET", 9999999999, "/v1/a/c/o", "")
+	sha512Sig := common.TempURLHMAC(sha512.New, []byte("mykey"), "GET", 9999999999, "/v1/a/c/o", "")
+	for _, sig := range []string{
+		hex.EncodeToString(sha256Sig),
+		"sha256:" + base64.RawURLEncoding.EncodeToString(sha256Sig),
+		hex.EncodeToString(sha512Sig),
+		"sha512:" + base64.RawURLEncoding.EncodeToString(sha512Sig),
+	} {
+		require.Equal(t, 200, tempurlTestStatus(t, testTempURLDigests, "temp_url_sig="+sig+"&temp_url_expires=9999999999"), sig)
+	}
+	onlySha512 := map[string]bool{"sha512": true}
+	require.Equal(t, 401, tempurlTestStatus(t, onlySha512, "temp_url_sig="+hex.EncodeToString(sha256Sig)+"&temp_url_expires=9999999999"))
+	require.Equal(t, 401, tempurlTestStatus(t, onlySha512, "temp_url_sig=f2d61be897a27c03ac9a0dac3a8c4f6ce3a3d623&temp_url_expires=9999999999"))
+	require.Equal(t, 200, tempurlTestStatus(t, onlySha512, "temp_url_sig="+hex.EncodeToString(sha512Sig)+"&temp_url_expires=9999999999"))
+	// A sha512 signature claiming to be sha256 is the wrong length.
+	require.Equal(t, 401, tempurlTestStatus(t, testTempURLDigests, "temp_url_sig=sha256:"+base64.RawURLEncoding.EncodeToString(sha512Sig)+"&temp_url_expires=9999999999"))
+}
+
+func TestTempurlMiddlewareIPRange(t *testing.T) {
+	// httptest requests come from 192.0.2.1.
+	for ipRange, status := range map[string]int{"192.0.2.0/24": 200, "192.0.2.1": 200, "10.0.0.0/8": 401, "10.0.0.1": 401, "junk": 401} {
+		sig := hex.EncodeToString(common.TempURLHMAC(sha256.New, []byte("mykey"), "GET", 9999999999, "/v1/a/c/o", ipRange))
+		query := fmt.Sprintf("temp_url_sig=%s&temp_url_expires=9999999999&temp_url_ip_range=%s", sig, ipRange)
+		require.Equal(t, status, tempurlTestStatus(t, testTempURLDigests, query), ipRange)
+	}
+	// The range is part of the signature, so it can't be added or changed.
+	sig := hex.EncodeToString(common.TempURLHMAC(sha256.New, []byte("mykey"), "GET", 9999999999, "/v1/a/c/o", ""))
+	require.Equal(t, 401, tempurlTestStatus(t, testTempURLDigests, "temp_url_sig="+sig+"&temp_url_expires=9999999999&temp_url_ip_range=192.0.2.1"))
+	sig = hex.EncodeToString(common.TempURLHMAC(sha256.New, []byte("mykey"), "GET", 9999999999, "/v1/a/c/o", "192.0.2.1"))
+	require.Equal(t, 401, tempurlTestStatus(t, testTempURLDigests, "temp_url_sig="+sig+"&temp_url_expires=9999999999&temp_url_ip_range=192.0.2.0/24"))
+}
+
+func TestNewTempURLDigests(t *testing.T) {
+	_, err := NewTempURL(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	c, err := conf.StringConfig("[filter:tempurl]\nallowed_digests = sha256 md5\n")
+	require.Nil(t, err)
+	_, err = NewTempURL(c.GetSection("filter:tempurl"), common.NewTestScope())
+	require.NotNil(t, err)
+}
@@ -0,0 +1,69 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// VerifyAuditLog checks the hash chain of the proxy audit log files given,
+// oldest first.
+func VerifyAuditLog(flags *flag.FlagSet, cnf srv.ConfigLoader) bool {
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return false
+	}
+	v := &common.AuditVerifier{}
+	if keyFile := flags.Lookup("k").Value.(flag.Getter).Get().(string); keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			fmt.Println("Unable to read key:", err)
+			return false
+		}
+		v.Key = []byte(strings.TrimSpace(string(data)))
+	}
+	first := int64(0)
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Println("Unable to open audit log:", err)
+			return false
+		}
+		err = v.Verify(f)
+		f.Close()
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			return false
+		}
+		if first == 0 && v.Records > 0 {
+			first = v.Seq - v.Records + 1
+		}
+	}
+	if v.Records == 0 {
+		fmt.Println("No records found")
+		return true
+	}
+	fmt.Printf("Verified %d records, %d to %d\n", v.Records, first, v.Seq)
+	fmt.Printf("Last hash: %s\n", v.Prev)
+	return true
+}
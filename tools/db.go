@@ -2,6 +2,7 @@ package tools
 
 import (
 	"database/sql"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
@@ -118,11 +119,35 @@ func newDB(serverconf *conf.Config, memoryDBID string) (*dbInstance, error) {
             state INTEGER NOT NULL      -- 0 = unmounted, 1 = mounted
         );
 
+        -- what the weight ramp of each ring is waiting on
+        CREATE TABLE IF NOT EXISTS ring_ramp (
+            rtype TEXT NOT NULL,                 -- account, container, object
+            policy INTEGER NOT NULL,             -- only used with object
+            changed_date TIMESTAMP DEFAULT 0,    -- last weight step or partition move, 0 = none seen
+            waiting_for TEXT NOT NULL DEFAULT "" -- what the ramp was last logged as waiting for
+        );
+
         CREATE TABLE IF NOT EXISTS ring_log (
             create_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
             rtype TEXT NOT NULL,                -- account, container, object
             policy INTEGER NOT NULL,            -- only used with object
             reason TEXT NOT NULL
+        );
+
+        -- tracks each failed device from its removal until its replacement
+        -- has been ramped back up to full weight
+        CREATE TABLE IF NOT EXISTS device_replacement (
+            create_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            update_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            rtype TEXT NOT NULL,         -- account, container, object
+            policy INTEGER NOT NULL,     -- only used with object
+            ip TEXT NOT NULL,
+            port INTEGER NOT NULL,
+            device TEXT NOT NULL,
+            device_id INTEGER NOT NULL,  -- id in the builder; the failed device's until the replacement is added
+            weight REAL NOT NULL,        -- weight of the failed device, which the replacement is ramped up to
+            dev TEXT NOT NULL,           -- JSON of the failed device's builder entry
+            state TEXT NOT NULL          -- restoring, restored, ramping, complete
         )
     `)
 	if err != nil {
@@ -709,6 +734,69 @@ func (db *dbInstance) addDeviceState(ip string, port int, device string, mounted
 	return err
 }
 
+// setRingChanged records that a ring's weights were stepped or its
+// partitions moved, which the weight ramp waits for the cluster to catch up
+// with.
+func (db *dbInstance) setRingChanged(typ string, policy int, changed time.Time) error {
+	return db.updateRingRamp(typ, policy, "changed_date", changed)
+}
+
+// setRingRampWaitingFor records what a ring's weight ramp was last logged as
+// waiting for.
+func (db *dbInstance) setRingRampWaitingFor(typ string, policy int, waitingFor string) error {
+	return db.updateRingRamp(typ, policy, "waiting_for", waitingFor)
+}
+
+func (db *dbInstance) updateRingRamp(typ string, policy int, column string, value interface{}) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+        UPDATE ring_ramp
+        SET `+column+` = ?
+        WHERE rtype = ?
+          AND policy = ?
+    `, value, typ, policy)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err = tx.Exec(`
+            INSERT INTO ring_ramp
+            (rtype, policy, `+column+`)
+            VALUES (?, ?, ?)
+        `, typ, policy, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ringRamp returns when a ring's weights were last stepped or its partitions
+// moved, zero if never, and what its weight ramp was last logged as waiting
+// for.
+func (db *dbInstance) ringRamp(typ string, policy int) (time.Time, string, error) {
+	var changed time.Time
+	var waitingFor string
+	err := db.db.QueryRow(`
+        SELECT changed_date, waiting_for
+        FROM ring_ramp
+        WHERE rtype = ?
+          AND policy = ?
+    `, typ, policy).Scan(&changed, &waitingFor)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if changed.UnixNano() == 0 {
+		changed = time.Time{}
+	}
+	return changed, waitingFor, err
+}
+
 func (db *dbInstance) addRingLog(typ string, policy int, reason string) error {
 	_, err := db.db.Exec(`
         INSERT INTO ring_log
@@ -717,3 +805,146 @@ func (db *dbInstance) addRingLog(typ string, policy int, reason string) error {
     `, typ, policy, reason)
 	return err
 }
+
+type ringLogEntry struct {
+	Created time.Time `json:"created"`
+	Type    string    `json:"type"`
+	Policy  int       `json:"policy"`
+	Reason  string    `json:"reason"`
+}
+
+// ringLogs returns the most recent ring log entries, newest first. A limit <=
+// 0 returns all entries.
+func (db *dbInstance) ringLogs(limit int) ([]*ringLogEntry, error) {
+	var entries []*ringLogEntry
+	var rows *sql.Rows
+	var err error
+	defer func() {
+		if rows != nil {
+			rows.Close()
+		}
+	}()
+	query := `
+        SELECT create_date, rtype, policy, reason
+        FROM ring_log
+        ORDER BY create_date DESC, rowid DESC
+    `
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	if rows, err = db.db.Query(query); err != nil {
+		return entries, err
+	}
+	for rows.Next() {
+		entry := &ringLogEntry{}
+		if err = rows.Scan(&entry.Created, &entry.Type, &entry.Policy, &entry.Reason); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+type deviceReplacement struct {
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Type     string    `json:"type"`
+	Policy   int       `json:"policy"`
+	Ip       string    `json:"ip"`
+	Port     int       `json:"port"`
+	Device   string    `json:"device"`
+	DeviceID int       `json:"device_id"`
+	Weight   float64   `json:"weight"`
+	Dev      string    `json:"-"`
+	State    string    `json:"state"`
+}
+
+// addDeviceReplacement starts tracking a failed device, replacing any earlier
+// entry for the same device.
+func (db *dbInstance) addDeviceReplacement(dr *deviceReplacement) error {
+	var tx *sql.Tx
+	var err error
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	tx, err = db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`
+        DELETE FROM device_replacement
+        WHERE rtype = ?
+          AND policy = ?
+          AND ip = ?
+          AND port = ?
+          AND device = ?
+    `, dr.Type, dr.Policy, dr.Ip, dr.Port, dr.Device); err != nil {
+		return err
+	}
+	now := time.Now()
+	if _, err = tx.Exec(`
+        INSERT INTO device_replacement
+        (create_date, update_date, rtype, policy, ip, port, device, device_id, weight, dev, state)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, now, now, dr.Type, dr.Policy, dr.Ip, dr.Port, dr.Device, dr.DeviceID, dr.Weight, dr.Dev, dr.State); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	tx = nil
+	dr.Created = now
+	dr.Updated = now
+	return nil
+}
+
+// deviceReplacements returns the tracked device replacements, oldest first.
+func (db *dbInstance) deviceReplacements() ([]*deviceReplacement, error) {
+	var drs []*deviceReplacement
+	var rows *sql.Rows
+	var err error
+	defer func() {
+		if rows != nil {
+			rows.Close()
+		}
+	}()
+	if rows, err = db.db.Query(`
+        SELECT create_date, update_date, rtype, policy, ip, port, device, device_id, weight, dev, state
+        FROM device_replacement
+        ORDER BY create_date
+    `); err != nil {
+		return drs, err
+	}
+	for rows.Next() {
+		dr := &deviceReplacement{}
+		if err = rows.Scan(&dr.Created, &dr.Updated, &dr.Type, &dr.Policy, &dr.Ip, &dr.Port, &dr.Device, &dr.DeviceID, &dr.Weight, &dr.Dev, &dr.State); err != nil {
+			return drs, err
+		}
+		drs = append(drs, dr)
+	}
+	return drs, nil
+}
+
+// updateDeviceReplacement records a new state and device id for the
+// replacement.
+func (db *dbInstance) updateDeviceReplacement(dr *deviceReplacement, state string, deviceID int) error {
+	now := time.Now()
+	_, err := db.db.Exec(`
+        UPDATE device_replacement
+        SET update_date = ?, state = ?, device_id = ?
+        WHERE rtype = ?
+          AND policy = ?
+          AND ip = ?
+          AND port = ?
+          AND device = ?
+    `, now, state, deviceID, dr.Type, dr.Policy, dr.Ip, dr.Port, dr.Device)
+	if err != nil {
+		return err
+	}
+	dr.Updated = now
+	dr.State = state
+	dr.DeviceID = deviceID
+	return nil
+}
@@ -0,0 +1,261 @@
+package tools
+
+// Failed device replacement, driven by the unmounted monitor:
+//
+// restoring: the device was unmounted (or its server down) long enough to be
+//            removed from the builder; the partitions it held are queued for
+//            priority replication from their surviving peers to the devices
+//            that took them over.
+// restored:  those replications have all completed.
+// ramping:   a device was seen mounted again at the same ip:port/device; it
+//            was put back in the builder at weight 0 with the failed device's
+//            weight as its target, and the ring monitor is stepping it up.
+// complete:  the replacement has reached its target weight.
+//
+// Each step is recorded in the ring log, and GET /replacements on andrewd
+// returns the replacements along with the most recent ring log entries.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// getFailedDeviceRestores returns, for each partition the failed device held
+// in oldRing, the device id in newRing that took over that replica. Much like
+// restoredevice, the data is then restored from any surviving peer.
+func getFailedDeviceRestores(oldRing, newRing ring.Ring, failedDeviceID int) map[uint64]int {
+	restores := map[uint64]int{}
+	for partition := uint64(0); true; partition++ {
+		oldDevs := oldRing.GetNodes(partition)
+		newDevs := newRing.GetNodes(partition)
+		if oldDevs == nil || newDevs == nil {
+			break
+		}
+		for replica, dev := range oldDevs {
+			if dev.Id == failedDeviceID && replica < len(newDevs) && newDevs[replica].Id != failedDeviceID {
+				restores[partition] = newDevs[replica].Id
+				break
+			}
+		}
+	}
+	return restores
+}
+
+// failedDeviceReason is the reason the restores of a failed device are queued
+// under, so each device's restores can be told apart from the others'.
+func failedDeviceReason(deviceID int) string {
+	return fmt.Sprintf("failed device id:%d", deviceID)
+}
+
+func replacementKey(ip string, port int, device string) string {
+	return fmt.Sprintf("%s:%d/%s", ip, port, device)
+}
+
+// deviceFailed starts tracking a device that has just been removed from the
+// builder and queues the restore of its partitions.
+func (um *unmountedMonitor) deviceFailed(logger *zap.Logger, typ string, policy int, dev *ring.RingBuilderDevice, weight float64, oldRing, newRing ring.Ring) {
+	devJSON, err := json.Marshal(dev)
+	if err != nil {
+		logger.Error("could not serialize failed device", zap.Error(err))
+		return
+	}
+	restores := getFailedDeviceRestores(oldRing, newRing, int(dev.Id))
+	queued := 0
+	for partition, toDeviceID := range restores {
+		if err := um.aa.db.queuePartitionReplication(typ, policy, partition, failedDeviceReason(int(dev.Id)), -1, toDeviceID); err != nil {
+			logger.Error("could not queue restore of failed device partition", zap.Uint64("partition", partition), zap.Int("to device", toDeviceID), zap.Error(err))
+			continue
+		}
+		queued++
+	}
+	if err := um.aa.db.addDeviceReplacement(&deviceReplacement{
+		Type:     typ,
+		Policy:   policy,
+		Ip:       dev.Ip,
+		Port:     int(dev.Port),
+		Device:   dev.Device,
+		DeviceID: int(dev.Id),
+		Weight:   weight,
+		Dev:      string(devJSON),
+		State:    "restoring",
+	}); err != nil {
+		logger.Error("could not record failed device", zap.Error(err))
+	}
+	um.aa.db.addRingLog(typ, policy, fmt.Sprintf("queued restore of %d partitions from failed device %s id:%d on %s:%d", queued, dev.Device, dev.Id, dev.Ip, dev.Port))
+}
+
+// replacementMounted puts a device back into the builder at weight 0, ramping
+// to the failed device's weight, once a disk is mounted in its place.
+func (um *unmountedMonitor) replacementMounted(logger *zap.Logger, dr *deviceReplacement) {
+	logger = logger.With(zap.String("type", dr.Type), zap.Int("policy", dr.Policy))
+	ringBuilder, ringBuilderFilePath, err := ring.GetRingBuilder(dr.Type, dr.Policy)
+	if err != nil {
+		logger.Error("Could not find builder", zap.Error(err))
+		return
+	}
+	ringBuilderLock, err := ring.LockBuilderPath(ringBuilderFilePath)
+	if err != nil {
+		logger.Error("Could not lock builder path", zap.String("ring builder file path", ringBuilderFilePath), zap.Error(err))
+		return
+	}
+	defer ringBuilderLock.Close()
+	ringBuilder, ringBuilderFilePath, err = ring.GetRingBuilder(dr.Type, dr.Policy)
+	if err != nil {
+		logger.Error("Could not find builder after lock", zap.Error(err))
+		return
+	}
+	id := int64(-1)
+	for _, dev := range ringBuilder.SearchDevs(-1, -1, dr.Ip, int64(dr.Port), "", -1, dr.Device, -1, "", "") {
+		id = dev.Id
+		if dev.Weight < 0 {
+			// The failed device's entry is kept, unless it was purged, so bring it back rather than adding a new one.
+			if err = ringBuilder.SetDevWeight(id, 0); err != nil {
+				logger.Error("Could not bring back failed device", zap.Int64("id", id), zap.Error(err))
+				return
+			}
+		}
+	}
+	if id < 0 {
+		dev := &ring.RingBuilderDevice{}
+		if err = json.Unmarshal([]byte(dr.Dev), dev); err != nil {
+			logger.Error("Could not parse failed device", zap.Error(err))
+			return
+		}
+		dev.Id = -1
+		dev.Weight = 0
+		if id, err = ringBuilder.AddDev(dev); err != nil {
+			logger.Error("Could not add replacement device", zap.Error(err))
+			return
+		}
+	}
+	if err = ringBuilder.SetDevTargetWeight(id, dr.Weight, dr.Weight*um.replacementWeightStep/100); err != nil {
+		logger.Error("Could not set target weight of replacement device", zap.Int64("id", id), zap.Error(err))
+		return
+	}
+	if err = ringBuilder.Save(ringBuilderFilePath); err != nil {
+		logger.Error("Error while saving builder", zap.String("path", ringBuilderFilePath), zap.Error(err))
+		return
+	}
+	// Rebalancing writes out a ring with the new device, which gets the ring monitor scheduling the rebalances that ramp it up.
+	if _, _, _, err = ring.Rebalance(ringBuilderFilePath, false, false, true); err != nil {
+		logger.Error("Error while rebalancing", zap.String("path", ringBuilderFilePath), zap.Error(err))
+	}
+	if err = um.aa.db.updateDeviceReplacement(dr, "ramping", int(id)); err != nil {
+		logger.Error("could not update device replacement", zap.Error(err))
+	}
+	um.aa.db.addRingLog(dr.Type, dr.Policy, fmt.Sprintf("replacement device %s id:%d on %s:%d added at weight 0, ramping to %v", dr.Device, id, dr.Ip, dr.Port, dr.Weight))
+}
+
+// advanceReplacements moves replacements along once their restores have
+// completed or their ramps have finished.
+func (um *unmountedMonitor) advanceReplacements(logger *zap.Logger) {
+	drs, err := um.aa.db.deviceReplacements()
+	if err != nil {
+		logger.Error("could not retrieve device replacements", zap.Error(err))
+		return
+	}
+	builders := map[string]*ring.RingBuilder{}
+	for _, dr := range drs {
+		switch dr.State {
+		case "restoring":
+			qrs, err := um.aa.db.queuedReplications(dr.Type, dr.Policy, failedDeviceReason(dr.DeviceID))
+			if err != nil {
+				logger.Error("queuedReplications", zap.Error(err))
+				continue
+			}
+			if len(qrs) > 0 {
+				continue
+			}
+			if err = um.aa.db.updateDeviceReplacement(dr, "restored", dr.DeviceID); err != nil {
+				logger.Error("could not update device replacement", zap.Error(err))
+				continue
+			}
+			um.aa.db.addRingLog(dr.Type, dr.Policy, fmt.Sprintf("restored partitions of failed device %s id:%d on %s:%d", dr.Device, dr.DeviceID, dr.Ip, dr.Port))
+		case "ramping":
+			key := fmt.Sprintf("%s-%d", dr.Type, dr.Policy)
+			ringBuilder, ok := builders[key]
+			if !ok {
+				if ringBuilder, _, err = ring.GetRingBuilder(dr.Type, dr.Policy); err != nil {
+					logger.Error("Could not find builder", zap.String("type", dr.Type), zap.Int("policy", dr.Policy), zap.Error(err))
+					continue
+				}
+				builders[key] = ringBuilder
+			}
+			var dev *ring.RingBuilderDevice
+			if dr.DeviceID < len(ringBuilder.Devs) {
+				dev = ringBuilder.Devs[dr.DeviceID]
+			}
+			var reason string
+			if dev == nil || dev.Weight < 0 {
+				reason = fmt.Sprintf("replacement device %s id:%d on %s:%d was removed before reaching its target weight", dr.Device, dr.DeviceID, dr.Ip, dr.Port)
+			} else if dev.WeightStep == 0 {
+				reason = fmt.Sprintf("replacement device %s id:%d on %s:%d ramped to weight %v", dr.Device, dr.DeviceID, dr.Ip, dr.Port, dev.Weight)
+			} else {
+				continue
+			}
+			if err = um.aa.db.updateDeviceReplacement(dr, "complete", dr.DeviceID); err != nil {
+				logger.Error("could not update device replacement", zap.Error(err))
+				continue
+			}
+			um.aa.db.addRingLog(dr.Type, dr.Policy, reason)
+		}
+	}
+}
+
+// pendingReplacements returns the replacements still waiting for a disk to be
+// mounted, by ip:port/device.
+func (um *unmountedMonitor) pendingReplacements() (map[string][]*deviceReplacement, error) {
+	drs, err := um.aa.db.deviceReplacements()
+	if err != nil {
+		return nil, err
+	}
+	pending := map[string][]*deviceReplacement{}
+	for _, dr := range drs {
+		if dr.State == "restoring" || dr.State == "restored" {
+			key := replacementKey(dr.Ip, dr.Port, dr.Device)
+			pending[key] = append(pending[key], dr)
+		}
+	}
+	return pending, nil
+}
+
+// ReplacementsHandler reports the device replacements andrewd is tracking
+// along with the most recent ring log entries; ?limit= sets how many log
+// entries, 100 by default.
+func (server *AutoAdmin) ReplacementsHandler(writer http.ResponseWriter, request *http.Request) {
+	limit := 100
+	if l, err := strconv.Atoi(request.URL.Query().Get("limit")); err == nil {
+		limit = l
+	}
+	drs, err := server.db.deviceReplacements()
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	logs, err := server.db.ringLogs(limit)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	if drs == nil {
+		drs = []*deviceReplacement{}
+	}
+	if logs == nil {
+		logs = []*ringLogEntry{}
+	}
+	body, err := json.Marshal(map[string]interface{}{"replacements": drs, "ring_log": logs})
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(body)
+}
@@ -0,0 +1,108 @@
+package tools
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"go.uber.org/zap"
+)
+
+func TestGetFailedDeviceRestores(t *testing.T) {
+	builder, err := ring.NewRingBuilder(6, 3, 1, false)
+	require.Nil(t, err)
+	for z := 0; z < 4; z++ {
+		_, err := builder.AddDev(&ring.RingBuilderDevice{Id: -1, Region: 1, Zone: int64(z), Ip: fmt.Sprintf("127.0.0.%d", z+1), Port: 6000, Device: "sda", Weight: 100, Scheme: "http"})
+		require.Nil(t, err)
+	}
+	_, _, _, err = builder.Rebalance()
+	require.Nil(t, err)
+	oldRing := builder.GetRing()
+	builder.RemoveDev(2, false)
+	_, _, _, err = builder.Rebalance()
+	require.Nil(t, err)
+	newRing := builder.GetRing()
+
+	restores := getFailedDeviceRestores(oldRing, newRing, 2)
+	held := 0
+	for partition := uint64(0); partition < oldRing.PartitionCount(); partition++ {
+		for replica, dev := range oldRing.GetNodes(partition) {
+			if dev.Id != 2 {
+				continue
+			}
+			held++
+			toID, ok := restores[partition]
+			require.True(t, ok)
+			require.Equal(t, newRing.GetNodes(partition)[replica].Id, toID)
+			require.NotEqual(t, 2, toID)
+		}
+	}
+	require.True(t, held > 0)
+	require.Equal(t, held, len(restores))
+}
+
+func TestDeviceReplacements(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestDeviceReplacements"))
+	require.Nil(t, err)
+	dr := &deviceReplacement{Type: "object", Policy: 0, Ip: "127.0.0.1", Port: 6000, Device: "sda", DeviceID: 3, Weight: 100, Dev: "{}", State: "restoring"}
+	require.Nil(t, db.addDeviceReplacement(dr))
+	drs, err := db.deviceReplacements()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(drs))
+	require.Equal(t, "restoring", drs[0].State)
+	require.Equal(t, 3, drs[0].DeviceID)
+	require.Equal(t, float64(100), drs[0].Weight)
+
+	require.Nil(t, db.updateDeviceReplacement(drs[0], "ramping", 7))
+	drs, err = db.deviceReplacements()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(drs))
+	require.Equal(t, "ramping", drs[0].State)
+	require.Equal(t, 7, drs[0].DeviceID)
+
+	// the same device failing again replaces the earlier entry.
+	require.Nil(t, db.addDeviceReplacement(dr))
+	drs, err = db.deviceReplacements()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(drs))
+	require.Equal(t, "restoring", drs[0].State)
+
+	require.Nil(t, db.addRingLog("object", 0, "first"))
+	require.Nil(t, db.addRingLog("object", 0, "second"))
+	logs, err := db.ringLogs(1)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(logs))
+	require.Equal(t, "second", logs[0].Reason)
+}
+
+func TestAdvanceReplacementsRestored(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestAdvanceReplacementsRestored"))
+	require.Nil(t, err)
+	um := &unmountedMonitor{aa: &AutoAdmin{logger: zap.NewNop(), db: db}}
+	for _, id := range []int{3, 5} {
+		require.Nil(t, db.addDeviceReplacement(&deviceReplacement{Type: "object", Policy: 0, Ip: "127.0.0.1", Port: 6000, Device: fmt.Sprintf("sd%d", id), DeviceID: id, Weight: 100, Dev: "{}", State: "restoring"}))
+	}
+	require.Nil(t, db.queuePartitionReplication("object", 0, 1, failedDeviceReason(5), -1, 2))
+
+	// Only the device whose restores have all completed is restored.
+	um.advanceReplacements(zap.NewNop())
+	drs, err := db.deviceReplacements()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(drs))
+	states := map[int]string{}
+	for _, dr := range drs {
+		states[dr.DeviceID] = dr.State
+	}
+	require.Equal(t, map[int]string{3: "restored", 5: "restoring"}, states)
+
+	qrs, err := db.queuedReplications("object", 0, "")
+	require.Nil(t, err)
+	require.Nil(t, db.clearQueuedReplication(qrs[0]))
+	um.advanceReplacements(zap.NewNop())
+	drs, err = db.deviceReplacements()
+	require.Nil(t, err)
+	for _, dr := range drs {
+		require.Equal(t, "restored", dr.State)
+	}
+}
@@ -0,0 +1,371 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/containerserver"
+	"go.uber.org/zap"
+)
+
+// These are the sysmeta headers the symlink middleware keeps a link's target
+// in; transitioned objects are replaced with static links to their copies.
+const (
+	lifecycleSymlinkTarget        = "X-Object-Sysmeta-Symlink-Target"
+	lifecycleSymlinkTargetAccount = "X-Object-Sysmeta-Symlink-Target-Account"
+	lifecycleSymlinkTargetEtag    = "X-Object-Sysmeta-Symlink-Target-Etag"
+	lifecycleSymlinkTargetBytes   = "X-Object-Sysmeta-Symlink-Target-Bytes"
+)
+
+// lifecycle applies the lifecycle rules containers have been given through
+// the proxy, expiring objects and moving them to other storage policies.
+type lifecycle struct {
+	aa       *AutoAdmin
+	interval time.Duration
+}
+
+// lifecycleContainer is a container being walked, with what's needed to
+// apply its rules.
+type lifecycleContainer struct {
+	account   string
+	container string
+	policy    int
+	readACL   string
+	rules     []common.LifecycleRule
+	// targets are the transition containers known to exist.
+	targets map[string]bool
+	// expired and transitioned count the objects changed this pass.
+	expired      int
+	transitioned int
+}
+
+func newLifecycle(aa *AutoAdmin) *lifecycle {
+	l := &lifecycle{
+		aa:       aa,
+		interval: time.Duration(aa.serverconf.GetInt("lifecycle", "interval", 3600)) * time.Second,
+	}
+	if l.interval < time.Second {
+		l.interval = time.Second
+	}
+	return l
+}
+
+func (l *lifecycle) runForever() {
+	for {
+		sleepFor := l.runOnce()
+		if sleepFor < 0 {
+			break
+		}
+		time.Sleep(sleepFor)
+	}
+}
+
+func (l *lifecycle) runOnce() time.Duration {
+	start := time.Now()
+	logger := l.aa.logger.With(zap.String("process", "lifecycle"))
+	logger.Debug("starting pass")
+	if err := l.aa.db.startProcessPass("lifecycle", "", 0); err != nil {
+		logger.Error("startProcessPass", zap.Error(err))
+	}
+	var containers, expired, transitioned, errors int
+	marker := ""
+	for {
+		records, err := listObjects(l.aa.hClient, common.LifecycleAccount, common.LifecycleContainer, map[string]string{"marker": marker})
+		if err != nil {
+			logger.Error("listing containers", zap.Error(err))
+			errors++
+			break
+		}
+		for _, record := range records {
+			lc, err := l.walk(record.Name, start)
+			if lc != nil {
+				containers++
+				expired += lc.expired
+				transitioned += lc.transitioned
+			}
+			if err != nil {
+				logger.Error("applying lifecycle rules", zap.String("record", record.Name), zap.Error(err))
+				errors++
+			}
+		}
+		if len(records) < common.CONTAINER_LISTING_LIMIT {
+			break
+		}
+		marker = records[len(records)-1].Name
+	}
+	if err := l.aa.db.progressProcessPass("lifecycle", "", 0, fmt.Sprintf("%d containers, %d objects expired, %d objects transitioned, %d errors", containers, expired, transitioned, errors)); err != nil {
+		logger.Error("progressProcessPass", zap.Error(err))
+	}
+	if err := l.aa.db.completeProcessPass("lifecycle", "", 0); err != nil {
+		logger.Error("completeProcessPass", zap.Error(err))
+	}
+	sleepFor := time.Until(start.Add(l.interval))
+	if sleepFor < 0 {
+		sleepFor = 0
+	}
+	logger.Debug("pass complete", zap.Int("containers", containers), zap.Int("expired", expired), zap.Int("transitioned", transitioned), zap.Int("errors", errors), zap.String("sleep for", sleepFor.String()))
+	return sleepFor
+}
+
+// walk applies a container's rules to each of its objects. The record is
+// removed once the container is gone or has no rules.
+func (l *lifecycle) walk(record string, now time.Time) (*lifecycleContainer, error) {
+	account, container, err := common.ParseLifecycleRecord(record)
+	if err != nil {
+		return nil, deleteObject(l.aa.hClient, common.LifecycleAccount, common.LifecycleContainer, record)
+	}
+	resp := l.aa.hClient.HeadContainer(account, container, http.Header{})
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || (resp.StatusCode/100 == 2 && resp.Header.Get(common.LifecycleSysmeta) == "") {
+		return nil, deleteObject(l.aa.hClient, common.LifecycleAccount, common.LifecycleContainer, record)
+	} else if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("HEAD %s/%s: %d", account, container, resp.StatusCode)
+	}
+	rules, err := common.ParseLifecycleRules(resp.Header.Get(common.LifecycleSysmeta))
+	if err != nil {
+		return nil, err
+	}
+	policy, err := strconv.Atoi(resp.Header.Get("X-Backend-Storage-Policy-Index"))
+	if err != nil {
+		return nil, fmt.Errorf("HEAD %s/%s: invalid X-Backend-Storage-Policy-Index %q", account, container, resp.Header.Get("X-Backend-Storage-Policy-Index"))
+	}
+	lc := &lifecycleContainer{account: account, container: container, policy: policy, readACL: resp.Header.Get("X-Container-Read"), rules: rules, targets: map[string]bool{}}
+	// Links to the container's own transition containers are objects that
+	// have been moved, which may still expire.
+	transitioned := "/v1/" + common.Urlencode(account) + "/" + common.Urlencode("."+container+"+policy")
+	marker := ""
+	var errs []string
+	for {
+		objects, err := listObjects(l.aa.hClient, account, container, map[string]string{"marker": marker})
+		if err != nil {
+			return lc, err
+		}
+		for _, obj := range objects {
+			if obj.SymlinkPath != "" && !strings.HasPrefix(obj.SymlinkPath, transitioned) {
+				continue
+			}
+			if err := l.apply(lc, obj, obj.SymlinkPath != "", now); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if len(objects) < common.CONTAINER_LISTING_LIMIT {
+			break
+		}
+		marker = objects[len(objects)-1].Name
+	}
+	for _, rule := range rules {
+		if p := l.aa.policies.NameLookup(rule.StoragePolicy); p != nil && p.Index != policy {
+			if err := l.sweep(lc, common.LifecycleTransitionContainer(container, p.Index)); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return lc, fmt.Errorf("%d errors in %s/%s, the first: %s", len(errs), account, container, errs[0])
+	}
+	return lc, nil
+}
+
+// apply expires or transitions the object if one of the container's rules
+// says it's time.
+func (l *lifecycle) apply(lc *lifecycleContainer, obj containerserver.ObjectListingRecord, moved bool, now time.Time) error {
+	lastModified, err := time.ParseInLocation("2006-01-02T15:04:05.000000", obj.LastModified, common.GMT)
+	if err != nil {
+		return fmt.Errorf("%s: invalid last_modified %q", obj.Name, obj.LastModified)
+	}
+	var expireAt time.Time
+	var transition *common.LifecycleRule
+	for i, rule := range lc.rules {
+		if !rule.Matches(obj.Name) {
+			continue
+		}
+		if at := rule.ExpiresAt(lastModified); !at.IsZero() && (expireAt.IsZero() || at.Before(expireAt)) {
+			expireAt = at
+		}
+		if at := rule.TransitionsAt(lastModified); transition == nil && !at.IsZero() && !at.After(now) {
+			transition = &lc.rules[i]
+		}
+	}
+	// Objects due to expire before the next pass are given an X-Delete-At, so
+	// the object servers stop serving them on time.
+	if !expireAt.IsZero() && expireAt.Before(now.Add(l.interval)) {
+		return l.expire(lc, obj.Name, expireAt)
+	}
+	if transition != nil && !moved {
+		return l.transition(lc, obj.Name, transition)
+	}
+	return nil
+}
+
+func (l *lifecycle) expire(lc *lifecycleContainer, name string, at time.Time) error {
+	resp := l.aa.hClient.HeadObject(lc.account, lc.container, name, http.Header{})
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	} else if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HEAD %s/%s/%s: %d", lc.account, lc.container, name, resp.StatusCode)
+	}
+	// The object servers won't take an X-Delete-At in the past.
+	if soon := time.Now().Add(time.Minute); at.Before(soon) {
+		at = soon
+	}
+	if deleteAt, err := common.ParseDate(resp.Header.Get("X-Delete-At")); err == nil && !deleteAt.After(at) {
+		return nil
+	}
+	// A POST replaces the object's metadata, so it has to be sent again.
+	header := lifecycleMetadata(resp.Header)
+	header.Set("X-Delete-At", strconv.FormatInt(at.Unix(), 10))
+	header.Set("X-Timestamp", common.GetTimestamp())
+	resp = l.aa.hClient.PostObject(lc.account, lc.container, name, header)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("POST %s/%s/%s: %d", lc.account, lc.container, name, resp.StatusCode)
+	}
+	lc.expired++
+	return nil
+}
+
+// transition copies the object to a container in the rule's storage policy
+// and replaces it with a static link to the copy.
+func (l *lifecycle) transition(lc *lifecycleContainer, name string, rule *common.LifecycleRule) error {
+	policy := l.aa.policies.NameLookup(rule.StoragePolicy)
+	if policy == nil {
+		return fmt.Errorf("unknown storage policy %q", rule.StoragePolicy)
+	} else if policy.Index == lc.policy {
+		return nil
+	}
+	target := common.LifecycleTransitionContainer(lc.container, policy.Index)
+	if !lc.targets[target] {
+		resp := l.aa.hClient.PutContainer(lc.account, target, common.Map2Headers(map[string]string{
+			"X-Storage-Policy": policy.Name,
+			"X-Container-Read": lc.readACL,
+			"X-Timestamp":      common.GetTimestamp(),
+		}))
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("PUT %s/%s: %d", lc.account, target, resp.StatusCode)
+		}
+		lc.targets[target] = true
+	}
+	resp := l.aa.hClient.GetObject(lc.account, lc.container, name, http.Header{})
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	} else if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("GET %s/%s/%s: %d", lc.account, lc.container, name, resp.StatusCode)
+	}
+	// Large object manifests and links are left alone.
+	if resp.Header.Get("X-Static-Large-Object") != "" || resp.Header.Get("X-Object-Manifest") != "" || resp.Header.Get(lifecycleSymlinkTarget) != "" {
+		return nil
+	}
+	timestamp, err := strconv.ParseFloat(resp.Header.Get("X-Timestamp"), 64)
+	if err != nil {
+		return fmt.Errorf("GET %s/%s/%s: invalid X-Timestamp %q", lc.account, lc.container, name, resp.Header.Get("X-Timestamp"))
+	}
+	etag := strings.Trim(resp.Header.Get("Etag"), "\"")
+	contentType := resp.Header.Get("Content-Type")
+	header := lifecycleMetadata(resp.Header)
+	header.Set("Content-Length", resp.Header.Get("Content-Length"))
+	header.Set("Content-Type", contentType)
+	header.Set("Etag", etag)
+	header.Set("X-Timestamp", resp.Header.Get("X-Timestamp"))
+	putResp := l.aa.hClient.PutObject(lc.account, target, name, header, resp.Body)
+	putResp.Body.Close()
+	if putResp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s/%s/%s: %d", lc.account, target, name, putResp.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	params["symlink_target"] = common.Urlencode(target + "/" + name)
+	params["symlink_target_account"] = common.Urlencode(lc.account)
+	params["symlink_target_etag"] = etag
+	params["symlink_target_bytes"] = resp.Header.Get("Content-Length")
+	header = lifecycleMetadata(resp.Header)
+	header.Set("Content-Length", "0")
+	header.Set("Content-Type", contentType)
+	header.Set(lifecycleSymlinkTarget, params["symlink_target"])
+	header.Set(lifecycleSymlinkTargetAccount, params["symlink_target_account"])
+	header.Set(lifecycleSymlinkTargetEtag, etag)
+	header.Set(lifecycleSymlinkTargetBytes, params["symlink_target_bytes"])
+	header.Set("X-Object-Sysmeta-Container-Update-Override-Content-Type", mime.FormatMediaType(mediaType, params))
+	// The link is timestamped just after the object it replaces, so that it
+	// loses to anything written since the object was copied.
+	header.Set("X-Timestamp", common.CanonicalTimestamp(timestamp+0.00001))
+	linkResp := l.aa.hClient.PutObject(lc.account, lc.container, name, header, bytes.NewReader(nil))
+	linkResp.Body.Close()
+	if linkResp.StatusCode/100 != 2 {
+		// Most likely the object was overwritten; either way the copy isn't
+		// needed.
+		if err := deleteObject(l.aa.hClient, lc.account, target, name); err != nil {
+			return err
+		}
+		if linkResp.StatusCode == http.StatusConflict {
+			return nil
+		}
+		return fmt.Errorf("PUT %s/%s/%s: %d", lc.account, lc.container, name, linkResp.StatusCode)
+	}
+	lc.transitioned++
+	return nil
+}
+
+// sweep deletes the copies in a transition container that are no longer
+// linked to, because the link expired or the object was overwritten.
+func (l *lifecycle) sweep(lc *lifecycleContainer, target string) error {
+	marker := ""
+	for {
+		copies, err := listObjects(l.aa.hClient, lc.account, target, map[string]string{"marker": marker})
+		if err != nil {
+			return err
+		}
+		for _, c := range copies {
+			resp := l.aa.hClient.HeadObject(lc.account, lc.container, c.Name, http.Header{})
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 && resp.Header.Get(lifecycleSymlinkTarget) == common.Urlencode(target+"/"+c.Name) {
+				continue
+			} else if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+				return fmt.Errorf("HEAD %s/%s/%s: %d", lc.account, lc.container, c.Name, resp.StatusCode)
+			}
+			if err := deleteObject(l.aa.hClient, lc.account, target, c.Name); err != nil {
+				return err
+			}
+		}
+		if len(copies) < common.CONTAINER_LISTING_LIMIT {
+			return nil
+		}
+		marker = copies[len(copies)-1].Name
+	}
+}
+
+// lifecycleMetadata returns the user metadata of an object.
+func lifecycleMetadata(objHeader http.Header) http.Header {
+	header := http.Header{}
+	for k := range objHeader {
+		if strings.HasPrefix(k, "X-Object-Meta-") || k == "Content-Disposition" || k == "Content-Encoding" {
+			header.Set(k, objHeader.Get(k))
+		}
+	}
+	return header
+}
@@ -0,0 +1,218 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/containerserver"
+	"github.com/troubling/nectar/nectarutil"
+	"go.uber.org/zap"
+)
+
+type testLifecycleObject struct {
+	header http.Header
+	body   string
+}
+
+// testLifecycleClient is an in memory cluster, just enough of one for the
+// lifecycle job.
+type testLifecycleClient struct {
+	testDispersionClient
+	policies   conf.PolicyList
+	containers map[string]http.Header
+	objects    map[string]*testLifecycleObject
+}
+
+func newTestLifecycleClient(policies conf.PolicyList) *testLifecycleClient {
+	return &testLifecycleClient{policies: policies, containers: map[string]http.Header{}, objects: map[string]*testLifecycleObject{}}
+}
+
+func (c *testLifecycleClient) put(path string, lastModified time.Time, body string, header map[string]string) {
+	h := common.Map2Headers(header)
+	h.Set("X-Timestamp", common.CanonicalTimestampFromTime(lastModified))
+	h.Set("Etag", fmt.Sprintf("etag-%s", body))
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	c.objects[path] = &testLifecycleObject{header: h, body: body}
+}
+
+func (c *testLifecycleClient) PutContainer(account string, container string, headers http.Header) *http.Response {
+	h := http.Header{"X-Backend-Storage-Policy-Index": {"0"}}
+	if policy := c.policies.NameLookup(headers.Get("X-Storage-Policy")); policy != nil {
+		h.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(policy.Index))
+	}
+	h.Set("X-Container-Read", headers.Get("X-Container-Read"))
+	c.containers[account+"/"+container] = h
+	return nectarutil.ResponseStub(201, "")
+}
+
+func (c *testLifecycleClient) HeadContainer(account string, container string, headers http.Header) *http.Response {
+	h, ok := c.containers[account+"/"+container]
+	if !ok {
+		return nectarutil.ResponseStub(404, "")
+	}
+	resp := nectarutil.ResponseStub(204, "")
+	resp.Header = h
+	return resp
+}
+
+func (c *testLifecycleClient) GetContainer(account string, container string, options map[string]string, headers http.Header) *http.Response {
+	if _, ok := c.containers[account+"/"+container]; !ok {
+		return nectarutil.ResponseStub(404, "")
+	}
+	prefix := account + "/" + container + "/"
+	olrs := []containerserver.ObjectListingRecord{}
+	for path, obj := range c.objects {
+		if !strings.HasPrefix(path, prefix) || path[len(prefix):] <= options["marker"] {
+			continue
+		}
+		lastModified, _ := common.ParseDate(obj.header.Get("X-Timestamp"))
+		olr := containerserver.ObjectListingRecord{Name: path[len(prefix):], LastModified: lastModified.Format("2006-01-02T15:04:05.000000")}
+		if target := obj.header.Get(lifecycleSymlinkTarget); target != "" {
+			olr.SymlinkPath = "/v1/" + obj.header.Get(lifecycleSymlinkTargetAccount) + "/" + target
+		}
+		olrs = append(olrs, olr)
+	}
+	sort.Slice(olrs, func(i, j int) bool { return olrs[i].Name < olrs[j].Name })
+	out, _ := json.Marshal(olrs)
+	return nectarutil.ResponseStub(200, string(out))
+}
+
+func (c *testLifecycleClient) PutObject(account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	path := account + "/" + container + "/" + obj
+	if existing := c.objects[path]; existing != nil && existing.header.Get("X-Timestamp") >= headers.Get("X-Timestamp") {
+		return nectarutil.ResponseStub(409, "")
+	}
+	body, _ := ioutil.ReadAll(src)
+	h := http.Header{}
+	for k := range headers {
+		h.Set(k, headers.Get(k))
+	}
+	c.objects[path] = &testLifecycleObject{header: h, body: string(body)}
+	return nectarutil.ResponseStub(201, "")
+}
+
+func (c *testLifecycleClient) PostObject(account string, container string, obj string, headers http.Header) *http.Response {
+	existing := c.objects[account+"/"+container+"/"+obj]
+	if existing == nil {
+		return nectarutil.ResponseStub(404, "")
+	}
+	for k := range existing.header {
+		if strings.HasPrefix(k, "X-Object-Meta-") {
+			existing.header.Del(k)
+		}
+	}
+	for k := range headers {
+		existing.header.Set(k, headers.Get(k))
+	}
+	return nectarutil.ResponseStub(202, "")
+}
+
+func (c *testLifecycleClient) GetObject(account string, container string, obj string, headers http.Header) *http.Response {
+	existing := c.objects[account+"/"+container+"/"+obj]
+	if existing == nil {
+		return nectarutil.ResponseStub(404, "")
+	}
+	resp := nectarutil.ResponseStub(200, existing.body)
+	for k := range existing.header {
+		resp.Header.Set(k, existing.header.Get(k))
+	}
+	return resp
+}
+
+func (c *testLifecycleClient) HeadObject(account string, container string, obj string, headers http.Header) *http.Response {
+	resp := c.GetObject(account, container, obj, headers)
+	resp.Body = ioutil.NopCloser(strings.NewReader(""))
+	return resp
+}
+
+func (c *testLifecycleClient) DeleteObject(account string, container string, obj string, headers http.Header) *http.Response {
+	path := account + "/" + container + "/" + obj
+	if c.objects[path] == nil {
+		return nectarutil.ResponseStub(404, "")
+	}
+	delete(c.objects, path)
+	return nectarutil.ResponseStub(204, "")
+}
+
+func TestLifecycle(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestLifecycle"))
+	require.Nil(t, err)
+	policies := conf.PolicyList{0: {Index: 0, Name: "gold"}, 1: {Index: 1, Name: "ec"}}
+	c := newTestLifecycleClient(policies)
+	c.PutContainer("a", "c", common.Map2Headers(map[string]string{"X-Container-Read": ".r:*"}))
+	c.containers["a/c"].Set(common.LifecycleSysmeta, `[{"prefix": "logs/", "expire_after_days": 30}, {"prefix": "big/", "transition_after_days": 7, "expire_after_days": 60, "storage_policy": "ec"}]`)
+	c.put(common.LifecycleAccount+"/"+common.LifecycleContainer+"/"+common.LifecycleRecord("a", "c"), time.Now(), "", nil)
+	c.put(common.LifecycleAccount+"/"+common.LifecycleContainer+"/"+common.LifecycleRecord("a", "gone"), time.Now(), "", nil)
+	c.containers[common.LifecycleAccount+"/"+common.LifecycleContainer] = http.Header{}
+	day := 24 * time.Hour
+	now := time.Now()
+	c.put("a/c/logs/old", now.Add(-40*day), "old log", map[string]string{"X-Object-Meta-Color": "blue"})
+	c.put("a/c/logs/new", now.Add(-day), "new log", nil)
+	c.put("a/c/big/old", now.Add(-10*day), "big old", map[string]string{"Content-Type": "text/plain", "X-Object-Meta-Color": "red"})
+	c.put("a/c/big/new", now.Add(-day), "big new", nil)
+	c.put("a/c/big/ancient", now.Add(-70*day), "big ancient", nil)
+	c.put("a/c/other", now.Add(-100*day), "other", nil)
+
+	l := newLifecycle(&AutoAdmin{logger: zap.NewNop(), hClient: c, policies: policies, db: db})
+	require.True(t, l.runOnce() > 0)
+
+	// The record for the missing container is cleaned up.
+	require.Nil(t, c.objects[common.LifecycleAccount+"/"+common.LifecycleContainer+"/a/gone"])
+	require.NotNil(t, c.objects[common.LifecycleAccount+"/"+common.LifecycleContainer+"/a/c"])
+
+	// Expirations.
+	deleteAt, err := strconv.ParseInt(c.objects["a/c/logs/old"].header.Get("X-Delete-At"), 10, 64)
+	require.Nil(t, err)
+	require.True(t, deleteAt > now.Unix())
+	require.Equal(t, "blue", c.objects["a/c/logs/old"].header.Get("X-Object-Meta-Color"))
+	require.NotEqual(t, "", c.objects["a/c/big/ancient"].header.Get("X-Delete-At"))
+	require.Nil(t, c.objects["a/.c+policy1/big/ancient"])
+	for _, path := range []string{"a/c/logs/new", "a/c/big/new", "a/c/other"} {
+		require.Equal(t, "", c.objects[path].header.Get("X-Delete-At"), path)
+		require.Equal(t, "", c.objects[path].header.Get(lifecycleSymlinkTarget), path)
+	}
+
+	// The transition.
+	require.Equal(t, "1", c.containers["a/.c+policy1"].Get("X-Backend-Storage-Policy-Index"))
+	require.Equal(t, ".r:*", c.containers["a/.c+policy1"].Get("X-Container-Read"))
+	moved := c.objects["a/.c+policy1/big/old"]
+	require.NotNil(t, moved)
+	require.Equal(t, "big old", moved.body)
+	require.Equal(t, "red", moved.header.Get("X-Object-Meta-Color"))
+	link := c.objects["a/c/big/old"]
+	require.Equal(t, "", link.body)
+	require.Equal(t, ".c%2Bpolicy1/big/old", link.header.Get(lifecycleSymlinkTarget))
+	require.Equal(t, "a", link.header.Get(lifecycleSymlinkTargetAccount))
+	require.Equal(t, "etag-big old", link.header.Get(lifecycleSymlinkTargetEtag))
+	require.Equal(t, "7", link.header.Get(lifecycleSymlinkTargetBytes))
+	require.Equal(t, "text/plain", link.header.Get("Content-Type"))
+	require.Equal(t, "red", link.header.Get("X-Object-Meta-Color"))
+	require.True(t, link.header.Get("X-Timestamp") > moved.header.Get("X-Timestamp"))
+
+	// Nothing changes on a second pass.
+	l.runOnce()
+	require.Equal(t, "big old", c.objects["a/.c+policy1/big/old"].body)
+	require.Equal(t, ".c%2Bpolicy1/big/old", c.objects["a/c/big/old"].header.Get(lifecycleSymlinkTarget))
+
+	// Once the link is overwritten, the copy is swept up.
+	c.put("a/c/big/old", now, "newer", nil)
+	l.runOnce()
+	require.Nil(t, c.objects["a/.c+policy1/big/old"])
+	require.Equal(t, "newer", c.objects["a/c/big/old"].body)
+
+	// Without rules the container is forgotten.
+	c.containers["a/c"].Del(common.LifecycleSysmeta)
+	l.runOnce()
+	require.Nil(t, c.objects[common.LifecycleAccount+"/"+common.LifecycleContainer+"/a/c"])
+}
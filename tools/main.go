@@ -601,6 +601,7 @@ func (server *AutoAdmin) GetHandler(config conf.Config, metricsPrefix string) ht
 	router.Get("/loglevel", server.logLevel)
 	router.Put("/loglevel", server.logLevel)
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
+	router.Get("/replacements", commonHandlers.ThenFunc(server.ReplacementsHandler))
 	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
 	return alice.New(middleware.Metrics(metricsScope)).Then(router)
@@ -637,6 +638,9 @@ func (a *AutoAdmin) RunForever() {
 	go newReplication(a).runForever()
 	go newRingMonitor(a).runForever()
 	go newRingScan(a).runForever()
+	go newMultipartCleanup(a).runForever()
+	go newLifecycle(a).runForever()
+	go newPolicyMigration(a).runForever()
 }
 
 func NewAdmin(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader) (ipPort *srv.IpPort, server srv.Server, logger srv.LowLevelLogger, err error) {
@@ -0,0 +1,181 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/containerserver"
+	"go.uber.org/zap"
+)
+
+// multipartCleanup deletes the parts of multipart uploads that were started
+// more than abandonAfter ago and never completed or aborted.
+type multipartCleanup struct {
+	aa           *AutoAdmin
+	interval     time.Duration
+	abandonAfter time.Duration
+}
+
+func newMultipartCleanup(aa *AutoAdmin) *multipartCleanup {
+	mc := &multipartCleanup{
+		aa:           aa,
+		interval:     time.Duration(aa.serverconf.GetInt("multipart-cleanup", "interval", 3600)) * time.Second,
+		abandonAfter: time.Duration(aa.serverconf.GetInt("multipart-cleanup", "abandon_after", common.ONE_WEEK)) * time.Second,
+	}
+	if mc.interval < time.Second {
+		mc.interval = time.Second
+	}
+	return mc
+}
+
+func (mc *multipartCleanup) runForever() {
+	for {
+		sleepFor := mc.runOnce()
+		if sleepFor < 0 {
+			break
+		}
+		time.Sleep(sleepFor)
+	}
+}
+
+func (mc *multipartCleanup) runOnce() time.Duration {
+	start := time.Now()
+	logger := mc.aa.logger.With(zap.String("process", "multipart cleanup"))
+	logger.Debug("starting pass")
+	if err := mc.aa.db.startProcessPass("multipart cleanup", "", 0); err != nil {
+		logger.Error("startProcessPass", zap.Error(err))
+	}
+	var cleaned, errors int
+	// Records are named by the time the upload started, so everything before
+	// this end marker is old enough to be abandoned.
+	endMarker := fmt.Sprintf("%010d", start.Add(-mc.abandonAfter).Unix())
+	marker := ""
+	for {
+		records, err := listObjects(mc.aa.hClient, common.MultipartUploadsAccount, common.MultipartUploadsContainer, map[string]string{"marker": marker, "end_marker": endMarker})
+		if err != nil {
+			logger.Error("listing uploads", zap.Error(err))
+			errors++
+			break
+		}
+		for _, record := range records {
+			if err := mc.cleanup(record.Name); err != nil {
+				logger.Error("cleaning up upload", zap.String("record", record.Name), zap.Error(err))
+				errors++
+				continue
+			}
+			cleaned++
+		}
+		if len(records) < common.CONTAINER_LISTING_LIMIT {
+			break
+		}
+		marker = records[len(records)-1].Name
+	}
+	if err := mc.aa.db.progressProcessPass("multipart cleanup", "", 0, fmt.Sprintf("%d abandoned uploads cleaned up, %d errors", cleaned, errors)); err != nil {
+		logger.Error("progressProcessPass", zap.Error(err))
+	}
+	if err := mc.aa.db.completeProcessPass("multipart cleanup", "", 0); err != nil {
+		logger.Error("completeProcessPass", zap.Error(err))
+	}
+	sleepFor := time.Until(start.Add(mc.interval))
+	if sleepFor < 0 {
+		sleepFor = 0
+	}
+	logger.Debug("pass complete", zap.Int("cleaned", cleaned), zap.Int("errors", errors), zap.String("sleep for", sleepFor.String()))
+	return sleepFor
+}
+
+// listObjects returns a page of a container listing, or nothing if the
+// container doesn't exist.
+func listObjects(c client.ProxyClient, account, container string, options map[string]string) ([]containerserver.ObjectListingRecord, error) {
+	return listObjectsWithHeaders(c, account, container, options, http.Header{})
+}
+
+func listObjectsWithHeaders(c client.ProxyClient, account, container string, options map[string]string, headers http.Header) ([]containerserver.ObjectListingRecord, error) {
+	options["format"] = "json"
+	resp := c.GetContainer(account, container, options, headers)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("GET %s/%s: %d", account, container, resp.StatusCode)
+	}
+	var records []containerserver.ObjectListingRecord
+	if err := json.Unmarshal(body, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// deleteObject deletes an object, which is fine if it's already gone.
+func deleteObject(c client.ProxyClient, account, container, object string) error {
+	resp := c.DeleteObject(account, container, object, common.Map2Headers(map[string]string{
+		"X-Timestamp": common.GetTimestamp(),
+	}))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("DELETE %s/%s/%s: %d", account, container, object, resp.StatusCode)
+	}
+	return nil
+}
+
+// cleanup deletes the parts and marker of the upload named by record, if it's
+// still in progress, and then the record itself. An upload that has no marker
+// was completed or aborted, and any parts it has belong to the completed
+// object.
+func (mc *multipartCleanup) cleanup(record string) error {
+	_, account, container, object, uploadId, err := common.ParseMultipartUploadRecord(record)
+	if err != nil {
+		mc.aa.logger.Error("invalid multipart upload record", zap.String("record", record), zap.Error(err))
+		return deleteObject(mc.aa.hClient, common.MultipartUploadsAccount, common.MultipartUploadsContainer, record)
+	}
+	segments := common.MultipartSegmentsContainer(container)
+	markerName := object + "/" + uploadId
+	resp := mc.aa.hClient.HeadObject(account, segments, markerName, http.Header{})
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		for {
+			parts, err := listObjects(mc.aa.hClient, account, segments, map[string]string{"prefix": markerName + "/"})
+			if err != nil {
+				return err
+			}
+			for _, part := range parts {
+				if err := deleteObject(mc.aa.hClient, account, segments, part.Name); err != nil {
+					return err
+				}
+			}
+			if len(parts) < common.CONTAINER_LISTING_LIMIT {
+				break
+			}
+		}
+		if err := deleteObject(mc.aa.hClient, account, segments, markerName); err != nil {
+			return err
+		}
+		mc.aa.logger.Info("cleaned up abandoned multipart upload", zap.String("account", account), zap.String("container", container), zap.String("object", object), zap.String("upload id", uploadId))
+	} else if resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("HEAD %s/%s/%s: %d", account, segments, markerName, resp.StatusCode)
+	}
+	return deleteObject(mc.aa.hClient, common.MultipartUploadsAccount, common.MultipartUploadsContainer, record)
+}
@@ -0,0 +1,89 @@
+package tools
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/containerserver"
+	"github.com/troubling/nectar/nectarutil"
+	"go.uber.org/zap"
+)
+
+type testMultipartClient struct {
+	testDispersionClient
+	// objects maps account/container to the names of the objects in it.
+	objects map[string]map[string]bool
+}
+
+func (c *testMultipartClient) put(account, container, obj string) {
+	if c.objects[account+"/"+container] == nil {
+		c.objects[account+"/"+container] = map[string]bool{}
+	}
+	c.objects[account+"/"+container][obj] = true
+}
+
+func (c *testMultipartClient) GetContainer(account string, container string, options map[string]string, headers http.Header) *http.Response {
+	olrs := []containerserver.ObjectListingRecord{}
+	for name := range c.objects[account+"/"+container] {
+		if strings.HasPrefix(name, options["prefix"]) && name > options["marker"] && (options["end_marker"] == "" || name < options["end_marker"]) {
+			olrs = append(olrs, containerserver.ObjectListingRecord{Name: name})
+		}
+	}
+	sort.Slice(olrs, func(i, j int) bool { return olrs[i].Name < olrs[j].Name })
+	out, _ := json.Marshal(olrs)
+	return nectarutil.ResponseStub(200, string(out))
+}
+
+func (c *testMultipartClient) HeadObject(account string, container string, obj string, headers http.Header) *http.Response {
+	if c.objects[account+"/"+container][obj] {
+		return nectarutil.ResponseStub(200, "")
+	}
+	return nectarutil.ResponseStub(404, "")
+}
+
+func (c *testMultipartClient) DeleteObject(account string, container string, obj string, headers http.Header) *http.Response {
+	if !c.objects[account+"/"+container][obj] {
+		return nectarutil.ResponseStub(404, "")
+	}
+	delete(c.objects[account+"/"+container], obj)
+	return nectarutil.ResponseStub(204, "")
+}
+
+func TestMultipartCleanup(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestMultipartCleanup"))
+	require.Nil(t, err)
+	c := &testMultipartClient{objects: map[string]map[string]bool{}}
+	now := time.Now()
+	segments := common.MultipartSegmentsContainer("c")
+	// An abandoned upload with two parts.
+	c.put(common.MultipartUploadsAccount, common.MultipartUploadsContainer, common.MultipartUploadRecord(now.Add(-8*24*time.Hour), "a", "c", "o", "id1"))
+	c.put("a", segments, "o/id1")
+	c.put("a", segments, "o/id1/1")
+	c.put("a", segments, "o/id1/2")
+	// An old upload that was completed, whose parts are in use.
+	c.put(common.MultipartUploadsAccount, common.MultipartUploadsContainer, common.MultipartUploadRecord(now.Add(-9*24*time.Hour), "a", "c", "o2", "id2"))
+	c.put("a", segments, "o2/id2/1")
+	// A recent upload.
+	c.put(common.MultipartUploadsAccount, common.MultipartUploadsContainer, common.MultipartUploadRecord(now.Add(-time.Hour), "a", "c", "o3", "id3"))
+	c.put("a", segments, "o3/id3")
+	c.put("a", segments, "o3/id3/1")
+
+	mc := newMultipartCleanup(&AutoAdmin{logger: zap.NewNop(), hClient: c, db: db})
+	require.Equal(t, common.ONE_WEEK*time.Second, mc.abandonAfter)
+	require.True(t, mc.runOnce() > 0)
+	require.Equal(t, map[string]bool{"o2/id2/1": true, "o3/id3": true, "o3/id3/1": true}, c.objects["a/"+segments])
+	records := c.objects[common.MultipartUploadsAccount+"/"+common.MultipartUploadsContainer]
+	require.Equal(t, 1, len(records))
+	for record := range records {
+		_, _, _, object, uploadId, err := common.ParseMultipartUploadRecord(record)
+		require.Nil(t, err)
+		require.Equal(t, "o3", object)
+		require.Equal(t, "id3", uploadId)
+	}
+}
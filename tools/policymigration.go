@@ -0,0 +1,362 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// policyMigration moves the objects of the containers being migrated to
+// another storage policy out of the policy they were in. Once a container has
+// nothing left to move, and has been migrating for at least settleTime so
+// that any late container updates have arrived, the migration is done.
+type policyMigration struct {
+	aa         *AutoAdmin
+	interval   time.Duration
+	settleTime time.Duration
+}
+
+// policyMigrationContainer is a container being migrated.
+type policyMigrationContainer struct {
+	account   string
+	container string
+	migration *common.PolicyMigration
+	// moved counts the objects moved this pass, and remaining what was left
+	// to move when the pass got to the container.
+	moved     int
+	remaining int64
+}
+
+func newPolicyMigration(aa *AutoAdmin) *policyMigration {
+	pm := &policyMigration{
+		aa:         aa,
+		interval:   time.Duration(aa.serverconf.GetInt("policy-migration", "interval", 300)) * time.Second,
+		settleTime: time.Duration(aa.serverconf.GetInt("policy-migration", "settle_time", 86400)) * time.Second,
+	}
+	if pm.interval < time.Second {
+		pm.interval = time.Second
+	}
+	return pm
+}
+
+func (pm *policyMigration) runForever() {
+	for {
+		sleepFor := pm.runOnce()
+		if sleepFor < 0 {
+			break
+		}
+		time.Sleep(sleepFor)
+	}
+}
+
+func (pm *policyMigration) runOnce() time.Duration {
+	start := time.Now()
+	logger := pm.aa.logger.With(zap.String("process", "policy migration"))
+	logger.Debug("starting pass")
+	if err := pm.aa.db.startProcessPass("policy migration", "", 0); err != nil {
+		logger.Error("startProcessPass", zap.Error(err))
+	}
+	var containers, moved, errors int
+	var remaining int64
+	marker := ""
+	for {
+		records, err := listObjects(pm.aa.hClient, common.PolicyMigrationAccount, common.PolicyMigrationContainer, map[string]string{"marker": marker})
+		if err != nil {
+			logger.Error("listing containers", zap.Error(err))
+			errors++
+			break
+		}
+		for _, record := range records {
+			pmc, err := pm.migrate(record.Name, record.LastModified, start)
+			if pmc != nil {
+				containers++
+				moved += pmc.moved
+				remaining += pmc.remaining
+				logger.Info("migrating container", zap.String("account", pmc.account), zap.String("container", pmc.container),
+					zap.Int("from", pmc.migration.From), zap.Int("to", pmc.migration.To), zap.Int("moved", pmc.moved), zap.Int64("remaining", pmc.remaining))
+			}
+			if err != nil {
+				logger.Error("migrating container", zap.String("record", record.Name), zap.Error(err))
+				errors++
+			}
+			if err := pm.aa.db.progressProcessPass("policy migration", "", 0, fmt.Sprintf("%d containers, %d objects moved, %d objects remaining, %d errors", containers, moved, remaining, errors)); err != nil {
+				logger.Error("progressProcessPass", zap.Error(err))
+			}
+		}
+		if len(records) < common.CONTAINER_LISTING_LIMIT {
+			break
+		}
+		marker = records[len(records)-1].Name
+	}
+	if err := pm.aa.db.progressProcessPass("policy migration", "", 0, fmt.Sprintf("%d containers, %d objects moved, %d objects remaining, %d errors", containers, moved, remaining, errors)); err != nil {
+		logger.Error("progressProcessPass", zap.Error(err))
+	}
+	if err := pm.aa.db.completeProcessPass("policy migration", "", 0); err != nil {
+		logger.Error("completeProcessPass", zap.Error(err))
+	}
+	sleepFor := time.Until(start.Add(pm.interval))
+	if sleepFor < 0 {
+		sleepFor = 0
+	}
+	logger.Debug("pass complete", zap.Int("containers", containers), zap.Int("moved", moved), zap.Int("errors", errors), zap.String("sleep for", sleepFor.String()))
+	return sleepFor
+}
+
+// migrate moves what's left of a container in the policy it's migrating
+// from. The record is removed once the container is gone or the migration is
+// done.
+func (pm *policyMigration) migrate(record, started string, now time.Time) (*policyMigrationContainer, error) {
+	account, container, err := common.ParsePolicyMigrationRecord(record)
+	if err != nil {
+		return nil, deleteObject(pm.aa.hClient, common.PolicyMigrationAccount, common.PolicyMigrationContainer, record)
+	}
+	resp := pm.aa.hClient.HeadContainer(account, container, http.Header{})
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, deleteObject(pm.aa.hClient, common.PolicyMigrationAccount, common.PolicyMigrationContainer, record)
+	} else if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("HEAD %s/%s: %d", account, container, resp.StatusCode)
+	}
+	migration, err := common.ParsePolicyMigration(resp.Header.Get(common.PolicyMigrationSysmeta))
+	if err != nil {
+		return nil, deleteObject(pm.aa.hClient, common.PolicyMigrationAccount, common.PolicyMigrationContainer, record)
+	}
+	// A container server that missed the change of policy is brought up to
+	// date.
+	if resp.Header.Get("X-Backend-Storage-Policy-Index") != strconv.Itoa(migration.To) {
+		if err := setPolicyMigration(pm.aa.hClient, account, container, migration); err != nil {
+			return nil, err
+		}
+	}
+	pmc := &policyMigrationContainer{account: account, container: container, migration: migration}
+	pmc.remaining, _ = strconv.ParseInt(resp.Header.Get("X-Container-Policy-Migration-Objects-Remaining"), 10, 64)
+	fromHeader := policyMigrationHeader(migration, migration.From)
+	listed := 0
+	marker := ""
+	var errs []string
+	for {
+		objects, err := listObjectsWithHeaders(pm.aa.hClient, account, container, map[string]string{"marker": marker}, fromHeader)
+		if err != nil {
+			return pmc, err
+		}
+		listed += len(objects)
+		for _, obj := range objects {
+			if err := pm.move(pmc, obj.Name); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if len(objects) < common.CONTAINER_LISTING_LIMIT {
+			break
+		}
+		marker = objects[len(objects)-1].Name
+	}
+	if len(errs) > 0 {
+		return pmc, fmt.Errorf("%d errors in %s/%s, the first: %s", len(errs), account, container, errs[0])
+	}
+	if startedAt, err := time.ParseInLocation("2006-01-02T15:04:05.000000", started, common.GMT); listed == 0 && err == nil && now.Sub(startedAt) >= pm.settleTime {
+		resp := pm.aa.hClient.PostContainer(account, container, common.Map2Headers(map[string]string{
+			common.PolicyMigrationSysmeta: "",
+			"X-Timestamp":                 common.GetTimestamp(),
+		}))
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return pmc, fmt.Errorf("POST %s/%s: %d", account, container, resp.StatusCode)
+		}
+		pm.aa.logger.Info("container migration done", zap.String("account", account), zap.String("container", container), zap.Int("from", migration.From), zap.Int("to", migration.To))
+		return pmc, deleteObject(pm.aa.hClient, common.PolicyMigrationAccount, common.PolicyMigrationContainer, record)
+	}
+	return pmc, nil
+}
+
+// move copies an object from the container's old policy to its new one and
+// deletes the old copy.
+func (pm *policyMigration) move(pmc *policyMigrationContainer, name string) error {
+	resp := pm.aa.hClient.GetObject(pmc.account, pmc.container, name, policyMigrationHeader(pmc.migration, pmc.migration.From))
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// The listing is out of date; a delete brings it up to date.
+		return pm.deleteOld(pmc, name, common.GetTimestamp())
+	} else if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("GET %s/%s/%s: %d", pmc.account, pmc.container, name, resp.StatusCode)
+	}
+	timestamp, err := strconv.ParseFloat(resp.Header.Get("X-Timestamp"), 64)
+	if err != nil {
+		return fmt.Errorf("GET %s/%s/%s: invalid X-Timestamp %q", pmc.account, pmc.container, name, resp.Header.Get("X-Timestamp"))
+	}
+	header := policyMigrationMetadata(resp.Header)
+	header.Set("Content-Length", resp.Header.Get("Content-Length"))
+	header.Set("Etag", strings.Trim(resp.Header.Get("Etag"), "\""))
+	header.Set("X-Timestamp", resp.Header.Get("X-Timestamp"))
+	header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(pmc.migration.To))
+	header.Set(common.PolicyMigrationHeader, pmc.migration.String())
+	putResp := pm.aa.hClient.PutObject(pmc.account, pmc.container, name, header, resp.Body)
+	putResp.Body.Close()
+	// A conflict means the object has been written since in the new policy.
+	if putResp.StatusCode/100 != 2 && putResp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("PUT %s/%s/%s: %d", pmc.account, pmc.container, name, putResp.StatusCode)
+	}
+	// The old copy is deleted as of just after the object that was copied, so
+	// that anything written to the old policy since is kept to be moved later.
+	if err := pm.deleteOld(pmc, name, common.CanonicalTimestamp(timestamp+0.00001)); err != nil {
+		return err
+	}
+	pmc.moved++
+	return nil
+}
+
+func (pm *policyMigration) deleteOld(pmc *policyMigrationContainer, name, timestamp string) error {
+	header := policyMigrationHeader(pmc.migration, pmc.migration.From)
+	header.Set("X-Timestamp", timestamp)
+	resp := pm.aa.hClient.DeleteObject(pmc.account, pmc.container, name, header)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("DELETE %s/%s/%s: %d", pmc.account, pmc.container, name, resp.StatusCode)
+	}
+	return nil
+}
+
+// policyMigrationHeader returns the headers for a request about a migrating
+// container's objects in one of the migration's policies.
+func policyMigrationHeader(migration *common.PolicyMigration, policy int) http.Header {
+	return http.Header{
+		"X-Backend-Storage-Policy-Index": {strconv.Itoa(policy)},
+		common.PolicyMigrationHeader:     {migration.String()},
+	}
+}
+
+// policyMigrationMetadata returns the metadata the object servers keep for an
+// object, other than what they work out from the object itself.
+func policyMigrationMetadata(objHeader http.Header) http.Header {
+	header := http.Header{}
+	for k := range objHeader {
+		switch {
+		case strings.HasPrefix(k, "X-Object-Meta-"), strings.HasPrefix(k, "X-Object-Sysmeta-"):
+		case k == "Content-Type", k == "Content-Disposition", k == "Content-Encoding", k == "X-Delete-At":
+		case k == "X-Object-Manifest", k == "X-Static-Large-Object":
+		default:
+			continue
+		}
+		header.Set(k, objHeader.Get(k))
+	}
+	return header
+}
+
+// setPolicyMigration changes a container's storage policy to the one it's
+// being migrated to.
+func setPolicyMigration(c client.ProxyClient, account, container string, migration *common.PolicyMigration) error {
+	resp := c.PostContainer(account, container, common.Map2Headers(map[string]string{
+		common.PolicyMigrationHeader:  migration.String(),
+		common.PolicyMigrationSysmeta: migration.String(),
+		"X-Timestamp":                 common.GetTimestamp(),
+	}))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s/%s: %d", account, container, resp.StatusCode)
+	}
+	return nil
+}
+
+// startPolicyMigration records a container for andrewd to migrate and
+// changes its storage policy; from then on new objects go to the new policy
+// and the old one is still read from until the migration is done.
+func startPolicyMigration(c client.ProxyClient, account, container string, policy int) error {
+	resp := c.HeadContainer(account, container, http.Header{})
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HEAD %s/%s: %d", account, container, resp.StatusCode)
+	}
+	current, err := strconv.Atoi(resp.Header.Get("X-Backend-Storage-Policy-Index"))
+	if err != nil {
+		return fmt.Errorf("HEAD %s/%s: invalid X-Backend-Storage-Policy-Index %q", account, container, resp.Header.Get("X-Backend-Storage-Policy-Index"))
+	}
+	if migration, err := common.ParsePolicyMigration(resp.Header.Get(common.PolicyMigrationSysmeta)); err == nil {
+		return fmt.Errorf("%s/%s is already being migrated from policy %d to %d", account, container, migration.From, migration.To)
+	}
+	if current == policy {
+		return fmt.Errorf("%s/%s is already in policy %d", account, container, policy)
+	}
+	for _, resp := range []*http.Response{
+		c.PutAccount(common.PolicyMigrationAccount, common.Map2Headers(map[string]string{"X-Timestamp": common.GetTimestamp()})),
+		c.PutContainer(common.PolicyMigrationAccount, common.PolicyMigrationContainer, common.Map2Headers(map[string]string{"X-Timestamp": common.GetTimestamp()})),
+	} {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("creating %s/%s: %d", common.PolicyMigrationAccount, common.PolicyMigrationContainer, resp.StatusCode)
+		}
+	}
+	resp = c.PutObject(common.PolicyMigrationAccount, common.PolicyMigrationContainer, common.PolicyMigrationRecord(account, container), common.Map2Headers(map[string]string{
+		"Content-Length": "0",
+		"Content-Type":   "text/plain",
+		"X-Timestamp":    common.GetTimestamp(),
+	}), bytes.NewReader(nil))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("recording migration of %s/%s: %d", account, container, resp.StatusCode)
+	}
+	return setPolicyMigration(c, account, container, &common.PolicyMigration{From: current, To: policy})
+}
+
+// MigratePolicy starts moving a container to another storage policy, which
+// andrewd then carries out.
+func MigratePolicy(flags *flag.FlagSet, cnf srv.ConfigLoader) bool {
+	policyName := flags.Lookup("P").Value.(flag.Getter).Get().(string)
+	parts := strings.SplitN(flags.Arg(0), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || policyName == "" {
+		flags.Usage()
+		return false
+	}
+	policies, err := cnf.GetPolicies()
+	if err != nil {
+		fmt.Println("Unable to load policies:", err)
+		return false
+	}
+	policy := policies.NameLookup(policyName)
+	if policy == nil {
+		fmt.Printf("No policy named %q\n", policyName)
+		return false
+	} else if policy.Deprecated {
+		fmt.Printf("Policy %q is deprecated\n", policyName)
+		return false
+	}
+	var certFile, keyFile string
+	if serverconf, err := getAndrewdConf(flags); err == nil {
+		certFile = serverconf.GetDefault("andrewd", "cert_file", "")
+		keyFile = serverconf.GetDefault("andrewd", "key_file", "")
+	}
+	logger := zap.NewNop()
+	pdc, err := client.NewProxyDirectClient(policies, cnf, logger, certFile, keyFile)
+	if err != nil {
+		fmt.Println("Could not make client:", err)
+		return false
+	}
+	if err := startPolicyMigration(client.NewProxyClient(pdc, nil, nil, logger), parts[0], parts[1], policy.Index); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	fmt.Printf("Migrating %s/%s to policy %q; andrewd will move its objects.\n", parts[0], parts[1], policy.Name)
+	return true
+}
@@ -0,0 +1,229 @@
+package tools
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/containerserver"
+	"github.com/troubling/nectar/nectarutil"
+	"go.uber.org/zap"
+)
+
+// testPolicyMigrationClient is an in memory cluster with more than one
+// storage policy, just enough of one for migrating containers.
+type testPolicyMigrationClient struct {
+	testDispersionClient
+	containers map[string]http.Header
+	// objects are by policy, then path.
+	objects map[int]map[string]*testLifecycleObject
+	// records are when each path was put in the migration record container.
+	records map[string]time.Time
+}
+
+func newTestPolicyMigrationClient() *testPolicyMigrationClient {
+	return &testPolicyMigrationClient{
+		containers: map[string]http.Header{},
+		objects:    map[int]map[string]*testLifecycleObject{0: {}, 1: {}},
+		records:    map[string]time.Time{},
+	}
+}
+
+func (c *testPolicyMigrationClient) policy(account, container string, headers http.Header) int {
+	if headers.Get(common.PolicyMigrationHeader) != "" {
+		if policy, err := strconv.Atoi(headers.Get("X-Backend-Storage-Policy-Index")); err == nil {
+			return policy
+		}
+	}
+	policy, _ := strconv.Atoi(c.containers[account+"/"+container].Get("X-Backend-Storage-Policy-Index"))
+	return policy
+}
+
+func (c *testPolicyMigrationClient) PutAccount(account string, headers http.Header) *http.Response {
+	return nectarutil.ResponseStub(201, "")
+}
+
+func (c *testPolicyMigrationClient) PutContainer(account string, container string, headers http.Header) *http.Response {
+	if c.containers[account+"/"+container] == nil {
+		c.containers[account+"/"+container] = http.Header{"X-Backend-Storage-Policy-Index": {"0"}}
+	}
+	return nectarutil.ResponseStub(201, "")
+}
+
+func (c *testPolicyMigrationClient) PostContainer(account string, container string, headers http.Header) *http.Response {
+	h := c.containers[account+"/"+container]
+	if h == nil {
+		return nectarutil.ResponseStub(404, "")
+	}
+	for k := range headers {
+		switch k {
+		case "X-Timestamp", "X-Backend-Storage-Policy-Index":
+		case common.PolicyMigrationHeader:
+			if m, err := common.ParsePolicyMigration(headers.Get(k)); err == nil {
+				h.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(m.To))
+			}
+		default:
+			h.Set(k, headers.Get(k))
+		}
+	}
+	return nectarutil.ResponseStub(204, "")
+}
+
+func (c *testPolicyMigrationClient) HeadContainer(account string, container string, headers http.Header) *http.Response {
+	h, ok := c.containers[account+"/"+container]
+	if !ok {
+		return nectarutil.ResponseStub(404, "")
+	}
+	resp := nectarutil.ResponseStub(204, "")
+	for k := range h {
+		resp.Header.Set(k, h.Get(k))
+	}
+	if m, err := common.ParsePolicyMigration(h.Get(common.PolicyMigrationSysmeta)); err == nil {
+		remaining := 0
+		for path := range c.objects[m.From] {
+			if strings.HasPrefix(path, account+"/"+container+"/") {
+				remaining++
+			}
+		}
+		resp.Header.Set("X-Container-Policy-Migration-Objects-Remaining", strconv.Itoa(remaining))
+	}
+	return resp
+}
+
+func (c *testPolicyMigrationClient) GetContainer(account string, container string, options map[string]string, headers http.Header) *http.Response {
+	if _, ok := c.containers[account+"/"+container]; !ok {
+		return nectarutil.ResponseStub(404, "")
+	}
+	prefix := account + "/" + container + "/"
+	olrs := []containerserver.ObjectListingRecord{}
+	if account == common.PolicyMigrationAccount {
+		for path, at := range c.records {
+			olrs = append(olrs, containerserver.ObjectListingRecord{Name: path, LastModified: at.UTC().Format("2006-01-02T15:04:05.000000")})
+		}
+	} else {
+		for path := range c.objects[c.policy(account, container, headers)] {
+			if strings.HasPrefix(path, prefix) && path[len(prefix):] > options["marker"] {
+				olrs = append(olrs, containerserver.ObjectListingRecord{Name: path[len(prefix):]})
+			}
+		}
+	}
+	sort.Slice(olrs, func(i, j int) bool { return olrs[i].Name < olrs[j].Name })
+	out, _ := json.Marshal(olrs)
+	return nectarutil.ResponseStub(200, string(out))
+}
+
+func (c *testPolicyMigrationClient) PutObject(account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	if account == common.PolicyMigrationAccount {
+		c.records[obj] = time.Now()
+		return nectarutil.ResponseStub(201, "")
+	}
+	objects := c.objects[c.policy(account, container, headers)]
+	path := account + "/" + container + "/" + obj
+	if existing := objects[path]; existing != nil && existing.header.Get("X-Timestamp") >= headers.Get("X-Timestamp") {
+		return nectarutil.ResponseStub(409, "")
+	}
+	body, _ := ioutil.ReadAll(src)
+	h := http.Header{}
+	for k := range headers {
+		if k != "X-Backend-Storage-Policy-Index" && k != common.PolicyMigrationHeader {
+			h.Set(k, headers.Get(k))
+		}
+	}
+	objects[path] = &testLifecycleObject{header: h, body: string(body)}
+	return nectarutil.ResponseStub(201, "")
+}
+
+func (c *testPolicyMigrationClient) GetObject(account string, container string, obj string, headers http.Header) *http.Response {
+	existing := c.objects[c.policy(account, container, headers)][account+"/"+container+"/"+obj]
+	if existing == nil {
+		return nectarutil.ResponseStub(404, "")
+	}
+	resp := nectarutil.ResponseStub(200, existing.body)
+	for k := range existing.header {
+		resp.Header.Set(k, existing.header.Get(k))
+	}
+	return resp
+}
+
+func (c *testPolicyMigrationClient) DeleteObject(account string, container string, obj string, headers http.Header) *http.Response {
+	if account == common.PolicyMigrationAccount {
+		delete(c.records, obj)
+		return nectarutil.ResponseStub(204, "")
+	}
+	objects := c.objects[c.policy(account, container, headers)]
+	path := account + "/" + container + "/" + obj
+	if objects[path] == nil {
+		return nectarutil.ResponseStub(404, "")
+	} else if objects[path].header.Get("X-Timestamp") >= headers.Get("X-Timestamp") {
+		return nectarutil.ResponseStub(409, "")
+	}
+	delete(objects, path)
+	return nectarutil.ResponseStub(204, "")
+}
+
+func TestPolicyMigration(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestPolicyMigration"))
+	require.Nil(t, err)
+	c := newTestPolicyMigrationClient()
+	c.PutContainer("a", "c", http.Header{})
+	put := func(policy int, path, body string, ts time.Time) {
+		c.objects[policy][path] = &testLifecycleObject{
+			header: common.Map2Headers(map[string]string{
+				"X-Timestamp":        common.CanonicalTimestampFromTime(ts),
+				"Content-Type":       "text/plain",
+				"Content-Length":     strconv.Itoa(len(body)),
+				"Etag":               "etag-" + body,
+				"X-Object-Meta-Name": path,
+			}),
+			body: body,
+		}
+	}
+	now := time.Now()
+	put(0, "a/c/1", "one", now.Add(-time.Hour))
+	put(0, "a/c/2", "two", now.Add(-time.Hour))
+	// 3 was overwritten in the new policy after the migration started.
+	put(0, "a/c/3", "three", now.Add(-time.Hour))
+	put(1, "a/c/3", "three again", now)
+
+	require.NotNil(t, startPolicyMigration(c, "a", "c", 0))
+	require.NotNil(t, startPolicyMigration(c, "a", "nope", 1))
+	require.Nil(t, startPolicyMigration(c, "a", "c", 1))
+	require.Equal(t, "1", c.containers["a/c"].Get("X-Backend-Storage-Policy-Index"))
+	require.Equal(t, "0:1", c.containers["a/c"].Get(common.PolicyMigrationSysmeta))
+	require.False(t, c.records["a/c"].IsZero())
+	require.NotNil(t, startPolicyMigration(c, "a", "c", 0))
+
+	pm := newPolicyMigration(&AutoAdmin{logger: zap.NewNop(), hClient: c, db: db})
+	pm.settleTime = time.Hour
+	pm.runOnce()
+	require.Equal(t, 0, len(c.objects[0]))
+	require.Equal(t, 3, len(c.objects[1]))
+	require.Equal(t, "one", c.objects[1]["a/c/1"].body)
+	require.Equal(t, "a/c/1", c.objects[1]["a/c/1"].header.Get("X-Object-Meta-Name"))
+	require.Equal(t, "text/plain", c.objects[1]["a/c/1"].header.Get("Content-Type"))
+	require.Equal(t, "three again", c.objects[1]["a/c/3"].body)
+	_, _, progress, _, err := db.processPass("policy migration", "", 0)
+	require.Nil(t, err)
+	require.Equal(t, "1 containers, 3 objects moved, 3 objects remaining, 0 errors", progress)
+
+	// The migration isn't done until it has had time to settle.
+	pm.runOnce()
+	require.Equal(t, "0:1", c.containers["a/c"].Get(common.PolicyMigrationSysmeta))
+	require.False(t, c.records["a/c"].IsZero())
+
+	c.records["a/c"] = now.Add(-2 * time.Hour)
+	// A container server that missed the change of policy is fixed up.
+	c.containers["a/c"].Set("X-Backend-Storage-Policy-Index", "0")
+	pm.runOnce()
+	require.Equal(t, "1", c.containers["a/c"].Get("X-Backend-Storage-Policy-Index"))
+	require.Equal(t, "", c.containers["a/c"].Get(common.PolicyMigrationSysmeta))
+	require.True(t, c.records["a/c"].IsZero())
+}
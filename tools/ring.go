@@ -18,6 +18,7 @@ package tools
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -41,6 +42,45 @@ func PrintDevs(devs []*ring.RingBuilderDevice) {
 	fmt.Println(brimtext.Align(data, brimtext.NewSimpleAlignOptions()))
 }
 
+var errBadDeviceString = errors.New("Invalid device string")
+
+var deviceStringRegexp = regexp.MustCompile(`^(?:r(?P<region>\d+))?z(?P<zone>\d+)(?:s(?P<scheme>http|https))?-(?P<ip>[\d\.]+):(?P<port>\d+)(?:R(?P<replication_ip>[\d\.]+):(?P<replication_port>\d+))?\/(?P<device>[^_]+)(?:_(?P<metadata>.+))?$`)
+
+// parseDeviceString parses a device of the form [r<region>]z<zone>[s<scheme>]-<ip>:<port>[R<r_ip>:<r_port>]/<device_name>_<meta>.
+// The returned device has an Id of -1 and no weight.
+func parseDeviceString(deviceStr string) (*ring.RingBuilderDevice, error) {
+	var err error
+	matches := deviceStringRegexp.FindAllStringSubmatch(deviceStr, -1)
+	if len(matches) == 0 {
+		return nil, errBadDeviceString
+	}
+	dev := &ring.RingBuilderDevice{Id: -1, Scheme: "http"}
+	if matches[0][1] != "" {
+		if dev.Region, err = strconv.ParseInt(matches[0][1], 0, 64); err != nil {
+			return nil, err
+		}
+	}
+	if dev.Zone, err = strconv.ParseInt(matches[0][2], 0, 64); err != nil {
+		return nil, err
+	}
+	if matches[0][3] != "" {
+		dev.Scheme = matches[0][3]
+	}
+	dev.Ip = matches[0][4]
+	if dev.Port, err = strconv.ParseInt(matches[0][5], 0, 64); err != nil {
+		return nil, err
+	}
+	if matches[0][6] != "" {
+		dev.ReplicationIp = matches[0][6]
+		if dev.ReplicationPort, err = strconv.ParseInt(matches[0][7], 0, 64); err != nil {
+			return nil, err
+		}
+	}
+	dev.Device = matches[0][8]
+	dev.Meta = matches[0][9]
+	return dev, nil
+}
+
 func RingBuildCmd(flags *flag.FlagSet) {
 	args := flags.Args()
 	if len(args) < 1 || args[0] == "help" {
@@ -49,6 +89,13 @@ func RingBuildCmd(flags *flag.FlagSet) {
 	}
 	debug := flags.Lookup("debug").Value.String() == "true"
 	jsonOut := flags.Lookup("json").Value.String() == "true"
+	if args[0] == "diff" {
+		if err := ringDiff(args[1:], jsonOut); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	pth := args[0]
 	cmd := ""
 	if len(args) == 1 {
@@ -261,6 +308,71 @@ func RingBuildCmd(flags *flag.FlagSet) {
 			}
 		}
 
+	case "set_target_weight":
+		weightFlags := flag.NewFlagSet("set_target_weight", flag.ExitOnError)
+		region := weightFlags.Int64("region", -1, "Device region.")
+		zone := weightFlags.Int64("zone", -1, "Device zone.")
+		scheme := weightFlags.String("scheme", "", "URI scheme(http/https)")
+		ip := weightFlags.String("ip", "", "Device ip address.")
+		port := weightFlags.Int64("port", -1, "Device port.")
+		repIp := weightFlags.String("replication-ip", "", "Device replication address.")
+		repPort := weightFlags.Int64("replication-port", -1, "Device replication port.")
+		device := weightFlags.String("device", "", "Device name.")
+		weight := weightFlags.Float64("weight", -1.0, "Device weight.")
+		meta := weightFlags.String("meta", "", "Metadata.")
+		yes := weightFlags.Bool("yes", false, "Force yes.")
+		if err := weightFlags.Parse(args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		args := weightFlags.Args()
+		if len(args) < 2 {
+			weightFlags.Usage()
+			os.Exit(1)
+		}
+		targetWeight, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		step, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		devs, err := ring.Search(pth, *region, *zone, *ip, *port, *repIp, *repPort, *device, *weight, *meta, *scheme)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if len(devs) == 0 {
+			fmt.Println("No matching devices found.")
+			return
+		} else {
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Println("Search matched the following devices:")
+			PrintDevs(devs)
+			if !*yes {
+				fmt.Printf("Are you sure you want to ramp the weight to %.2f in steps of %.2f for these %d devices (y/n)? ", targetWeight, step, len(devs))
+				resp, err := reader.ReadString('\n')
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				if resp[0] != 'y' && resp[0] != 'Y' {
+					fmt.Println("No devices updated.")
+					return
+				}
+			}
+			err := ring.SetTargetWeight(pth, devs, targetWeight, step)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			} else {
+				fmt.Println("Target weight updated successfully.")
+			}
+		}
+
 	case "remove":
 		removeFlags := flag.NewFlagSet("set_weight", flag.ExitOnError)
 		region := removeFlags.Int64("region", -1, "Device region.")
@@ -319,71 +431,30 @@ func RingBuildCmd(flags *flag.FlagSet) {
 	case "add":
 		// TODO: Add config option version of add function
 		// TODO: Add support for multiple adds in a single command
-		var err error
-		var region, zone, port, replicationPort int64
-		var ip, replicationIp, device, scheme string
-		var weight float64
-
 		if len(args) < 4 {
 			flags.Usage()
 			os.Exit(1)
 		}
-		deviceStr := args[2]
-		rx := regexp.MustCompile(`^(?:r(?P<region>\d+))?z(?P<zone>\d+)(?:s(?P<scheme>http|https))?-(?P<ip>[\d\.]+):(?P<port>\d+)(?:R(?P<replication_ip>[\d\.]+):(?P<replication_port>\d+))?\/(?P<device>[^_]+)(?:_(?P<metadata>.+))?$`)
-		matches := rx.FindAllStringSubmatch(deviceStr, -1)
-		if len(matches) == 0 {
-			flags.Usage()
-			os.Exit(1)
-		}
-		if matches[0][1] != "" {
-			region, err = strconv.ParseInt(matches[0][1], 0, 64)
-			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-		} else {
-			region = 0
-		}
-		zone, err = strconv.ParseInt(matches[0][2], 0, 64)
+		dev, err := parseDeviceString(args[2])
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		if matches[0][3] != "" {
-			scheme = matches[0][3]
-		} else {
-			scheme = "http"
-		}
-		ip = matches[0][4]
-		port, err = strconv.ParseInt(matches[0][5], 0, 64)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		if matches[0][6] != "" {
-			replicationIp = matches[0][6]
-			replicationPort, err = strconv.ParseInt(matches[0][7], 0, 64)
-			if err != nil {
+			if err == errBadDeviceString {
+				flags.Usage()
+			} else {
 				fmt.Println(err)
-				os.Exit(1)
 			}
-		} else {
-			replicationIp = ""
-			replicationPort = 0
+			os.Exit(1)
 		}
-		device = matches[0][8]
-		weight, err = strconv.ParseFloat(args[3], 64)
+		weight, err := strconv.ParseFloat(args[3], 64)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-		id, err := ring.AddDevice(pth, -1, region, zone, scheme, ip, port, replicationIp, replicationPort, device, weight, debug)
+		id, err := ring.AddDevice(pth, -1, dev.Region, dev.Zone, dev.Scheme, dev.Ip, dev.Port, dev.ReplicationIp, dev.ReplicationPort, dev.Device, weight, debug)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		} else {
-			fmt.Printf("Device %s with %.2f weight added with id %d\n", device, weight, id)
+			fmt.Printf("Device %s with %.2f weight added with id %d\n", dev.Device, weight, id)
 		}
 	case "load":
 		builder, err := ring.NewRingBuilderFromFile(pth, debug)
@@ -434,6 +505,9 @@ func RingBuildCmd(flags *flag.FlagSet) {
 			// TODO: Figure out how to do ring comparisons
 
 			PrintDevs(builder.Devs)
+			for _, dev := range builder.RampingDevs() {
+				fmt.Printf("Device %d is ramping from weight %v to %v in steps of %v\n", dev.Id, dev.Weight, dev.TargetWeight, dev.WeightStep)
+			}
 		}
 
 	case "analyze":
@@ -569,6 +643,40 @@ func RingBuildCmd(flags *flag.FlagSet) {
 		}
 		fmt.Println("Done!")
 
+	case "simulate":
+		if err := ringSimulate(pth, args[2:], debug, jsonOut); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+	case "export":
+		out := os.Stdout
+		if len(args) > 2 {
+			f, err := os.Create(args[2])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			out = f
+		}
+		if _, err := ring.ExportJSON(pth, out); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+	case "import":
+		if len(args) < 3 {
+			flags.Usage()
+			os.Exit(1)
+		}
+		format, err := ring.ImportJSON(args[2], pth)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %s from %s to %s\n", format, args[2], pth)
+
 	case "validate":
 		err := ring.Validate(pth)
 		if err != nil {
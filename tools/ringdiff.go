@@ -0,0 +1,203 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/objectserver"
+)
+
+// ringDevChange is a device whose address or weight differs between two rings.
+type ringDevChange struct {
+	Old *ring.Device `json:"old"`
+	New *ring.Device `json:"new"`
+}
+
+type ringDiffReport struct {
+	OldRing          string                   `json:"old_ring"`
+	NewRing          string                   `json:"new_ring"`
+	Partitions       uint64                   `json:"partitions"`
+	Replicas         uint64                   `json:"replicas"`
+	PartsMoved       int                      `json:"parts_moved"`
+	PercentMoved     float64                  `json:"percent_moved"`
+	Devs             []*ring.SimulationDevice `json:"devs"`
+	Added            []*ring.Device           `json:"added"`
+	Removed          []*ring.Device           `json:"removed"`
+	Readdressed      []*ringDevChange         `json:"readdressed"`
+	Reweighted       []*ringDevChange         `json:"reweighted"`
+	DispersionBefore map[string]float64       `json:"dispersion_before"`
+	DispersionAfter  map[string]float64       `json:"dispersion_after"`
+	DispersionChange map[string]float64       `json:"dispersion_change"`
+	// EstimatedBytesMoved is -1 when no disk usage could be gathered.
+	EstimatedBytesMoved int64    `json:"estimated_bytes_moved"`
+	ReconErrors         []string `json:"recon_errors,omitempty"`
+}
+
+// getRingDiff compares two rings; est may be nil if no byte estimate is wanted.
+func getRingDiff(oldRing, newRing ring.Ring, est *partBytesEstimate) (*ringDiffReport, error) {
+	if oldRing.PartitionCount() != newRing.PartitionCount() {
+		return nil, fmt.Errorf("Partition counts differ (%d != %d); rings with different part powers can not be compared", oldRing.PartitionCount(), newRing.PartitionCount())
+	}
+	report := &ringDiffReport{
+		Partitions:          newRing.PartitionCount(),
+		Replicas:            newRing.ReplicaCount(),
+		Devs:                ring.DevicePartMoves(oldRing, newRing),
+		DispersionBefore:    ring.TierDispersion(oldRing),
+		DispersionAfter:     ring.TierDispersion(newRing),
+		DispersionChange:    map[string]float64{},
+		EstimatedBytesMoved: -1,
+	}
+	for _, name := range ring.TierNames {
+		report.DispersionChange[name] = report.DispersionAfter[name] - report.DispersionBefore[name]
+	}
+	oldDevs := map[int]*ring.Device{}
+	for _, dev := range oldRing.AllDevices() {
+		if dev != nil {
+			oldDevs[dev.Id] = dev
+		}
+	}
+	newDevs := map[int]bool{}
+	for _, dev := range newRing.AllDevices() {
+		if dev == nil {
+			continue
+		}
+		newDevs[dev.Id] = true
+		old, ok := oldDevs[dev.Id]
+		if !ok {
+			report.Added = append(report.Added, dev)
+			continue
+		}
+		if old.Ip != dev.Ip || old.Port != dev.Port || old.ReplicationIp != dev.ReplicationIp || old.ReplicationPort != dev.ReplicationPort || old.Device != dev.Device || old.Scheme != dev.Scheme {
+			report.Readdressed = append(report.Readdressed, &ringDevChange{Old: old, New: dev})
+		}
+		if old.Weight != dev.Weight {
+			report.Reweighted = append(report.Reweighted, &ringDevChange{Old: old, New: dev})
+		}
+	}
+	for _, dev := range oldRing.AllDevices() {
+		if dev != nil && !newDevs[dev.Id] {
+			report.Removed = append(report.Removed, dev)
+		}
+	}
+	for _, dev := range report.Devs {
+		report.PartsMoved += int(dev.PartsGained)
+	}
+	jobs := objectserver.GetPartMoveJobs(oldRing, newRing, nil, 0)
+	if total := report.Partitions * report.Replicas; total > 0 {
+		report.PercentMoved = 100.0 * float64(report.PartsMoved) / float64(total)
+	}
+	if est != nil {
+		report.ReconErrors = est.Errors
+		if est.AvgPartBytes > 0 {
+			// Replicas added by a replica count increase have no job; assume they are average sized.
+			bytes := float64(report.PartsMoved-len(jobs)) * est.AvgPartBytes
+			for _, job := range jobs {
+				if partBytes, ok := est.DevPartBytes[int64(job.FromDevice.Id)]; ok {
+					bytes += partBytes
+				} else {
+					bytes += est.AvgPartBytes
+				}
+			}
+			report.EstimatedBytesMoved = int64(bytes)
+		}
+	}
+	return report, nil
+}
+
+func (r *ringDiffReport) String() string {
+	s := fmt.Sprintf("%s => %s\n", r.OldRing, r.NewRing)
+	s += fmt.Sprintf("%d of %d partition replicas move (%.2f%%)\n", r.PartsMoved, r.Partitions*r.Replicas, r.PercentMoved)
+	for _, dev := range r.Added {
+		s += fmt.Sprintf("Added: %d %s:%d/%s weight %v\n", dev.Id, dev.Ip, dev.Port, dev.Device, dev.Weight)
+	}
+	for _, dev := range r.Removed {
+		s += fmt.Sprintf("Removed: %d %s:%d/%s\n", dev.Id, dev.Ip, dev.Port, dev.Device)
+	}
+	for _, c := range r.Readdressed {
+		s += fmt.Sprintf("Readdressed: %d %s:%d/%s (replication %s:%d) => %s:%d/%s (replication %s:%d)\n", c.New.Id, c.Old.Ip, c.Old.Port, c.Old.Device, c.Old.ReplicationIp, c.Old.ReplicationPort, c.New.Ip, c.New.Port, c.New.Device, c.New.ReplicationIp, c.New.ReplicationPort)
+	}
+	for _, c := range r.Reweighted {
+		s += fmt.Sprintf("Reweighted: %d %s:%d/%s %v => %v\n", c.New.Id, c.New.Ip, c.New.Port, c.New.Device, c.Old.Weight, c.New.Weight)
+	}
+	for _, name := range ring.TierNames {
+		s += fmt.Sprintf("Dispersion %s: %.2f%% => %.2f%% (%+.2f%%)\n", name, r.DispersionBefore[name], r.DispersionAfter[name], r.DispersionChange[name])
+	}
+	for _, e := range r.ReconErrors {
+		s += fmt.Sprintf("!! %s\n", e)
+	}
+	if r.EstimatedBytesMoved >= 0 {
+		s += fmt.Sprintf("Estimated bytes moved: %d\n", r.EstimatedBytesMoved)
+	}
+	return s
+}
+
+// ringDiff implements "ring diff <old.ring.gz> <new.ring.gz>".
+func ringDiff(args []string, jsonOut bool) error {
+	diffFlags := flag.NewFlagSet("diff", flag.ExitOnError)
+	useRecon := diffFlags.Bool("recon", true, "Query recon for disk usage to estimate bytes moved.")
+	timeout := diffFlags.Duration("timeout", 10*time.Second, "Timeout for recon requests.")
+	if err := diffFlags.Parse(args); err != nil {
+		return err
+	}
+	if diffFlags.NArg() != 2 {
+		return fmt.Errorf("usage: diff [-recon=false] <old.ring.gz> <new.ring.gz>")
+	}
+	oldRing, err := ring.LoadRing(diffFlags.Arg(0), "", "")
+	if err != nil {
+		return fmt.Errorf("Unable to load %s: %s", diffFlags.Arg(0), err)
+	}
+	newRing, err := ring.LoadRing(diffFlags.Arg(1), "", "")
+	if err != nil {
+		return fmt.Errorf("Unable to load %s: %s", diffFlags.Arg(1), err)
+	}
+	var est *partBytesEstimate
+	if *useRecon {
+		est = getPartBytesEstimate(http.Client{Timeout: *timeout}, oldRing)
+	}
+	report, err := getRingDiff(oldRing, newRing, est)
+	if err != nil {
+		return err
+	}
+	report.OldRing = diffFlags.Arg(0)
+	report.NewRing = diffFlags.Arg(1)
+	if jsonOut {
+		b, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(b)
+		os.Stdout.Write([]byte("\n"))
+		return nil
+	}
+	fmt.Print(report)
+	var changed []*ring.SimulationDevice
+	for _, dev := range report.Devs {
+		if dev.PartsGained > 0 || dev.PartsLost > 0 {
+			changed = append(changed, dev)
+		}
+	}
+	if len(changed) > 0 {
+		printSimulationDevs(changed)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+func TestRingDiff(t *testing.T) {
+	b, err := ring.NewRingBuilder(6, 3, 0, false)
+	require.Nil(t, err)
+	for z := int64(0); z < 3; z++ {
+		_, err := b.AddDev(&ring.RingBuilderDevice{Id: -1, Zone: z, Ip: fmt.Sprintf("127.0.0.%d", z+1), Port: 6000, Device: "sda", Weight: 100, Scheme: "http"})
+		require.Nil(t, err)
+	}
+	_, _, _, err = b.Rebalance()
+	require.Nil(t, err)
+	oldRing := b.GetRing()
+
+	_, err = b.AddDev(&ring.RingBuilderDevice{Id: -1, Zone: 3, Ip: "127.0.0.4", Port: 6000, Device: "sda", Weight: 100, Scheme: "http"})
+	require.Nil(t, err)
+	require.Nil(t, b.UpdateDevInfo(0, "127.0.0.9", -1, "", -1, "", "", ""))
+	require.Nil(t, b.SetDevWeight(1, 50))
+	b.PretendMinPartHoursPassed()
+	_, _, _, err = b.Rebalance()
+	require.Nil(t, err)
+	newRing := b.GetRing()
+
+	est := &partBytesEstimate{DevPartBytes: map[int64]float64{}, AvgPartBytes: 10}
+	report, err := getRingDiff(oldRing, newRing, est)
+	require.Nil(t, err)
+	require.Equal(t, uint64(64), report.Partitions)
+	require.Equal(t, 1, len(report.Added))
+	require.Equal(t, 3, report.Added[0].Id)
+	require.Equal(t, 0, len(report.Removed))
+	require.Equal(t, 1, len(report.Readdressed))
+	require.Equal(t, "127.0.0.9", report.Readdressed[0].New.Ip)
+	require.Equal(t, 1, len(report.Reweighted))
+	require.Equal(t, 50.0, report.Reweighted[0].New.Weight)
+	require.True(t, report.PartsMoved > 0)
+	gained := int64(0)
+	for _, dev := range report.Devs {
+		gained += dev.PartsGained
+	}
+	require.Equal(t, int64(report.PartsMoved), gained)
+	require.Equal(t, int64(report.PartsMoved*10), report.EstimatedBytesMoved)
+
+	_, err = getRingDiff(oldRing, newRing, nil)
+	require.Nil(t, err)
+}
@@ -5,6 +5,11 @@ package tools
 // initial_delay = 1      # seconds to wait between ring checks for the first pass
 // pass_time_target = 60  # seconds to try to make subsequent passes take
 // report_interval = 600  # seconds between progress reports
+//
+// Devices given a target weight with "hummingbird ring <builder> set_target_weight"
+// have their weights stepped toward the target on each scheduled rebalance,
+// once replication and dispersion scans have caught up with the last weight
+// step or partition move.
 
 import (
 	"fmt"
@@ -165,19 +170,25 @@ func (rm *ringMonitor) runOnce() time.Duration {
 						logger.Error("Could not find builder after lock", zap.String("type", ringTask.typ), zap.Int("policy", ringTask.policy), zap.Error(err))
 						return false
 					}
+					if len(ringBuilder.RampingDevs()) > 0 {
+						rm.stepWeights(ringBuilder, ringBuilderFilePath, ringTask.typ, ringTask.policy, taskLogger)
+					}
 					var changedReplicas int
 					changedReplicas, _, _, err = ring.Rebalance(ringBuilderFilePath, false, false, true)
 					if err != nil {
 						logger.Error("Error while rebalancing", zap.String("type", ringTask.typ), zap.Int("policy", ringTask.policy), zap.String("path", ringBuilderFilePath), zap.Error(err))
 						return false
 					}
+					if changedReplicas > 0 {
+						rm.setRingChanged(ringTask.typ, ringTask.policy, taskLogger)
+					}
 					if err := ringTask.ring.Reload(); err != nil {
 						atomic.AddInt64(&errors, 1)
 						taskLogger.Error("could not reload", zap.Error(err))
 						return false
 					}
-					// So we don't get stuck rebalancing a ring by tiny amounts for forever:
-					if float64(changedReplicas)/(float64(ringBuilder.Parts)*ringBuilder.Replicas) < 0.01 {
+					// So we don't get stuck rebalancing a ring by tiny amounts for forever; devices still ramping keep the schedule going though:
+					if float64(changedReplicas)/(float64(ringBuilder.Parts)*ringBuilder.Replicas) < 0.01 && len(ringBuilder.RampingDevs()) == 0 {
 						rm.aa.db.addRingLog(ringTask.typ, ringTask.policy, fmt.Sprintf("rebalanced due to schedule; now settled"))
 						rm.aa.db.setRingHash(ringTask.typ, ringTask.policy, ringTask.ring.MD5(), time.Time{})
 					} else {
@@ -230,6 +241,7 @@ func (rm *ringMonitor) runOnce() time.Duration {
 				continue
 			}
 			failed := false
+			moved := false
 			for partition := uint64(0); partition < partitionCount && !failed; partition++ {
 				previousDev := previousRing.GetNodes(partition)
 				currentDev := ringTask.ring.GetNodes(partition)
@@ -256,10 +268,14 @@ func (rm *ringMonitor) runOnce() time.Duration {
 							break
 						} else {
 							atomic.AddInt64(&partitionCopiesChanged, 1)
+							moved = true
 						}
 					}
 				}
 			}
+			if moved {
+				rm.setRingChanged(ringTask.typ, ringTask.policy, changeTaskLogger)
+			}
 			if !failed {
 				if err = rm.aa.db.setRingHash(ringTask.typ, ringTask.policy, ringTask.ring.MD5(), time.Now().Add(randomDuration(time.Minute*30, time.Hour))); err != nil {
 					atomic.AddInt64(&errors, 1)
@@ -290,6 +306,83 @@ func (rm *ringMonitor) runOnce() time.Duration {
 	return sleepFor
 }
 
+// stepWeights moves the weights of ramping devices a step toward their
+// target weights and saves the builder, but only once the cluster has caught
+// up with the previous weight step or partition move. The builder lock must
+// already be held.
+func (rm *ringMonitor) stepWeights(builder *ring.RingBuilder, builderPath string, typ string, policy int, logger *zap.Logger) {
+	changed, loggedWaitingFor, err := rm.aa.db.ringRamp(typ, policy)
+	if err != nil {
+		logger.Error("could not retrieve when the ring last changed; not stepping weights", zap.Error(err))
+		return
+	}
+	waitingFor, err := weightRampWaitingFor(rm.aa.db, builder, typ, policy, changed)
+	if err != nil {
+		logger.Error("could not determine if the cluster has caught up; not stepping weights", zap.Error(err))
+		return
+	}
+	if waitingFor != "" {
+		logger.Debug("not stepping weights", zap.String("waiting for", waitingFor))
+		// The ring log only gets what the ramp is waiting for when that
+		// changes, not on every scheduled rebalance.
+		if waitingFor != loggedWaitingFor {
+			rm.aa.db.addRingLog(typ, policy, fmt.Sprintf("weight ramp waiting for %s", waitingFor))
+			rm.aa.db.setRingRampWaitingFor(typ, policy, waitingFor)
+		}
+		return
+	}
+	devs := builder.StepWeights()
+	if err := builder.Save(builderPath); err != nil {
+		logger.Error("could not save builder after stepping weights", zap.String("path", builderPath), zap.Error(err))
+		return
+	}
+	for _, dev := range devs {
+		logger.Debug("stepped weight", zap.Int64("device", dev.Id), zap.Float64("weight", dev.Weight), zap.Float64("target weight", dev.TargetWeight))
+	}
+	rm.aa.db.addRingLog(typ, policy, fmt.Sprintf("stepped weights of %d devices toward their target weights", len(devs)))
+	rm.setRingChanged(typ, policy, logger)
+	rm.aa.db.setRingRampWaitingFor(typ, policy, "")
+}
+
+// setRingChanged records that the ring's weights were stepped or its
+// partitions moved just now.
+func (rm *ringMonitor) setRingChanged(typ string, policy int, logger *zap.Logger) {
+	if err := rm.aa.db.setRingChanged(typ, policy, time.Now()); err != nil {
+		logger.Error("could not record the ring change for the weight ramp", zap.Error(err))
+	}
+}
+
+// weightRampWaitingFor returns what the cluster is still catching up on
+// since the ring last changed, its weights stepped or partitions moved, or an
+// empty string if the next weight step can be taken. Replication queued by
+// the ring monitor or dispersion scans must be finished and, except for
+// account rings which aren't scanned, a full dispersion scan pass must have
+// run since the ring changed. The reasons given don't include counts or
+// times, so that they only change when what's being waited for does.
+func weightRampWaitingFor(db *dbInstance, builder *ring.RingBuilder, typ string, policy int, ringChanged time.Time) (string, error) {
+	if secs := builder.MinPartSecondsLeft(); secs > 0 {
+		return "min_part_hours to pass", nil
+	}
+	qrs, err := db.queuedReplications(typ, policy, "")
+	if err != nil {
+		return "", err
+	}
+	if len(qrs) > 0 {
+		return "queued partition replications to finish", nil
+	}
+	if typ == "account" {
+		return "", nil
+	}
+	start, _, _, complete, err := db.processPass("dispersion scan", typ, policy)
+	if err != nil {
+		return "", err
+	}
+	if complete.IsZero() || start.Before(ringChanged) {
+		return "a dispersion scan pass since the last ring change", nil
+	}
+	return "", nil
+}
+
 func randomDuration(min, max time.Duration) time.Duration {
 	return time.Duration(int64(min) + rand.Int63n(int64(max)-int64(min)+1))
 }
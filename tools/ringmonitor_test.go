@@ -0,0 +1,61 @@
+package tools
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+func TestWeightRampWaitingFor(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestWeightRampWaitingFor"))
+	require.Nil(t, err)
+	builder, err := ring.NewRingBuilder(4, 3, 1, false)
+	require.Nil(t, err)
+	ringChanged := time.Now().Add(-time.Minute)
+
+	waitingFor, err := weightRampWaitingFor(db, builder, "object", 0, ringChanged)
+	require.Nil(t, err)
+	require.Contains(t, waitingFor, "dispersion scan")
+	waitingFor, err = weightRampWaitingFor(db, builder, "account", 0, ringChanged)
+	require.Nil(t, err)
+	require.Equal(t, "", waitingFor)
+
+	require.Nil(t, db.startProcessPass("dispersion scan", "object", 0))
+	require.Nil(t, db.completeProcessPass("dispersion scan", "object", 0))
+	waitingFor, err = weightRampWaitingFor(db, builder, "object", 0, ringChanged)
+	require.Nil(t, err)
+	require.Equal(t, "", waitingFor)
+	// a scan that started before the ring changed doesn't count.
+	waitingFor, err = weightRampWaitingFor(db, builder, "object", 0, time.Now().Add(time.Minute))
+	require.Nil(t, err)
+	require.Contains(t, waitingFor, "dispersion scan")
+
+	require.Nil(t, db.queuePartitionReplication("object", 0, 1, "ring change", 0, 1))
+	waitingFor, err = weightRampWaitingFor(db, builder, "object", 0, ringChanged)
+	require.Nil(t, err)
+	require.Equal(t, "queued partition replications to finish", waitingFor)
+}
+
+func TestRingRamp(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestRingRamp"))
+	require.Nil(t, err)
+	changed, waitingFor, err := db.ringRamp("object", 1)
+	require.Nil(t, err)
+	require.True(t, changed.IsZero())
+	require.Equal(t, "", waitingFor)
+
+	now := time.Now().Round(time.Second)
+	require.Nil(t, db.setRingChanged("object", 1, now))
+	require.Nil(t, db.setRingRampWaitingFor("object", 1, "min_part_hours to pass"))
+	require.Nil(t, db.setRingChanged("object", 0, now.Add(time.Hour)))
+	changed, waitingFor, err = db.ringRamp("object", 1)
+	require.Nil(t, err)
+	require.True(t, now.Equal(changed))
+	require.Equal(t, "min_part_hours to pass", waitingFor)
+	changed, waitingFor, err = db.ringRamp("object", 0)
+	require.Nil(t, err)
+	require.True(t, now.Add(time.Hour).Equal(changed))
+	require.Equal(t, "", waitingFor)
+}
@@ -0,0 +1,336 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gholt/brimtext"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// parseSimulationTarget fills in the device an op refers to; either a device id or <ip>:<port>/<device>.
+func parseSimulationTarget(op *ring.SimulationOp, target string) error {
+	if id, err := strconv.ParseInt(target, 10, 64); err == nil {
+		op.DevId = id
+		return nil
+	}
+	op.DevId = -1
+	slash := strings.Index(target, "/")
+	colon := strings.LastIndex(target, ":")
+	if slash < 0 || colon < 0 || colon > slash {
+		return fmt.Errorf("Invalid device %q; expected an id or <ip>:<port>/<device>", target)
+	}
+	port, err := strconv.ParseInt(target[colon+1:slash], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid port in %q", target)
+	}
+	op.Ip = target[:colon]
+	op.Port = port
+	op.Device = target[slash+1:]
+	return nil
+}
+
+// parseSimulationScript reads the hypothetical changes for "ring simulate", one per line:
+//
+//	add <device> <weight>
+//	set_weight <id | ip:port/device> <weight>
+//	remove <id | ip:port/device> [purge]
+//
+// <device> is in the same form "ring add" takes. Blank lines and lines starting with # are ignored.
+func parseSimulationScript(r io.Reader) ([]*ring.SimulationOp, error) {
+	var ops []*ring.SimulationOp
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		op := &ring.SimulationOp{Op: fields[0]}
+		switch op.Op {
+		case "add":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("Line %d: usage is add <device> <weight>", lineNo)
+			}
+			dev, err := parseDeviceString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %s", lineNo, err)
+			}
+			if dev.Weight, err = strconv.ParseFloat(fields[2], 64); err != nil {
+				return nil, fmt.Errorf("Line %d: %s", lineNo, err)
+			}
+			op.Dev = dev
+		case "set_weight":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("Line %d: usage is set_weight <device> <weight>", lineNo)
+			}
+			if err := parseSimulationTarget(op, fields[1]); err != nil {
+				return nil, fmt.Errorf("Line %d: %s", lineNo, err)
+			}
+			weight, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %s", lineNo, err)
+			}
+			op.Weight = weight
+		case "remove":
+			if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "purge") {
+				return nil, fmt.Errorf("Line %d: usage is remove <device> [purge]", lineNo)
+			}
+			if err := parseSimulationTarget(op, fields[1]); err != nil {
+				return nil, fmt.Errorf("Line %d: %s", lineNo, err)
+			}
+			op.Purge = len(fields) == 3
+		default:
+			return nil, fmt.Errorf("Line %d: unknown operation %q", lineNo, op.Op)
+		}
+		ops = append(ops, op)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// partBytesEstimate holds what recon tells us about the size of partitions and how fast replication moves them.
+type partBytesEstimate struct {
+	// DevPartBytes is the average bytes per partition replica for each device id that reported disk usage.
+	DevPartBytes map[int64]float64
+	// AvgPartBytes is the average bytes per partition replica across every device that reported.
+	AvgPartBytes float64
+	// BytesPerSec is the average replication rate of a single drive; zero if unknown.
+	BytesPerSec float64
+	Errors      []string
+}
+
+// getPartBytesEstimate queries the diskusage recon and replication progress of every server in the ring.
+// The partition counts used are the devices' counts in the ring given.
+func getPartBytesEstimate(client http.Client, r ring.Ring) *partBytesEstimate {
+	est := &partBytesEstimate{DevPartBytes: map[int64]float64{}}
+	allDevs, servers := getRingData(r, false)
+	devParts := map[int]int64{}
+	for part := uint64(0); ; part++ {
+		nodes := r.GetNodes(part)
+		if nodes == nil {
+			break
+		}
+		for _, dev := range nodes {
+			devParts[dev.Id]++
+		}
+	}
+	var totalBytes, totalParts int64
+	var sentBytes int64
+	var sentDur time.Duration
+	for _, server := range servers {
+		data, err := queryHostRecon(client, server, "diskusage")
+		if err != nil {
+			est.Errors = append(est.Errors, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		var usage []struct {
+			Device  string `json:"device"`
+			Mounted bool   `json:"mounted"`
+			Used    int64  `json:"used"`
+		}
+		if err := json.Unmarshal(data, &usage); err != nil {
+			est.Errors = append(est.Errors, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		for _, u := range usage {
+			dev, ok := allDevs[deviceId(server.ip, server.port, u.Device)]
+			if !ok || !u.Mounted || devParts[dev.Id] == 0 {
+				continue
+			}
+			est.DevPartBytes[int64(dev.Id)] = float64(u.Used) / float64(devParts[dev.Id])
+			totalBytes += u.Used
+			totalParts += devParts[dev.Id]
+		}
+		stats, err := queryHostReplication(client, server)
+		if err != nil {
+			est.Errors = append(est.Errors, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		for _, dStats := range stats {
+			driveDur := dStats.LastPassFinishDate.Sub(dStats.PassStarted)
+			if dStats.LastPassFinishDate.IsZero() {
+				driveDur = time.Since(dStats.PassStarted)
+			}
+			if driveDur > 0 {
+				sentBytes += dStats.BytesSent
+				sentDur += driveDur
+			}
+		}
+	}
+	if totalParts > 0 {
+		est.AvgPartBytes = float64(totalBytes) / float64(totalParts)
+	}
+	if sentDur > 0 {
+		est.BytesPerSec = float64(sentBytes) / sentDur.Seconds()
+	}
+	return est
+}
+
+// estimateMove returns the estimated bytes that have to move for the device changes and how long the busiest device would take to send or receive its share.
+func (est *partBytesEstimate) estimateMove(devs []*ring.SimulationDevice) (int64, time.Duration) {
+	var total, busiest float64
+	for _, dev := range devs {
+		partBytes, ok := est.DevPartBytes[dev.Id]
+		if !ok {
+			partBytes = est.AvgPartBytes
+		}
+		lost := float64(dev.PartsLost) * partBytes
+		gained := float64(dev.PartsGained) * est.AvgPartBytes
+		total += lost
+		if lost > busiest {
+			busiest = lost
+		}
+		if gained > busiest {
+			busiest = gained
+		}
+	}
+	if est.BytesPerSec <= 0 {
+		return int64(total), 0
+	}
+	return int64(total), time.Duration(busiest/est.BytesPerSec) * time.Second
+}
+
+type ringSimulateReport struct {
+	*ring.SimulationResult
+	EstimatedBytesMoved     int64    `json:"estimated_bytes_moved"`
+	EstimatedReplicationSec int64    `json:"estimated_replication_seconds"`
+	MinimumElapsedSec       int64    `json:"minimum_elapsed_seconds"`
+	ReconErrors             []string `json:"recon_errors,omitempty"`
+}
+
+func printDispersion(label string, dispersion map[string]float64) {
+	if dispersion == nil {
+		return
+	}
+	s := label
+	for _, name := range ring.TierNames {
+		s += fmt.Sprintf(" %s=%.2f%%", name, dispersion[name])
+	}
+	fmt.Println(s)
+}
+
+func printSimulationDevs(devs []*ring.SimulationDevice) {
+	data := [][]string{{"ID", "REGION", "ZONE", "IP ADDRESS", "PORT", "NAME", "WEIGHT", "BEFORE", "AFTER", "GAINED", "LOST"}, nil}
+	for _, dev := range devs {
+		data = append(data, []string{strconv.FormatInt(dev.Id, 10), strconv.FormatInt(dev.Region, 10), strconv.FormatInt(dev.Zone, 10), dev.Ip, strconv.FormatInt(dev.Port, 10), dev.Device, strconv.FormatFloat(dev.Weight, 'f', -1, 64), strconv.FormatInt(dev.PartsBefore, 10), strconv.FormatInt(dev.PartsAfter, 10), strconv.FormatInt(dev.PartsGained, 10), strconv.FormatInt(dev.PartsLost, 10)})
+	}
+	fmt.Println(brimtext.Align(data, brimtext.NewSimpleAlignOptions()))
+}
+
+// ringSimulate implements "ring <builder> simulate"; the builder file is only read, never saved.
+func ringSimulate(pth string, args []string, debug, jsonOut bool) error {
+	simFlags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	cycles := simFlags.Int("cycles", 10, "Maximum number of min_part_hours cycles to simulate.")
+	useRecon := simFlags.Bool("recon", true, "Query recon for disk usage and replication rates to estimate bytes moved.")
+	timeout := simFlags.Duration("timeout", 10*time.Second, "Timeout for recon requests.")
+	if err := simFlags.Parse(args); err != nil {
+		return err
+	}
+	if simFlags.NArg() != 1 || *cycles < 1 {
+		return fmt.Errorf("usage: simulate [-cycles n] [-recon=false] <script_file>, with n at least 1")
+	}
+	f, err := os.Open(simFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+	ops, err := parseSimulationScript(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	builder, err := ring.NewRingBuilderFromFile(pth, debug)
+	if err != nil {
+		return err
+	}
+	var est *partBytesEstimate
+	if *useRecon && len(builder.Devs) > 0 {
+		if r := builder.GetRing(); r.ReplicaCount() > 0 && r.PartitionCount() > 0 {
+			est = getPartBytesEstimate(http.Client{Timeout: *timeout}, r)
+		}
+	}
+	res, err := ring.Simulate(builder, ops, *cycles)
+	if err != nil {
+		return err
+	}
+	report := &ringSimulateReport{SimulationResult: res}
+	movingCycles := 0
+	for _, c := range res.Cycles {
+		if c.PartsMoved > 0 {
+			movingCycles++
+		}
+	}
+	minimumElapsed := time.Duration(res.WaitSeconds) * time.Second
+	if movingCycles > 1 {
+		minimumElapsed += time.Duration((movingCycles-1)*res.MinPartHours) * time.Hour
+	}
+	report.MinimumElapsedSec = int64(minimumElapsed / time.Second)
+	if est != nil {
+		bytesMoved, dur := est.estimateMove(res.Devs)
+		report.EstimatedBytesMoved = bytesMoved
+		report.EstimatedReplicationSec = int64(dur / time.Second)
+		report.ReconErrors = est.Errors
+	}
+	if jsonOut {
+		b, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(b)
+		os.Stdout.Write([]byte("\n"))
+		return nil
+	}
+	for _, c := range res.Cycles {
+		fmt.Printf("Cycle %d: %d partition replicas moved, %d devices removed, %.02f balance\n", c.Cycle, c.PartsMoved, c.Removed, c.Balance)
+	}
+	if last := res.Cycles[len(res.Cycles)-1]; last.PartsMoved > 0 {
+		fmt.Printf("Ring was still moving partitions after %d cycles.\n", len(res.Cycles))
+	}
+	fmt.Printf("Total partition replicas moved: %d\n", res.PartsMoved)
+	fmt.Printf("Final balance: %.02f\n", res.Balance)
+	printDispersion("Dispersion before:", res.DispersionBefore)
+	printDispersion("Dispersion after: ", res.DispersionAfter)
+	fmt.Printf("Minimum time to apply (min_part_hours %d): %v\n", res.MinPartHours, time.Duration(report.MinimumElapsedSec)*time.Second)
+	if est != nil {
+		for _, e := range est.Errors {
+			fmt.Printf("!! %s\n", e)
+		}
+		if est.AvgPartBytes > 0 {
+			fmt.Printf("Estimated bytes moved: %d\n", report.EstimatedBytesMoved)
+		} else {
+			fmt.Println("Estimated bytes moved: unknown (no disk usage available)")
+		}
+		if report.EstimatedReplicationSec > 0 {
+			fmt.Printf("Estimated replication time: %v\n", time.Duration(report.EstimatedReplicationSec)*time.Second)
+		}
+	}
+	printSimulationDevs(res.Devs)
+	return nil
+}
@@ -0,0 +1,74 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+func TestParseSimulationScript(t *testing.T) {
+	script := `
+# add a new rack
+add r1z3-10.0.0.5:6000/sdb 100
+set_weight 3 50
+set_weight 10.0.0.5:6000/sdb 25.5
+remove 7 purge
+`
+	ops, err := parseSimulationScript(strings.NewReader(script))
+	require.Nil(t, err)
+	require.Equal(t, 4, len(ops))
+	require.Equal(t, "add", ops[0].Op)
+	require.Equal(t, int64(1), ops[0].Dev.Region)
+	require.Equal(t, int64(3), ops[0].Dev.Zone)
+	require.Equal(t, "10.0.0.5", ops[0].Dev.Ip)
+	require.Equal(t, int64(6000), ops[0].Dev.Port)
+	require.Equal(t, "sdb", ops[0].Dev.Device)
+	require.Equal(t, 100.0, ops[0].Dev.Weight)
+	require.Equal(t, int64(-1), ops[0].Dev.Id)
+	require.Equal(t, &ring.SimulationOp{Op: "set_weight", DevId: 3, Weight: 50}, ops[1])
+	require.Equal(t, &ring.SimulationOp{Op: "set_weight", DevId: -1, Ip: "10.0.0.5", Port: 6000, Device: "sdb", Weight: 25.5}, ops[2])
+	require.Equal(t, &ring.SimulationOp{Op: "remove", DevId: 7, Purge: true}, ops[3])
+
+	_, err = parseSimulationScript(strings.NewReader("explode 3\n"))
+	require.NotNil(t, err)
+	_, err = parseSimulationScript(strings.NewReader("add z1-bad 1\n"))
+	require.NotNil(t, err)
+	_, err = parseSimulationScript(strings.NewReader("remove 10.0.0.5/sdb\n"))
+	require.NotNil(t, err)
+}
+
+func TestEstimateMove(t *testing.T) {
+	est := &partBytesEstimate{DevPartBytes: map[int64]float64{0: 200}, AvgPartBytes: 100, BytesPerSec: 10}
+	bytes, dur := est.estimateMove([]*ring.SimulationDevice{
+		{Id: 0, PartsLost: 2},
+		{Id: 1, PartsLost: 1},
+		{Id: 2, PartsGained: 3},
+	})
+	require.Equal(t, int64(500), bytes)
+	require.Equal(t, int64(40), int64(dur.Seconds()))
+}
+
+func TestRingSimulateCycles(t *testing.T) {
+	for _, cycles := range []string{"0", "-1"} {
+		err := ringSimulate("/nonexistent/object.builder", []string{"-cycles", cycles, "/nonexistent/script"}, false, false)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "usage")
+	}
+}
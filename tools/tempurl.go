@@ -0,0 +1,83 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// signTempURL returns path with the query string that makes it a temp URL.
+// With prefix set, the object part of the path is a prefix and the URL works
+// for every object whose name starts with it.
+func signTempURL(method, path, key string, expires int64, prefix bool, ipRange, digest string) (string, error) {
+	newHash, ok := common.TempURLDigests[digest]
+	if !ok {
+		return "", fmt.Errorf("Unknown digest %q", digest)
+	}
+	parts := strings.SplitN(path, "/", 5)
+	if len(parts) != 5 || parts[0] != "" || parts[1] != "v1" || parts[2] == "" || parts[3] == "" || (parts[4] == "" && !prefix) {
+		return "", fmt.Errorf("Path must be /v1/<account>/<container>/<object>")
+	}
+	signed := path
+	if prefix {
+		signed = "prefix:" + path
+	}
+	sig := hex.EncodeToString(common.TempURLHMAC(newHash, []byte(key), strings.ToUpper(method), expires, signed, ipRange))
+	q := "temp_url_sig=" + sig + "&temp_url_expires=" + strconv.FormatInt(expires, 10)
+	if prefix {
+		q += "&temp_url_prefix=" + url.QueryEscape(parts[4])
+	}
+	if ipRange != "" {
+		q += "&temp_url_ip_range=" + url.QueryEscape(ipRange)
+	}
+	return path + "?" + q, nil
+}
+
+// TempURL prints a temp URL for the method, lifetime, path and key given.
+func TempURL(flags *flag.FlagSet, cnf srv.ConfigLoader) bool {
+	if flags.NArg() != 4 {
+		flags.Usage()
+		return false
+	}
+	seconds, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+	if err != nil || seconds < 0 {
+		fmt.Println("Invalid seconds:", flags.Arg(1))
+		return false
+	}
+	expires := seconds
+	if !flags.Lookup("absolute").Value.(flag.Getter).Get().(bool) {
+		expires += time.Now().Unix()
+	}
+	u, err := signTempURL(flags.Arg(0), flags.Arg(2), flags.Arg(3), expires,
+		flags.Lookup("prefix").Value.(flag.Getter).Get().(bool),
+		flags.Lookup("ip-range").Value.(flag.Getter).Get().(string),
+		flags.Lookup("digest").Value.(flag.Getter).Get().(string))
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	fmt.Println(u)
+	return true
+}
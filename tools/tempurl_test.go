@@ -0,0 +1,43 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignTempURL(t *testing.T) {
+	u, err := signTempURL("get", "/v1/AUTH_account/container/object", "mykey", 1493709631, false, "", "sha1")
+	require.Nil(t, err)
+	require.Equal(t, "/v1/AUTH_account/container/object?temp_url_sig=6deb0c7da21f396f1368681dc0bd57df0d1c4369&temp_url_expires=1493709631", u)
+
+	u, err = signTempURL("GET", "/v1/a/c/o", "mykey", 9999999999, true, "", "sha1")
+	require.Nil(t, err)
+	require.Equal(t, "/v1/a/c/o?temp_url_sig=058e0771c69f7e1eb1eacbd68396920fd06ff261&temp_url_expires=9999999999&temp_url_prefix=o", u)
+
+	u, err = signTempURL("GET", "/v1/a/c/", "mykey", 9999999999, true, "10.0.0.0/8", "sha512")
+	require.Nil(t, err)
+	require.Contains(t, u, "&temp_url_prefix=&temp_url_ip_range=10.0.0.0%2F8")
+
+	_, err = signTempURL("GET", "/v1/a/c/o", "mykey", 1, false, "", "md5")
+	require.NotNil(t, err)
+	for _, path := range []string{"/v1/a/c", "/v1/a/c/", "v1/a/c/o", "/v2/a/c/o", "/v1//c/o"} {
+		_, err = signTempURL("GET", path, "mykey", 1, false, "", "sha256")
+		require.NotNil(t, err, path)
+	}
+}
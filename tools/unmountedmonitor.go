@@ -8,6 +8,7 @@ package tools
 // state_retention = 86400          # seconds to retain state entries
 // server_down_limit = 14400        # seconds a server can be down before removal
 // device_unmounted_limit = 3600    # seconds a device can be unmounted before removal
+// replacement_weight_step = 25     # percent of its target weight a replacement device ramps up by per rebalance
 
 import (
 	"encoding/json"
@@ -30,17 +31,22 @@ type unmountedMonitor struct {
 	stateRetention       time.Duration
 	serverDownLimit      time.Duration
 	deviceUnmountedLimit time.Duration
+	// percent of its target weight a replacement device ramps up by per rebalance
+	replacementWeightStep float64
+	// failed devices waiting for a replacement to be mounted, by ip:port/device
+	pending map[string][]*deviceReplacement
 }
 
 func newUnmountedMonitor(aa *AutoAdmin) *unmountedMonitor {
 	um := &unmountedMonitor{
-		aa:                   aa,
-		delay:                time.Duration(aa.serverconf.GetInt("unmounted-monitor", "initial_delay", 10)) * time.Second,
-		passTimeTarget:       time.Duration(aa.serverconf.GetInt("unmounted-monitor", "pass_time_target", 600)) * time.Second,
-		reportInterval:       time.Duration(aa.serverconf.GetInt("unmounted-monitor", "report_interval", 60)) * time.Second,
-		stateRetention:       time.Duration(aa.serverconf.GetInt("unmounted-monitor", "state_retention", 86400)) * time.Second,
-		serverDownLimit:      time.Duration(aa.serverconf.GetInt("unmounted-monitor", "server_down_limit", 14400)) * time.Second,
-		deviceUnmountedLimit: time.Duration(aa.serverconf.GetInt("unmounted-monitor", "device_unmounted_limit", 3600)) * time.Second,
+		aa:                    aa,
+		delay:                 time.Duration(aa.serverconf.GetInt("unmounted-monitor", "initial_delay", 10)) * time.Second,
+		passTimeTarget:        time.Duration(aa.serverconf.GetInt("unmounted-monitor", "pass_time_target", 600)) * time.Second,
+		reportInterval:        time.Duration(aa.serverconf.GetInt("unmounted-monitor", "report_interval", 60)) * time.Second,
+		stateRetention:        time.Duration(aa.serverconf.GetInt("unmounted-monitor", "state_retention", 86400)) * time.Second,
+		serverDownLimit:       time.Duration(aa.serverconf.GetInt("unmounted-monitor", "server_down_limit", 14400)) * time.Second,
+		deviceUnmountedLimit:  time.Duration(aa.serverconf.GetInt("unmounted-monitor", "device_unmounted_limit", 3600)) * time.Second,
+		replacementWeightStep: aa.serverconf.GetFloat("unmounted-monitor", "replacement_weight_step", 25),
 	}
 	if um.delay < 0 {
 		um.delay = time.Second
@@ -51,6 +57,9 @@ func newUnmountedMonitor(aa *AutoAdmin) *unmountedMonitor {
 	if um.reportInterval < 0 {
 		um.reportInterval = time.Second
 	}
+	if um.replacementWeightStep <= 0 || um.replacementWeightStep > 100 {
+		um.replacementWeightStep = 100
+	}
 	return um
 }
 
@@ -81,6 +90,11 @@ func (um *unmountedMonitor) runOnce() time.Duration {
 	var serversDown int64
 	var devicesMounted int64
 	var devicesUnmounted int64
+	pending, err := um.pendingReplacements()
+	if err != nil {
+		logger.Error("could not retrieve device replacements", zap.Error(err))
+	}
+	um.pending = pending
 	endpoints := um.reconUnmountedEndpoints()
 	cancel := make(chan struct{})
 	progressDone := make(chan struct{})
@@ -158,6 +172,7 @@ func (um *unmountedMonitor) runOnce() time.Duration {
 	}
 	close(cancel)
 	<-progressDone
+	um.advanceReplacements(logger)
 	um.delay = um.passTimeTarget / time.Duration(delays)
 	sleepFor := time.Until(start.Add(um.passTimeTarget))
 	if sleepFor < 0 {
@@ -201,6 +216,17 @@ func (um *unmountedMonitor) reconUnmountedEndpoints() map[string]*endpointIPPort
 			}
 		}
 	}
+	// A server that was down long enough for all its devices to be removed
+	// still needs checking for replacements.
+	for _, drs := range um.pending {
+		for _, dr := range drs {
+			dev := &ring.RingBuilderDevice{}
+			if err := json.Unmarshal([]byte(dr.Dev), dev); err != nil || dev.Scheme == "" {
+				continue
+			}
+			endpointMap[fmt.Sprintf("%s://%s:%d/recon/diskusage", dev.Scheme, dr.Ip, dr.Port)] = &endpointIPPort{ip: dr.Ip, port: dr.Port}
+		}
+	}
 	return endpointMap
 }
 
@@ -249,6 +275,11 @@ func (um *unmountedMonitor) deviceMounted(logger *zap.Logger, ip string, port in
 	if err := um.aa.db.addDeviceState(ip, port, device, true, time.Now().Add(-um.stateRetention)); err != nil {
 		logger.Error("could not add device mounted state", zap.Error(err))
 	}
+	key := replacementKey(ip, port, device)
+	for _, dr := range um.pending[key] {
+		um.replacementMounted(logger, dr)
+	}
+	delete(um.pending, key)
 }
 
 func (um *unmountedMonitor) deviceUnmounted(logger *zap.Logger, ip string, port int, device string) {
@@ -321,11 +352,16 @@ func (um *unmountedMonitor) removeFromBuilder(logger *zap.Logger, ip string, por
 		logger.Error("Could not find builder after lock", zap.String("type", typ), zap.Int("policy", policy), zap.Error(err))
 		return
 	}
-	changed := false
+	oldRing := ringBuilder.GetRing()
+	type failedDevice struct {
+		dev    ring.RingBuilderDevice
+		weight float64
+	}
+	var failed []failedDevice
 	for _, dev := range ringBuilder.SearchDevs(-1, -1, ip, int64(port), "", -1, device, -1, "", "") {
 		if dev.Weight >= 0 {
+			failed = append(failed, failedDevice{dev: *dev, weight: dev.Weight})
 			ringBuilder.RemoveDev(dev.Id, false)
-			changed = true
 			if device == "" {
 				um.aa.db.addRingLog(typ, policy, fmt.Sprintf("server %s:%d down; removed device %s id:%d", ip, port, dev.Device, dev.Id))
 			} else {
@@ -333,7 +369,7 @@ func (um *unmountedMonitor) removeFromBuilder(logger *zap.Logger, ip string, por
 			}
 		}
 	}
-	if !changed {
+	if len(failed) == 0 {
 		return
 	}
 	err = ringBuilder.Save(ringBuilderFilePath)
@@ -349,6 +385,14 @@ func (um *unmountedMonitor) removeFromBuilder(logger *zap.Logger, ip string, por
 	} else {
 		um.aa.db.addRingLog(typ, policy, fmt.Sprintf("rebalanced due to downed device %s on %s:%d", device, ip, port))
 	}
+	if ringBuilder, _, err = ring.GetRingBuilder(typ, policy); err != nil {
+		logger.Error("Could not reload builder after rebalance", zap.String("type", typ), zap.Int("policy", policy), zap.Error(err))
+		return
+	}
+	newRing := ringBuilder.GetRing()
+	for _, f := range failed {
+		um.deviceFailed(logger, typ, policy, &f.dev, f.weight, oldRing, newRing)
+	}
 	// NOTE: The ringmonitor.go will detect these ring changes on disk and
 	// initiate a fastscan for ringscan.go to push out the new rings.
 }